@@ -0,0 +1,103 @@
+// Package framing provides small helpers for reading a framed message off
+// a net.Conn, looping on Read until the framing condition is satisfied (a
+// delimiter, a fixed byte count, or a length prefix) or a per-op deadline
+// elapses. A single Read into a fixed-size buffer silently truncates
+// responses that arrive in more than one TCP segment or exceed the
+// buffer; these helpers exist to avoid repeating that bug across modules.
+package framing
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ReadUntil reads from conn until delim has been seen, max bytes have been
+// read, or deadline elapses. The returned bytes include delim.
+func ReadUntil(conn net.Conn, delim []byte, max int, deadline time.Duration) ([]byte, error) {
+	if deadline > 0 {
+		conn.SetReadDeadline(time.Now().Add(deadline))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	var buf bytes.Buffer
+	chunk := make([]byte, 4096)
+	for buf.Len() < max {
+		n, err := conn.Read(chunk)
+		if n > 0 {
+			buf.Write(chunk[:n])
+			if idx := bytes.Index(buf.Bytes(), delim); idx >= 0 {
+				end := idx + len(delim)
+				return buf.Bytes()[:end], nil
+			}
+		}
+		if err != nil {
+			return buf.Bytes(), err
+		}
+	}
+	return buf.Bytes(), fmt.Errorf("read %d bytes without seeing delimiter", buf.Len())
+}
+
+// ReadLineCRLF reads a single CRLF-terminated line, per ReadUntil's rules.
+func ReadLineCRLF(conn net.Conn, max int, deadline time.Duration) ([]byte, error) {
+	return ReadUntil(conn, []byte("\r\n"), max, deadline)
+}
+
+// ReadLengthPrefixed reads a lenBytes-byte length prefix (big- or
+// little-endian per littleEndian), then reads the body it describes. If
+// lengthIncludesPrefix is true (as in Terraria's framing), the prefix
+// value counts itself and the body read is (length - lenBytes) bytes;
+// otherwise the prefix value is the body length on its own. The returned
+// slice includes the length prefix.
+func ReadLengthPrefixed(conn net.Conn, lenBytes int, littleEndian, lengthIncludesPrefix bool, max int, deadline time.Duration) ([]byte, error) {
+	if deadline > 0 {
+		conn.SetReadDeadline(time.Now().Add(deadline))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	prefix := make([]byte, lenBytes)
+	if err := readFull(conn, prefix); err != nil {
+		return nil, fmt.Errorf("error reading %d-byte length prefix: %w", lenBytes, err)
+	}
+
+	var length uint64
+	for i, b := range prefix {
+		shift := i * 8
+		if !littleEndian {
+			shift = (lenBytes - 1 - i) * 8
+		}
+		length |= uint64(b) << shift
+	}
+	bodyLen := length
+	if lengthIncludesPrefix {
+		if length < uint64(lenBytes) {
+			return nil, fmt.Errorf("length prefix %d is smaller than the %d-byte prefix itself", length, lenBytes)
+		}
+		bodyLen -= uint64(lenBytes)
+	}
+
+	if int(bodyLen) > max {
+		return nil, fmt.Errorf("length prefix implies a %d byte body, exceeding the %d byte limit", bodyLen, max)
+	}
+
+	body := make([]byte, bodyLen)
+	if err := readFull(conn, body); err != nil {
+		return nil, fmt.Errorf("error reading %d-byte body: %w", bodyLen, err)
+	}
+
+	return append(prefix, body...), nil
+}
+
+// readFull reads exactly len(buf) bytes, looping on short reads.
+func readFull(conn net.Conn, buf []byte) error {
+	read := 0
+	for read < len(buf) {
+		n, err := conn.Read(buf[read:])
+		read += n
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package framing
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestReadLengthPrefixedShortPrefix verifies that a length prefix smaller
+// than lenBytes (as a hostile or buggy server sending e.g. 0x0000 for a
+// 2-byte, prefix-inclusive length) is rejected instead of underflowing
+// bodyLen and attempting a huge allocation.
+func TestReadLengthPrefixedShortPrefix(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		server.Write([]byte{0x00, 0x00})
+	}()
+
+	_, err := ReadLengthPrefixed(client, 2, false, true, 65536, time.Second)
+	if err == nil {
+		t.Fatal("expected an error for a length prefix shorter than lenBytes, got nil")
+	}
+}
+
+func TestReadLengthPrefixedOK(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		server.Write([]byte{0x00, 0x05, 'h', 'e', 'l'})
+	}()
+
+	got, err := ReadLengthPrefixed(client, 2, false, true, 65536, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []byte{0x00, 0x05, 'h', 'e', 'l'}
+	if string(got) != string(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
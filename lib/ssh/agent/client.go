@@ -0,0 +1,222 @@
+// Package agent implements a client for the ssh-agent protocol, as
+// documented in [PROTOCOL.agent]. It lets a scan attempt real publickey
+// userauth using keys held by the operator's live agent (typically
+// reached via $SSH_AUTH_SOCK) instead of requiring key material on disk.
+//
+// The wire format is a 4-byte big-endian length, a 1-byte message type,
+// and a per-type payload.
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/zmap/zgrab2/lib/ssh"
+)
+
+// Message numbers used by this client, per [PROTOCOL.agent].
+const (
+	agentFailure           = 5
+	agentSuccess           = 6
+	agentRequestIdentities = 11
+	agentIdentitiesAnswer  = 12
+	agentSignRequest       = 13
+	agentSignResponse      = 14
+)
+
+// Signature request flags, per [PROTOCOL.agent.ext]: requesting one of
+// these for an RSA key asks the agent to sign with rsa-sha2-256/512
+// instead of the legacy ssh-rsa (SHA-1) algorithm.
+const (
+	agentRSASHA2256 = 1 << 1
+	agentRSASHA2512 = 1 << 2
+)
+
+// Key is a public key as reported by the agent's identity list.
+type Key struct {
+	Format  string
+	Blob    []byte
+	Comment string
+}
+
+// Type returns the key's algorithm name.
+func (k *Key) Type() string {
+	return k.Format
+}
+
+// Marshal returns the key's wire-format blob.
+func (k *Key) Marshal() []byte {
+	return k.Blob
+}
+
+// Agent is the subset of the ssh-agent protocol this client supports:
+// listing identities and signing with one of them.
+type Agent interface {
+	// List returns the identities known to the agent.
+	List() ([]*Key, error)
+
+	// Sign asks the agent to sign data with the private key
+	// corresponding to pub.
+	Sign(pub ssh.PublicKey, data []byte) (*ssh.Signature, error)
+}
+
+// client is an Agent backed by a live connection to an ssh-agent, such as
+// a Unix socket dialed from $SSH_AUTH_SOCK.
+type client struct {
+	conn io.ReadWriter
+}
+
+// NewClient returns an Agent that speaks the ssh-agent protocol over rw.
+func NewClient(rw io.ReadWriter) Agent {
+	return &client{conn: rw}
+}
+
+// writePacket frames and writes a single agent protocol message.
+func writePacket(w io.Writer, messageType byte, payload []byte) error {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(1+len(payload)))
+	if _, err := w.Write(length); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{messageType}); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readPacket reads and returns a single agent protocol message's type and payload.
+func readPacket(r io.Reader) (messageType byte, payload []byte, err error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	if len(body) == 0 {
+		return 0, nil, errors.New("agent: empty message")
+	}
+	return body[0], body[1:], nil
+}
+
+// List requests the agent's identities and returns them as Keys.
+func (c *client) List() ([]*Key, error) {
+	if err := writePacket(c.conn, agentRequestIdentities, nil); err != nil {
+		return nil, fmt.Errorf("agent: error requesting identities: %w", err)
+	}
+
+	messageType, payload, err := readPacket(c.conn)
+	if err != nil {
+		return nil, fmt.Errorf("agent: error reading identities answer: %w", err)
+	}
+	if messageType == agentFailure {
+		return nil, errors.New("agent: request failed")
+	}
+	if messageType != agentIdentitiesAnswer {
+		return nil, fmt.Errorf("agent: unexpected message type %d", messageType)
+	}
+
+	if len(payload) < 4 {
+		return nil, errors.New("agent: truncated identities answer")
+	}
+	numKeys := binary.BigEndian.Uint32(payload[:4])
+	payload = payload[4:]
+
+	keys := make([]*Key, 0, numKeys)
+	for i := uint32(0); i < numKeys; i++ {
+		blob, rest, err := readString(payload)
+		if err != nil {
+			return nil, fmt.Errorf("agent: error reading key blob: %w", err)
+		}
+		comment, rest, err := readString(rest)
+		if err != nil {
+			return nil, fmt.Errorf("agent: error reading key comment: %w", err)
+		}
+		format, _, err := readString(blob)
+		if err != nil {
+			return nil, fmt.Errorf("agent: error reading key format: %w", err)
+		}
+		keys = append(keys, &Key{Format: string(format), Blob: blob, Comment: string(comment)})
+		payload = rest
+	}
+
+	return keys, nil
+}
+
+// Sign asks the agent to sign data with the key matching pub. RSA keys
+// are signed with rsa-sha2-512 where the agent supports it, so the
+// returned Signature.Format may legitimately differ from pub.Type()
+// ("ssh-rsa"); callers must use Signature.Format, not pub.Type(), when
+// reporting or verifying the algorithm actually used.
+func (c *client) Sign(pub ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	var flags uint32
+	if pub.Type() == "ssh-rsa" {
+		flags = agentRSASHA2512
+	}
+
+	var req []byte
+	req = appendString(req, pub.Marshal())
+	req = appendString(req, data)
+	req = appendUint32(req, flags)
+
+	if err := writePacket(c.conn, agentSignRequest, req); err != nil {
+		return nil, fmt.Errorf("agent: error sending sign request: %w", err)
+	}
+
+	messageType, payload, err := readPacket(c.conn)
+	if err != nil {
+		return nil, fmt.Errorf("agent: error reading sign response: %w", err)
+	}
+	if messageType == agentFailure {
+		return nil, errors.New("agent: sign request failed")
+	}
+	if messageType != agentSignResponse {
+		return nil, fmt.Errorf("agent: unexpected message type %d", messageType)
+	}
+
+	sigBlob, _, err := readString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("agent: error reading signature blob: %w", err)
+	}
+	format, rest, err := readString(sigBlob)
+	if err != nil {
+		return nil, fmt.Errorf("agent: error reading signature format: %w", err)
+	}
+	blob, _, err := readString(rest)
+	if err != nil {
+		return nil, fmt.Errorf("agent: error reading signature value: %w", err)
+	}
+
+	return &ssh.Signature{Format: string(format), Blob: blob}, nil
+}
+
+// readString reads a 4-byte-length-prefixed string from buf, returning
+// its value and the remaining bytes.
+func readString(buf []byte) (value, rest []byte, err error) {
+	if len(buf) < 4 {
+		return nil, nil, errors.New("agent: truncated length-prefixed string")
+	}
+	length := binary.BigEndian.Uint32(buf[:4])
+	buf = buf[4:]
+	if uint64(length) > uint64(len(buf)) {
+		return nil, nil, errors.New("agent: length-prefixed string exceeds buffer")
+	}
+	return buf[:length], buf[length:], nil
+}
+
+// appendString appends a 4-byte-length-prefixed string to buf.
+func appendString(buf, s []byte) []byte {
+	buf = appendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// appendUint32 appends a big-endian uint32 to buf.
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
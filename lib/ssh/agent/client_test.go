@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestPacketRoundTrip verifies writePacket/readPacket agree on the
+// 4-byte-length-prefixed, 1-byte-message-type wire format from
+// [PROTOCOL.agent].
+func TestPacketRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	payload := []byte("hello agent")
+	if err := writePacket(&buf, agentSignRequest, payload); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+
+	messageType, got, err := readPacket(&buf)
+	if err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+	if messageType != agentSignRequest {
+		t.Fatalf("messageType = %d, want %d", messageType, agentSignRequest)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("payload = %q, want %q", got, payload)
+	}
+}
+
+// TestReadPacketRejectsEmptyMessage verifies a message with a length
+// prefix of zero (no message-type byte at all) is rejected rather than
+// panicking on body[0].
+func TestReadPacketRejectsEmptyMessage(t *testing.T) {
+	var buf bytes.Buffer
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], 0)
+	buf.Write(length[:])
+
+	if _, _, err := readPacket(&buf); err == nil {
+		t.Fatal("expected an error reading a zero-length agent message")
+	}
+}
+
+// TestReadStringRejectsOverrunLength verifies a length-prefixed string
+// claiming more bytes than are actually present is rejected instead of
+// slicing out of range.
+func TestReadStringRejectsOverrunLength(t *testing.T) {
+	var buf []byte
+	buf = appendUint32(buf, 100)
+	buf = append(buf, []byte("short")...)
+
+	if _, _, err := readString(buf); err == nil {
+		t.Fatal("expected an error reading an over-length string")
+	}
+}
+
+// scriptedIdentitiesAnswer builds the payload of an agentIdentitiesAnswer
+// message for the given keys, in the wire format List() expects.
+func scriptedIdentitiesAnswer(keys []*Key) []byte {
+	payload := appendUint32(nil, uint32(len(keys)))
+	for _, k := range keys {
+		payload = appendString(payload, k.Blob)
+		payload = appendString(payload, []byte(k.Comment))
+	}
+	return payload
+}
+
+// TestClientListDecodesIdentities drives client.List() end to end over a
+// net.Pipe against a hand-scripted agentIdentitiesAnswer, the way a real
+// ssh-agent (reached via $SSH_AUTH_SOCK) would respond to
+// agentRequestIdentities.
+func TestClientListDecodesIdentities(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// Blob must itself start with a length-prefixed copy of Format, since
+	// List() recovers Format by reading the first string out of Blob.
+	want := []*Key{
+		{Format: "ssh-ed25519", Comment: "alice@example.com"},
+		{Format: "ssh-rsa", Comment: "bob@example.com"},
+	}
+	for _, k := range want {
+		k.Blob = appendString(nil, []byte(k.Format))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		messageType, _, err := readPacket(serverConn)
+		if err != nil {
+			done <- err
+			return
+		}
+		if messageType != agentRequestIdentities {
+			done <- errUnexpectedRequest(messageType)
+			return
+		}
+		done <- writePacket(serverConn, agentIdentitiesAnswer, scriptedIdentitiesAnswer(want))
+	}()
+
+	c := NewClient(clientConn)
+	done2 := make(chan struct {
+		keys []*Key
+		err  error
+	}, 1)
+	go func() {
+		keys, err := c.List()
+		done2 <- struct {
+			keys []*Key
+			err  error
+		}{keys, err}
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("scripted server side: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("scripted server side never completed")
+	}
+
+	select {
+	case r := <-done2:
+		if r.err != nil {
+			t.Fatalf("List: %v", r.err)
+		}
+		if len(r.keys) != len(want) {
+			t.Fatalf("got %d keys, want %d", len(r.keys), len(want))
+		}
+		for i, k := range r.keys {
+			if k.Format != want[i].Format {
+				t.Errorf("key %d: Format = %q, want %q", i, k.Format, want[i].Format)
+			}
+			if k.Comment != want[i].Comment {
+				t.Errorf("key %d: Comment = %q, want %q", i, k.Comment, want[i].Comment)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client.List never returned")
+	}
+}
+
+type errUnexpectedRequest byte
+
+func (e errUnexpectedRequest) Error() string {
+	return "unexpected request message type"
+}
+
+// client.Sign, Keyring, and Signers are not covered here: they all take or
+// return ssh.PublicKey/ssh.Signer/ssh.Signature, and those types are
+// defined in lib/ssh/keys.go, which isn't part of this snapshot, so no
+// value of those types can be constructed in this tree to drive them.
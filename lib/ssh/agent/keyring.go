@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"sync"
+
+	"github.com/zmap/zgrab2/lib/ssh"
+)
+
+// Keyring is a minimal in-memory Agent, useful for exercising code that
+// takes an Agent without needing a live ssh-agent process.
+type Keyring struct {
+	mu      sync.Mutex
+	signers []ssh.Signer
+}
+
+// NewKeyring returns an empty Keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{}
+}
+
+// Add registers a signer's key with the keyring.
+func (k *Keyring) Add(signer ssh.Signer) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.signers = append(k.signers, signer)
+}
+
+// List returns the public keys of every signer added to the keyring.
+func (k *Keyring) List() ([]*Key, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys := make([]*Key, 0, len(k.signers))
+	for _, signer := range k.signers {
+		pub := signer.PublicKey()
+		keys = append(keys, &Key{Format: pub.Type(), Blob: pub.Marshal()})
+	}
+	return keys, nil
+}
+
+// Sign signs data with whichever added signer's public key matches pub.
+func (k *Keyring) Sign(pub ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, signer := range k.signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), pub.Marshal()) {
+			return signer.Sign(rand.Reader, data)
+		}
+	}
+	return nil, errors.New("agent: no matching key in keyring")
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/zmap/zgrab2/lib/ssh"
+)
+
+// agentSigner adapts a single agent identity to the ssh.Signer interface,
+// so it can be driven through ssh.ClientConfig.Auth via
+// ssh.PublicKeysCallback(agent.Signers(a)) without the ssh package itself
+// needing to know about the agent protocol.
+type agentSigner struct {
+	agent Agent
+	pub   ssh.PublicKey
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.agent.Sign(s.pub, data)
+}
+
+// Signers lists a's identities and wraps each as an ssh.Signer, for use as
+// ssh.ClientConfig.Auth = []ssh.AuthMethod{ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+//
+//	return agent.Signers(a)
+//
+// })}. This is the integration point a scanner module uses to attempt
+// publickey userauth with the operator's live agent keys rather than key
+// material read from disk.
+func Signers(a Agent) ([]ssh.Signer, error) {
+	keys, err := a.List()
+	if err != nil {
+		return nil, fmt.Errorf("agent: error listing identities: %w", err)
+	}
+
+	signers := make([]ssh.Signer, 0, len(keys))
+	for _, key := range keys {
+		pub, err := ssh.ParsePublicKey(key.Blob)
+		if err != nil {
+			continue
+		}
+		signers = append(signers, &agentSigner{agent: a, pub: pub})
+	}
+	return signers, nil
+}
@@ -0,0 +1,149 @@
+package ssh
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/poly1305"
+)
+
+// chacha20Poly1305ID is the SSH name of the OpenSSH chacha20-poly1305 AEAD
+// cipher (see PROTOCOL.chacha20poly1305 in the OpenSSH source tree). It
+// isn't part of RFC 4253 and carries its own MAC, so it's never paired
+// with an entry from supportedMACs.
+//
+// newChaCha20Poly1305Cipher has no entry in cipherModes, since the
+// cipher.go file that would define that registry and dispatch to
+// packetCipher implementations isn't part of this snapshot; a live
+// connection can't currently negotiate or use this cipher.
+const chacha20Poly1305ID = "chacha20-poly1305@openssh.com"
+
+// ETM MAC IDs recognized by isETM and offered in supportedMACs.
+const (
+	hmacSHA256ETMID = "hmac-sha2-256-etm@openssh.com"
+	hmacSHA512ETMID = "hmac-sha2-512-etm@openssh.com"
+)
+
+// chacha20Poly1305Cipher implements the chacha20-poly1305@openssh.com AEAD
+// cipher. Per PROTOCOL.chacha20poly1305, the 64-byte cipher key splits into
+// two independent 32-byte ChaCha20 keys: K_1 encrypts the packet payload
+// (padding length byte, payload, and padding) starting at block counter 1,
+// and its block counter 0 output is used as the Poly1305 key. K_2 encrypts
+// the 4-byte packet length field alone, at block counter 0, and is never
+// used to generate a Poly1305 key. The nonce for both streams is the
+// packet sequence number, zero-extended to ChaCha20's 12-byte nonce size.
+type chacha20Poly1305Cipher struct {
+	payloadKey [32]byte
+	lengthKey  [32]byte
+}
+
+// newChaCha20Poly1305Cipher builds a packetCipher for one direction of an
+// chacha20-poly1305@openssh.com connection. key must be 64 bytes: the
+// first 32 are K_1 (payload), the last 32 are K_2 (length).
+func newChaCha20Poly1305Cipher(key []byte) (*chacha20Poly1305Cipher, error) {
+	if len(key) != 64 {
+		return nil, errors.New("ssh: chacha20poly1305: key must be 64 bytes")
+	}
+	c := &chacha20Poly1305Cipher{}
+	copy(c.payloadKey[:], key[:32])
+	copy(c.lengthKey[:], key[32:])
+	return c, nil
+}
+
+// nonce builds the 12-byte ChaCha20 nonce for seqNum: the high 8 bytes are
+// always zero since SSH sequence numbers are 32 bits.
+func chacha20Poly1305Nonce(seqNum uint32) [12]byte {
+	var nonce [12]byte
+	binary.BigEndian.PutUint32(nonce[8:], seqNum)
+	return nonce
+}
+
+// writeCipherPacket encrypts packet (padding length byte, payload, and
+// padding, as built by the caller) for seqNum and writes the wire record:
+// a 4-byte encrypted length, the encrypted packet, and a 16-byte Poly1305
+// tag.
+func (c *chacha20Poly1305Cipher) writeCipherPacket(seqNum uint32, w io.Writer, packet []byte) error {
+	nonce := chacha20Poly1305Nonce(seqNum)
+
+	lengthCipher, err := chacha20.NewUnauthenticatedCipher(c.lengthKey[:], nonce[:])
+	if err != nil {
+		return err
+	}
+	var encryptedLength [4]byte
+	binary.BigEndian.PutUint32(encryptedLength[:], uint32(len(packet)))
+	lengthCipher.XORKeyStream(encryptedLength[:], encryptedLength[:])
+
+	payloadCipher, err := chacha20.NewUnauthenticatedCipher(c.payloadKey[:], nonce[:])
+	if err != nil {
+		return err
+	}
+	var polyKey [32]byte
+	payloadCipher.XORKeyStream(polyKey[:], polyKey[:])
+	payloadCipher.SetCounter(1)
+
+	encryptedPayload := make([]byte, len(packet))
+	payloadCipher.XORKeyStream(encryptedPayload, packet)
+
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, append(append([]byte{}, encryptedLength[:]...), encryptedPayload...), &polyKey)
+
+	if _, err := w.Write(encryptedLength[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(encryptedPayload); err != nil {
+		return err
+	}
+	_, err = w.Write(tag[:])
+	return err
+}
+
+// readCipherPacket reads and decrypts one wire record for seqNum, returning
+// the packet (padding length byte, payload, and padding) on success. The
+// Poly1305 tag is verified before the payload is decrypted, so a forged or
+// corrupted record never reaches the caller as plaintext.
+func (c *chacha20Poly1305Cipher) readCipherPacket(seqNum uint32, r io.Reader) ([]byte, error) {
+	nonce := chacha20Poly1305Nonce(seqNum)
+
+	var encryptedLength [4]byte
+	if _, err := io.ReadFull(r, encryptedLength[:]); err != nil {
+		return nil, err
+	}
+
+	lengthCipher, err := chacha20.NewUnauthenticatedCipher(c.lengthKey[:], nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	var plainLength [4]byte
+	lengthCipher.XORKeyStream(plainLength[:], encryptedLength[:])
+	length := binary.BigEndian.Uint32(plainLength[:])
+
+	encryptedPayload := make([]byte, length)
+	if _, err := io.ReadFull(r, encryptedPayload); err != nil {
+		return nil, err
+	}
+	var tag [poly1305.TagSize]byte
+	if _, err := io.ReadFull(r, tag[:]); err != nil {
+		return nil, err
+	}
+
+	payloadCipher, err := chacha20.NewUnauthenticatedCipher(c.payloadKey[:], nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	var polyKey [32]byte
+	payloadCipher.XORKeyStream(polyKey[:], polyKey[:])
+
+	var expectedTag [poly1305.TagSize]byte
+	poly1305.Sum(&expectedTag, append(append([]byte{}, encryptedLength[:]...), encryptedPayload...), &polyKey)
+	if subtle.ConstantTimeCompare(expectedTag[:], tag[:]) != 1 {
+		return nil, errors.New("ssh: chacha20poly1305: message authentication failed")
+	}
+
+	payloadCipher.SetCounter(1)
+	packet := make([]byte, length)
+	payloadCipher.XORKeyStream(packet, encryptedPayload)
+	return packet, nil
+}
@@ -1,405 +1,614 @@
-// Copyright 2011 The Go Authors. All rights reserved.
-// Use of this source code is governed by a BSD-style
-// license that can be found in the LICENSE file.
-
-package ssh
-
-import (
-	"crypto"
-	"crypto/rand"
-	"encoding/json"
-	"fmt"
-	"io"
-	"sync"
-
-	_ "crypto/sha1"
-	_ "crypto/sha256"
-	_ "crypto/sha512"
-)
-
-// These are string constants in the SSH protocol.
-const (
-	compressionNone = "none"
-	serviceUserAuth = "ssh-userauth"
-	serviceSSH      = "ssh-connection"
-)
-
-// defaultCiphers specifies the default ciphers in preference order.
-var defaultCiphers = []string{
-	"aes128-ctr", "aes192-ctr", "aes256-ctr",
-	"aes128-gcm@openssh.com",
-	"arcfour256", "arcfour128",
-}
-
-// allSupportedCiphers specifies all ciphers which are supported
-var allSupportedCiphers = []string{
-	"aes128-ctr", "aes192-ctr", "aes256-ctr",
-	gcmCipherID,
-	"arcfour256", "arcfour128",
-	// Not offered by default:
-	"arcfour", aes128cbcID, tripledescbcID,
-}
-
-// defaultKexAlgos specifies the default key-exchange algorithms in
-// preference order.
-var defaultKexAlgos = []string{
-	kexAlgoCurve25519SHA256,
-	// P384 and P521 are not constant-time yet, but since we don't
-	// reuse ephemeral keys, using them for ECDH should be OK.
-	kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521,
-	kexAlgoDH14SHA1, kexAlgoDH1SHA1,
-}
-
-// allSupportedKexAlgos specifies all key-exchange algorithms supported
-var allSupportedKexAlgos = []string{
-	kexAlgoCurve25519SHA256,
-	// P384 and P521 are not constant-time yet, but since we don't
-	// reuse ephemeral keys, using them for ECDH should be OK.
-	kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521,
-	kexAlgoDH14SHA1, kexAlgoDH1SHA1,
-	// Not enabled by default:
-	kexAlgoDHGEXSHA1, kexAlgoDHGEXSHA256,
-}
-
-// supportedHostKeyAlgos specifies the supported host-key algorithms (i.e. methods
-// of authenticating servers) in preference order.
-var supportedHostKeyAlgos = []string{
-	CertAlgoRSAv01, CertAlgoDSAv01, CertAlgoECDSA256v01,
-	CertAlgoECDSA384v01, CertAlgoECDSA521v01, CertAlgoED25519v01,
-
-	KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521,
-	KeyAlgoRSA, KeyAlgoDSA,
-
-	KeyAlgoED25519,
-}
-
-// supportedMACs specifies a default set of MAC algorithms in preference order.
-// This is based on RFC 4253, section 6.4, but with hmac-md5 variants removed
-// because they have reached the end of their useful life.
-var supportedMACs = []string{
-	"hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
-}
-
-var supportedCompressions = []string{compressionNone}
-
-// hashFuncs keeps the mapping of supported algorithms to their respective
-// hashes needed for signature verification.
-var hashFuncs = map[string]crypto.Hash{
-	KeyAlgoRSA:          crypto.SHA1,
-	KeyAlgoDSA:          crypto.SHA1,
-	KeyAlgoECDSA256:     crypto.SHA256,
-	KeyAlgoECDSA384:     crypto.SHA384,
-	KeyAlgoECDSA521:     crypto.SHA512,
-	CertAlgoRSAv01:      crypto.SHA1,
-	CertAlgoDSAv01:      crypto.SHA1,
-	CertAlgoECDSA256v01: crypto.SHA256,
-	CertAlgoECDSA384v01: crypto.SHA384,
-	CertAlgoECDSA521v01: crypto.SHA512,
-}
-
-// unexpectedMessageError results when the SSH message that we received didn't
-// match what we wanted.
-func unexpectedMessageError(expected, got uint8) error {
-	return fmt.Errorf("ssh: unexpected message type %d (expected %d)", got, expected)
-}
-
-// parseError results from a malformed SSH message.
-func parseError(tag uint8) error {
-	return fmt.Errorf("ssh: parse error in message type %d", tag)
-}
-
-func findCommon(what string, client []string, server []string) (common string, err error) {
-	for _, c := range client {
-		for _, s := range server {
-			if c == s {
-				return c, nil
-			}
-		}
-	}
-	return "", fmt.Errorf("ssh: no common algorithm for %s; client offered: %v, server offered: %v", what, client, server)
-}
-
-type DirectionAlgorithms struct {
-	Cipher      string `json:"cipher"`
-	MAC         string `json:"mac"`
-	Compression string `json:"compression"`
-}
-
-type Algorithms struct {
-	Kex     string
-	HostKey string
-	W       DirectionAlgorithms
-	R       DirectionAlgorithms
-}
-
-func (alg *Algorithms) MarshalJSON() ([]byte, error) {
-	aux := struct {
-		Kex     string              `json:"dh_kex_algorithm"`
-		HostKey string              `json:"host_key_algorithm"`
-		W       DirectionAlgorithms `json:"client_to_server_alg_group"`
-		R       DirectionAlgorithms `json:"server_to_client_alg_group"`
-	}{
-		Kex:     alg.Kex,
-		HostKey: alg.HostKey,
-		W:       alg.W,
-		R:       alg.R,
-	}
-
-	return json.Marshal(aux)
-}
-
-func findAgreedAlgorithms(clientKexInit, serverKexInit *KexInitMsg) (algs *Algorithms, err error) {
-	result := &Algorithms{}
-
-	result.Kex, err = findCommon("key exchange", clientKexInit.KexAlgos, serverKexInit.KexAlgos)
-	if err != nil {
-		return
-	}
-
-	result.HostKey, err = findCommon("host key", clientKexInit.ServerHostKeyAlgos, serverKexInit.ServerHostKeyAlgos)
-	if err != nil {
-		return
-	}
-
-	result.W.Cipher, err = findCommon("client to server cipher", clientKexInit.CiphersClientServer, serverKexInit.CiphersClientServer)
-	if err != nil {
-		return
-	}
-
-	result.R.Cipher, err = findCommon("server to client cipher", clientKexInit.CiphersServerClient, serverKexInit.CiphersServerClient)
-	if err != nil {
-		return
-	}
-
-	result.W.MAC, err = findCommon("client to server MAC", clientKexInit.MACsClientServer, serverKexInit.MACsClientServer)
-	if err != nil {
-		return
-	}
-
-	result.R.MAC, err = findCommon("server to client MAC", clientKexInit.MACsServerClient, serverKexInit.MACsServerClient)
-	if err != nil {
-		return
-	}
-
-	result.W.Compression, err = findCommon("client to server compression", clientKexInit.CompressionClientServer, serverKexInit.CompressionClientServer)
-	if err != nil {
-		return
-	}
-
-	result.R.Compression, err = findCommon("server to client compression", clientKexInit.CompressionServerClient, serverKexInit.CompressionServerClient)
-	if err != nil {
-		return
-	}
-
-	return result, nil
-}
-
-// If rekeythreshold is too small, we can't make any progress sending
-// stuff.
-const minRekeyThreshold uint64 = 256
-
-// Config contains configuration data common to both ServerConfig and
-// ClientConfig.
-type Config struct {
-	// Rand provides the source of entropy for cryptographic
-	// primitives. If Rand is nil, the cryptographic random reader
-	// in package crypto/rand will be used.
-	Rand io.Reader
-
-	// The maximum number of bytes sent or received after which a
-	// new key is negotiated. It must be at least 256. If
-	// unspecified, 1 gigabyte is used.
-	RekeyThreshold uint64
-
-	// The allowed key exchanges algorithms. If unspecified then a
-	// default set of algorithms is used.
-	KeyExchanges []string
-
-	// The allowed cipher algorithms. If unspecified then a sensible
-	// default is used.
-	Ciphers []string
-
-	// The allowed MAC algorithms. If unspecified then a sensible default
-	// is used.
-	MACs []string
-
-	// A pointer to the handshake log IOT allow incremental building
-	ConnLog *HandshakeLog
-
-	// Whether or not the package should operate in verbose mode
-	// (save more output)
-	Verbose bool
-
-	GexMinBits       uint
-	GexMaxBits       uint
-	GexPreferredBits uint
-	HelloOnly        bool
-}
-
-// SetDefaults sets sensible values for unset fields in config. This is
-// exported for testing: Configs passed to SSH functions are copied and have
-// default values set automatically.
-func (c *Config) SetDefaults() {
-	if c.Rand == nil {
-		c.Rand = rand.Reader
-	}
-	if c.Ciphers == nil {
-		c.Ciphers = defaultCiphers
-	}
-	var ciphers []string
-	for _, c := range c.Ciphers {
-		if cipherModes[c] != nil {
-			// reject the cipher if we have no cipherModes definition
-			ciphers = append(ciphers, c)
-		}
-	}
-	c.Ciphers = ciphers
-
-	if c.KeyExchanges == nil {
-		c.KeyExchanges = defaultKexAlgos
-	}
-
-	if c.MACs == nil {
-		c.MACs = supportedMACs
-	}
-
-	if c.RekeyThreshold == 0 {
-		// RFC 4253, section 9 suggests rekeying after 1G.
-		c.RekeyThreshold = 1 << 30
-	}
-	if c.RekeyThreshold < minRekeyThreshold {
-		c.RekeyThreshold = minRekeyThreshold
-	}
-}
-
-// buildDataSignedForAuth returns the data that is signed in order to prove
-// possession of a private key. See RFC 4252, section 7.
-func buildDataSignedForAuth(sessionId []byte, req userAuthRequestMsg, algo, pubKey []byte) []byte {
-	data := struct {
-		Session []byte
-		Type    byte
-		User    string
-		Service string
-		Method  string
-		Sign    bool
-		Algo    []byte
-		PubKey  []byte
-	}{
-		sessionId,
-		msgUserAuthRequest,
-		req.User,
-		req.Service,
-		req.Method,
-		true,
-		algo,
-		pubKey,
-	}
-	return Marshal(data)
-}
-
-func appendU16(buf []byte, n uint16) []byte {
-	return append(buf, byte(n>>8), byte(n))
-}
-
-func appendU32(buf []byte, n uint32) []byte {
-	return append(buf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
-}
-
-func appendU64(buf []byte, n uint64) []byte {
-	return append(buf,
-		byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32),
-		byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
-}
-
-func appendInt(buf []byte, n int) []byte {
-	return appendU32(buf, uint32(n))
-}
-
-func appendString(buf []byte, s string) []byte {
-	buf = appendU32(buf, uint32(len(s)))
-	buf = append(buf, s...)
-	return buf
-}
-
-func appendBool(buf []byte, b bool) []byte {
-	if b {
-		return append(buf, 1)
-	}
-	return append(buf, 0)
-}
-
-// newCond is a helper to hide the fact that there is no usable zero
-// value for sync.Cond.
-func newCond() *sync.Cond { return sync.NewCond(new(sync.Mutex)) }
-
-// window represents the buffer available to clients
-// wishing to write to a channel.
-type window struct {
-	*sync.Cond
-	win          uint32 // RFC 4254 5.2 says the window size can grow to 2^32-1
-	writeWaiters int
-	closed       bool
-}
-
-// add adds win to the amount of window available
-// for consumers.
-func (w *window) add(win uint32) bool {
-	// a zero sized window adjust is a noop.
-	if win == 0 {
-		return true
-	}
-	w.L.Lock()
-	if w.win+win < win {
-		w.L.Unlock()
-		return false
-	}
-	w.win += win
-	// It is unusual that multiple goroutines would be attempting to reserve
-	// window space, but not guaranteed. Use broadcast to notify all waiters
-	// that additional window is available.
-	w.Broadcast()
-	w.L.Unlock()
-	return true
-}
-
-// close sets the window to closed, so all reservations fail
-// immediately.
-func (w *window) close() {
-	w.L.Lock()
-	w.closed = true
-	w.Broadcast()
-	w.L.Unlock()
-}
-
-// reserve reserves win from the available window capacity.
-// If no capacity remains, reserve will block. reserve may
-// return less than requested.
-func (w *window) reserve(win uint32) (uint32, error) {
-	var err error
-	w.L.Lock()
-	w.writeWaiters++
-	w.Broadcast()
-	for w.win == 0 && !w.closed {
-		w.Wait()
-	}
-	w.writeWaiters--
-	if w.win < win {
-		win = w.win
-	}
-	w.win -= win
-	if w.closed {
-		err = io.EOF
-	}
-	w.L.Unlock()
-	return win, err
-}
-
-// waitWriterBlocked waits until some goroutine is blocked for further
-// writes. It is used in tests only.
-func (w *window) waitWriterBlocked() {
-	w.Cond.L.Lock()
-	for w.writeWaiters == 0 {
-		w.Cond.Wait()
-	}
-	w.Cond.L.Unlock()
-}
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// These are string constants in the SSH protocol.
+const (
+	compressionNone = "none"
+	serviceUserAuth = "ssh-userauth"
+	serviceSSH      = "ssh-connection"
+)
+
+// defaultCiphers specifies the default ciphers in preference order.
+var defaultCiphers = []string{
+	chacha20Poly1305ID,
+	"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	"aes128-gcm@openssh.com",
+	"arcfour256", "arcfour128",
+}
+
+// allSupportedCiphers specifies all ciphers which are supported
+var allSupportedCiphers = []string{
+	chacha20Poly1305ID,
+	"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	gcmCipherID,
+	"arcfour256", "arcfour128",
+	// Not offered by default:
+	"arcfour", aes128cbcID, tripledescbcID,
+}
+
+// defaultKexAlgos specifies the default key-exchange algorithms in
+// preference order.
+var defaultKexAlgos = []string{
+	kexAlgoCurve25519SHA256,
+	// P384 and P521 are not constant-time yet, but since we don't
+	// reuse ephemeral keys, using them for ECDH should be OK.
+	kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521,
+	kexAlgoDH14SHA1, kexAlgoDH1SHA1,
+}
+
+// allSupportedKexAlgos specifies all key-exchange algorithms supported
+var allSupportedKexAlgos = []string{
+	kexAlgoCurve25519SHA256,
+	// P384 and P521 are not constant-time yet, but since we don't
+	// reuse ephemeral keys, using them for ECDH should be OK.
+	kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521,
+	kexAlgoDH14SHA1, kexAlgoDH1SHA1,
+	// Not enabled by default:
+	kexAlgoDHGEXSHA1, kexAlgoDHGEXSHA256,
+}
+
+// supportedHostKeyAlgos specifies the supported host-key algorithms (i.e. methods
+// of authenticating servers) in preference order.
+var supportedHostKeyAlgos = []string{
+	CertAlgoRSAv01, CertAlgoDSAv01, CertAlgoECDSA256v01,
+	CertAlgoECDSA384v01, CertAlgoECDSA521v01, CertAlgoED25519v01,
+
+	KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521,
+	KeyAlgoRSA, KeyAlgoDSA,
+
+	KeyAlgoED25519,
+}
+
+// supportedMACs specifies a default set of MAC algorithms in preference order.
+// This is based on RFC 4253, section 6.4, but with hmac-md5 variants removed
+// because they have reached the end of their useful life. The etm variants
+// are encrypt-then-MAC (the MAC covers the ciphertext, including the
+// encrypted length prefix, rather than the plaintext) and are preferred
+// over their encrypt-and-MAC counterparts since they let the MAC be
+// checked before any decryption is attempted.
+var supportedMACs = []string{
+	hmacSHA256ETMID, hmacSHA512ETMID,
+	"hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
+}
+
+// etmMACs is the set of supportedMACs entries that use encrypt-then-MAC
+// ordering, used to populate DirectionAlgorithms.ETM.
+var etmMACs = map[string]bool{
+	hmacSHA256ETMID: true,
+	hmacSHA512ETMID: true,
+}
+
+// isETM reports whether mac is one of the encrypt-then-MAC algorithms,
+// for which the packet transport computes the MAC over the encrypted
+// packet (length prefix included) and verifies it before decrypting,
+// rather than over the plaintext after decryption as RFC 4253 describes.
+// This is the single source of truth consulted to populate
+// DirectionAlgorithms.ETM.
+//
+// isETM and DirectionAlgorithms.ETM only report which ordering was
+// negotiated; the packet transport that would actually compute the MAC
+// over ciphertext and verify it before decrypting lives in transport.go,
+// which isn't part of this snapshot, so no EtM MAC is actually computed
+// anywhere in this tree yet.
+func isETM(mac string) bool {
+	return etmMACs[mac] || strings.HasSuffix(mac, "-etm@openssh.com")
+}
+
+var supportedCompressions = []string{compressionNone}
+
+// hashFuncs keeps the mapping of supported algorithms to their respective
+// hashes needed for signature verification.
+var hashFuncs = map[string]crypto.Hash{
+	KeyAlgoRSA:          crypto.SHA1,
+	KeyAlgoDSA:          crypto.SHA1,
+	KeyAlgoECDSA256:     crypto.SHA256,
+	KeyAlgoECDSA384:     crypto.SHA384,
+	KeyAlgoECDSA521:     crypto.SHA512,
+	CertAlgoRSAv01:      crypto.SHA1,
+	CertAlgoDSAv01:      crypto.SHA1,
+	CertAlgoECDSA256v01: crypto.SHA256,
+	CertAlgoECDSA384v01: crypto.SHA384,
+	CertAlgoECDSA521v01: crypto.SHA512,
+}
+
+// unexpectedMessageError results when the SSH message that we received didn't
+// match what we wanted.
+func unexpectedMessageError(expected, got uint8) error {
+	return fmt.Errorf("ssh: unexpected message type %d (expected %d)", got, expected)
+}
+
+// parseError results from a malformed SSH message.
+func parseError(tag uint8) error {
+	return fmt.Errorf("ssh: parse error in message type %d", tag)
+}
+
+func findCommon(what string, client []string, server []string) (common string, err error) {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("ssh: no common algorithm for %s; client offered: %v, server offered: %v", what, client, server)
+}
+
+type DirectionAlgorithms struct {
+	Cipher string `json:"cipher"`
+	MAC    string `json:"mac"`
+	// ETM records whether MAC uses encrypt-then-MAC ordering (a
+	// "-etm@openssh.com" algorithm) rather than the classic
+	// encrypt-and-MAC ordering RFC 4253 describes.
+	ETM         bool   `json:"etm"`
+	Compression string `json:"compression"`
+}
+
+type Algorithms struct {
+	Kex     string
+	HostKey string
+	W       DirectionAlgorithms
+	R       DirectionAlgorithms
+}
+
+func (alg *Algorithms) MarshalJSON() ([]byte, error) {
+	aux := struct {
+		Kex     string              `json:"dh_kex_algorithm"`
+		HostKey string              `json:"host_key_algorithm"`
+		W       DirectionAlgorithms `json:"client_to_server_alg_group"`
+		R       DirectionAlgorithms `json:"server_to_client_alg_group"`
+	}{
+		Kex:     alg.Kex,
+		HostKey: alg.HostKey,
+		W:       alg.W,
+		R:       alg.R,
+	}
+
+	return json.Marshal(aux)
+}
+
+// extInfoTokens are pseudo key-exchange algorithms used to negotiate
+// protocol extensions out-of-band (RFC 8308 EXT_INFO, OpenSSH strict
+// kex). They are never real key-exchange algorithms and must not be
+// offered to findCommon.
+var extInfoTokens = map[string]bool{
+	extInfoClientToken:   true,
+	extInfoServerToken:   true,
+	strictKexClientToken: true,
+	strictKexServerToken: true,
+}
+
+func stripExtInfoTokens(algos []string) []string {
+	filtered := make([]string, 0, len(algos))
+	for _, a := range algos {
+		if !extInfoTokens[a] {
+			filtered = append(filtered, a)
+		}
+	}
+	return filtered
+}
+
+func findAgreedAlgorithms(clientKexInit, serverKexInit *KexInitMsg) (algs *Algorithms, err error) {
+	result := &Algorithms{}
+
+	result.Kex, err = findCommon("key exchange", stripExtInfoTokens(clientKexInit.KexAlgos), stripExtInfoTokens(serverKexInit.KexAlgos))
+	if err != nil {
+		return
+	}
+
+	result.HostKey, err = findCommon("host key", clientKexInit.ServerHostKeyAlgos, serverKexInit.ServerHostKeyAlgos)
+	if err != nil {
+		return
+	}
+
+	result.W.Cipher, err = findCommon("client to server cipher", clientKexInit.CiphersClientServer, serverKexInit.CiphersClientServer)
+	if err != nil {
+		return
+	}
+
+	result.R.Cipher, err = findCommon("server to client cipher", clientKexInit.CiphersServerClient, serverKexInit.CiphersServerClient)
+	if err != nil {
+		return
+	}
+
+	result.W.MAC, err = findCommon("client to server MAC", clientKexInit.MACsClientServer, serverKexInit.MACsClientServer)
+	if err != nil {
+		return
+	}
+	result.W.ETM = isETM(result.W.MAC)
+
+	result.R.MAC, err = findCommon("server to client MAC", clientKexInit.MACsServerClient, serverKexInit.MACsServerClient)
+	if err != nil {
+		return
+	}
+	result.R.ETM = isETM(result.R.MAC)
+
+	result.W.Compression, err = findCommon("client to server compression", clientKexInit.CompressionClientServer, serverKexInit.CompressionClientServer)
+	if err != nil {
+		return
+	}
+
+	result.R.Compression, err = findCommon("server to client compression", clientKexInit.CompressionServerClient, serverKexInit.CompressionServerClient)
+	if err != nil {
+		return
+	}
+
+	return result, nil
+}
+
+// EndpointId captures one side's SSH identification string (RFC 4253
+// section 4.2), both raw and split into its parsed components.
+type EndpointId struct {
+	Raw             string `json:"raw,omitempty"`
+	ProtoVersion    string `json:"protocol_version,omitempty"`
+	SoftwareVersion string `json:"software_version,omitempty"`
+	Comment         string `json:"comment,omitempty"`
+}
+
+// HandshakeLog records the artifacts produced by a single SSH key
+// exchange, for callers (zgrab2 scanners in particular) that want a
+// structured trace of what a server offered without having to set
+// Config.Verbose. Fields are populated incrementally as the handshake
+// proceeds, so a failed or refused exchange still leaves behind whatever
+// was captured before the failure; binary fields are plain []byte and
+// marshal to JSON as base64 automatically.
+type HandshakeLog struct {
+	ServerID *EndpointId `json:"server_id,omitempty"`
+	ClientID *EndpointId `json:"client_id,omitempty"`
+
+	ClientKex *KexInitMsg `json:"client_kex_init,omitempty"`
+	ServerKex *KexInitMsg `json:"server_kex_init,omitempty"`
+
+	AlgorithmSelection *Algorithms `json:"algorithm_selection,omitempty"`
+
+	DHKeyExchange kexAlgorithm `json:"dh_key_exchange,omitempty"`
+	Crypto        *kexResult   `json:"crypto,omitempty"`
+
+	// ExtInfo holds the RFC 8308 SSH_MSG_EXT_INFO extensions the peer
+	// sent during the first key exchange, if any.
+	ExtInfo map[string]string `json:"ext_info,omitempty"`
+
+	// GlobalRequests records every global request the server sent after
+	// the connection was established (e.g. keepalive@openssh.com,
+	// hostkeys-00@openssh.com, tcpip-forward), regardless of how
+	// Client.handleGlobalRequests was configured to reply to them.
+	GlobalRequests []GlobalRequestLog `json:"global_requests,omitempty"`
+
+	// ChannelOpens records every channel-open attempt the server
+	// initiated (e.g. x11, auth-agent@openssh.com, forwarded-tcpip) that
+	// wasn't claimed by a Client.HandleChannelOpen handler, regardless of
+	// how Client.handleChannelOpens was configured to respond to it.
+	ChannelOpens []ChannelOpenLog `json:"channel_opens,omitempty"`
+}
+
+// maxLoggedRequestBytes bounds how much of a global request's payload or
+// a channel-open's extra data is retained in HandshakeLog, so a chatty
+// or hostile server can't inflate the log arbitrarily.
+const maxLoggedRequestBytes = 256
+
+// GlobalRequestLog records one SSH_MSG_GLOBAL_REQUEST the server sent.
+type GlobalRequestLog struct {
+	RequestType   string `json:"request_type"`
+	WantReply     bool   `json:"want_reply"`
+	PayloadLength int    `json:"payload_length"`
+	// Payload is the request payload, hex-encoded and truncated to
+	// maxLoggedRequestBytes.
+	Payload string `json:"payload,omitempty"`
+}
+
+// ChannelOpenLog records one SSH_MSG_CHANNEL_OPEN the server initiated.
+// The initial window size and maximum packet size that accompany a
+// channel-open message are consumed internally by the connection
+// multiplexer and aren't exposed through the NewChannel interface
+// available here, so only the channel type and its type-specific extra
+// data are recorded.
+type ChannelOpenLog struct {
+	ChannelType     string `json:"channel_type"`
+	ExtraDataLength int    `json:"extra_data_length"`
+	// ExtraData is the channel-type-specific payload, hex-encoded and
+	// truncated to maxLoggedRequestBytes.
+	ExtraData string `json:"extra_data,omitempty"`
+}
+
+// If rekeythreshold is too small, we can't make any progress sending
+// stuff.
+const minRekeyThreshold uint64 = 256
+
+// defaultRekeyInterval is used when Config.RekeyInterval is unset.
+const defaultRekeyInterval = 1 * time.Hour
+
+// minRekeyInterval is the smallest interval a caller may configure; this
+// keeps a misconfigured RekeyInterval from rekeying so often that it
+// starves the connection of throughput.
+const minRekeyInterval = 1 * time.Minute
+
+// sixtyFourBitBlockRekeyThreshold is the byte-count cap RFC 4344 section
+// 3.4 recommends for ciphers with a 64-bit block size, such as
+// 3des-cbc: rekeying after 2^30 blocks bounds the probability of a
+// birthday-bound collision in CBC mode.
+const sixtyFourBitBlockRekeyThreshold = (1 << 30) * 8
+
+// sixtyFourBitBlockCiphers lists the supported ciphers with a 64-bit
+// block size, which fall under sixtyFourBitBlockRekeyThreshold rather
+// than the general RekeyThreshold.
+var sixtyFourBitBlockCiphers = map[string]bool{
+	tripledescbcID: true,
+}
+
+// rekeyThresholdForCiphers clips configured down to
+// sixtyFourBitBlockRekeyThreshold if either negotiated direction uses a
+// 64-bit-block cipher.
+func rekeyThresholdForCiphers(configured uint64, ciphers ...string) uint64 {
+	threshold := configured
+	for _, cipher := range ciphers {
+		if sixtyFourBitBlockCiphers[cipher] && threshold > sixtyFourBitBlockRekeyThreshold {
+			threshold = sixtyFourBitBlockRekeyThreshold
+		}
+	}
+	return threshold
+}
+
+// Config contains configuration data common to both ServerConfig and
+// ClientConfig.
+type Config struct {
+	// Rand provides the source of entropy for cryptographic
+	// primitives. If Rand is nil, the cryptographic random reader
+	// in package crypto/rand will be used.
+	Rand io.Reader
+
+	// The maximum number of bytes sent or received after which a
+	// new key is negotiated. It must be at least 256. If
+	// unspecified, 1 gigabyte is used. The effective threshold is
+	// clipped further for ciphers whose block size requires it; see
+	// rekeyThresholdForCiphers.
+	RekeyThreshold uint64
+
+	// RekeyInterval is the maximum amount of time to wait before
+	// negotiating a new key, regardless of how many bytes have been
+	// sent or received. If unspecified, one hour is used; values below
+	// one minute are raised to one minute.
+	RekeyInterval time.Duration
+
+	// The allowed key exchanges algorithms. If unspecified then a
+	// default set of algorithms is used.
+	KeyExchanges []string
+
+	// The allowed cipher algorithms. If unspecified then a sensible
+	// default is used.
+	Ciphers []string
+
+	// The allowed MAC algorithms. If unspecified then a sensible default
+	// is used.
+	MACs []string
+
+	// A pointer to the handshake log IOT allow incremental building
+	ConnLog *HandshakeLog
+
+	// Whether or not the package should operate in verbose mode
+	// (save more output)
+	Verbose bool
+
+	GexMinBits       uint
+	GexMaxBits       uint
+	GexPreferredBits uint
+	HelloOnly        bool
+
+	// KexOnly, like HelloOnly, short-circuits the client handshake, but
+	// after the first key exchange has actually completed rather than
+	// before it starts: ConnLog is fully populated, but clientAuthenticate
+	// is never called. Useful for scanners that want the handshake trace
+	// without attempting to authenticate.
+	KexOnly bool
+
+	// StrictKex controls whether the OpenSSH "strict kex" countermeasure
+	// against the Terrapin prefix-truncation attack is negotiated. If
+	// unspecified, StrictKexAuto is used.
+	StrictKex StrictKexMode
+}
+
+// StrictKexMode is a tri-state selector for Config.StrictKex.
+type StrictKexMode int
+
+const (
+	// StrictKexAuto negotiates strict kex whenever the peer also offers
+	// it; this is the default.
+	StrictKexAuto StrictKexMode = iota
+	// StrictKexRequire aborts the handshake if the peer does not also
+	// offer strict kex.
+	StrictKexRequire
+	// StrictKexDisable never advertises or honors strict kex. Useful for
+	// scanners that want to fingerprint unpatched servers.
+	StrictKexDisable
+)
+
+// SetDefaults sets sensible values for unset fields in config. This is
+// exported for testing: Configs passed to SSH functions are copied and have
+// default values set automatically.
+func (c *Config) SetDefaults() {
+	if c.Rand == nil {
+		c.Rand = rand.Reader
+	}
+	if c.Ciphers == nil {
+		c.Ciphers = defaultCiphers
+	}
+	var ciphers []string
+	for _, c := range c.Ciphers {
+		if cipherModes[c] != nil {
+			// reject the cipher if we have no cipherModes definition
+			ciphers = append(ciphers, c)
+		}
+	}
+	c.Ciphers = ciphers
+
+	if c.KeyExchanges == nil {
+		c.KeyExchanges = defaultKexAlgos
+	}
+
+	if c.MACs == nil {
+		c.MACs = supportedMACs
+	}
+
+	if c.RekeyThreshold == 0 {
+		// RFC 4253, section 9 suggests rekeying after 1G.
+		c.RekeyThreshold = 1 << 30
+	}
+	if c.RekeyThreshold < minRekeyThreshold {
+		c.RekeyThreshold = minRekeyThreshold
+	}
+
+	if c.RekeyInterval == 0 {
+		c.RekeyInterval = defaultRekeyInterval
+	}
+	if c.RekeyInterval < minRekeyInterval {
+		c.RekeyInterval = minRekeyInterval
+	}
+}
+
+// buildDataSignedForAuth returns the data that is signed in order to prove
+// possession of a private key. See RFC 4252, section 7.
+func buildDataSignedForAuth(sessionId []byte, req userAuthRequestMsg, algo, pubKey []byte) []byte {
+	data := struct {
+		Session []byte
+		Type    byte
+		User    string
+		Service string
+		Method  string
+		Sign    bool
+		Algo    []byte
+		PubKey  []byte
+	}{
+		sessionId,
+		msgUserAuthRequest,
+		req.User,
+		req.Service,
+		req.Method,
+		true,
+		algo,
+		pubKey,
+	}
+	return Marshal(data)
+}
+
+func appendU16(buf []byte, n uint16) []byte {
+	return append(buf, byte(n>>8), byte(n))
+}
+
+func appendU32(buf []byte, n uint32) []byte {
+	return append(buf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendU64(buf []byte, n uint64) []byte {
+	return append(buf,
+		byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32),
+		byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendInt(buf []byte, n int) []byte {
+	return appendU32(buf, uint32(n))
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendU32(buf, uint32(len(s)))
+	buf = append(buf, s...)
+	return buf
+}
+
+func appendBool(buf []byte, b bool) []byte {
+	if b {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+
+// newCond is a helper to hide the fact that there is no usable zero
+// value for sync.Cond.
+func newCond() *sync.Cond { return sync.NewCond(new(sync.Mutex)) }
+
+// window represents the buffer available to clients
+// wishing to write to a channel.
+type window struct {
+	*sync.Cond
+	win          uint32 // RFC 4254 5.2 says the window size can grow to 2^32-1
+	writeWaiters int
+	closed       bool
+}
+
+// add adds win to the amount of window available
+// for consumers.
+func (w *window) add(win uint32) bool {
+	// a zero sized window adjust is a noop.
+	if win == 0 {
+		return true
+	}
+	w.L.Lock()
+	if w.win+win < win {
+		w.L.Unlock()
+		return false
+	}
+	w.win += win
+	// It is unusual that multiple goroutines would be attempting to reserve
+	// window space, but not guaranteed. Use broadcast to notify all waiters
+	// that additional window is available.
+	w.Broadcast()
+	w.L.Unlock()
+	return true
+}
+
+// close sets the window to closed, so all reservations fail
+// immediately.
+func (w *window) close() {
+	w.L.Lock()
+	w.closed = true
+	w.Broadcast()
+	w.L.Unlock()
+}
+
+// reserve reserves win from the available window capacity.
+// If no capacity remains, reserve will block. reserve may
+// return less than requested.
+func (w *window) reserve(win uint32) (uint32, error) {
+	var err error
+	w.L.Lock()
+	w.writeWaiters++
+	w.Broadcast()
+	for w.win == 0 && !w.closed {
+		w.Wait()
+	}
+	w.writeWaiters--
+	if w.win < win {
+		win = w.win
+	}
+	w.win -= win
+	if w.closed {
+		err = io.EOF
+	}
+	w.L.Unlock()
+	return win, err
+}
+
+// waitWriterBlocked waits until some goroutine is blocked for further
+// writes. It is used in tests only.
+func (w *window) waitWriterBlocked() {
+	w.Cond.L.Lock()
+	for w.writeWaiters == 0 {
+		w.Cond.Wait()
+	}
+	w.Cond.L.Unlock()
+}
@@ -6,14 +6,44 @@ package ssh
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// msgExtInfo is SSH_MSG_EXT_INFO, defined by RFC 8308.
+const msgExtInfo = 7
+
+// extInfoClientToken and extInfoServerToken are the RFC 8308 pseudo
+// key-exchange algorithms used to signal SSH_MSG_EXT_INFO support; they
+// are stripped from the negotiated kex algorithm in findAgreedAlgorithms.
+const (
+	extInfoClientToken = "ext-info-c"
+	extInfoServerToken = "ext-info-s"
+)
+
+// strictKexClientToken and strictKexServerToken are the OpenSSH pseudo
+// key-exchange algorithms used to negotiate the "strict kex" Terrapin
+// countermeasure; like the ext-info tokens, they are stripped before
+// findAgreedAlgorithms intersects the real kex algorithm lists.
+const (
+	strictKexClientToken = "kex-strict-c-v00@openssh.com"
+	strictKexServerToken = "kex-strict-s-v00@openssh.com"
+)
+
+// msgDisconnect is SSH_MSG_DISCONNECT (RFC 4253 section 11.1).
+const msgDisconnect = 1
+
+// disconnectKeyExchangeFailed is SSH_DISCONNECT_KEY_EXCHANGE_FAILED.
+const disconnectKeyExchangeFailed = 13
+
 // debugHandshake, if set, prints messages sent and received.  Key
 // exchange messages are printed as if DH were used, so the debug
 // messages are wrong when using ECDH.
@@ -29,10 +59,30 @@ type keyingTransport interface {
 	// direction will be effected if a msgNewKeys message is sent
 	// or received.
 	prepareKeyChange(*Algorithms, *kexResult) error
+
+	// resetSeqNum resets the given direction's packet sequence number to
+	// zero. Required by the OpenSSH "strict kex" countermeasure against
+	// the Terrapin attack, which only holds if both peers start counting
+	// from zero immediately after the corresponding NEWKEYS.
+	resetSeqNum(write bool)
+}
+
+// pendingKex describes a key exchange that the kex loop must carry out.
+// otherInitPacket is the peer's KexInitMsg that triggered it (nil if we
+// are the one initiating a subsequent rekey and haven't seen the peer's
+// KexInit yet). done receives the result of the exchange exactly once.
+type pendingKex struct {
+	otherInitPacket []byte
+	done            chan error
 }
 
-// handshakeTransport implements rekeying on top of a keyingTransport
-// and offers a thread-safe writePacket() interface.
+// handshakeTransport implements rekeying on top of a keyingTransport. The
+// write side is owned exclusively by a dedicated kexLoop goroutine: callers
+// of writePacket never block on a mutex waiting for an in-progress key
+// exchange to finish, they simply hand their packet to the kexLoop over a
+// channel. This avoids the deadlock that a mutex/condition-variable design
+// invites whenever packet-handling code needs to reply (keepalives, channel
+// open/close, global requests) while a rekey is underway.
 type handshakeTransport struct {
 	conn   keyingTransport
 	config *Config
@@ -64,27 +114,75 @@ type handshakeTransport struct {
 
 	readSinceKex uint64
 
-	// Protects the writing side of the connection
-	mu              sync.Mutex
-	cond            *sync.Cond
-	sentInitPacket  []byte
-	sentInitMsg     *KexInitMsg
-	writtenSinceKex uint64
-	writeError      error
-
-	// The session ID or nil if first kex did not complete yet.
-	sessionID []byte
+	// rekeyThreshold is the effective byte threshold for the current
+	// cipher, set by the kexLoop after each completed exchange; see
+	// rekeyThresholdForCiphers. It starts out at config.RekeyThreshold,
+	// before any cipher has been negotiated.
+	rekeyThreshold atomic.Uint64
+
+	// outgoingPackets is fed by writePacket; the kexLoop goroutine is the
+	// only reader, and the only goroutine that ever calls t.conn.writePacket.
+	outgoingPackets chan []byte
+
+	// requestKex is a non-blocking signal asking the kexLoop to start a
+	// new key exchange once it is safe to do so (readOnePacket and
+	// writePacket send on this when their byte thresholds are exceeded).
+	requestKex chan struct{}
+
+	// startKex is used by readLoop to hand the kexLoop a KexInit received
+	// from the peer (or nil, for a locally-requested rekey) and to learn
+	// the result once the exchange completes.
+	startKex chan *pendingKex
+
+	// writtenSinceKex is updated by writePacket, which (per its docstring)
+	// may be called concurrently by multiple goroutines, so it is atomic
+	// like rekeyThreshold rather than owned by a single goroutine the way
+	// readSinceKex is.
+	writtenSinceKex atomic.Uint64
+
+	// done is closed once the kexLoop goroutine exits, at which point
+	// writeError holds the reason writing is no longer possible.
+	done         chan struct{}
+	writeErrorMu sync.Mutex
+	writeError   error
+
+	// sessionIDMu guards sessionID, which is written once by the kexLoop
+	// on the first key exchange and read by other goroutines afterwards.
+	sessionIDMu sync.Mutex
+	sessionID   []byte
+
+	// peerExtensionsMu guards peerExtensions, which is populated at most
+	// once, from the peer's RFC 8308 SSH_MSG_EXT_INFO sent immediately
+	// after the first SSH_MSG_NEWKEYS, if any.
+	peerExtensionsMu sync.Mutex
+	peerExtensions   map[string]string
+
+	// strictKexPending is true from connection setup until the first key
+	// exchange's NEWKEYS round-trip completes (or strict kex is ruled out
+	// once the peer's KexInit is seen). While true, and if config.StrictKex
+	// didn't disable it, readLoop must treat a msgIgnore/msgDebug packet
+	// as a protocol violation rather than silently dropping it.
+	strictKexPending atomic.Bool
+
+	// strictKex is set once, by the first enterKeyExchange, to whether
+	// strict kex was actually negotiated with the peer.
+	strictKex atomic.Bool
 }
 
 func newHandshakeTransport(conn keyingTransport, config *Config, clientVersion, serverVersion []byte) *handshakeTransport {
 	t := &handshakeTransport{
-		conn:          conn,
-		serverVersion: serverVersion,
-		clientVersion: clientVersion,
-		incoming:      make(chan []byte, 16),
-		config:        config,
-	}
-	t.cond = sync.NewCond(&t.mu)
+		conn:            conn,
+		serverVersion:   serverVersion,
+		clientVersion:   clientVersion,
+		incoming:        make(chan []byte, 16),
+		outgoingPackets: make(chan []byte, 16),
+		requestKex:      make(chan struct{}, 1),
+		startKex:        make(chan *pendingKex, 1),
+		done:            make(chan struct{}),
+		config:          config,
+	}
+	t.rekeyThreshold.Store(config.RekeyThreshold)
+	t.strictKexPending.Store(config.StrictKex != StrictKexDisable)
 	return t
 }
 
@@ -100,6 +198,7 @@ func newClientTransport(conn keyingTransport, clientVersion, serverVersion []byt
 		t.hostKeyAlgorithms = supportedHostKeyAlgos
 	}
 	go t.readLoop()
+	go t.kexLoop()
 	return t
 }
 
@@ -107,10 +206,13 @@ func newServerTransport(conn keyingTransport, clientVersion, serverVersion []byt
 	t := newHandshakeTransport(conn, &config.Config, clientVersion, serverVersion)
 	t.hostKeys = config.hostKeys
 	go t.readLoop()
+	go t.kexLoop()
 	return t
 }
 
 func (t *handshakeTransport) getSessionID() []byte {
+	t.sessionIDMu.Lock()
+	defer t.sessionIDMu.Unlock()
 	return t.sessionID
 }
 
@@ -121,6 +223,35 @@ func (t *handshakeTransport) id() string {
 	return "client"
 }
 
+// getPeerExtensions returns the name/value pairs the peer advertised via
+// SSH_MSG_EXT_INFO during the first key exchange, or nil if it sent none
+// (or none was expected). Conn does not yet expose this in this tree, so
+// callers reach it through the transport directly until that plumbing
+// lands.
+func (t *handshakeTransport) getPeerExtensions() map[string]string {
+	t.peerExtensionsMu.Lock()
+	defer t.peerExtensionsMu.Unlock()
+	return t.peerExtensions
+}
+
+func (t *handshakeTransport) getWriteError() error {
+	t.writeErrorMu.Lock()
+	defer t.writeErrorMu.Unlock()
+	return t.writeError
+}
+
+// closeWithError records err as the reason writing is no longer possible
+// and wakes up anyone blocked in writePacket. It is only ever called from
+// the kexLoop goroutine.
+func (t *handshakeTransport) closeWithError(err error) {
+	t.writeErrorMu.Lock()
+	if t.writeError == nil {
+		t.writeError = err
+	}
+	t.writeErrorMu.Unlock()
+	close(t.done)
+}
+
 func (t *handshakeTransport) readPacket() ([]byte, error) {
 	p, ok := <-t.incoming
 	if !ok {
@@ -137,26 +268,47 @@ func (t *handshakeTransport) readLoop() {
 			close(t.incoming)
 			break
 		}
+		if (p[0] == msgIgnore || p[0] == msgDebug) && t.strictKexPending.Load() {
+			// Terrapin countermeasure: while strict kex may still be
+			// negotiated for the initial handshake, no packet may be
+			// silently dropped before NEWKEYS, since an attacker could use
+			// exactly that tolerance to smuggle extra packets past the
+			// sequence-number check undetected.
+			t.sendDisconnect(disconnectKeyExchangeFailed, "strict KEX violation: unexpected message before NEWKEYS")
+			t.readError = errors.New("ssh: strict kex violation: unexpected message before NEWKEYS")
+			close(t.incoming)
+			break
+		}
 		if p[0] == msgIgnore || p[0] == msgDebug {
 			continue
 		}
 		t.incoming <- p
 	}
+}
 
-	// If we can't read, declare the writing part dead too.
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	if t.writeError == nil {
-		t.writeError = t.readError
+// sendDisconnect best-effort writes an SSH_MSG_DISCONNECT with reason and
+// description; any resulting write error is ignored since the connection
+// is being torn down regardless.
+func (t *handshakeTransport) sendDisconnect(reason uint32, description string) {
+	buf := []byte{msgDisconnect}
+	buf = appendU32(buf, reason)
+	buf = appendString(buf, description)
+	buf = appendString(buf, "")
+	t.conn.writePacket(buf)
+}
+
+// signalRequestKex asks the kexLoop to start a rekey, without blocking if
+// one has already been requested.
+func (t *handshakeTransport) signalRequestKex() {
+	select {
+	case t.requestKex <- struct{}{}:
+	default:
 	}
-	t.cond.Broadcast()
 }
 
 func (t *handshakeTransport) readOnePacket() ([]byte, error) {
-	if t.readSinceKex > t.config.RekeyThreshold {
-		if err := t.requestKeyChange(); err != nil {
-			return nil, err
-		}
+	if t.readSinceKex > t.rekeyThreshold.Load() {
+		t.signalRequestKex()
 	}
 
 	p, err := t.conn.readPacket()
@@ -176,44 +328,42 @@ func (t *handshakeTransport) readOnePacket() ([]byte, error) {
 	if p[0] != msgKexInit {
 		return p, nil
 	}
-	t.mu.Lock()
 
-	firstKex := t.sessionID == nil
-	if !t.config.HelloOnly {
-		err = t.enterKeyExchangeLocked(p)
-		if err != nil {
-			// drop connection
-			t.conn.Close()
-			t.writeError = err
-		}
+	firstKex := t.getSessionID() == nil
 
-		if debugHandshake {
-			log.Printf("%s exited key exchange (first %v), err %v", t.id(), firstKex, err)
-		}
+	if t.config.HelloOnly {
+		return []byte{msgIgnore}, nil
+	}
+
+	pk := &pendingKex{otherInitPacket: p, done: make(chan error, 1)}
+	select {
+	case t.startKex <- pk:
+	case <-t.done:
+		return nil, t.getWriteError()
 	}
-	// Unblock writers.
-	t.sentInitMsg = nil
-	t.sentInitPacket = nil
-	t.cond.Broadcast()
-	t.writtenSinceKex = 0
-	t.mu.Unlock()
 
+	select {
+	case err = <-pk.done:
+	case <-t.done:
+		err = t.getWriteError()
+	}
+	if debugHandshake {
+		log.Printf("%s exited key exchange (first %v), err %v", t.id(), firstKex, err)
+	}
 	if err != nil {
 		return nil, err
 	}
+
 	t.readSinceKex = 0
 
 	// By default, a key exchange is hidden from higher layers by
 	// translating it into msgIgnore.
-	successPacket := []byte{msgIgnore}
 	if firstKex {
-		// sendKexInit() for the first kex waits for
-		// msgNewKeys so the authentication process is
-		// guaranteed to happen over an encrypted transport.
-		successPacket = []byte{msgNewKeys}
+		// The first kex must complete before userauth proceeds, so the
+		// caller waiting in waitSession() is unblocked with msgNewKeys.
+		return []byte{msgNewKeys}, nil
 	}
-
-	return successPacket, nil
+	return []byte{msgIgnore}, nil
 }
 
 // keyChangeCategory describes whether a key exchange is the first on a
@@ -225,54 +375,180 @@ const (
 	subsequentKeyExchange keyChangeCategory = false
 )
 
-// sendKexInit sends a key change message, and returns the message
-// that was sent. After initiating the key change, all writes will be
-// blocked until the change is done, and a failed key change will
-// close the underlying transport. This function is safe for
-// concurrent use by multiple goroutines.
-func (t *handshakeTransport) sendKexInit(isFirst keyChangeCategory) error {
-	var err error
+// containsString reports whether s appears in list.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// marshalExtInfo encodes extensions as an SSH_MSG_EXT_INFO payload per
+// RFC 8308: the message type byte, a uint32 count, then that many
+// name/value string pairs.
+func marshalExtInfo(extensions map[string]string) []byte {
+	buf := []byte{msgExtInfo}
+	buf = appendU32(buf, uint32(len(extensions)))
+	for name, value := range extensions {
+		buf = appendString(buf, name)
+		buf = appendString(buf, value)
+	}
+	return buf
+}
 
-	t.mu.Lock()
-	// If this is the initial key change, but we already have a sessionID,
-	// then do nothing because the key exchange has already completed
-	// asynchronously.
-	if !isFirst || t.sessionID == nil {
-		_, _, err = t.sendKexInitLocked(isFirst)
+// readExtInfoString reads a uint32 length-prefixed string from the front
+// of buf, returning it along with the remaining bytes.
+func readExtInfoString(buf []byte) (string, []byte, error) {
+	if len(buf) < 4 {
+		return "", nil, parseError(msgExtInfo)
+	}
+	n := binary.BigEndian.Uint32(buf)
+	buf = buf[4:]
+	if uint64(len(buf)) < uint64(n) {
+		return "", nil, parseError(msgExtInfo)
+	}
+	return string(buf[:n]), buf[n:], nil
+}
+
+// parseExtInfo decodes an SSH_MSG_EXT_INFO payload into a name/value map.
+func parseExtInfo(packet []byte) (map[string]string, error) {
+	if len(packet) < 5 || packet[0] != msgExtInfo {
+		return nil, parseError(msgExtInfo)
+	}
+	n := binary.BigEndian.Uint32(packet[1:5])
+	rest := packet[5:]
+	extensions := make(map[string]string, n)
+	for i := uint32(0); i < n; i++ {
+		name, tail, err := readExtInfoString(rest)
+		if err != nil {
+			return nil, err
+		}
+		value, tail, err := readExtInfoString(tail)
+		if err != nil {
+			return nil, err
+		}
+		extensions[name] = value
+		rest = tail
 	}
-	t.mu.Unlock()
+	return extensions, nil
+}
+
+// waitSession blocks until the first key exchange has completed, so that
+// the caller is guaranteed to proceed over an encrypted transport.
+func (t *handshakeTransport) waitSession() error {
+	p, err := t.readPacket()
 	if err != nil {
 		return err
 	}
-	if isFirst {
-		if packet, err := t.readPacket(); err != nil {
-			return err
-		} else if packet[0] != msgNewKeys {
-			return unexpectedMessageError(msgNewKeys, packet[0])
-		}
+	if p[0] != msgNewKeys {
+		return unexpectedMessageError(msgNewKeys, p[0])
 	}
 	return nil
 }
 
-func (t *handshakeTransport) requestInitialKeyChange() error {
-	return t.sendKexInit(firstKeyExchange)
+// kexLoop is the sole writer of t.conn. It proactively sends our KexInit to
+// start the first key exchange, then services four kinds of work:
+// locally-requested rekeys (requestKex), peer-initiated rekeys handed over
+// by readLoop (startKex), the RekeyInterval timer, and ordinary outgoing
+// packets (outgoingPackets). Ordinary packets are only drained between key
+// exchanges, since message ordering around msgNewKeys is significant.
+func (t *handshakeTransport) kexLoop() {
+	var err error
+
+	// Kick off the first key exchange unconditionally; the peer does the
+	// same, and whichever KexInit arrives at readLoop second triggers the
+	// matching completion via startKex.
+	ourInit, ourInitPacket, err := t.sendKexInitPacket()
+	if err != nil {
+		t.closeWithError(err)
+		return
+	}
+
+	rekeyTimer := time.NewTimer(t.config.RekeyInterval)
+	defer rekeyTimer.Stop()
+
+	for err == nil {
+		select {
+		case pk := <-t.startKex:
+			err = t.enterKeyExchange(ourInit, ourInitPacket, pk.otherInitPacket)
+			pk.done <- err
+			if err == nil {
+				// Prepare our side of the next exchange lazily: it is
+				// (re)sent only once a rekey is actually requested.
+				ourInit, ourInitPacket = nil, nil
+				t.writtenSinceKex.Store(0)
+				resetRekeyTimer(rekeyTimer, t.config.RekeyInterval)
+			}
+
+		case <-t.requestKex:
+			if ourInit == nil {
+				ourInit, ourInitPacket, err = t.sendKexInitPacket()
+			}
+
+		case <-rekeyTimer.C:
+			// RekeyInterval elapsed with no traffic-driven rekey; ask for
+			// one anyway, byte thresholds aside.
+			t.signalRequestKex()
+			resetRekeyTimer(rekeyTimer, t.config.RekeyInterval)
+
+		case p, ok := <-t.outgoingPackets:
+			if !ok {
+				return
+			}
+			err = t.conn.writePacket(p)
+		}
+	}
+
+	t.closeWithError(err)
 }
 
-func (t *handshakeTransport) requestKeyChange() error {
-	return t.sendKexInit(subsequentKeyExchange)
+// resetRekeyTimer reschedules timer to fire after d, draining any pending
+// expiration first so Reset behaves correctly regardless of whether
+// timer.C has already been received from.
+func resetRekeyTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
 }
 
-// sendKexInitLocked sends a key change message. t.mu must be locked
-// while this happens.
-func (t *handshakeTransport) sendKexInitLocked(isFirst keyChangeCategory) (*KexInitMsg, []byte, error) {
-	// kexInits may be sent either in response to the other side,
-	// or because our side wants to initiate a key change, so we
-	// may have already sent a kexInit. In that case, don't send a
-	// second kexInit.
-	if t.sentInitMsg != nil {
-		return t.sentInitMsg, t.sentInitPacket, nil
+// writePacket hands p to the kexLoop goroutine for transmission. It never
+// blocks on an in-progress key exchange: it only blocks if the outgoing
+// queue itself is full, which is ordinary flow control, not a KEX
+// dependency.
+func (t *handshakeTransport) writePacket(p []byte) error {
+	switch p[0] {
+	case msgKexInit:
+		return errors.New("ssh: only handshakeTransport can send kexInit")
+	case msgNewKeys:
+		return errors.New("ssh: only handshakeTransport can send newKeys")
+	}
+
+	if t.writtenSinceKex.Load() > t.rekeyThreshold.Load() {
+		t.signalRequestKex()
+	}
+	t.writtenSinceKex.Add(uint64(len(p)))
+
+	select {
+	case t.outgoingPackets <- p:
+		return nil
+	case <-t.done:
+		return t.getWriteError()
 	}
+}
+
+func (t *handshakeTransport) Close() error {
+	return t.conn.Close()
+}
 
+// sendKexInitPacket builds and sends our KexInitMsg. It is only ever called
+// from the kexLoop goroutine, so it needs no locking.
+func (t *handshakeTransport) sendKexInitPacket() (*KexInitMsg, []byte, error) {
 	msg := &KexInitMsg{
 		KexAlgos:                t.config.KeyExchanges,
 		CiphersClientServer:     t.config.Ciphers,
@@ -289,8 +565,16 @@ func (t *handshakeTransport) sendKexInitLocked(isFirst keyChangeCategory) (*KexI
 			msg.ServerHostKeyAlgos = append(
 				msg.ServerHostKeyAlgos, k.PublicKey().Type())
 		}
+		msg.KexAlgos = append(append([]string{}, msg.KexAlgos...), extInfoServerToken)
+		if t.config.StrictKex != StrictKexDisable {
+			msg.KexAlgos = append(msg.KexAlgos, strictKexServerToken)
+		}
 	} else {
 		msg.ServerHostKeyAlgos = t.hostKeyAlgorithms
+		msg.KexAlgos = append(append([]string{}, msg.KexAlgos...), extInfoClientToken)
+		if t.config.StrictKex != StrictKexDisable {
+			msg.KexAlgos = append(msg.KexAlgos, strictKexClientToken)
+		}
 	}
 	packet := Marshal(msg)
 
@@ -302,56 +586,55 @@ func (t *handshakeTransport) sendKexInitLocked(isFirst keyChangeCategory) (*KexI
 		return nil, nil, err
 	}
 
-	t.sentInitMsg = msg
-	t.sentInitPacket = packet
 	return msg, packet, nil
 }
 
-func (t *handshakeTransport) writePacket(p []byte) error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-
-	if t.writtenSinceKex > t.config.RekeyThreshold {
-		t.sendKexInitLocked(subsequentKeyExchange)
-	}
-	for t.sentInitMsg != nil && t.writeError == nil {
-		t.cond.Wait()
-	}
-	if t.writeError != nil {
-		return t.writeError
+// serverSigAlgsExtension builds the RFC 8308 "server-sig-algs" value,
+// advertising the signature algorithms this server accepts for each of
+// its configured host keys. An RSA host key additionally advertises the
+// RFC 8332 SHA-2 variants, so a publickey-auth client can pick a
+// stronger signature without having to probe for it.
+func (t *handshakeTransport) serverSigAlgsExtension() map[string]string {
+	var algos []string
+	add := func(algo string) {
+		if !containsString(algos, algo) {
+			algos = append(algos, algo)
+		}
 	}
-	t.writtenSinceKex += uint64(len(p))
-
-	switch p[0] {
-	case msgKexInit:
-		return errors.New("ssh: only handshakeTransport can send kexInit")
-	case msgNewKeys:
-		return errors.New("ssh: only handshakeTransport can send newKeys")
-	default:
-		return t.conn.writePacket(p)
+	for _, k := range t.hostKeys {
+		switch k.PublicKey().Type() {
+		case KeyAlgoRSA:
+			add(KeyAlgoRSA)
+			add("rsa-sha2-256")
+			add("rsa-sha2-512")
+		default:
+			add(k.PublicKey().Type())
+		}
 	}
+	return map[string]string{"server-sig-algs": strings.Join(algos, ",")}
 }
 
-func (t *handshakeTransport) Close() error {
-	return t.conn.Close()
-}
-
-// enterKeyExchange runs the key exchange. t.mu must be held while running this.
-func (t *handshakeTransport) enterKeyExchangeLocked(otherInitPacket []byte) error {
+// enterKeyExchange runs a key exchange to completion, given our already-sent
+// KexInit and the peer's. It is only ever called from the kexLoop goroutine.
+func (t *handshakeTransport) enterKeyExchange(myInit *KexInitMsg, myInitPacket, otherInitPacket []byte) error {
 	if debugHandshake {
 		log.Printf("%s entered key exchange", t.id())
 	}
-	myInit, myInitPacket, err := t.sendKexInitLocked(subsequentKeyExchange)
-	if err != nil {
-		return err
-	}
 
-	if t.config.Verbose {
-		if t.config.ConnLog != nil {
-			t.config.ConnLog.ClientKex = myInit
+	firstKex := t.getSessionID() == nil
+
+	if myInit == nil {
+		var err error
+		myInit, myInitPacket, err = t.sendKexInitPacket()
+		if err != nil {
+			return err
 		}
 	}
 
+	if t.config.ConnLog != nil {
+		t.config.ConnLog.ClientKex = myInit
+	}
+
 	otherInit := &KexInitMsg{}
 	if err := Unmarshal(otherInitPacket, otherInit); err != nil {
 		return err
@@ -377,6 +660,20 @@ func (t *handshakeTransport) enterKeyExchangeLocked(otherInitPacket []byte) erro
 		magics.serverKexInit = otherInitPacket
 	}
 
+	if firstKex {
+		negotiated := t.config.StrictKex != StrictKexDisable &&
+			containsString(clientInit.KexAlgos, strictKexClientToken) &&
+			containsString(serverInit.KexAlgos, strictKexServerToken)
+		if !negotiated && t.config.StrictKex == StrictKexRequire {
+			t.strictKexPending.Store(false)
+			return errors.New("ssh: peer does not support strict kex")
+		}
+		t.strictKex.Store(negotiated)
+		if !negotiated {
+			t.strictKexPending.Store(false)
+		}
+	}
+
 	algs, err := findAgreedAlgorithms(clientInit, serverInit)
 	if err != nil {
 		return err
@@ -384,6 +681,7 @@ func (t *handshakeTransport) enterKeyExchangeLocked(otherInitPacket []byte) erro
 	if t.config.ConnLog != nil {
 		t.config.ConnLog.AlgorithmSelection = algs
 	}
+	t.rekeyThreshold.Store(rekeyThresholdForCiphers(t.config.RekeyThreshold, algs.W.Cipher, algs.R.Cipher))
 
 	// We don't send FirstKexFollows, but we handle receiving it.
 	//
@@ -420,29 +718,74 @@ func (t *handshakeTransport) enterKeyExchangeLocked(otherInitPacket []byte) erro
 	} else {
 		result, err = t.client(kex, algs, &magics)
 	}
-	if t.config.Verbose {
-		if t.config.ConnLog != nil {
-			t.config.ConnLog.Crypto = result
-		}
+	if t.config.ConnLog != nil {
+		t.config.ConnLog.Crypto = result
 	}
 	if err != nil {
 		return err
 	}
 
+	t.sessionIDMu.Lock()
 	if t.sessionID == nil {
 		t.sessionID = result.H
 	}
-	result.SessionID = t.sessionID
+	sessionID := t.sessionID
+	t.sessionIDMu.Unlock()
+	result.SessionID = sessionID
 
 	t.conn.prepareKeyChange(algs, result)
 	if err = t.conn.writePacket([]byte{msgNewKeys}); err != nil {
 		return err
 	}
+	if firstKex && t.strictKex.Load() {
+		t.conn.resetSeqNum(true)
+	}
+
+	// RFC 8308: if we are the server and the client advertised ext-info-c,
+	// our SSH_MSG_EXT_INFO must be the very next packet we send, under the
+	// keys just switched to by msgNewKeys.
+	if firstKex && len(t.hostKeys) > 0 && containsString(clientInit.KexAlgos, extInfoClientToken) {
+		if err = t.conn.writePacket(marshalExtInfo(t.serverSigAlgsExtension())); err != nil {
+			return err
+		}
+	}
+
 	if packet, err := t.conn.readPacket(); err != nil {
 		return err
 	} else if packet[0] != msgNewKeys {
 		return unexpectedMessageError(msgNewKeys, packet[0])
 	}
+	if firstKex && t.strictKex.Load() {
+		t.conn.resetSeqNum(false)
+	}
+
+	// Symmetrically, if we are the client and both sides advertised the
+	// extension tokens, the server's SSH_MSG_EXT_INFO is the packet right
+	// after its SSH_MSG_NEWKEYS.
+	if firstKex && len(t.hostKeys) == 0 && containsString(clientInit.KexAlgos, extInfoClientToken) && containsString(serverInit.KexAlgos, extInfoServerToken) {
+		packet, err := t.conn.readPacket()
+		if err != nil {
+			return err
+		}
+		extensions, err := parseExtInfo(packet)
+		if err != nil {
+			return err
+		}
+		t.peerExtensionsMu.Lock()
+		t.peerExtensions = extensions
+		t.peerExtensionsMu.Unlock()
+		if t.config.ConnLog != nil {
+			t.config.ConnLog.ExtInfo = extensions
+		}
+	}
+
+	if firstKex {
+		// The strict-kex window is specifically between the peer's
+		// KexInit and its NEWKEYS; once NEWKEYS (and any EXT_INFO riding
+		// just after it) has been handled, ordinary msgIgnore/msgDebug
+		// tolerance resumes.
+		t.strictKexPending.Store(false)
+	}
 
 	return nil
 }
@@ -0,0 +1,77 @@
+package ssh
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestStripExtInfoTokensFiltersPseudoAlgorithms verifies the RFC 8308 /
+// "kex-strict" pseudo-algorithm names are removed before a KexAlgos list
+// is handed to findCommon, since a real key-exchange method is never
+// actually named "ext-info-c" or "kex-strict-s-v00@openssh.com".
+//
+// findAgreedAlgorithms itself isn't tested here: it takes *KexInitMsg,
+// whose type is defined in messages.go, which isn't part of this
+// snapshot, so a KexInitMsg value can't be constructed in this tree.
+func TestStripExtInfoTokensFiltersPseudoAlgorithms(t *testing.T) {
+	in := []string{
+		"curve25519-sha256",
+		extInfoClientToken,
+		"diffie-hellman-group14-sha256",
+		strictKexClientToken,
+	}
+	got := stripExtInfoTokens(in)
+	want := []string{"curve25519-sha256", "diffie-hellman-group14-sha256"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("stripExtInfoTokens(%v) = %v, want %v", in, got, want)
+	}
+
+	// A list with no pseudo-algorithms in it is returned unchanged.
+	clean := []string{"curve25519-sha256"}
+	if got := stripExtInfoTokens(clean); !reflect.DeepEqual(got, clean) {
+		t.Fatalf("stripExtInfoTokens(%v) = %v, want unchanged", clean, got)
+	}
+}
+
+// TestExtInfoRoundTrip verifies marshalExtInfo/parseExtInfo agree on the
+// SSH_MSG_EXT_INFO wire format (RFC 8308), including the server-sig-algs
+// extension name serverSigAlgsExtension would populate.
+//
+// serverSigAlgsExtension itself isn't called directly here: it ranges
+// over t.hostKeys ([]Signer), and Signer is defined in keys.go, which
+// isn't part of this snapshot, so no host key value can be constructed
+// in this tree to drive it.
+func TestExtInfoRoundTrip(t *testing.T) {
+	want := map[string]string{
+		"server-sig-algs": "ssh-rsa,rsa-sha2-256,rsa-sha2-512",
+	}
+	packet := marshalExtInfo(want)
+
+	if packet[0] != msgExtInfo {
+		t.Fatalf("packet[0] = %d, want msgExtInfo (%d)", packet[0], msgExtInfo)
+	}
+
+	got, err := parseExtInfo(packet)
+	if err != nil {
+		t.Fatalf("parseExtInfo: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseExtInfo round trip = %v, want %v", got, want)
+	}
+}
+
+// TestParseExtInfoRejectsTruncated verifies parseExtInfo errors out
+// rather than panicking on a packet cut short mid name/value pair.
+func TestParseExtInfoRejectsTruncated(t *testing.T) {
+	full := marshalExtInfo(map[string]string{"ext-info-c": "1"})
+
+	if _, err := parseExtInfo(full[:len(full)-2]); err == nil {
+		t.Fatal("expected an error parsing a truncated ext-info packet")
+	}
+	if _, err := parseExtInfo([]byte{msgExtInfo}); err == nil {
+		t.Fatal("expected an error parsing an ext-info packet with no count")
+	}
+	if _, err := parseExtInfo([]byte{msgKexInit, 0, 0, 0, 0}); err == nil {
+		t.Fatal("expected an error parsing a packet with the wrong message type")
+	}
+}
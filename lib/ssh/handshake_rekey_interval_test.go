@@ -0,0 +1,62 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSetDefaultsRekeyInterval verifies RekeyInterval/RekeyThreshold get
+// the documented defaults and minimums from Config.SetDefaults, since
+// kexLoop's timer-based rekey (exercised below) trusts SetDefaults to
+// have already sanitized these fields.
+func TestSetDefaultsRekeyInterval(t *testing.T) {
+	var c Config
+	c.SetDefaults()
+	if c.RekeyInterval != defaultRekeyInterval {
+		t.Errorf("RekeyInterval = %v, want default %v", c.RekeyInterval, defaultRekeyInterval)
+	}
+	if c.RekeyThreshold != 1<<30 {
+		t.Errorf("RekeyThreshold = %d, want default %d", c.RekeyThreshold, uint64(1<<30))
+	}
+
+	c = Config{RekeyInterval: time.Second}
+	c.SetDefaults()
+	if c.RekeyInterval != minRekeyInterval {
+		t.Errorf("RekeyInterval = %v, want clamped minimum %v", c.RekeyInterval, minRekeyInterval)
+	}
+}
+
+// TestRekeyTimerRequestsKexWithNoTraffic reproduces kexLoop's
+// rekeyTimer-driven branch in isolation (kexLoop itself can't run here
+// because its first call, sendKexInitPacket, needs the KexInitMsg/Marshal
+// machinery that isn't part of this tree): it arms a rekeyTimer exactly
+// as kexLoop does and checks that, with no outgoing traffic at all, the
+// timer firing alone calls signalRequestKex and gets itself rearmed.
+func TestRekeyTimerRequestsKexWithNoTraffic(t *testing.T) {
+	conn := &fakeKeyingConn{}
+	tr := newHandshakeTransport(conn, &Config{}, nil, nil)
+
+	const interval = 10 * time.Millisecond
+	rekeyTimer := time.NewTimer(interval)
+	defer rekeyTimer.Stop()
+
+	fired := make(chan struct{})
+	go func() {
+		<-rekeyTimer.C
+		tr.signalRequestKex()
+		resetRekeyTimer(rekeyTimer, interval)
+		close(fired)
+	}()
+
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("rekeyTimer never fired")
+	}
+
+	select {
+	case <-tr.requestKex:
+	default:
+		t.Fatal("rekeyTimer firing did not signal requestKex")
+	}
+}
@@ -0,0 +1,107 @@
+package ssh
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptedKeyingConn is a keyingTransport double whose readPacket replays
+// a fixed script of packets before returning errScriptExhausted, so a
+// test can feed readLoop an exact sequence (e.g. an SSH_MSG_IGNORE
+// injected just before NEWKEYS) without a real peer.
+type scriptedKeyingConn struct {
+	fakeKeyingConn
+	script []byte // one message-type byte per scripted packet
+	pos    int
+}
+
+var errScriptExhausted = errors.New("scriptedKeyingConn: script exhausted")
+
+func (s *scriptedKeyingConn) readPacket() ([]byte, error) {
+	if s.pos >= len(s.script) {
+		return nil, errScriptExhausted
+	}
+	p := []byte{s.script[s.pos]}
+	s.pos++
+	return p, nil
+}
+
+// newTestHandshakeTransport builds a handshakeTransport around a scripted
+// conn with StrictKex on or off, and starts its readLoop (but not kexLoop,
+// which would hit the missing KexInitMsg/Marshal wall via
+// sendKexInitPacket; readLoop alone is self-contained and is all this
+// test needs).
+func newTestHandshakeTransport(script []byte, strict StrictKexMode) *handshakeTransport {
+	conn := &scriptedKeyingConn{script: script}
+	tr := newHandshakeTransport(conn, &Config{StrictKex: strict}, nil, nil)
+	go tr.readLoop()
+	return tr
+}
+
+// TestStrictKexRejectsIgnoreBeforeNewKeys is the Terrapin-countermeasure
+// case the request asked for directly: a scripted peer sends
+// SSH_MSG_IGNORE before the first NEWKEYS, and with strict kex pending
+// (the default until a key exchange completes), readLoop must treat that
+// as a violation rather than silently drop it.
+func TestStrictKexRejectsIgnoreBeforeNewKeys(t *testing.T) {
+	tr := newTestHandshakeTransport([]byte{msgIgnore}, StrictKexRequire)
+
+	select {
+	case _, ok := <-tr.incoming:
+		if ok {
+			t.Fatal("expected incoming to be closed after a strict-kex violation, got a packet instead")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("readLoop never closed incoming after the scripted SSH_MSG_IGNORE")
+	}
+
+	if tr.readError == nil || !strings.Contains(tr.readError.Error(), "strict kex violation") {
+		t.Fatalf("readError = %v, want a strict kex violation error", tr.readError)
+	}
+}
+
+// TestStrictKexDisabledToleratesIgnoreBeforeNewKeys verifies the
+// complementary non-strict path: with StrictKexDisable, the same scripted
+// SSH_MSG_IGNORE is tolerated (silently dropped) rather than torn down,
+// and a following ordinary packet still reaches the caller.
+func TestStrictKexDisabledToleratesIgnoreBeforeNewKeys(t *testing.T) {
+	tr := newTestHandshakeTransport([]byte{msgIgnore, msgDebug, msgChannelData}, StrictKexDisable)
+
+	select {
+	case p, ok := <-tr.incoming:
+		if !ok {
+			t.Fatalf("incoming closed unexpectedly, readError = %v", tr.readError)
+		}
+		if p[0] != msgChannelData {
+			t.Fatalf("got message type %d, want msgChannelData (%d)", p[0], msgChannelData)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("readLoop never delivered the packet past the tolerated msgIgnore/msgDebug")
+	}
+}
+
+// TestStrictKexPendingClearedAfterFirstKex verifies that once
+// strictKexPending is cleared (as enterKeyExchange does on completion,
+// win or lose, when strict kex wasn't actually negotiated), a subsequent
+// SSH_MSG_IGNORE is tolerated rather than torn down — strict kex only
+// ever governs the handshake before the first NEWKEYS.
+func TestStrictKexPendingClearedAfterFirstKex(t *testing.T) {
+	conn := &scriptedKeyingConn{script: []byte{msgIgnore, msgChannelData}}
+	tr := newHandshakeTransport(conn, &Config{StrictKex: StrictKexRequire}, nil, nil)
+	tr.strictKexPending.Store(false)
+	go tr.readLoop()
+
+	select {
+	case p, ok := <-tr.incoming:
+		if !ok {
+			t.Fatalf("incoming closed unexpectedly, readError = %v", tr.readError)
+		}
+		if p[0] != msgChannelData {
+			t.Fatalf("got message type %d, want msgChannelData (%d)", p[0], msgChannelData)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("readLoop never delivered the packet once strictKexPending was cleared")
+	}
+}
@@ -0,0 +1,192 @@
+package ssh
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKeyingConn is a minimal keyingTransport double for exercising
+// handshakeTransport's write-side concurrency without a real key
+// exchange: its writePacket just records the packet, and its other
+// methods are no-ops.
+type fakeKeyingConn struct {
+	mu      sync.Mutex
+	written [][]byte
+}
+
+func (f *fakeKeyingConn) writePacket(p []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written = append(f.written, append([]byte(nil), p...))
+	return nil
+}
+
+func (f *fakeKeyingConn) readPacket() ([]byte, error) {
+	select {}
+}
+
+func (f *fakeKeyingConn) Close() error { return nil }
+
+func (f *fakeKeyingConn) prepareKeyChange(*Algorithms, *kexResult) error { return nil }
+
+func (f *fakeKeyingConn) resetSeqNum(write bool) {}
+
+// TestWritePacketDoesNotBlockOnKex verifies the core property of the
+// channel-based rekeying rewrite: writePacket only blocks on the
+// outgoingPackets queue itself being full, never on an in-progress key
+// exchange. Without a goroutine draining outgoingPackets (standing in for
+// a kexLoop that is busy with enterKeyExchange), writes up to the
+// channel's buffer must still succeed promptly; one more must block until
+// the queue is drained.
+func TestWritePacketDoesNotBlockOnKex(t *testing.T) {
+	conn := &fakeKeyingConn{}
+	config := &Config{RekeyThreshold: 1 << 30}
+	tr := newHandshakeTransport(conn, config, []byte("client"), []byte("server"))
+
+	const bufferSize = 16
+	for i := 0; i < bufferSize; i++ {
+		done := make(chan error, 1)
+		go func() { done <- tr.writePacket([]byte{msgChannelData, byte(i)}) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("writePacket %d: %v", i, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("writePacket %d blocked despite spare outgoingPackets capacity", i)
+		}
+	}
+
+	// The queue is now full; one more write must block until drained.
+	blocked := make(chan error, 1)
+	go func() { blocked <- tr.writePacket([]byte{msgChannelData, 0xFF}) }()
+	select {
+	case <-blocked:
+		t.Fatal("writePacket on a full queue returned without anyone draining it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Draining one slot (what kexLoop's outgoingPackets case does) must
+	// unblock it.
+	<-tr.outgoingPackets
+	select {
+	case err := <-blocked:
+		if err != nil {
+			t.Fatalf("writePacket after drain: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writePacket stayed blocked after the queue was drained")
+	}
+}
+
+// TestWritePacketRejectsKexMessages verifies that callers cannot smuggle
+// msgKexInit/msgNewKeys through the public writePacket, since only the
+// kexLoop goroutine itself may send those.
+func TestWritePacketRejectsKexMessages(t *testing.T) {
+	conn := &fakeKeyingConn{}
+	tr := newHandshakeTransport(conn, &Config{}, nil, nil)
+
+	if err := tr.writePacket([]byte{msgKexInit}); err == nil {
+		t.Fatal("expected an error writing msgKexInit through writePacket")
+	}
+	if err := tr.writePacket([]byte{msgNewKeys}); err == nil {
+		t.Fatal("expected an error writing msgNewKeys through writePacket")
+	}
+}
+
+// TestWritePacketUnblocksOnClose verifies that a writePacket call blocked
+// on a full outgoingPackets queue is released, with the stored error, once
+// closeWithError runs (e.g. because the kexLoop goroutine exited).
+func TestWritePacketUnblocksOnClose(t *testing.T) {
+	conn := &fakeKeyingConn{}
+	tr := newHandshakeTransport(conn, &Config{}, nil, nil)
+
+	for i := 0; i < cap(tr.outgoingPackets); i++ {
+		if err := tr.writePacket([]byte{msgChannelData}); err != nil {
+			t.Fatalf("writePacket %d: %v", i, err)
+		}
+	}
+
+	wantErr := errors.New("kex loop exited")
+	blocked := make(chan error, 1)
+	go func() { blocked <- tr.writePacket([]byte{msgChannelData}) }()
+
+	select {
+	case <-blocked:
+		t.Fatal("writePacket returned before the queue was drained or closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tr.closeWithError(wantErr)
+
+	select {
+	case err := <-blocked:
+		if !errors.Is(err, wantErr) {
+			t.Fatalf("got error %v, want %v", err, wantErr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writePacket stayed blocked after closeWithError")
+	}
+}
+
+// TestWrittenSinceKexConcurrent exercises writePacket from many goroutines
+// at once and checks writtenSinceKex tallies every byte exactly once, with
+// no lost updates under the race detector. This is the counter chunk1-1's
+// own fix made atomic; previously a plain uint64 read-modify-write here
+// raced with concurrent callers.
+func TestWrittenSinceKexConcurrent(t *testing.T) {
+	conn := &fakeKeyingConn{}
+	tr := newHandshakeTransport(conn, &Config{RekeyThreshold: 1 << 30}, nil, nil)
+
+	const goroutines = 50
+	const packetLen = 8 // 1 type byte + 7 payload bytes
+
+	var wg sync.WaitGroup
+	// Keep a drain goroutine running so writers past the buffer size don't
+	// block for the rest of the test.
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-tr.outgoingPackets:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer close(stop)
+
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			tr.writePacket(make([]byte, packetLen))
+		}()
+	}
+	wg.Wait()
+
+	if got, want := tr.writtenSinceKex.Load(), uint64(goroutines*packetLen); got != want {
+		t.Fatalf("writtenSinceKex = %d, want %d", got, want)
+	}
+}
+
+// TestResetRekeyTimer verifies the timer-rearm helper fires promptly and
+// tolerates being called again before the channel has been drained.
+func TestResetRekeyTimer(t *testing.T) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	resetRekeyTimer(timer, time.Millisecond)
+	select {
+	case <-timer.C:
+	case <-time.After(time.Second):
+		t.Fatal("resetRekeyTimer did not reschedule the timer to fire promptly")
+	}
+
+	// Resetting again, with the channel already drained, must not panic
+	// or deadlock (this is the drain-if-pending branch).
+	resetRekeyTimer(timer, time.Millisecond)
+	<-timer.C
+}
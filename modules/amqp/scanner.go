@@ -1,191 +1,499 @@
-// Package amqp contains the zgrab2 Module implementation for AMQP.
-//
-// The scan performs a banner grab by sending the AMQP protocol header
-// and awaiting the server's response.
-//
-// The output is the server's response, indicating whether it supports AMQP.
-package amqp
-
-import (
-	"fmt"
-	"net"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-// ScanResults is the output of the scan.
-type ScanResults struct {
-	// Banner is the initial data banner sent by the server.
-	Banner string `json:"banner,omitempty"`
-
-	// TLSLog is the standard shared TLS handshake log.
-	// Only present if the TLS flag is set.
-	TLSLog *zgrab2.TLSLog `json:"tls,omitempty"`
-}
-
-// Flags are the AMQP-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-	zgrab2.TLSFlags
-
-	Verbose     bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
-	ImplicitTLS bool `long:"implicit-tls" description:"Attempt to connect via a TLS wrapped connection"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct {
-}
-
-// Scanner implements the zgrab2.Scanner interface, and holds the state
-// for a single scan.
-type Scanner struct {
-	config *Flags
-}
-
-// Connection holds the state for a single connection to the AMQP server.
-type Connection struct {
-	config  *Flags
-	results ScanResults
-	conn    net.Conn
-}
-
-// RegisterModule registers the amqp zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("amqp", "AMQP", module.Description(), 5672, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns the default flags object to be filled in with the
-// command-line arguments.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns an overview of this module.
-func (m *Module) Description() string {
-	return "Grab an AMQP banner"
-}
-
-// Validate flags
-func (f *Flags) Validate(args []string) error {
-	return nil
-}
-
-// Help returns this module's help string.
-func (f *Flags) Help() string {
-	return ""
-}
-
-// Protocol returns the protocol identifier for the scanner.
-func (s *Scanner) Protocol() string {
-	return "amqp"
-}
-
-// Init initializes the Scanner instance with the flags from the command
-// line.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// GetName returns the configured name for the Scanner.
-func (s *Scanner) GetName() string {
-	return s.config.Name
-}
-
-// GetTrigger returns the Trigger defined in the Flags.
-func (scanner *Scanner) GetTrigger() string {
-	return scanner.config.Trigger
-}
-
-// readResponse reads the server's response.
-func (amqp *Connection) readResponse() (string, error) {
-	buffer := make([]byte, 10000)
-	n, err := amqp.conn.Read(buffer)
-	if err != nil {
-		return "", err
-	}
-	return string(buffer[:n]), nil
-}
-
-// GetAMQPBanner reads the data sent by the server immediately after connecting.
-func (amqp *Connection) GetAMQPBanner() (bool, error) {
-	// AMQP protocol header
-	header := []byte{0x41, 0x4D, 0x51, 0x50, 0x00, 0x01, 0x00, 0x00}
-	_, err := amqp.conn.Write(header)
-	if err != nil {
-		return false, err
-	}
-	banner, err := amqp.readResponse()
-	if err != nil {
-		return false, err
-	}
-	amqp.results.Banner = banner
-
-	// Validate the response
-	if len(banner) >= 8 && banner[:4] == "AMQP" {
-		return true, nil
-	}
-	return false, fmt.Errorf("invalid AMQP response: %s", banner)
-}
-
-// SetupTLS sets up a TLS connection if the ImplicitTLS flag is set.
-func (amqp *Connection) SetupTLS() error {
-	tlsConn, err := amqp.config.TLSFlags.GetTLSConnection(amqp.conn)
-	if err != nil {
-		return fmt.Errorf("error setting up TLS connection: %w", err)
-	}
-	amqp.results.TLSLog = tlsConn.GetLog()
-	err = tlsConn.Handshake()
-	if err != nil {
-		return fmt.Errorf("TLS handshake failed: %w", err)
-	}
-	amqp.conn = tlsConn
-	return nil
-}
-
-// Scan performs the configured scan on the AMQP server.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
-	var err error
-	conn, err := t.Open(&s.config.BaseFlags)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
-	}
-	cn := conn
-	defer func() {
-		cn.Close()
-	}()
-
-	results := ScanResults{}
-	amqp := Connection{conn: cn, config: s.config, results: results}
-
-	if s.config.ImplicitTLS {
-		if err := amqp.SetupTLS(); err != nil {
-			return zgrab2.TryGetScanStatus(err), &amqp.results, err
-		}
-	}
-
-	isValidBanner, err := amqp.GetAMQPBanner()
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), &amqp.results, fmt.Errorf("error reading AMQP banner: %w", err)
-	}
-	if !isValidBanner {
-		return zgrab2.TryGetScanStatus(fmt.Errorf("invalid AMQP banner")), &amqp.results, nil
-	}
-	return zgrab2.SCAN_SUCCESS, &amqp.results, nil
-}
+// Package amqp contains the zgrab2 Module implementation for AMQP.
+//
+// The scan performs a protocol-header negotiation appropriate to the
+// selected --version: for 0-9-1/0-10 it decodes the broker's
+// connection.start method frame, and for 1.0 it first solicits a SASL
+// mechanisms frame (when --sasl is set) before falling back to the plain
+// AMQP 1.0 header exchange.
+package amqp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// protoHeader09 is the AMQP 0-9-1 protocol header.
+var protoHeader09 = []byte{'A', 'M', 'Q', 'P', 0x00, 0x01, 0x00, 0x00}
+
+// protoHeader010 is the AMQP 0-10 protocol header.
+var protoHeader010 = []byte{'A', 'M', 'Q', 'P', 0x01, 0x01, 0x00, 0x0a}
+
+// protoHeaderSASL is the AMQP 1.0 SASL protocol header (id=3), per the
+// AMQP 1.0 specification section 5.3.2.
+var protoHeaderSASL = []byte{'A', 'M', 'Q', 'P', 0x03, 0x01, 0x00, 0x00}
+
+// protoHeader10 is the plain AMQP 1.0 protocol header (id=0).
+var protoHeader10 = []byte{'A', 'M', 'Q', 'P', 0x00, 0x01, 0x00, 0x00}
+
+// ServerProperties holds the fields zgrab2 cares about from a 0-9-1
+// connection.start method's server-properties field table.
+type ServerProperties struct {
+	Product      string   `json:"product,omitempty"`
+	Version      string   `json:"version,omitempty"`
+	Platform     string   `json:"platform,omitempty"`
+	ClusterName  string   `json:"cluster_name,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	// Banner is the raw data read immediately after connecting.
+	Banner string `json:"banner,omitempty"`
+
+	// ServerProperties holds the decoded server-properties table from a
+	// 0-9-1/0-10 connection.start method frame.
+	ServerProperties *ServerProperties `json:"server_properties,omitempty"`
+
+	// Mechanisms lists the SASL mechanisms offered by an AMQP 1.0 broker.
+	SASLMechanisms []string `json:"sasl_mechanisms,omitempty"`
+
+	// TLSLog is the standard shared TLS handshake log.
+	// Only present if the TLS flag is set.
+	TLSLog *zgrab2.TLSLog `json:"tls,omitempty"`
+}
+
+// Flags are the AMQP-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+	zgrab2.TLSFlags
+
+	Verbose     bool   `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+	ImplicitTLS bool   `long:"implicit-tls" description:"Attempt to connect via a TLS wrapped connection"`
+	StartTLS    bool   `long:"starttls" description:"Negotiate TLS on the same port after the server advertises support for it"`
+	Version     string `long:"version" default:"0-9-1" description:"AMQP protocol version to negotiate: 0-9-1, 0-10, or 1.0"`
+	SASL        bool   `long:"sasl" description:"For --version 1.0, solicit and parse the SASL mechanisms frame before the plain AMQP 1.0 header exchange"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface, and holds the state
+// for a single scan.
+type Scanner struct {
+	config *Flags
+}
+
+// Connection holds the state for a single connection to the AMQP server.
+type Connection struct {
+	config  *Flags
+	results ScanResults
+	conn    net.Conn
+}
+
+// RegisterModule registers the amqp zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("amqp", "AMQP", module.Description(), 5672, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object to be filled in with the
+// command-line arguments.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Grab an AMQP banner"
+}
+
+// Validate flags
+func (f *Flags) Validate(args []string) error {
+	switch f.Version {
+	case "0-9-1", "0-10", "1.0":
+	default:
+		return fmt.Errorf("invalid --version %q: must be one of 0-9-1, 0-10, 1.0", f.Version)
+	}
+	return nil
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (s *Scanner) Protocol() string {
+	return "amqp"
+}
+
+// Init initializes the Scanner instance with the flags from the command
+// line.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// readResponse reads the server's response.
+func (amqp *Connection) readResponse() ([]byte, error) {
+	buffer := make([]byte, 10000)
+	n, err := amqp.conn.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:n], nil
+}
+
+// readShortString decodes a 0-9-1 shortstr (1-byte length prefix).
+func readShortString(data []byte) (string, []byte, error) {
+	if len(data) < 1 {
+		return "", nil, fmt.Errorf("truncated shortstr length")
+	}
+	n := int(data[0])
+	data = data[1:]
+	if len(data) < n {
+		return "", nil, fmt.Errorf("truncated shortstr value")
+	}
+	return string(data[:n]), data[n:], nil
+}
+
+// readLongString decodes a 0-9-1 longstr (4-byte length prefix).
+func readLongString(data []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, fmt.Errorf("truncated longstr length")
+	}
+	n := int(binary.BigEndian.Uint32(data[:4]))
+	data = data[4:]
+	if len(data) < n {
+		return nil, nil, fmt.Errorf("truncated longstr value")
+	}
+	return data[:n], data[n:], nil
+}
+
+// readFieldValue decodes a single 0-9-1 field-value (a type octet followed
+// by a type-dependent payload) and returns it as a Go value, per the AMQP
+// 0-9-1 spec section 4.2.5.5.
+func readFieldValue(data []byte) (interface{}, []byte, error) {
+	if len(data) < 1 {
+		return nil, nil, fmt.Errorf("truncated field value type")
+	}
+	tag := data[0]
+	data = data[1:]
+	switch tag {
+	case 'S': // long string
+		s, rest, err := readLongString(data)
+		return string(s), rest, err
+	case 's': // short string
+		return readShortString(data)
+	case 't': // boolean
+		if len(data) < 1 {
+			return nil, nil, fmt.Errorf("truncated boolean")
+		}
+		return data[0] != 0, data[1:], nil
+	case 'I': // signed 32-bit int
+		if len(data) < 4 {
+			return nil, nil, fmt.Errorf("truncated int")
+		}
+		return int32(binary.BigEndian.Uint32(data[:4])), data[4:], nil
+	case 'F': // nested field table
+		table, rest, err := readFieldTable(data)
+		return table, rest, err
+	case 'A': // field array
+		return readFieldArray(data)
+	case 'V': // no field (void)
+		return nil, data, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported field-value type %q", tag)
+	}
+}
+
+// readFieldArray decodes a 0-9-1 field-array: a 4-byte length followed by
+// that many bytes of back-to-back field-values.
+func readFieldArray(data []byte) ([]interface{}, []byte, error) {
+	n, rest, err := readLongString(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	var values []interface{}
+	for len(n) > 0 {
+		var v interface{}
+		v, n, err = readFieldValue(n)
+		if err != nil {
+			return values, rest, err
+		}
+		values = append(values, v)
+	}
+	return values, rest, nil
+}
+
+// readFieldTable decodes a 0-9-1 field-table: a 4-byte length followed by
+// that many bytes of shortstr-keyed field-values.
+func readFieldTable(data []byte) (map[string]interface{}, []byte, error) {
+	raw, rest, err := readLongString(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	table := make(map[string]interface{})
+	for len(raw) > 0 {
+		var key string
+		key, raw, err = readShortString(raw)
+		if err != nil {
+			return table, rest, err
+		}
+		var value interface{}
+		value, raw, err = readFieldValue(raw)
+		if err != nil {
+			return table, rest, err
+		}
+		table[key] = value
+	}
+	return table, rest, nil
+}
+
+// classMethodConnectionStart is the (class, method) pair for
+// connection.start, per the 0-9-1 spec.
+const (
+	classConnection            = 10
+	methodConnectionStart      = 10
+	frameHeaderLen             = 7 // type(1) + channel(2) + size(4)
+	frameEndOctetOffsetPadding = 1 // trailing frame-end octet
+)
+
+// parseConnectionStart decodes the class/method frame that follows the
+// 0-9-1/0-10 protocol header, extracting server-properties. The frame
+// header (type/channel/size) and the trailing frame-end octet are skipped
+// rather than string-matched, per the wire format rather than a prefix
+// heuristic.
+func parseConnectionStart(data []byte) (*ServerProperties, error) {
+	if len(data) < frameHeaderLen+4 {
+		return nil, fmt.Errorf("response too short to contain a method frame")
+	}
+	payload := data[frameHeaderLen:]
+
+	class := binary.BigEndian.Uint16(payload[0:2])
+	method := binary.BigEndian.Uint16(payload[2:4])
+	if class != classConnection || method != methodConnectionStart {
+		return nil, fmt.Errorf("expected connection.start (class %d, method %d), got class %d method %d",
+			classConnection, methodConnectionStart, class, method)
+	}
+
+	// version-major(1) + version-minor(1) + server-properties(table) + ...
+	rest := payload[4:]
+	if len(rest) < 2 {
+		return nil, fmt.Errorf("truncated connection.start")
+	}
+	rest = rest[2:]
+
+	table, _, err := readFieldTable(rest)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding server-properties: %w", err)
+	}
+
+	props := &ServerProperties{}
+	if v, ok := table["product"].(string); ok {
+		props.Product = v
+	}
+	if v, ok := table["version"].(string); ok {
+		props.Version = v
+	}
+	if v, ok := table["platform"].(string); ok {
+		props.Platform = v
+	}
+	if v, ok := table["cluster_name"].(string); ok {
+		props.ClusterName = v
+	}
+	if caps, ok := table["capabilities"].(map[string]interface{}); ok {
+		for name, enabled := range caps {
+			if b, ok := enabled.(bool); ok && b {
+				props.Capabilities = append(props.Capabilities, name)
+			}
+		}
+	}
+	return props, nil
+}
+
+// parseSASLMechanisms decodes an AMQP 1.0 SASL-mechanisms frame's
+// sasl-server-mechanisms symbol array. This is a best-effort scan for the
+// mechanism names embedded in the frame body, since a full AMQP 1.0 type
+// codec is out of scope here.
+func parseSASLMechanisms(data []byte) []string {
+	var mechanisms []string
+	for _, known := range []string{"SCRAM-SHA-256", "SCRAM-SHA-1", "PLAIN", "ANONYMOUS", "EXTERNAL", "GSSAPI"} {
+		if containsASCII(data, known) {
+			mechanisms = append(mechanisms, known)
+		}
+	}
+	return mechanisms
+}
+
+// containsASCII reports whether needle appears as a contiguous ASCII
+// substring of data.
+func containsASCII(data []byte, needle string) bool {
+	if len(needle) == 0 || len(data) < len(needle) {
+		return false
+	}
+	for i := 0; i+len(needle) <= len(data); i++ {
+		if string(data[i:i+len(needle)]) == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate09 sends the 0-9-1 or 0-10 protocol header and decodes the
+// server's connection.start method frame.
+func (amqp *Connection) negotiate09(header []byte) error {
+	if _, err := amqp.conn.Write(header); err != nil {
+		return err
+	}
+	banner, err := amqp.readResponse()
+	if err != nil {
+		return err
+	}
+	amqp.results.Banner = string(banner)
+
+	if len(banner) >= 4 && string(banner[:4]) == "AMQP" {
+		// The server rejected our header and echoed back its own
+		// supported protocol header instead of a method frame.
+		return fmt.Errorf("server rejected protocol header: %x", banner)
+	}
+
+	props, err := parseConnectionStart(banner)
+	if err != nil {
+		return fmt.Errorf("error decoding connection.start: %w", err)
+	}
+	amqp.results.ServerProperties = props
+	return nil
+}
+
+// negotiate10 optionally solicits the SASL mechanisms frame, then performs
+// the plain AMQP 1.0 protocol header exchange.
+func (amqp *Connection) negotiate10() error {
+	if amqp.config.SASL {
+		if _, err := amqp.conn.Write(protoHeaderSASL); err != nil {
+			return err
+		}
+		saslResp, err := amqp.readResponse()
+		if err != nil {
+			return err
+		}
+		amqp.results.Banner = string(saslResp)
+		amqp.results.SASLMechanisms = parseSASLMechanisms(saslResp)
+	}
+
+	if _, err := amqp.conn.Write(protoHeader10); err != nil {
+		return err
+	}
+	banner, err := amqp.readResponse()
+	if err != nil {
+		return err
+	}
+	if amqp.results.Banner == "" {
+		amqp.results.Banner = string(banner)
+	}
+	if len(banner) < 8 || string(banner[:4]) != "AMQP" {
+		return fmt.Errorf("invalid AMQP 1.0 response: %x", banner)
+	}
+	return nil
+}
+
+// GetAMQPBanner negotiates the protocol header appropriate to --version
+// and decodes the server's response.
+func (amqp *Connection) GetAMQPBanner() error {
+	switch amqp.config.Version {
+	case "0-10":
+		return amqp.negotiate09(protoHeader010)
+	case "1.0":
+		return amqp.negotiate10()
+	default:
+		return amqp.negotiate09(protoHeader09)
+	}
+}
+
+// SetupTLS sets up a TLS connection if the ImplicitTLS flag is set.
+func (amqp *Connection) SetupTLS() error {
+	tlsConn, err := amqp.config.TLSFlags.GetTLSConnection(amqp.conn)
+	if err != nil {
+		return fmt.Errorf("error setting up TLS connection: %w", err)
+	}
+	amqp.results.TLSLog = tlsConn.GetLog()
+	err = tlsConn.Handshake()
+	if err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	amqp.conn = tlsConn
+	return nil
+}
+
+// upgradeStartTLS negotiates TLS on the same port once the server's
+// server-properties capabilities advertise support for it, mirroring the
+// imap/xmpp STARTTLS pattern.
+func (amqp *Connection) upgradeStartTLS() error {
+	if amqp.results.ServerProperties == nil {
+		return fmt.Errorf("cannot negotiate STARTTLS without a decoded connection.start")
+	}
+	advertised := false
+	for _, capability := range amqp.results.ServerProperties.Capabilities {
+		if capability == "starttls" {
+			advertised = true
+			break
+		}
+	}
+	if !advertised {
+		return fmt.Errorf("server did not advertise starttls support")
+	}
+	return amqp.SetupTLS()
+}
+
+// Scan performs the configured scan on the AMQP server.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	var err error
+	conn, err := t.Open(&s.config.BaseFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	cn := conn
+	defer func() {
+		cn.Close()
+	}()
+
+	results := ScanResults{}
+	amqpConn := Connection{conn: cn, config: s.config, results: results}
+
+	if s.config.ImplicitTLS {
+		if err := amqpConn.SetupTLS(); err != nil {
+			return zgrab2.TryGetScanStatus(err), &amqpConn.results, err
+		}
+	}
+
+	if err := amqpConn.GetAMQPBanner(); err != nil {
+		return zgrab2.TryGetScanStatus(err), &amqpConn.results, fmt.Errorf("error reading AMQP banner: %w", err)
+	}
+
+	if s.config.StartTLS {
+		if err := amqpConn.upgradeStartTLS(); err != nil {
+			return zgrab2.TryGetScanStatus(err), &amqpConn.results, fmt.Errorf("error upgrading to STARTTLS: %w", err)
+		}
+	}
+
+	return zgrab2.SCAN_SUCCESS, &amqpConn.results, nil
+}
@@ -1,186 +1,696 @@
-// Package bolt contains the zgrab2 Module implementation for Bolt.
-package bolt
-
-import (
-	"encoding/binary"
-	"fmt"
-	"net"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-// ScanResults is the output of the scan.
-type ScanResults struct {
-	// Initial identification bytes sent by the server.
-	Identification string `json:"identification,omitempty"`
-
-	// Server response to the version negotiation message.
-	VersionResponse string `json:"version_response,omitempty"`
-
-	// ProtocolVersion is the version of the Bolt protocol supported by the server.
-	ProtocolVersion uint32 `json:"protocol_version,omitempty"`
-}
-
-// Flags are the Bolt-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct {
-}
-
-// Scanner implements the zgrab2.Scanner interface, and holds the state
-// for a single scan.
-type Scanner struct {
-	config *Flags
-}
-
-// Connection holds the state for a single connection to the Bolt server.
-type Connection struct {
-	config  *Flags
-	results ScanResults
-	conn    net.Conn
-}
-
-// RegisterModule registers the bolt zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("bolt", "Bolt", module.Description(), 7687, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns the default flags object to be filled in with the
-// command-line arguments.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns an overview of this module.
-func (m *Module) Description() string {
-	return "Scan for Bolt protocol support"
-}
-
-// Validate flags
-func (f *Flags) Validate(args []string) (err error) {
-	return
-}
-
-// Help returns this module's help string.
-func (f *Flags) Help() string {
-	return ""
-}
-
-// Protocol returns the protocol identifer for the scanner.
-func (s *Scanner) Protocol() string {
-	return "bolt"
-}
-
-// Init initializes the Scanner instance with the flags from the command
-// line.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// GetName returns the configured name for the Scanner.
-func (s *Scanner) GetName() string {
-	return s.config.Name
-}
-
-// GetTrigger returns the Trigger defined in the Flags.
-func (scanner *Scanner) GetTrigger() string {
-	return scanner.config.Trigger
-}
-
-// sendBytes sends a byte slice to the server.
-func (conn *Connection) sendBytes(data []byte) error {
-	_, err := conn.conn.Write(data)
-	return err
-}
-
-// readBytes reads a specified number of bytes from the server.
-func (conn *Connection) readBytes(numBytes int) ([]byte, error) {
-	buffer := make([]byte, numBytes)
-	_, err := conn.conn.Read(buffer)
-	return buffer, err
-}
-
-// establishConnection establishes a TCP connection to the target.
-func (conn *Connection) establishConnection(target zgrab2.ScanTarget) error {
-	c, err := target.Open(&conn.config.BaseFlags)
-	if err != nil {
-		return fmt.Errorf("error opening connection: %w", err)
-	}
-	conn.conn = c
-	return nil
-}
-
-// Scan performs the configured scan on the Bolt server, as follows:
-//   - Establish a TCP connection
-//   - Send the identification bytes
-//   - Send the version negotiation message
-//   - Receive and validate the server response
-//   - Output the results
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
-	var err error
-	conn := &Connection{config: s.config}
-
-	if err = conn.establishConnection(t); err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error establishing connection: %w", err)
-	}
-	defer conn.conn.Close()
-
-	// Send identification bytes
-	identification := []byte{0x60, 0x60, 0xB0, 0x17}
-	if err = conn.sendBytes(identification); err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error sending identification bytes: %w", err)
-	}
-	conn.results.Identification = fmt.Sprintf("%x", identification)
-
-	// Send version negotiation message
-	versionMsg := []byte{
-		0x00, 0x00, 0x00, 0x01,
-		0x00, 0x00, 0x00, 0x02,
-		0x00, 0x00, 0x00, 0x03,
-		0x00, 0x00, 0x00, 0x00,
-	}
-	if err = conn.sendBytes(versionMsg); err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error sending version negotiation message: %w", err)
-	}
-
-	// Receive and validate server response
-	response, err := conn.readBytes(4)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error reading server response: %w", err)
-	}
-	conn.results.VersionResponse = fmt.Sprintf("%x", response)
-
-	// Interpret the response as a 32-bit integer
-	if len(response) != 4 {
-		return zgrab2.SCAN_PROTOCOL_ERROR, &conn.results, fmt.Errorf("invalid response length: expected 4 bytes, got %d", len(response))
-	}
-	version := binary.BigEndian.Uint32(response)
-	conn.results.ProtocolVersion = version
-
-	if version == 0 {
-		return zgrab2.SCAN_APPLICATION_ERROR, &conn.results, fmt.Errorf("invalid protocol version: %d", version)
-	}
-
-	return zgrab2.SCAN_SUCCESS, &conn.results, nil
-}
+// Package bolt contains the zgrab2 Module implementation for Bolt.
+package bolt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	// Initial identification bytes sent by the server.
+	Identification string `json:"identification,omitempty"`
+
+	// Server response to the version negotiation message.
+	VersionResponse string `json:"version_response,omitempty"`
+
+	// ProtocolVersion is the highest version of the Bolt protocol the
+	// server chose, across all negotiation rounds.
+	ProtocolVersion uint32 `json:"protocol_version,omitempty"`
+
+	// SupportedVersions lists every version the server chose across the
+	// negotiation rounds run (bounded by MaxNegotiations), from highest
+	// to lowest, e.g. ["5.4","4.4","4.3","3.0"].
+	SupportedVersions []string `json:"supported_versions,omitempty"`
+
+	// ServerAgent is the "server" field of a successful HELLO response,
+	// e.g. "Neo4j/5.13.0".
+	ServerAgent string `json:"server_agent,omitempty"`
+
+	// ConnectionID is the "connection_id" field of a successful HELLO
+	// response.
+	ConnectionID string `json:"connection_id,omitempty"`
+
+	// Metadata holds every other field of the HELLO response map,
+	// stringified, for whatever else a server discloses (advertised
+	// auth schemes, hints, etc).
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// AuthFailure is the "message"/"code" a FAILURE response to HELLO
+	// carries, if the server rejected it.
+	AuthFailure string `json:"auth_failure,omitempty"`
+
+	// TLSLog records the TLS handshake, if UseTLS or TLSFirst caused one
+	// to be attempted.
+	TLSLog *zgrab2.TLSLog `json:"tls,omitempty"`
+
+	// PlaintextRejected is true if TLSFirst was set, the plaintext
+	// identification bytes were rejected (connection closed or reset)
+	// before a TLS attempt, indicating the server requires Bolt-over-TLS.
+	PlaintextRejected bool `json:"plaintext_rejected,omitempty"`
+}
+
+// Flags are the Bolt-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+	zgrab2.TLSFlags
+
+	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+
+	UseTLS bool `long:"use-tls" description:"Unconditionally wrap the connection in TLS before the Bolt handshake"`
+
+	TLSFirst bool `long:"tls-first" description:"Attempt a TLS handshake first, falling back to plaintext Bolt if it fails"`
+
+	MaxNegotiations int `long:"max-negotiations" default:"4" description:"Maximum number of version-negotiation rounds to run while enumerating SupportedVersions"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface, and holds the state
+// for a single scan.
+type Scanner struct {
+	config *Flags
+}
+
+// Connection holds the state for a single connection to the Bolt server.
+type Connection struct {
+	config  *Flags
+	results ScanResults
+	conn    net.Conn
+}
+
+// RegisterModule registers the bolt zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("bolt", "Bolt", module.Description(), 7687, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object to be filled in with the
+// command-line arguments.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Scan for Bolt protocol support"
+}
+
+// Validate flags
+func (f *Flags) Validate(args []string) (err error) {
+	if f.UseTLS && f.TLSFirst {
+		return fmt.Errorf("--use-tls and --tls-first are mutually exclusive")
+	}
+	return
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifer for the scanner.
+func (s *Scanner) Protocol() string {
+	return "bolt"
+}
+
+// Init initializes the Scanner instance with the flags from the command
+// line.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// sendBytes sends a byte slice to the server.
+func (conn *Connection) sendBytes(data []byte) error {
+	_, err := conn.conn.Write(data)
+	return err
+}
+
+// readBytes reads a specified number of bytes from the server.
+func (conn *Connection) readBytes(numBytes int) ([]byte, error) {
+	buffer := make([]byte, numBytes)
+	_, err := conn.conn.Read(buffer)
+	return buffer, err
+}
+
+// establishConnection establishes a TCP connection to the target.
+func (conn *Connection) establishConnection(target zgrab2.ScanTarget) error {
+	c, err := target.Open(&conn.config.BaseFlags)
+	if err != nil {
+		return fmt.Errorf("error opening connection: %w", err)
+	}
+	conn.conn = c
+	return nil
+}
+
+// upgradeTLS wraps conn.conn in a TLS connection, performs the handshake,
+// and records the resulting log. On success conn.conn becomes the TLS
+// connection; on failure conn.conn is left untouched so the caller can
+// decide whether to fall back to plaintext.
+func (conn *Connection) upgradeTLS() error {
+	tlsConn, err := conn.config.TLSFlags.GetTLSConnection(conn.conn)
+	if err != nil {
+		return fmt.Errorf("error setting up TLS connection: %w", err)
+	}
+	conn.results.TLSLog = tlsConn.GetLog()
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	conn.conn = tlsConn
+	return nil
+}
+
+// openConnection opens a fresh TCP connection to t and applies the
+// configured TLS policy (UseTLS/TLSFirst). Every version-negotiation
+// round calls this, since Bolt only lets a given connection choose a
+// version once; reusing it here, rather than duplicating the TLS
+// branch, keeps every round's timeout/TLS behavior identical to the
+// main session's.
+func (s *Scanner) openConnection(t zgrab2.ScanTarget) (*Connection, error) {
+	conn := &Connection{config: s.config}
+	if err := conn.establishConnection(t); err != nil {
+		return nil, fmt.Errorf("error establishing connection: %w", err)
+	}
+
+	if s.config.UseTLS {
+		if err := conn.upgradeTLS(); err != nil {
+			conn.conn.Close()
+			return nil, err
+		}
+	} else if s.config.TLSFirst {
+		if err := conn.upgradeTLS(); err != nil {
+			// Fall back to a fresh plaintext connection.
+			conn.conn.Close()
+			if err := conn.establishConnection(t); err != nil {
+				return nil, fmt.Errorf("error reopening connection for plaintext fallback: %w", err)
+			}
+		}
+	}
+	return conn, nil
+}
+
+// negotiateVersions enumerates the Bolt versions the server is willing
+// to choose: each round opens a fresh connection (via openConnection),
+// sends the identification bytes, proposes four candidate versions, and
+// records the server's choice. The first round proposes the 5.x/4.x
+// minor ranges plus 3.0 and 2.0; every round after that proposes only
+// versions strictly below the one just chosen, so repeating this up to
+// MaxNegotiations times walks down the server's supported-version list
+// instead of stopping at the first (highest) one found. It returns the
+// still-open connection from the round that chose the highest version,
+// with that connection's results (Identification, VersionResponse,
+// ProtocolVersion, SupportedVersions) already populated.
+func (s *Scanner) negotiateVersions(t zgrab2.ScanTarget) (conn *Connection, thrown error) {
+	var ceiling *boltVersion
+
+	for i := 0; i < s.config.MaxNegotiations; i++ {
+		round, err := s.openConnection(t)
+		if err != nil {
+			if conn != nil {
+				return conn, nil
+			}
+			return nil, err
+		}
+
+		identification := []byte{0x60, 0x60, 0xB0, 0x17}
+		if err := round.sendBytes(identification); err != nil {
+			if round.results.TLSLog == nil {
+				round.results.PlaintextRejected = true
+			}
+			round.conn.Close()
+			if conn != nil {
+				return conn, nil
+			}
+			return round, fmt.Errorf("error sending identification bytes: %w", err)
+		}
+		round.results.Identification = fmt.Sprintf("%x", identification)
+
+		var slots [4]versionSlot
+		if ceiling == nil {
+			slots = initialVersionProposal()
+		} else {
+			slots = proposalBelow(*ceiling)
+		}
+		if err := round.sendBytes(encodeProposal(slots)); err != nil {
+			round.conn.Close()
+			if conn != nil {
+				return conn, nil
+			}
+			return round, fmt.Errorf("error sending version proposal: %w", err)
+		}
+
+		response, err := round.readBytes(4)
+		if err != nil {
+			if round.results.TLSLog == nil {
+				round.results.PlaintextRejected = true
+			}
+			round.conn.Close()
+			if conn != nil {
+				return conn, nil
+			}
+			return round, fmt.Errorf("error reading version negotiation response: %w", err)
+		}
+		round.results.VersionResponse = fmt.Sprintf("%x", response)
+		round.results.ProtocolVersion = binary.BigEndian.Uint32(response)
+
+		chosen, ok := parseChosenVersion(response)
+		if !ok {
+			round.conn.Close()
+			break
+		}
+
+		if conn != nil {
+			round.results.SupportedVersions = append(conn.results.SupportedVersions, chosen.String())
+			conn.conn.Close()
+		} else {
+			round.results.SupportedVersions = []string{chosen.String()}
+		}
+		conn = round
+		ceiling = &chosen
+	}
+
+	if conn == nil {
+		return nil, fmt.Errorf("server did not accept any proposed Bolt version")
+	}
+	return conn, nil
+}
+
+// Scan performs the configured scan on the Bolt server, as follows:
+//   - Enumerate the server's supported Bolt versions (see negotiateVersions)
+//   - Send the HELLO/INIT message appropriate for the best version found
+//   - Output the results
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	conn, err := s.negotiateVersions(t)
+	if err != nil {
+		if conn != nil {
+			return zgrab2.TryGetScanStatus(err), &conn.results, err
+		}
+		return zgrab2.TryGetScanStatus(err), nil, err
+	}
+	defer conn.conn.Close()
+
+	// The negotiated version is packed as [0x00, 0x00, minor, major]; the
+	// major version is what determines the HELLO/INIT message shape.
+	majorVersion := conn.results.ProtocolVersion & 0xFF
+	if err := conn.sendHello(majorVersion); err != nil {
+		return zgrab2.TryGetScanStatus(err), &conn.results, fmt.Errorf("error sending HELLO: %w", err)
+	}
+
+	return zgrab2.SCAN_SUCCESS, &conn.results, nil
+}
+
+// boltVersion is a parsed Bolt protocol version (major.minor).
+type boltVersion struct {
+	major, minor uint8
+}
+
+func (v boltVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// versionSlot is one 4-byte entry of a version-negotiation proposal: a
+// major.minor version, plus how many minor versions below minor the
+// server may also choose (0 means minor exactly).
+type versionSlot struct {
+	major, minor, rng uint8
+}
+
+func (s versionSlot) encode() [4]byte {
+	return [4]byte{0x00, s.rng, s.minor, s.major}
+}
+
+// initialVersionProposal is the first round's proposal: the 5.x and 4.x
+// minor ranges (covering every minor version Neo4j has shipped in each),
+// then 3.0 and 2.0 as single versions.
+func initialVersionProposal() [4]versionSlot {
+	return [4]versionSlot{
+		{major: 5, minor: 8, rng: 8},
+		{major: 4, minor: 4, rng: 4},
+		{major: 3, minor: 0, rng: 0},
+		{major: 2, minor: 0, rng: 0},
+	}
+}
+
+// proposalBelow builds the next round's proposal: four slots covering
+// progressively older versions, strictly below ceiling, so repeating
+// the handshake walks down the server's supported-version list one
+// choice at a time.
+func proposalBelow(ceiling boltVersion) [4]versionSlot {
+	decMajor := func(m uint8) uint8 {
+		if m == 0 {
+			return 0
+		}
+		return m - 1
+	}
+
+	var first versionSlot
+	if ceiling.minor > 0 {
+		first = versionSlot{major: ceiling.major, minor: ceiling.minor - 1, rng: ceiling.minor - 1}
+	} else {
+		first = versionSlot{major: decMajor(ceiling.major), minor: 15, rng: 15}
+	}
+
+	second := decMajor(first.major)
+	third := decMajor(second)
+	return [4]versionSlot{
+		first,
+		{major: second, minor: 15, rng: 15},
+		{major: third, minor: 0},
+		{major: decMajor(third), minor: 0},
+	}
+}
+
+// encodeProposal concatenates the wire encoding of four version slots
+// into a single 16-byte version-negotiation message.
+func encodeProposal(slots [4]versionSlot) []byte {
+	buf := make([]byte, 0, 16)
+	for _, s := range slots {
+		b := s.encode()
+		buf = append(buf, b[:]...)
+	}
+	return buf
+}
+
+// parseChosenVersion decodes a 4-byte version-negotiation response. ok
+// is false for the all-zero response, which means the server accepted
+// none of the proposed versions.
+func parseChosenVersion(response []byte) (version boltVersion, ok bool) {
+	v := binary.BigEndian.Uint32(response)
+	if v == 0 {
+		return boltVersion{}, false
+	}
+	return boltVersion{major: uint8(v & 0xFF), minor: uint8((v >> 8) & 0xFF)}, true
+}
+
+// PackStream marker bytes this module encodes and decodes. Only the
+// subset HELLO/INIT and their SUCCESS/FAILURE responses actually use is
+// implemented: TinyString/String8/16, TinyMap/Map8, TinyStruct,
+// Int8/16/32/64, and Null.
+const (
+	psNull       = 0xC0
+	psInt8       = 0xC8
+	psInt16      = 0xC9
+	psInt32      = 0xCA
+	psInt64      = 0xCB
+	psTinyString = 0x80 // | length (0-15)
+	psString8    = 0xD0
+	psString16   = 0xD1
+	psTinyMap    = 0xA0 // | size (0-15)
+	psMap8       = 0xD8
+	psTinyStruct = 0xB0 // | size (0-15)
+
+	helloSignature   = 0x01
+	successSignature = 0x70
+	failureSignature = 0x7F
+)
+
+// packString appends the PackStream encoding of s to buf.
+func packString(buf []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n <= 15:
+		buf = append(buf, byte(psTinyString|n))
+	case n <= 0xFF:
+		buf = append(buf, psString8, byte(n))
+	default:
+		buf = append(buf, psString16, byte(n>>8), byte(n))
+	}
+	return append(buf, s...)
+}
+
+// packMap appends the PackStream encoding of a string-keyed map of
+// strings to buf, in the given key order (PackStream maps don't require
+// a particular order, but encoding deterministically keeps output
+// reproducible).
+func packMap(buf []byte, keys []string, values map[string]string) []byte {
+	n := len(keys)
+	switch {
+	case n <= 15:
+		buf = append(buf, byte(psTinyMap|n))
+	default:
+		buf = append(buf, psMap8, byte(n))
+	}
+	for _, k := range keys {
+		buf = packString(buf, k)
+		buf = packString(buf, values[k])
+	}
+	return buf
+}
+
+// chunkMessage wraps message in Bolt's chunked transport framing: one or
+// more 2-byte-length-prefixed chunks (here always a single chunk, since
+// HELLO/INIT bodies are small) followed by the 0x0000 end-of-message
+// marker.
+func chunkMessage(message []byte) []byte {
+	buf := make([]byte, 0, len(message)+4)
+	buf = append(buf, byte(len(message)>>8), byte(len(message)))
+	buf = append(buf, message...)
+	return append(buf, 0x00, 0x00)
+}
+
+// readChunkedMessage reads a full chunked message, concatenating chunks
+// until the 0x0000 end marker. A leading empty chunk with nothing
+// accumulated yet is a NOOP keepalive (used by Bolt 4.1+ servers) and is
+// skipped rather than treated as an empty message.
+func (conn *Connection) readChunkedMessage() ([]byte, error) {
+	var message []byte
+	for {
+		lengthBytes, err := conn.readBytes(2)
+		if err != nil {
+			return nil, fmt.Errorf("error reading chunk length: %w", err)
+		}
+		length := int(binary.BigEndian.Uint16(lengthBytes))
+		if length == 0 {
+			if len(message) == 0 {
+				continue // NOOP keepalive chunk; keep waiting for the real message
+			}
+			return message, nil
+		}
+		chunk, err := conn.readBytes(length)
+		if err != nil {
+			return nil, fmt.Errorf("error reading chunk body: %w", err)
+		}
+		message = append(message, chunk...)
+	}
+}
+
+// helloMessage builds the PackStream-encoded HELLO (Bolt 3+) or INIT
+// (Bolt 1/2) message for major, a TinyStruct with signature 0x01. Bolt 3+
+// carries a single merged map of user_agent, scheme, and any auth
+// fields; Bolt 1/2's INIT instead takes two fields, a user agent string
+// and a separate auth token map.
+func helloMessage(major uint32) []byte {
+	const userAgent = "zgrab2/1.0"
+
+	if major < 3 {
+		buf := []byte{byte(psTinyStruct | 2), helloSignature}
+		buf = packString(buf, userAgent)
+		buf = packMap(buf, nil, nil) // empty auth token map: no credentials offered
+		return buf
+	}
+
+	keys := []string{"user_agent", "scheme"}
+	values := map[string]string{"user_agent": userAgent, "scheme": "none"}
+	buf := []byte{byte(psTinyStruct | 1), helloSignature}
+	buf = packMap(buf, keys, values)
+	return buf
+}
+
+// sendHello sends a HELLO/INIT message appropriate for major and records
+// the server's SUCCESS or FAILURE response in the scan results.
+func (conn *Connection) sendHello(major uint32) error {
+	if err := conn.sendBytes(chunkMessage(helloMessage(major))); err != nil {
+		return fmt.Errorf("error sending HELLO message: %w", err)
+	}
+
+	response, err := conn.readChunkedMessage()
+	if err != nil {
+		return fmt.Errorf("error reading HELLO response: %w", err)
+	}
+
+	signature, fields, err := unpackStruct(response)
+	if err != nil {
+		return fmt.Errorf("error decoding HELLO response: %w", err)
+	}
+	if len(fields) != 1 {
+		return fmt.Errorf("unexpected HELLO response field count: %d", len(fields))
+	}
+	metadata, ok := fields[0].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("unexpected HELLO response field type: %T", fields[0])
+	}
+
+	switch signature {
+	case successSignature:
+		conn.results.Metadata = make(map[string]string, len(metadata))
+		for k, v := range metadata {
+			s := fmt.Sprintf("%v", v)
+			switch k {
+			case "server":
+				conn.results.ServerAgent = s
+			case "connection_id":
+				conn.results.ConnectionID = s
+			default:
+				conn.results.Metadata[k] = s
+			}
+		}
+	case failureSignature:
+		conn.results.AuthFailure = fmt.Sprintf("%v", metadata["message"])
+	default:
+		return fmt.Errorf("unexpected HELLO response signature: 0x%02x", signature)
+	}
+	return nil
+}
+
+// unpackStruct decodes a PackStream TinyStruct from data, returning its
+// signature byte and decoded fields.
+func unpackStruct(data []byte) (signature byte, fields []interface{}, err error) {
+	if len(data) == 0 {
+		return 0, nil, fmt.Errorf("empty message")
+	}
+	marker := data[0]
+	if marker&0xF0 != psTinyStruct {
+		return 0, nil, fmt.Errorf("unsupported struct marker: 0x%02x", marker)
+	}
+	size := int(marker & 0x0F)
+	if len(data) < 2 {
+		return 0, nil, fmt.Errorf("truncated struct header")
+	}
+	signature = data[1]
+	rest := data[2:]
+	fields = make([]interface{}, 0, size)
+	for i := 0; i < size; i++ {
+		var value interface{}
+		value, rest, err = unpackValue(rest)
+		if err != nil {
+			return 0, nil, err
+		}
+		fields = append(fields, value)
+	}
+	return signature, fields, nil
+}
+
+// unpackValue decodes a single PackStream value from the front of data,
+// returning the value and the remaining bytes.
+func unpackValue(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("truncated value")
+	}
+	marker := data[0]
+	switch {
+	case marker == psNull:
+		return nil, data[1:], nil
+	case marker == psInt8:
+		if len(data) < 2 {
+			return nil, nil, fmt.Errorf("truncated Int8 value")
+		}
+		return int64(int8(data[1])), data[2:], nil
+	case marker == psInt16:
+		if len(data) < 3 {
+			return nil, nil, fmt.Errorf("truncated Int16 value")
+		}
+		return int64(int16(binary.BigEndian.Uint16(data[1:3]))), data[3:], nil
+	case marker == psInt32:
+		if len(data) < 5 {
+			return nil, nil, fmt.Errorf("truncated Int32 value")
+		}
+		return int64(int32(binary.BigEndian.Uint32(data[1:5]))), data[5:], nil
+	case marker == psInt64:
+		if len(data) < 9 {
+			return nil, nil, fmt.Errorf("truncated Int64 value")
+		}
+		return int64(binary.BigEndian.Uint64(data[1:9])), data[9:], nil
+	case marker&0xF0 == psTinyString:
+		n := int(marker & 0x0F)
+		if len(data) < 1+n {
+			return nil, nil, fmt.Errorf("truncated TinyString value")
+		}
+		return string(data[1 : 1+n]), data[1+n:], nil
+	case marker == psString8:
+		if len(data) < 2 {
+			return nil, nil, fmt.Errorf("truncated String8 length")
+		}
+		n := int(data[1])
+		if len(data) < 2+n {
+			return nil, nil, fmt.Errorf("truncated String8 value")
+		}
+		return string(data[2 : 2+n]), data[2+n:], nil
+	case marker == psString16:
+		if len(data) < 3 {
+			return nil, nil, fmt.Errorf("truncated String16 length")
+		}
+		n := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+n {
+			return nil, nil, fmt.Errorf("truncated String16 value")
+		}
+		return string(data[3 : 3+n]), data[3+n:], nil
+	case marker&0xF0 == psTinyMap:
+		n := int(marker & 0x0F)
+		return unpackMap(n, data[1:])
+	case marker == psMap8:
+		if len(data) < 2 {
+			return nil, nil, fmt.Errorf("truncated Map8 length")
+		}
+		n := int(data[1])
+		return unpackMap(n, data[2:])
+	case int8(marker) >= -16:
+		// TINY_INT: every marker byte not otherwise matched above that,
+		// interpreted as signed, is >= -16 represents itself.
+		return int64(int8(marker)), data[1:], nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported PackStream marker: 0x%02x", marker)
+	}
+}
+
+// unpackMap decodes n key/value pairs from the front of data.
+func unpackMap(n int, data []byte) (map[string]interface{}, []byte, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, rest, err := unpackValue(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyStr, ok := key.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("map key is not a string: %T", key)
+		}
+		value, rest2, err := unpackValue(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		m[keyStr] = value
+		data = rest2
+	}
+	return m, data, nil
+}
@@ -1,163 +1,460 @@
-// Package cassandra contains the zgrab2 Module implementation for Cassandra protocol.
-package cassandra
-
-import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
-	"net"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-// ScanResults is the output of the scan.
-type ScanResults struct {
-	Banner string `json:"banner,omitempty"`
-}
-
-// Flags are the Cassandra-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct {
-}
-
-// Scanner implements the zgrab2.Scanner interface, and holds the state for a single scan.
-type Scanner struct {
-	config *Flags
-}
-
-// Connection holds the state for a single connection to the Cassandra server.
-type Connection struct {
-	buffer  [4096]byte
-	config  *Flags
-	results ScanResults
-	conn    net.Conn
-}
-
-// RegisterModule registers the cassandra zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("cassandra", "Cassandra", module.Description(), 9042, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns the default flags object to be filled in with the command-line arguments.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns an overview of this module.
-func (m *Module) Description() string {
-	return "Grab a Cassandra banner"
-}
-
-// Validate flags
-func (f *Flags) Validate(args []string) (err error) {
-	return
-}
-
-// Help returns this module's help string.
-func (f *Flags) Help() string {
-	return ""
-}
-
-// Protocol returns the protocol identifer for the scanner.
-func (s *Scanner) Protocol() string {
-	return "cassandra"
-}
-
-// Init initializes the Scanner instance with the flags from the command line.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// GetName returns the configured name for the Scanner.
-func (s *Scanner) GetName() string {
-	return s.config.Name
-}
-
-// GetTrigger returns the Trigger defined in the Flags.
-func (scanner *Scanner) GetTrigger() string {
-	return scanner.config.Trigger
-}
-
-// readResponse reads a response from the server.
-func (conn *Connection) readResponse() (string, error) {
-	respLen, err := zgrab2.ReadAvailable(conn.conn)
-	if err != nil {
-		return "", err
-	}
-	ret := string(respLen)
-	return ret, nil
-}
-
-// sendStartupMessage sends the STARTUP message to the server.
-func (conn *Connection) sendStartupMessage() error {
-	body := map[string]string{"CQL_VERSION": "3.0.0"}
-	bodyBuf := new(bytes.Buffer)
-	binary.Write(bodyBuf, binary.BigEndian, uint16(len(body)))
-	for key, value := range body {
-		binary.Write(bodyBuf, binary.BigEndian, uint16(len(key)))
-		bodyBuf.WriteString(key)
-		binary.Write(bodyBuf, binary.BigEndian, uint16(len(value)))
-		bodyBuf.WriteString(value)
-	}
-
-	frame := new(bytes.Buffer)
-	frame.WriteByte(0x04)                            // version
-	frame.WriteByte(0x00)                            // flags
-	binary.Write(frame, binary.BigEndian, uint16(0)) // stream
-	frame.WriteByte(0x01)                            // opcode (STARTUP)
-	binary.Write(frame, binary.BigEndian, uint32(bodyBuf.Len()))
-	frame.Write(bodyBuf.Bytes())
-
-	_, err := conn.conn.Write(frame.Bytes())
-	return err
-}
-
-// Scan performs the configured scan on the Cassandra server.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
-	var err error
-	conn, err := t.Open(&s.config.BaseFlags)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
-	}
-	defer conn.Close()
-
-	cn := &Connection{
-		conn:   conn,
-		config: s.config,
-	}
-
-	err = cn.sendStartupMessage()
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error sending STARTUP message: %w", err)
-	}
-
-	response, err := cn.readResponse()
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error reading response: %w", err)
-	}
-
-	cn.results.Banner = response
-	return zgrab2.SCAN_SUCCESS, &cn.results, nil
-}
+// Package cassandra contains the zgrab2 Module implementation for Cassandra protocol.
+package cassandra
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// CQL native protocol opcodes used by this scanner (CQL Binary Protocol
+// v3/v4/v5 section 2.4).
+const (
+	opcodeError        byte = 0x00
+	opcodeStartup      byte = 0x01
+	opcodeReady        byte = 0x02
+	opcodeAuthenticate byte = 0x03
+	opcodeOptions      byte = 0x05
+	opcodeSupported    byte = 0x06
+)
+
+// errorCodeUnsupportedVersion is the ERROR body code for "Invalid or
+// unsupported protocol version".
+const errorCodeUnsupportedVersion = 0x0000000A
+
+// maxFrameBodyLength bounds how large an advertised frame body we're
+// willing to read into memory.
+const maxFrameBodyLength = 1 << 20
+
+// highestProtocolVersion is the first version negotiation attempts.
+const highestProtocolVersion = 5
+
+// lowestProtocolVersion is the last version negotiation attempts before
+// giving up.
+const lowestProtocolVersion = 3
+
+// Frame is a single CQL native protocol frame: a 9-byte header (version,
+// flags, stream, opcode, length) followed by a length-prefixed body.
+// Note v5 changes the stream field's sign handling from v3/v4, but it
+// remains a two-byte field in the header either way.
+type Frame struct {
+	Version byte
+	Flags   byte
+	Stream  int16
+	Opcode  byte
+	Body    []byte
+}
+
+// encode serializes the frame as a client request at the given protocol
+// version (the top bit of the version byte is left clear for requests).
+func (f *Frame) encode(version byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(version & 0x7F)
+	buf.WriteByte(f.Flags)
+	binary.Write(buf, binary.BigEndian, f.Stream)
+	buf.WriteByte(f.Opcode)
+	binary.Write(buf, binary.BigEndian, uint32(len(f.Body)))
+	buf.Write(f.Body)
+	return buf.Bytes()
+}
+
+// decodeFrame reads a single frame from r.
+func decodeFrame(r io.Reader) (*Frame, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > maxFrameBodyLength {
+		return nil, fmt.Errorf("frame body too large: %d bytes", length)
+	}
+	body := make([]byte, length)
+	if length > 0 {
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+	}
+	return &Frame{
+		Version: header[0] &^ 0x80,
+		Flags:   header[1],
+		Stream:  int16(binary.BigEndian.Uint16(header[2:4])),
+		Opcode:  header[4],
+		Body:    body,
+	}, nil
+}
+
+// decodeShort reads a CQL [short] (uint16) at offset.
+func decodeShort(body []byte, offset int) (uint16, int, error) {
+	if offset+2 > len(body) {
+		return 0, offset, fmt.Errorf("truncated short at offset %d", offset)
+	}
+	return binary.BigEndian.Uint16(body[offset : offset+2]), offset + 2, nil
+}
+
+// decodeCQLString reads a CQL [string] (a [short] length followed by that
+// many UTF-8 bytes) at offset.
+func decodeCQLString(body []byte, offset int) (string, int, error) {
+	length, offset, err := decodeShort(body, offset)
+	if err != nil {
+		return "", offset, err
+	}
+	end := offset + int(length)
+	if end > len(body) {
+		return "", offset, fmt.Errorf("truncated string at offset %d", offset)
+	}
+	return string(body[offset:end]), end, nil
+}
+
+// decodeStringList reads a CQL [string list] ([short] count followed by
+// that many [string]s) at offset.
+func decodeStringList(body []byte, offset int) ([]string, int, error) {
+	count, offset, err := decodeShort(body, offset)
+	if err != nil {
+		return nil, offset, err
+	}
+	list := make([]string, 0, count)
+	for i := 0; i < int(count); i++ {
+		var s string
+		var err2 error
+		s, offset, err2 = decodeCQLString(body, offset)
+		if err2 != nil {
+			return nil, offset, err2
+		}
+		list = append(list, s)
+	}
+	return list, offset, nil
+}
+
+// decodeStringMultimap reads a CQL [string multimap] ([short] count
+// followed by that many {[string] key, [string list] value} pairs).
+func decodeStringMultimap(body []byte) (map[string][]string, error) {
+	count, offset, err := decodeShort(body, 0)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]string, count)
+	for i := 0; i < int(count); i++ {
+		var key string
+		key, offset, err = decodeCQLString(body, offset)
+		if err != nil {
+			return nil, err
+		}
+		var values []string
+		values, offset, err = decodeStringList(body, offset)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = values
+	}
+	return result, nil
+}
+
+// encodeStringMap serializes a CQL [string map] ([short] count followed
+// by that many {[string] key, [string] value} pairs).
+func encodeStringMap(m map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint16(len(m)))
+	for key, value := range m {
+		binary.Write(buf, binary.BigEndian, uint16(len(key)))
+		buf.WriteString(key)
+		binary.Write(buf, binary.BigEndian, uint16(len(value)))
+		buf.WriteString(value)
+	}
+	return buf.Bytes()
+}
+
+// decodeErrorBody reads an ERROR frame's [int] code and [string] message.
+func decodeErrorBody(body []byte) (code int32, message string, err error) {
+	if len(body) < 4 {
+		return 0, "", fmt.Errorf("truncated error body")
+	}
+	code = int32(binary.BigEndian.Uint32(body[0:4]))
+	message, _, err = decodeCQLString(body, 4)
+	return code, message, err
+}
+
+// unsupportedVersionPattern pulls candidate protocol version numbers out
+// of an "Invalid or unsupported protocol version" error message, e.g.
+// "Invalid or unsupported protocol version (5); supported versions are (3/v3, 4/v4)".
+var unsupportedVersionPattern = regexp.MustCompile(`\d+`)
+
+// parseMaxSupportedVersion extracts the highest protocol version number
+// strictly below attempted that appears in an unsupported-version error
+// message. It returns ok=false if no such version can be found, in which
+// case the caller should just step down by one.
+func parseMaxSupportedVersion(message string, attempted byte) (version byte, ok bool) {
+	var best byte
+	for _, match := range unsupportedVersionPattern.FindAllString(message, -1) {
+		n, err := strconv.Atoi(match)
+		if err != nil || n <= 0 || n >= int(attempted) {
+			continue
+		}
+		if byte(n) > best {
+			best = byte(n)
+			ok = true
+		}
+	}
+	return best, ok
+}
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	// SupportedOptions is the SUPPORTED response to the OPTIONS probe,
+	// keyed by option name (e.g. CQL_VERSION, COMPRESSION,
+	// PROTOCOL_VERSIONS).
+	SupportedOptions map[string][]string `json:"supported_options,omitempty"`
+
+	// ProtocolVersion is the CQL native protocol version the OPTIONS/
+	// STARTUP handshake ultimately negotiated.
+	ProtocolVersion byte `json:"protocol_version,omitempty"`
+
+	// Ready is true if the server replied READY to STARTUP without
+	// requiring authentication.
+	Ready bool `json:"ready,omitempty"`
+
+	// Authenticator is the authenticator class name from the server's
+	// AUTHENTICATE response, e.g.
+	// org.apache.cassandra.auth.PasswordAuthenticator.
+	Authenticator string `json:"authenticator,omitempty"`
+
+	// ErrorCode and ErrorMessage hold the last ERROR frame the server
+	// sent, if any.
+	ErrorCode    *int32 `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+
+	// Commands is an ordered transcript of every frame sent and received
+	// over the connection. The CQL native protocol has no STARTTLS
+	// mechanism of its own (TLS, where supported, is always implicit on
+	// a separate port), so this is a plain transcript rather than a hook
+	// into zgrab2.StartTLSUpgrader.
+	Commands zgrab2.CommandLog `json:"commands,omitempty"`
+}
+
+// Flags are the Cassandra-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+
+	CQLVersion  string `long:"cql-version" default:"3.0.0" description:"CQL_VERSION to advertise in the STARTUP message"`
+	Compression string `long:"compression" description:"COMPRESSION to advertise in the STARTUP message (lz4 or snappy)"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface, and holds the state for a single scan.
+type Scanner struct {
+	config *Flags
+}
+
+// Connection holds the state for a single connection to the Cassandra server.
+type Connection struct {
+	config  *Flags
+	results ScanResults
+	conn    net.Conn
+}
+
+// RegisterModule registers the cassandra zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("cassandra", "Cassandra", module.Description(), 9042, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object to be filled in with the command-line arguments.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Grab a Cassandra banner"
+}
+
+// Validate flags
+func (f *Flags) Validate(args []string) (err error) {
+	switch f.Compression {
+	case "", "lz4", "snappy":
+	default:
+		return fmt.Errorf("invalid --compression %q: must be lz4 or snappy", f.Compression)
+	}
+	return
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifer for the scanner.
+func (s *Scanner) Protocol() string {
+	return "cassandra"
+}
+
+// Init initializes the Scanner instance with the flags from the command line.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// sendFrame writes a frame to the server, requesting the given protocol
+// version, and reads back the server's reply.
+func (conn *Connection) sendFrame(version byte, opcode byte, body []byte) (*Frame, error) {
+	frame := &Frame{Flags: 0x00, Stream: 0, Opcode: opcode, Body: body}
+	encoded := frame.encode(version)
+	if _, err := conn.conn.Write(encoded); err != nil {
+		return nil, err
+	}
+	conn.results.Commands.Sent(encoded)
+
+	response, err := decodeFrame(conn.conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.results.Commands.Received(response.encode(version))
+	return response, nil
+}
+
+// negotiateVersion sends OPTIONS frames starting at highestProtocolVersion
+// and steps down (per the server's advertised maximum, when available)
+// until one is accepted, recording the SUPPORTED response. It returns the
+// accepted protocol version.
+func (conn *Connection) negotiateVersion() (byte, error) {
+	version := byte(highestProtocolVersion)
+	for version >= lowestProtocolVersion {
+		reply, err := conn.sendFrame(version, opcodeOptions, nil)
+		if err != nil {
+			return 0, fmt.Errorf("error sending OPTIONS at version %d: %w", version, err)
+		}
+
+		switch reply.Opcode {
+		case opcodeSupported:
+			supported, err := decodeStringMultimap(reply.Body)
+			if err != nil {
+				return 0, fmt.Errorf("error parsing SUPPORTED body: %w", err)
+			}
+			conn.results.SupportedOptions = supported
+			conn.results.ProtocolVersion = version
+			return version, nil
+
+		case opcodeError:
+			code, message, err := decodeErrorBody(reply.Body)
+			if err != nil {
+				return 0, fmt.Errorf("error parsing ERROR body: %w", err)
+			}
+			conn.results.ErrorCode = &code
+			conn.results.ErrorMessage = message
+			if code != errorCodeUnsupportedVersion {
+				return 0, fmt.Errorf("server returned ERROR 0x%08x: %s", uint32(code), message)
+			}
+			if next, ok := parseMaxSupportedVersion(message, version); ok {
+				version = next
+			} else {
+				version--
+			}
+
+		default:
+			return 0, fmt.Errorf("unexpected opcode 0x%02x in response to OPTIONS", reply.Opcode)
+		}
+	}
+	return 0, fmt.Errorf("no protocol version from %d down to %d was accepted", highestProtocolVersion, lowestProtocolVersion)
+}
+
+// sendStartup sends the STARTUP message at the negotiated protocol
+// version and records whether the server replies READY or AUTHENTICATE.
+func (conn *Connection) sendStartup(version byte) error {
+	options := map[string]string{"CQL_VERSION": conn.config.CQLVersion}
+	if conn.config.Compression != "" {
+		options["COMPRESSION"] = conn.config.Compression
+	}
+
+	reply, err := conn.sendFrame(version, opcodeStartup, encodeStringMap(options))
+	if err != nil {
+		return fmt.Errorf("error sending STARTUP: %w", err)
+	}
+
+	switch reply.Opcode {
+	case opcodeReady:
+		conn.results.Ready = true
+		return nil
+
+	case opcodeAuthenticate:
+		authenticator, _, err := decodeCQLString(reply.Body, 0)
+		if err != nil {
+			return fmt.Errorf("error parsing AUTHENTICATE body: %w", err)
+		}
+		conn.results.Authenticator = authenticator
+		return nil
+
+	case opcodeError:
+		code, message, err := decodeErrorBody(reply.Body)
+		if err != nil {
+			return fmt.Errorf("error parsing ERROR body: %w", err)
+		}
+		conn.results.ErrorCode = &code
+		conn.results.ErrorMessage = message
+		return fmt.Errorf("server returned ERROR 0x%08x: %s", uint32(code), message)
+
+	default:
+		return fmt.Errorf("unexpected opcode 0x%02x in response to STARTUP", reply.Opcode)
+	}
+}
+
+// Scan performs the configured scan on the Cassandra server.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	netConn, err := t.Open(&s.config.BaseFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	defer netConn.Close()
+
+	conn := &Connection{conn: netConn, config: s.config}
+
+	version, err := conn.negotiateVersion()
+	if err != nil {
+		if conn.results.ErrorCode != nil {
+			return zgrab2.SCAN_APPLICATION_ERROR, &conn.results, err
+		}
+		return zgrab2.SCAN_PROTOCOL_ERROR, &conn.results, err
+	}
+
+	if err := conn.sendStartup(version); err != nil {
+		if conn.results.ErrorCode != nil {
+			return zgrab2.SCAN_APPLICATION_ERROR, &conn.results, err
+		}
+		return zgrab2.SCAN_PROTOCOL_ERROR, &conn.results, err
+	}
+
+	return zgrab2.SCAN_SUCCESS, &conn.results, nil
+}
@@ -1,145 +1,415 @@
-// Package ipmi contains the zgrab2 Module implementation for IPMI.
-package ipmi
-
-import (
-	"fmt"
-	"net"
-	"time"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-// ScanResults is the output of the scan.
-type ScanResults struct {
-	PingSent     string `json:"ping_sent,omitempty"`
-	PongReceived string `json:"pong_received,omitempty"`
-}
-
-// Flags are the IPMI-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-
-	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct {
-}
-
-// Scanner implements the zgrab2.Scanner interface, and holds the state
-// for a single scan.
-type Scanner struct {
-	config *Flags
-}
-
-// RegisterModule registers the ipmi zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("ipmi", "IPMI", module.Description(), 623, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns the default flags object to be filled in with the
-// command-line arguments.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns an overview of this module.
-func (m *Module) Description() string {
-	return "Scan for IPMI (remote framebuffer) support"
-}
-
-// Validate flags
-func (f *Flags) Validate(args []string) (err error) {
-	return
-}
-
-// Help returns this module's help string.
-func (f *Flags) Help() string {
-	return ""
-}
-
-// Protocol returns the protocol identifier for the scanner.
-func (s *Scanner) Protocol() string {
-	return "ipmi"
-}
-
-// Init initializes the Scanner instance with the flags from the command
-// line.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// GetName returns the configured name for the Scanner.
-func (s *Scanner) GetName() string {
-	return s.config.Name
-}
-
-// GetTrigger returns the Trigger defined in the Flags.
-func (scanner *Scanner) GetTrigger() string {
-	return scanner.config.Trigger
-}
-
-// IPMI Ping and Pong messages
-const (
-	IPMIPingMessage = "\x06\x00\xFF\x06\x00\x00\x11\xBE\x80\x00\x00\x04"
-)
-
-// Scan performs the configured scan on the IPMI server.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
-	var err error
-
-	// Determine which port to connect to: target.Port or scanner.config.BaseFlags.Port
-	var port uint
-	if t.Port != nil {
-		port = *t.Port // Dereference target.Port if set
-	} else {
-		port = s.config.BaseFlags.Port // Use scanner's configured default port
-	}
-
-	// Establish the connection to the server
-	conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", t.IP.String(), port))
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
-	}
-	defer conn.Close()
-
-	results := ScanResults{}
-
-	// Send the IPMI Ping message
-	pingMsg := []byte(IPMIPingMessage)
-	_, err = conn.Write(pingMsg)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), &results, fmt.Errorf("error sending IPMI Ping: %w", err)
-	}
-	results.PingSent = fmt.Sprintf("%x", pingMsg)
-
-	// Set a timeout for the response
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-
-	// Receive the IPMI Pong message
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), &results, fmt.Errorf("error reading IPMI Pong: %w", err)
-	}
-	results.PongReceived = fmt.Sprintf("%x", buf[:n])
-
-	return zgrab2.SCAN_SUCCESS, &results, nil
-}
+// Package ipmi contains the zgrab2 Module implementation for IPMI.
+package ipmi
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// CipherSuite records one authentication algorithm the server accepted in
+// response to an RMCP+ Open Session Request.
+type CipherSuite struct {
+	AuthAlgorithm            uint8  `json:"auth_algorithm"`
+	AuthAlgorithmName        string `json:"auth_algorithm_name"`
+	IntegrityAlgorithm       uint8  `json:"integrity_algorithm"`
+	ConfidentialityAlgorithm uint8  `json:"confidentiality_algorithm"`
+}
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	PingSent     string `json:"ping_sent,omitempty"`
+	PongReceived string `json:"pong_received,omitempty"`
+
+	// CipherSuites lists the authentication/integrity/confidentiality
+	// algorithm triplets the server accepted across the per-algorithm
+	// RMCP+ Open Session Requests zgrab2 sent.
+	CipherSuites []CipherSuite `json:"cipher_suites,omitempty"`
+
+	// CipherZero is true if the server accepted authentication
+	// algorithm 0 ("none"), the well-known IPMI 2.0 cipher suite 0
+	// authentication bypass.
+	CipherZero bool `json:"cipher_zero,omitempty"`
+
+	// RAKPMessage2Hex is the hex-encoded RAKP Message 2 response
+	// (managed system random number, GUID, and key exchange auth code)
+	// captured from the first accepted non-zero cipher suite, if any.
+	// The auth code is an HMAC keyed on the account's password hash, so
+	// capturing it discloses material an offline attacker can use to
+	// brute-force that password.
+	RAKPMessage2Hex string `json:"rakp_message_2_hex,omitempty"`
+}
+
+// Flags are the IPMI-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+
+	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+
+	RMCPPlus bool `long:"rmcp-plus" description:"Follow the ASF ping/pong with an RMCP+ Open Session / RAKP fingerprint"`
+
+	Username string `long:"username" description:"Username to offer in RAKP Message 1" default:"root"`
+
+	RAKPTimeout time.Duration `long:"rakp-timeout" description:"Per-message timeout for the RMCP+ open session / RAKP exchange" default:"5s"`
+
+	RAKPRetries int `long:"rakp-retries" description:"Number of times to retry a timed-out RMCP+ message" default:"1"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface, and holds the state
+// for a single scan.
+type Scanner struct {
+	config *Flags
+}
+
+// RegisterModule registers the ipmi zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("ipmi", "IPMI", module.Description(), 623, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object to be filled in with the
+// command-line arguments.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Scan for IPMI (remote framebuffer) support"
+}
+
+// Validate flags
+func (f *Flags) Validate(args []string) (err error) {
+	return
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (s *Scanner) Protocol() string {
+	return "ipmi"
+}
+
+// Init initializes the Scanner instance with the flags from the command
+// line.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// IPMI Ping and Pong messages
+const (
+	IPMIPingMessage = "\x06\x00\xFF\x06\x00\x00\x11\xBE\x80\x00\x00\x04"
+)
+
+// RMCP+ payload types, per IPMI 2.0 section 13.8.
+const (
+	payloadTypeOpenSessionRequest  = 0x10
+	payloadTypeOpenSessionResponse = 0x11
+	payloadTypeRAKPMessage1        = 0x12
+	payloadTypeRAKPMessage2        = 0x13
+)
+
+// rmcpPlusAuthType is the AuthType/Format byte an RMCP+ session packet
+// carries in place of the legacy IPMI 1.5 auth types.
+const rmcpPlusAuthType = 0x06
+
+// authAlgorithms are the RAKP authentication algorithms zgrab2 probes, in
+// the order they're tried. 0x00 ("none") is the cipher suite 0
+// authentication-bypass condition.
+var authAlgorithms = []struct {
+	code uint8
+	name string
+}{
+	{0x00, "none"},
+	{0x01, "RAKP-HMAC-SHA1"},
+	{0x02, "RAKP-HMAC-MD5"},
+	{0x03, "RAKP-HMAC-SHA256"},
+}
+
+const (
+	integrityAlgorithmNone       = 0x00
+	confidentialityAlgorithmNone = 0x00
+)
+
+const (
+	maxPrivilegeLevelAdministrator = 0x04
+)
+
+// rmcpPlusHeader builds the RMCP + IPMI session wrapper around payload:
+// the 4-byte RMCP header (version, reserved, sequence number, class),
+// followed by the RMCP+ session header (auth type, payload type, session
+// ID, session sequence number, payload length).
+func rmcpPlusHeader(payloadType uint8, sessionID uint32, payload []byte) []byte {
+	buf := make([]byte, 0, 12+len(payload))
+	buf = append(buf, 0x06, 0x00, 0xFF, 0x07) // RMCP header: version, reserved, seq (no ack), class=IPMI
+	buf = append(buf, rmcpPlusAuthType, payloadType)
+	buf = binary.LittleEndian.AppendUint32(buf, sessionID)
+	buf = binary.LittleEndian.AppendUint32(buf, 0) // session sequence number: 0 before a session is established
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(payload)))
+	return append(buf, payload...)
+}
+
+// algorithmPayloadBlock builds one of the three 8-byte algorithm payload
+// blocks (auth type 0x00, integrity 0x01, confidentiality 0x02) an Open
+// Session Request carries.
+func algorithmPayloadBlock(blockType, algorithm uint8) []byte {
+	return []byte{blockType, 0, 0, 0, algorithm, 0, 0, 0}
+}
+
+// openSessionResult holds the fields zgrab2 cares about from an Open
+// Session Response.
+type openSessionResult struct {
+	statusCode               uint8
+	managedSystemSessionID   uint32
+	integrityAlgorithm       uint8
+	confidentialityAlgorithm uint8
+}
+
+// sendOpenSessionRequest proposes a single authentication algorithm and
+// returns the server's response, or an error (including a timeout, which
+// the caller treats as "algorithm rejected") if none arrives.
+func sendOpenSessionRequest(conn net.Conn, remoteSessionID uint32, authAlgorithm uint8, timeout time.Duration) (*openSessionResult, error) {
+	payload := []byte{0x00, maxPrivilegeLevelAdministrator, 0x00, 0x00}
+	payload = binary.LittleEndian.AppendUint32(payload, remoteSessionID)
+	payload = append(payload, algorithmPayloadBlock(0x00, authAlgorithm)...)
+	payload = append(payload, algorithmPayloadBlock(0x01, integrityAlgorithmNone)...)
+	payload = append(payload, algorithmPayloadBlock(0x02, confidentialityAlgorithmNone)...)
+
+	packet := rmcpPlusHeader(payloadTypeOpenSessionRequest, 0, payload)
+	if _, err := conn.Write(packet); err != nil {
+		return nil, fmt.Errorf("error sending open session request: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading open session response: %w", err)
+	}
+	return parseOpenSessionResponse(buf[:n])
+}
+
+// parseOpenSessionResponse extracts the status code, managed system
+// session ID, and the selected integrity/confidentiality algorithms from
+// an Open Session Response packet. It assumes the 12-byte RMCP+ header
+// this module itself generates on requests, which is also what
+// conformant servers send on responses.
+func parseOpenSessionResponse(packet []byte) (*openSessionResult, error) {
+	const headerLen = 12
+	if len(packet) < headerLen+8 {
+		return nil, fmt.Errorf("open session response too short: %d bytes", len(packet))
+	}
+	payload := packet[headerLen:]
+
+	result := &openSessionResult{
+		statusCode: payload[1],
+	}
+	if result.statusCode != 0 {
+		return result, nil
+	}
+	if len(payload) < 12+8+8+8 {
+		return nil, fmt.Errorf("open session response payload too short: %d bytes", len(payload))
+	}
+	result.managedSystemSessionID = binary.LittleEndian.Uint32(payload[8:12])
+	// The three 8-byte proposal blocks sit at auth@12, integrity@20, and
+	// confidentiality@28 (IPMI 2.0 section 13.17), each with its selected
+	// algorithm in the block's 5th byte.
+	result.integrityAlgorithm = payload[12+8+4]
+	result.confidentialityAlgorithm = payload[12+16+4]
+	return result, nil
+}
+
+// rakpMessage2 holds the fields of a RAKP Message 2 response that matter
+// for fingerprinting.
+type rakpMessage2 struct {
+	statusCode        uint8
+	managedSystemGUID []byte
+	authCode          []byte
+}
+
+// sendRAKPMessage1 sends RAKP Message 1 (the remote console's random
+// number and requested username) and returns the parsed RAKP Message 2
+// response.
+func sendRAKPMessage1(conn net.Conn, managedSessionID uint32, remoteConsoleRandom []byte, username string, timeout time.Duration) (*rakpMessage2, error) {
+	payload := []byte{0x00, 0x00, 0x00, 0x00}
+	payload = binary.LittleEndian.AppendUint32(payload, managedSessionID)
+	payload = append(payload, remoteConsoleRandom...)
+	payload = append(payload, maxPrivilegeLevelAdministrator, 0x00, 0x00)
+	payload = append(payload, uint8(len(username)))
+	payload = append(payload, []byte(username)...)
+
+	packet := rmcpPlusHeader(payloadTypeRAKPMessage1, managedSessionID, payload)
+	if _, err := conn.Write(packet); err != nil {
+		return nil, fmt.Errorf("error sending RAKP message 1: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RAKP message 2: %w", err)
+	}
+	return parseRAKPMessage2(buf[:n])
+}
+
+// parseRAKPMessage2 extracts the status code, managed system GUID, and
+// key exchange auth code from a RAKP Message 2 response.
+func parseRAKPMessage2(packet []byte) (*rakpMessage2, error) {
+	const headerLen = 12
+	if len(packet) < headerLen+8 {
+		return nil, fmt.Errorf("RAKP message 2 too short: %d bytes", len(packet))
+	}
+	payload := packet[headerLen:]
+
+	msg := &rakpMessage2{statusCode: payload[1]}
+	if msg.statusCode != 0 {
+		return msg, nil
+	}
+	const fixedLen = 4 + 4 + 16 + 16 // tag+status+reserved, console session ID, system random, system GUID
+	if len(payload) < fixedLen {
+		return nil, fmt.Errorf("RAKP message 2 payload too short: %d bytes", len(payload))
+	}
+	msg.managedSystemGUID = append([]byte{}, payload[4+4+16:fixedLen]...)
+	msg.authCode = append([]byte{}, payload[fixedLen:]...)
+	return msg, nil
+}
+
+// runRMCPPlusFingerprint proposes each of authAlgorithms in turn, records
+// the ones the server accepts, and, for the first accepted non-zero
+// algorithm, completes RAKP Message 1/2 to capture the auth code hash
+// disclosure.
+func (s *Scanner) runRMCPPlusFingerprint(conn net.Conn, results *ScanResults) error {
+	var remoteSessionID [4]byte
+	if _, err := rand.Read(remoteSessionID[:]); err != nil {
+		return fmt.Errorf("error generating remote console session ID: %w", err)
+	}
+	sessionID := binary.LittleEndian.Uint32(remoteSessionID[:])
+
+	var rakpDone bool
+	for _, alg := range authAlgorithms {
+		var resp *openSessionResult
+		var err error
+		for attempt := 0; attempt <= s.config.RAKPRetries; attempt++ {
+			resp, err = sendOpenSessionRequest(conn, sessionID, alg.code, s.config.RAKPTimeout)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			// Treat a timeout/error as "algorithm rejected" and move on.
+			continue
+		}
+		if resp.statusCode != 0 {
+			continue
+		}
+
+		results.CipherSuites = append(results.CipherSuites, CipherSuite{
+			AuthAlgorithm:            alg.code,
+			AuthAlgorithmName:        alg.name,
+			IntegrityAlgorithm:       resp.integrityAlgorithm,
+			ConfidentialityAlgorithm: resp.confidentialityAlgorithm,
+		})
+		if alg.code == 0x00 {
+			results.CipherZero = true
+		}
+
+		if !rakpDone && alg.code != 0x00 {
+			var remoteConsoleRandom [16]byte
+			if _, err := rand.Read(remoteConsoleRandom[:]); err != nil {
+				return fmt.Errorf("error generating RAKP random number: %w", err)
+			}
+			rakp2, err := sendRAKPMessage1(conn, resp.managedSystemSessionID, remoteConsoleRandom[:], s.config.Username, s.config.RAKPTimeout)
+			if err == nil && rakp2.statusCode == 0 {
+				results.RAKPMessage2Hex = fmt.Sprintf("%x", append(rakp2.managedSystemGUID, rakp2.authCode...))
+				rakpDone = true
+			}
+		}
+	}
+	return nil
+}
+
+// Scan performs the configured scan on the IPMI server.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	var err error
+
+	// Determine which port to connect to: target.Port or scanner.config.BaseFlags.Port
+	var port uint
+	if t.Port != nil {
+		port = *t.Port // Dereference target.Port if set
+	} else {
+		port = s.config.BaseFlags.Port // Use scanner's configured default port
+	}
+
+	// Establish the connection to the server
+	conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", t.IP.String(), port))
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	defer conn.Close()
+
+	results := ScanResults{}
+
+	// Send the IPMI Ping message
+	pingMsg := []byte(IPMIPingMessage)
+	_, err = conn.Write(pingMsg)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), &results, fmt.Errorf("error sending IPMI Ping: %w", err)
+	}
+	results.PingSent = fmt.Sprintf("%x", pingMsg)
+
+	// Set a timeout for the response
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Receive the IPMI Pong message
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), &results, fmt.Errorf("error reading IPMI Pong: %w", err)
+	}
+	results.PongReceived = fmt.Sprintf("%x", buf[:n])
+
+	if s.config.RMCPPlus {
+		if err := s.runRMCPPlusFingerprint(conn, &results); err != nil {
+			return zgrab2.TryGetScanStatus(err), &results, fmt.Errorf("error running RMCP+ fingerprint: %w", err)
+		}
+	}
+
+	return zgrab2.SCAN_SUCCESS, &results, nil
+}
@@ -0,0 +1,482 @@
+// Package ipp contains the zgrab2 Module implementation for IPP
+// (Internet Printing Protocol), as used for CUPS printer fingerprinting.
+//
+// The scan builds an IPP Get-Printer-Attributes request, POSTs it to the
+// target's IPP endpoint, and parses the response envelope and attribute
+// group into a ScanResults struct.
+package ipp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// IPP value tags that this scanner knows how to decode. See RFC 8010 §3.5.
+const (
+	tagEndOfAttributes byte = 0x03
+
+	tagInteger byte = 0x21
+	tagBoolean byte = 0x22
+	tagEnum    byte = 0x23
+
+	opGetPrinterAttributes uint16 = 0x000b
+)
+
+// cupsVersionRegex extracts a CUPS version string such as "CUPS/2.4.7" from
+// a Server header or attribute value.
+var cupsVersionRegex = regexp.MustCompile(`CUPS/([0-9.]+)`)
+
+// Attribute is a single name/value(s) pair decoded from the IPP response's
+// attribute groups.
+type Attribute struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	// MajorVersion and MinorVersion are the IPP version the server replied with.
+	MajorVersion int `json:"major_version,omitempty"`
+	MinorVersion int `json:"minor_version,omitempty"`
+
+	// VersionString is "<MajorVersion>.<MinorVersion>".
+	VersionString string `json:"version_string,omitempty"`
+
+	// StatusCode is the IPP status-code from the response envelope.
+	StatusCode int `json:"status_code,omitempty"`
+
+	PrinterMakeAndModel string `json:"printer_make_and_model,omitempty"`
+	PrinterInfo         string `json:"printer_info,omitempty"`
+	PrinterLocation     string `json:"printer_location,omitempty"`
+	PrinterState        string `json:"printer_state,omitempty"`
+	PrinterURISupported string `json:"printer_uri_supported,omitempty"`
+
+	// CUPSVersion is set when the Server header or a CUPS-* attribute
+	// reveals the CUPS version in use.
+	CUPSVersion string `json:"cups_version,omitempty"`
+
+	// CUPSAttributes holds any attribute whose name starts with "cups-" or "CUPS-".
+	CUPSAttributes []Attribute `json:"cups_attributes,omitempty"`
+
+	// Attributes holds every attribute returned in the printer attribute group.
+	Attributes []Attribute `json:"attributes,omitempty"`
+
+	// HTTPStatus is the raw HTTP status line returned by the server.
+	HTTPStatus string `json:"http_status,omitempty"`
+
+	// Server is the HTTP Server header, if any.
+	Server string `json:"server,omitempty"`
+
+	TLSLog *zgrab2.TLSLog `json:"tls,omitempty"`
+}
+
+// Flags are the IPP-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+	zgrab2.TLSFlags
+
+	Verbose  bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+	IPPS     bool `long:"ipps" description:"Wrap the connection in TLS from the start (IPPS)"`
+	StartTLS bool `long:"starttls" description:"Send an HTTP Upgrade request and switch to TLS before issuing the IPP request"`
+	MaxSize  int  `long:"max-size" default:"256000" description:"Maximum response body size, in bytes, to read"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface, and holds the state for a single scan.
+type Scanner struct {
+	config *Flags
+}
+
+// Connection holds the state for a single connection to the IPP server.
+type Connection struct {
+	conn    net.Conn
+	config  *Flags
+	results ScanResults
+	host    string
+}
+
+// RegisterModule registers the ipp zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("ipp", "IPP", module.Description(), 631, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object to be filled in with the command-line arguments.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Fingerprint an IPP/CUPS printer with a Get-Printer-Attributes request"
+}
+
+// Validate flags
+func (f *Flags) Validate(args []string) error {
+	if f.IPPS && f.StartTLS {
+		return fmt.Errorf("cannot specify both --ipps and --starttls")
+	}
+	return nil
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (s *Scanner) Protocol() string {
+	return "ipp"
+}
+
+// Init initializes the Scanner instance with the flags from the command line.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// encodeAttribute appends a single IPP attribute (tag, name, value) to buf.
+// Passing an empty name produces an additional value for the previous
+// attribute, per RFC 8010 §3.1.3.
+func encodeAttribute(buf *bytes.Buffer, tag byte, name, value string) {
+	buf.WriteByte(tag)
+	binary.Write(buf, binary.BigEndian, uint16(len(name)))
+	buf.WriteString(name)
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.WriteString(value)
+}
+
+// buildGetPrinterAttributesRequest builds the binary body of an IPP
+// Get-Printer-Attributes request for the given printer URI.
+func buildGetPrinterAttributesRequest(printerURI string) []byte {
+	const tagOperationAttributes byte = 0x01
+	const tagCharset byte = 0x47
+	const tagNaturalLanguage byte = 0x48
+	const tagURI byte = 0x45
+
+	var buf bytes.Buffer
+	buf.WriteByte(0x02) // version major
+	buf.WriteByte(0x00) // version minor
+	binary.Write(&buf, binary.BigEndian, opGetPrinterAttributes)
+	binary.Write(&buf, binary.BigEndian, uint32(1)) // request-id
+
+	buf.WriteByte(tagOperationAttributes)
+	encodeAttribute(&buf, tagCharset, "attributes-charset", "utf-8")
+	encodeAttribute(&buf, tagNaturalLanguage, "attributes-natural-language", "en")
+	encodeAttribute(&buf, tagURI, "printer-uri", printerURI)
+	buf.WriteByte(tagEndOfAttributes)
+
+	return buf.Bytes()
+}
+
+// printerURI synthesizes the printer-uri IPP clients are expected to send,
+// from the scan target and configured scheme/port.
+func printerURI(scheme, host string, port uint) string {
+	return fmt.Sprintf("%s://%s:%d/", scheme, host, port)
+}
+
+// isValueTag reports whether tag is a value tag (as opposed to a group
+// delimiter tag, which are 0x00-0x0f per RFC 8010 §3.5.1).
+func isValueTag(tag byte) bool {
+	return tag > 0x0f
+}
+
+// parseAttributes decodes the attribute groups of an IPP response body,
+// starting just after the status-code/request-id fields.
+func parseAttributes(body []byte) ([]Attribute, error) {
+	var attrs []Attribute
+	var cur *Attribute
+
+	i := 0
+	for i < len(body) {
+		tag := body[i]
+		i++
+		if tag == tagEndOfAttributes {
+			break
+		}
+		if !isValueTag(tag) {
+			// Group delimiter (operation-attributes-tag, printer-attributes-tag, ...).
+			cur = nil
+			continue
+		}
+		if i+2 > len(body) {
+			return attrs, fmt.Errorf("truncated attribute name length")
+		}
+		nameLen := int(binary.BigEndian.Uint16(body[i : i+2]))
+		i += 2
+		if i+nameLen > len(body) {
+			return attrs, fmt.Errorf("truncated attribute name")
+		}
+		name := string(body[i : i+nameLen])
+		i += nameLen
+
+		if i+2 > len(body) {
+			return attrs, fmt.Errorf("truncated attribute value length")
+		}
+		valueLen := int(binary.BigEndian.Uint16(body[i : i+2]))
+		i += 2
+		if i+valueLen > len(body) {
+			return attrs, fmt.Errorf("truncated attribute value")
+		}
+		valueBytes := body[i : i+valueLen]
+		i += valueLen
+
+		value := decodeAttributeValue(tag, valueBytes)
+
+		if name == "" && cur != nil {
+			// Additional value for the attribute currently being built.
+			cur.Values = append(cur.Values, value)
+			continue
+		}
+
+		attrs = append(attrs, Attribute{Name: name, Values: []string{value}})
+		cur = &attrs[len(attrs)-1]
+	}
+
+	return attrs, nil
+}
+
+// decodeAttributeValue renders an attribute's raw value bytes as a string,
+// interpreting integer/enum/boolean tags numerically.
+func decodeAttributeValue(tag byte, raw []byte) string {
+	switch tag {
+	case tagInteger, tagEnum:
+		if len(raw) == 4 {
+			return strconv.Itoa(int(int32(binary.BigEndian.Uint32(raw))))
+		}
+	case tagBoolean:
+		if len(raw) == 1 {
+			return strconv.FormatBool(raw[0] != 0)
+		}
+	}
+	return string(raw)
+}
+
+// attributeValue returns the first value of the named attribute, if present.
+func attributeValue(attrs []Attribute, name string) string {
+	for _, a := range attrs {
+		if a.Name == name && len(a.Values) > 0 {
+			return a.Values[0]
+		}
+	}
+	return ""
+}
+
+// fingerprintCUPS sets ScanResults.CUPSVersion if either the Server header
+// or an attribute value reveals a "CUPS/x.y.z" string.
+func (ipp *Connection) fingerprintCUPS(server string, attrs []Attribute) {
+	if m := cupsVersionRegex.FindStringSubmatch(server); m != nil {
+		ipp.results.CUPSVersion = m[1]
+		return
+	}
+	for _, a := range attrs {
+		for _, v := range a.Values {
+			if m := cupsVersionRegex.FindStringSubmatch(v); m != nil {
+				ipp.results.CUPSVersion = m[1]
+				return
+			}
+		}
+	}
+}
+
+// doRequest POSTs an IPP request body to the server and returns the decoded
+// HTTP response, with the body capped to --max-size bytes.
+func (ipp *Connection) doRequest(body []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequest("POST", "/", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error building IPP request: %w", err)
+	}
+	req.Host = ipp.host
+	req.Header.Set("Content-Type", "application/ipp")
+	req.ContentLength = int64(len(body))
+
+	if err := req.Write(ipp.conn); err != nil {
+		return nil, nil, fmt.Errorf("error sending IPP request: %w", err)
+	}
+
+	reader := bufio.NewReader(ipp.conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading HTTP response: %w", err)
+	}
+	defer resp.Body.Close()
+
+	limited := io.LimitReader(resp.Body, int64(ipp.config.MaxSize))
+	respBody, err := io.ReadAll(limited)
+	if err != nil {
+		return resp, nil, fmt.Errorf("error reading response body: %w", err)
+	}
+	return resp, respBody, nil
+}
+
+// upgradeStartTLS sends an HTTP Upgrade request for TLS and, if the server
+// agrees with a 101 response, performs the TLS handshake on the connection.
+func (ipp *Connection) upgradeStartTLS() error {
+	req, err := http.NewRequest("OPTIONS", "*", nil)
+	if err != nil {
+		return fmt.Errorf("error building Upgrade request: %w", err)
+	}
+	req.Host = ipp.host
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "TLS/1.0")
+
+	if err := req.Write(ipp.conn); err != nil {
+		return fmt.Errorf("error sending Upgrade request: %w", err)
+	}
+
+	reader := bufio.NewReader(ipp.conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return fmt.Errorf("error reading Upgrade response: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("server declined STARTTLS upgrade: %s", resp.Status)
+	}
+
+	tlsConn, err := ipp.config.TLSFlags.GetTLSConnection(ipp.conn)
+	if err != nil {
+		return fmt.Errorf("error setting up TLS connection: %w", err)
+	}
+	ipp.results.TLSLog = tlsConn.GetLog()
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	ipp.conn = tlsConn
+	return nil
+}
+
+// GetPrinterAttributes sends the Get-Printer-Attributes request and decodes
+// the response into ScanResults.
+func (ipp *Connection) GetPrinterAttributes(scheme string, port uint) error {
+	uri := printerURI(scheme, ipp.host, port)
+	body := buildGetPrinterAttributesRequest(uri)
+
+	resp, respBody, err := ipp.doRequest(body)
+	if err != nil {
+		return err
+	}
+
+	ipp.results.HTTPStatus = resp.Status
+	ipp.results.Server = resp.Header.Get("Server")
+
+	if len(respBody) < 8 {
+		return fmt.Errorf("IPP response too short (%d bytes)", len(respBody))
+	}
+
+	ipp.results.MajorVersion = int(respBody[0])
+	ipp.results.MinorVersion = int(respBody[1])
+	ipp.results.VersionString = fmt.Sprintf("%d.%d", respBody[0], respBody[1])
+	ipp.results.StatusCode = int(binary.BigEndian.Uint16(respBody[2:4]))
+	// respBody[4:8] is the echoed request-id.
+
+	attrs, err := parseAttributes(respBody[8:])
+	if err != nil {
+		return fmt.Errorf("error parsing IPP attributes: %w", err)
+	}
+	ipp.results.Attributes = attrs
+
+	ipp.results.PrinterMakeAndModel = attributeValue(attrs, "printer-make-and-model")
+	ipp.results.PrinterInfo = attributeValue(attrs, "printer-info")
+	ipp.results.PrinterLocation = attributeValue(attrs, "printer-location")
+	ipp.results.PrinterState = attributeValue(attrs, "printer-state")
+	ipp.results.PrinterURISupported = attributeValue(attrs, "printer-uri-supported")
+
+	for _, a := range attrs {
+		lower := strings.ToLower(a.Name)
+		if strings.HasPrefix(lower, "cups-") {
+			ipp.results.CUPSAttributes = append(ipp.results.CUPSAttributes, a)
+		}
+	}
+	ipp.fingerprintCUPS(ipp.results.Server, attrs)
+
+	return nil
+}
+
+// Scan performs the configured scan on the IPP server.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	conn, err := t.Open(&s.config.BaseFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	cn := conn
+	defer func() { cn.Close() }()
+
+	var port uint
+	if t.Port != nil {
+		port = uint(*t.Port)
+	} else {
+		port = s.config.Port
+	}
+	host := t.IP.String()
+	if t.Domain != "" {
+		host = t.Domain
+	}
+
+	scheme := "http"
+	ipp := Connection{conn: cn, config: s.config, host: host}
+
+	if s.config.IPPS {
+		scheme = "ipps"
+		tlsConn, err := s.config.TLSFlags.GetTLSConnection(cn)
+		if err != nil {
+			return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error setting up TLS connection: %w", err)
+		}
+		ipp.results.TLSLog = tlsConn.GetLog()
+		if err := tlsConn.Handshake(); err != nil {
+			return zgrab2.TryGetScanStatus(err), &ipp.results, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		ipp.conn = tlsConn
+		cn = tlsConn
+	} else if s.config.StartTLS {
+		scheme = "ipps"
+		if err := ipp.upgradeStartTLS(); err != nil {
+			return zgrab2.TryGetScanStatus(err), &ipp.results, fmt.Errorf("error upgrading to TLS: %w", err)
+		}
+	}
+
+	if err := ipp.GetPrinterAttributes(scheme, port); err != nil {
+		return zgrab2.TryGetScanStatus(err), &ipp.results, fmt.Errorf("error getting printer attributes: %w", err)
+	}
+
+	return zgrab2.SCAN_SUCCESS, &ipp.results, nil
+}
@@ -1,233 +1,508 @@
-package irc
-
-import (
-	"fmt"
-	"net"
-	"strings"
-	"time"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-// ScanResults contains the banner and full server response.
-type ScanResults struct {
-	Banner      string         `json:"banner,omitempty"`
-	Response    string         `json:"response,omitempty"`
-	Error       string         `json:"error,omitempty"`
-	TLSLog      *zgrab2.TLSLog `json:"tls,omitempty"`
-	ImplicitTLS bool           `json:"implicit_tls,omitempty"`
-}
-
-// Flags are the IRC-specific flags for the scanning plugin.
-type Flags struct {
-	zgrab2.BaseFlags
-	zgrab2.TLSFlags
-
-	Verbose     bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
-	IRCAuthTLS  bool `long:"authtls" description:"Upgrade connection to TLS"`
-	ImplicitTLS bool `long:"implicit-tls" description:"Start with a TLS-wrapped connection"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct {
-}
-
-// Scanner implements the zgrab2.Scanner interface.
-type Scanner struct {
-	config *Flags
-}
-
-// Connection holds the state for a single connection to the IRC server.
-type Connection struct {
-	config  *Flags
-	results ScanResults
-	conn    net.Conn
-	buffer  [10000]byte
-}
-
-// RegisterModule registers the IRC zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("irc", "IRC", module.Description(), 6667, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns a new Flags instance filled with default values.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description provides a description of the IRC scanning module.
-func (m *Module) Description() string {
-	return "Scan for IRC services by sending NICK and USER commands and analyzing the response. Supports upgrading to TLS."
-}
-
-// Validate ensures valid flag configuration.
-func (f *Flags) Validate(args []string) error {
-	if f.IRCAuthTLS && f.ImplicitTLS {
-		return fmt.Errorf("Cannot specify both --authtls and --implicit-tls")
-	}
-	return nil
-}
-
-// Help provides help information for the flags.
-func (f *Flags) Help() string {
-	return "IRC scanning plugin flags"
-}
-
-// Init initializes the scanner with command-line flags.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// Protocol returns the protocol identifier for the IRC scanner.
-func (s *Scanner) Protocol() string {
-	return "irc"
-}
-
-// GetName returns the scanner name.
-func (s *Scanner) GetName() string {
-	return "irc"
-}
-
-// GetTrigger returns the trigger for the scanner.
-func (s *Scanner) GetTrigger() string {
-	return s.config.Trigger
-}
-
-// isValidIRCResponse checks if the response follows the IRC protocol structure.
-func (irc *Connection) isValidIRCResponse(response string) bool {
-	// Check if it's a numeric response or a notice
-	return strings.Contains(response, "001") || strings.Contains(response, "NOTICE") || strings.Contains(response, "ERROR")
-}
-
-// readResponse reads a response from the server.
-func (irc *Connection) readResponse() (string, error) {
-	irc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	n, err := irc.conn.Read(irc.buffer[:])
-	if err != nil {
-		return "", err
-	}
-	return string(irc.buffer[:n]), nil
-}
-
-// sendCommand sends a command to the IRC server.
-func (irc *Connection) sendCommand(cmd string) error {
-	_, err := irc.conn.Write([]byte(cmd + "\r\n"))
-	return err
-}
-
-// GetIRCBanner reads the initial banner from the server.
-func (irc *Connection) GetIRCBanner() error {
-	banner, err := irc.readResponse()
-	if err != nil {
-		return err
-	}
-	irc.results.Banner = banner
-	return nil
-}
-
-// RegisterClient sends NICK and USER commands to register the IRC client.
-func (irc *Connection) RegisterClient() error {
-	if err := irc.sendCommand("NICK ScanningBot"); err != nil {
-		return err
-	}
-	if err := irc.sendCommand("USER ScanningBot 0 * :Scanning Bot"); err != nil {
-		return err
-	}
-	return nil
-}
-
-// SetupTLS performs a TLS handshake with the server.
-func (irc *Connection) SetupTLS() error {
-	var err error
-	tlsConn, err := irc.config.TLSFlags.GetTLSConnection(irc.conn)
-	if err != nil {
-		return fmt.Errorf("error setting up TLS connection: %w", err)
-	}
-	irc.results.TLSLog = tlsConn.GetLog()
-
-	err = tlsConn.Handshake()
-	if err != nil {
-		return fmt.Errorf("TLS handshake failed: %w", err)
-	}
-	irc.conn = tlsConn
-	return nil
-}
-
-// Scan performs the IRC scan.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, err error) {
-	conn, err := t.Open(&s.config.BaseFlags)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
-	}
-	cn := conn
-	defer func() {
-		cn.Close()
-	}()
-
-	results := ScanResults{}
-
-	// If implicit TLS is specified, wrap the connection in TLS from the start
-	if s.config.ImplicitTLS {
-		tlsConn, err := s.config.TLSFlags.GetTLSConnection(conn)
-		if err != nil {
-			return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error setting up TLS connection: %w", err)
-		}
-		results.ImplicitTLS = true
-		results.TLSLog = tlsConn.GetLog()
-		err = tlsConn.Handshake()
-		if err != nil {
-			return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("TLS handshake failed: %w", err)
-		}
-		cn = tlsConn
-	}
-
-	irc := Connection{conn: cn, config: s.config, results: results}
-
-	// Get the initial banner
-	if err := irc.GetIRCBanner(); err != nil {
-		return zgrab2.TryGetScanStatus(err), &irc.results, fmt.Errorf("error reading IRC banner: %w", err)
-	}
-
-	// If the --authtls flag is set, upgrade to TLS
-	if s.config.IRCAuthTLS {
-		if err := irc.SetupTLS(); err != nil {
-			return zgrab2.TryGetScanStatus(err), &irc.results, fmt.Errorf("error setting up TLS: %w", err)
-		}
-	}
-
-	// Register the client with NICK and USER commands
-	if err := irc.RegisterClient(); err != nil {
-		return zgrab2.TryGetScanStatus(err), &irc.results, fmt.Errorf("error sending registration commands: %w", err)
-	}
-
-	// Read and validate the server response
-	response, err := irc.readResponse()
-	if err != nil {
-		irc.results.Error = fmt.Sprintf("Failed to read server response: %v", err)
-		return zgrab2.SCAN_SUCCESS, &irc.results, nil
-	}
-
-	irc.results.Response = response
-	if irc.isValidIRCResponse(response) {
-		return zgrab2.SCAN_SUCCESS, &irc.results, nil
-	}
-
-	return zgrab2.SCAN_PROTOCOL_ERROR, &irc.results, fmt.Errorf("invalid IRC response")
-}
+package irc
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// maxRegistrationLines bounds how many lines we'll read while waiting
+// for the end of the post-registration numeric burst (376/422), as a
+// backstop alongside the per-read deadline.
+const maxRegistrationLines = 500
+
+// ScanResults contains the banner and full server response.
+type ScanResults struct {
+	Banner      string         `json:"banner,omitempty"`
+	Response    string         `json:"response,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	TLSLog      *zgrab2.TLSLog `json:"tls,omitempty"`
+	ImplicitTLS bool           `json:"implicit_tls,omitempty"`
+
+	// Capabilities holds every IRCv3 capability the server advertised in
+	// response to CAP LS 302, keyed by capability name, with any
+	// `=value` suffix as the map value (e.g. "sasl" -> "PLAIN,EXTERNAL").
+	Capabilities map[string]string `json:"capabilities,omitempty"`
+
+	// ISupport holds the RPL_ISUPPORT (005) TOKEN=value pairs collected
+	// from the registration burst.
+	ISupport map[string]string `json:"isupport,omitempty"`
+
+	// ServerName is the source prefix of the 001 RPL_WELCOME line.
+	ServerName string `json:"server_name,omitempty"`
+
+	// Version is the server-version field of the 004 RPL_MYINFO line.
+	Version string `json:"version,omitempty"`
+
+	// MOTD holds the 375/372/376 (or 422 ERR_NOMOTD) motd-numeric lines,
+	// in order.
+	MOTD []string `json:"motd,omitempty"`
+
+	// ConnectionNumerics holds the 001-005 connection-numeric lines, in order.
+	ConnectionNumerics []string `json:"connection_numerics,omitempty"`
+
+	// SASLMechanism is the mechanism named via --sasl-mechanism, if an
+	// AUTHENTICATE probe was sent.
+	SASLMechanism string `json:"sasl_mechanism,omitempty"`
+
+	// SASLChallenge is the raw AUTHENTICATE challenge line the server
+	// sent back, if any.
+	SASLChallenge string `json:"sasl_challenge,omitempty"`
+
+	// SASLMechanisms is the mechanism list from a 908 RPL_SASLMECHS
+	// response, sent when the requested mechanism isn't supported.
+	SASLMechanisms []string `json:"sasl_mechanisms,omitempty"`
+
+	// Commands is an ordered transcript of every command sent and line
+	// received over the connection, including the STARTTLS request and
+	// response if --starttls was set.
+	Commands zgrab2.CommandLog `json:"commands,omitempty"`
+}
+
+// Flags are the IRC-specific flags for the scanning plugin.
+type Flags struct {
+	zgrab2.BaseFlags
+	zgrab2.TLSFlags
+
+	Verbose     bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+	IRCAuthTLS  bool `long:"authtls" description:"Upgrade connection to TLS"`
+	ImplicitTLS bool `long:"implicit-tls" description:"Start with a TLS-wrapped connection"`
+
+	// StartTLS sends the IRCv3 STARTTLS command and upgrades to TLS on
+	// 670 RPL_STARTTLS, failing cleanly on 691 ERR_STARTTLS.
+	StartTLS bool `long:"starttls" description:"Send STARTTLS and upgrade to TLS on 670, failing cleanly on 691"`
+
+	// CapReq is a capability to request via CAP REQ after CAP LS, e.g. "sasl".
+	CapReq string `long:"cap-req" description:"Capability to request via CAP REQ after CAP LS (e.g. sasl)"`
+
+	// SASLMechanism, if set with --cap-req sasl, sends an AUTHENTICATE
+	// request for this mechanism and records the resulting challenge or
+	// mechanism list, without completing authentication.
+	SASLMechanism string `long:"sasl-mechanism" description:"SASL mechanism to advertise via AUTHENTICATE, to fingerprint the server's challenge/mechanism list without authenticating"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface.
+type Scanner struct {
+	config *Flags
+}
+
+// Connection holds the state for a single connection to the IRC server.
+type Connection struct {
+	config  *Flags
+	results ScanResults
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+// RegisterModule registers the IRC zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("irc", "IRC", module.Description(), 6667, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns a new Flags instance filled with default values.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description provides a description of the IRC scanning module.
+func (m *Module) Description() string {
+	return "Scan for IRC services by negotiating IRCv3 capabilities and sending NICK/USER. Supports upgrading to TLS."
+}
+
+// Validate ensures valid flag configuration.
+func (f *Flags) Validate(args []string) error {
+	if f.IRCAuthTLS && f.ImplicitTLS {
+		return fmt.Errorf("Cannot specify both --authtls and --implicit-tls")
+	}
+	if f.StartTLS && (f.IRCAuthTLS || f.ImplicitTLS) {
+		return fmt.Errorf("Cannot specify --starttls with --authtls or --implicit-tls")
+	}
+	if f.SASLMechanism != "" && f.CapReq == "" {
+		f.CapReq = "sasl"
+	}
+	return nil
+}
+
+// Help provides help information for the flags.
+func (f *Flags) Help() string {
+	return "IRC scanning plugin flags"
+}
+
+// Init initializes the scanner with command-line flags.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// Protocol returns the protocol identifier for the IRC scanner.
+func (s *Scanner) Protocol() string {
+	return "irc"
+}
+
+// GetName returns the scanner name.
+func (s *Scanner) GetName() string {
+	return "irc"
+}
+
+// GetTrigger returns the trigger for the scanner.
+func (s *Scanner) GetTrigger() string {
+	return s.config.Trigger
+}
+
+// parseIRCLine splits a single IRC protocol line into its optional
+// source prefix, command, and parameters (with any trailing ":"-prefixed
+// parameter treated as a single, space-containing parameter).
+func parseIRCLine(line string) (prefix, command string, params []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", "", nil
+	}
+	if strings.HasPrefix(line, ":") {
+		idx := strings.IndexByte(line, ' ')
+		if idx < 0 {
+			return line[1:], "", nil
+		}
+		prefix = line[1:idx]
+		line = line[idx+1:]
+	}
+	if idx := strings.Index(line, " :"); idx >= 0 {
+		params = strings.Fields(line[:idx])
+		params = append(params, line[idx+2:])
+	} else {
+		params = strings.Fields(line)
+	}
+	if len(params) > 0 {
+		command = params[0]
+		params = params[1:]
+	}
+	return prefix, command, params
+}
+
+// sendCommand sends a command to the IRC server.
+func (irc *Connection) sendCommand(cmd string) error {
+	data := []byte(cmd + "\r\n")
+	if _, err := irc.conn.Write(data); err != nil {
+		return err
+	}
+	irc.results.Commands.Sent(data)
+	return nil
+}
+
+// readLine reads a single line, trims its terminator, and appends the
+// raw line to the cumulative Response transcript.
+func (irc *Connection) readLine() (string, error) {
+	irc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := irc.reader.ReadString('\n')
+	if line != "" {
+		irc.results.Response += line
+		irc.results.Commands.Received([]byte(line))
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// negotiateCapLS sends CAP LS 302 and parses the (possibly multi-line)
+// CAP * LS response into results.Capabilities. Lines unrelated to the
+// CAP negotiation (e.g. a pre-registration NOTICE banner) are recorded
+// in results.Banner rather than discarded.
+func (irc *Connection) negotiateCapLS() error {
+	if err := irc.sendCommand("CAP LS 302"); err != nil {
+		return err
+	}
+	irc.results.Capabilities = make(map[string]string)
+	for {
+		line, err := irc.readLine()
+		if err != nil {
+			return err
+		}
+		_, command, params := parseIRCLine(line)
+		if !strings.EqualFold(command, "CAP") || len(params) < 2 || !strings.EqualFold(params[1], "LS") {
+			if irc.results.Banner != "" {
+				irc.results.Banner += "\n"
+			}
+			irc.results.Banner += line
+			continue
+		}
+
+		more := false
+		capList := ""
+		if len(params) >= 4 && params[2] == "*" {
+			more = true
+			capList = params[3]
+		} else if len(params) >= 3 {
+			capList = params[2]
+		}
+		for _, tok := range strings.Fields(capList) {
+			name, value, _ := strings.Cut(tok, "=")
+			irc.results.Capabilities[name] = value
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// requestCapability sends CAP REQ for a single capability and returns an
+// error if the server NAKs it.
+func (irc *Connection) requestCapability(capability string) error {
+	if err := irc.sendCommand("CAP REQ :" + capability); err != nil {
+		return err
+	}
+	line, err := irc.readLine()
+	if err != nil {
+		return fmt.Errorf("error reading CAP REQ response: %w", err)
+	}
+	_, command, params := parseIRCLine(line)
+	if !strings.EqualFold(command, "CAP") || len(params) < 2 {
+		return fmt.Errorf("unexpected response to CAP REQ %s: %s", capability, line)
+	}
+	if strings.EqualFold(params[1], "NAK") {
+		return fmt.Errorf("server rejected CAP REQ %s", capability)
+	}
+	return nil
+}
+
+// negotiateStartTLS sends STARTTLS and upgrades the connection to TLS on
+// 670, or returns an error on 691 (or any other response). It negotiates
+// through irc.reader, rather than a raw conn read, since negotiateCapLS
+// may already have buffered data ahead of the raw socket.
+func (irc *Connection) negotiateStartTLS() error {
+	upgrader := &zgrab2.StartTLSUpgrader{Log: &irc.results.Commands}
+
+	accepted := false
+	var rejection error
+	err := upgrader.Negotiate(irc.conn, irc.reader, 5*time.Second,
+		func() error {
+			return upgrader.Send(irc.conn, []byte("STARTTLS\r\n"))
+		},
+		func(response []byte) bool {
+			irc.results.Response += string(response)
+			_, command, params := parseIRCLine(strings.TrimRight(string(response), "\r\n"))
+			switch command {
+			case "670":
+				accepted = true
+				return true
+			case "691":
+				message := ""
+				if len(params) > 0 {
+					message = params[len(params)-1]
+				}
+				rejection = fmt.Errorf("server rejected STARTTLS (691): %s", message)
+				return true
+			default:
+				return false
+			}
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("error negotiating STARTTLS: %w", err)
+	}
+	if rejection != nil {
+		return rejection
+	}
+	if !accepted {
+		return fmt.Errorf("unexpected response to STARTTLS")
+	}
+	return irc.SetupTLS()
+}
+
+// probeSASL sends an AUTHENTICATE request for mechanism and records the
+// server's challenge (or 904/905 failure, or 908 mechanism list),
+// without completing authentication. Assumes the sasl capability has
+// already been requested and acknowledged.
+func (irc *Connection) probeSASL(mechanism string) error {
+	if err := irc.sendCommand("AUTHENTICATE " + mechanism); err != nil {
+		return err
+	}
+	irc.results.SASLMechanism = mechanism
+
+	line, err := irc.readLine()
+	if err != nil {
+		return fmt.Errorf("error reading AUTHENTICATE response: %w", err)
+	}
+	_, command, params := parseIRCLine(line)
+	switch command {
+	case "AUTHENTICATE":
+		if len(params) > 0 {
+			irc.results.SASLChallenge = params[0]
+		}
+	case "904", "905":
+		if len(params) > 0 {
+			irc.results.SASLChallenge = params[len(params)-1]
+		}
+	case "908":
+		if len(params) >= 2 {
+			irc.results.SASLMechanisms = strings.Split(params[1], ",")
+		}
+	default:
+		irc.results.SASLChallenge = line
+	}
+	return nil
+}
+
+// RegisterClient sends NICK and USER commands to register the IRC client.
+func (irc *Connection) RegisterClient() error {
+	if err := irc.sendCommand("NICK ScanningBot"); err != nil {
+		return err
+	}
+	if err := irc.sendCommand("USER ScanningBot 0 * :Scanning Bot"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// collectRegistrationBurst reads the post-registration numeric burst,
+// splitting it into connection numerics (001-005, also parsing
+// ISupport/ServerName/Version) and motd numerics (375/372/376, or 422 if
+// there's no MOTD), until the motd-end numeric is seen.
+func (irc *Connection) collectRegistrationBurst() error {
+	irc.results.ISupport = make(map[string]string)
+	for i := 0; i < maxRegistrationLines; i++ {
+		line, err := irc.readLine()
+		if err != nil {
+			return err
+		}
+		prefix, command, params := parseIRCLine(line)
+		switch command {
+		case "001":
+			irc.results.ServerName = prefix
+			irc.results.ConnectionNumerics = append(irc.results.ConnectionNumerics, line)
+		case "002", "003":
+			irc.results.ConnectionNumerics = append(irc.results.ConnectionNumerics, line)
+		case "004":
+			if len(params) >= 3 {
+				irc.results.Version = params[2]
+			}
+			irc.results.ConnectionNumerics = append(irc.results.ConnectionNumerics, line)
+		case "005":
+			irc.results.ConnectionNumerics = append(irc.results.ConnectionNumerics, line)
+			if len(params) >= 2 {
+				for _, tok := range params[1 : len(params)-1] {
+					name, value, _ := strings.Cut(tok, "=")
+					irc.results.ISupport[name] = value
+				}
+			}
+		case "375", "372":
+			irc.results.MOTD = append(irc.results.MOTD, line)
+		case "376", "422":
+			irc.results.MOTD = append(irc.results.MOTD, line)
+			return nil
+		}
+	}
+	return nil
+}
+
+// SetupTLS performs a TLS handshake with the server, replacing both the
+// connection and the buffered reader wrapping it.
+func (irc *Connection) SetupTLS() error {
+	tlsConn, err := irc.config.TLSFlags.GetTLSConnection(irc.conn)
+	if err != nil {
+		return fmt.Errorf("error setting up TLS connection: %w", err)
+	}
+	irc.results.TLSLog = tlsConn.GetLog()
+
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	irc.conn = tlsConn
+	irc.reader = bufio.NewReader(irc.conn)
+	return nil
+}
+
+// Scan performs the IRC scan.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, err error) {
+	netConn, err := t.Open(&s.config.BaseFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	cn := netConn
+	defer func() {
+		cn.Close()
+	}()
+
+	results := ScanResults{}
+
+	// If implicit TLS is specified, wrap the connection in TLS from the start
+	if s.config.ImplicitTLS {
+		tlsConn, err := s.config.TLSFlags.GetTLSConnection(cn)
+		if err != nil {
+			return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error setting up TLS connection: %w", err)
+		}
+		results.ImplicitTLS = true
+		results.TLSLog = tlsConn.GetLog()
+		if err := tlsConn.Handshake(); err != nil {
+			return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		cn = tlsConn
+	}
+
+	irc := &Connection{conn: cn, config: s.config, results: results}
+	irc.reader = bufio.NewReader(irc.conn)
+
+	if err := irc.negotiateCapLS(); err != nil {
+		return zgrab2.TryGetScanStatus(err), &irc.results, fmt.Errorf("error negotiating capabilities: %w", err)
+	}
+
+	// If the --authtls flag is set, upgrade to TLS
+	if s.config.IRCAuthTLS {
+		if err := irc.SetupTLS(); err != nil {
+			return zgrab2.TryGetScanStatus(err), &irc.results, fmt.Errorf("error setting up TLS: %w", err)
+		}
+	}
+
+	if s.config.StartTLS {
+		if err := irc.negotiateStartTLS(); err != nil {
+			return zgrab2.TryGetScanStatus(err), &irc.results, err
+		}
+	}
+
+	if s.config.CapReq != "" {
+		if err := irc.requestCapability(s.config.CapReq); err != nil {
+			return zgrab2.TryGetScanStatus(err), &irc.results, err
+		}
+		if strings.EqualFold(s.config.CapReq, "sasl") && s.config.SASLMechanism != "" {
+			if err := irc.probeSASL(s.config.SASLMechanism); err != nil {
+				return zgrab2.TryGetScanStatus(err), &irc.results, err
+			}
+		}
+	}
+
+	if err := irc.sendCommand("CAP END"); err != nil {
+		return zgrab2.TryGetScanStatus(err), &irc.results, fmt.Errorf("error sending CAP END: %w", err)
+	}
+
+	// Register the client with NICK and USER commands
+	if err := irc.RegisterClient(); err != nil {
+		return zgrab2.TryGetScanStatus(err), &irc.results, fmt.Errorf("error sending registration commands: %w", err)
+	}
+
+	if err := irc.collectRegistrationBurst(); err != nil {
+		irc.results.Error = fmt.Sprintf("error reading registration burst: %v", err)
+		return zgrab2.SCAN_SUCCESS, &irc.results, nil
+	}
+
+	return zgrab2.SCAN_SUCCESS, &irc.results, nil
+}
@@ -1,163 +1,434 @@
-package ldap
-
-import (
-	"bytes"
-	"fmt"
-
-	"github.com/go-asn1-ber/asn1-ber"
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-// ScanResults contains the output of the LDAP scan.
-type ScanResults struct {
-	BindResponse string `json:"bind_response,omitempty"`
-	RawResponse  string `json:"raw_response,omitempty"`
-	TLSLog *zgrab2.TLSLog `json:"tls,omitempty"`
-}
-
-// Flags contains LDAP-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-	zgrab2.TLSFlags
-
-	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
-	ImplicitTLS bool `long:"tls" description:"Attempt to connect via a TLS wrapped connection"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct{}
-
-// Scanner implements the zgrab2.Scanner interface.
-type Scanner struct {
-	config *Flags
-}
-
-// RegisterModule registers the ldap zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("ldap", "LDAP", module.Description(), 389, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns a default Flags object.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns an overview of this module.
-func (m *Module) Description() string {
-	return "Probe for LDAP servers"
-}
-
-// Validate checks the flags for consistency.
-func (f *Flags) Validate(args []string) error {
-	return nil
-}
-
-// Help returns this module's help string.
-func (f *Flags) Help() string {
-	return ""
-}
-
-// Protocol returns the protocol identifier for the scanner.
-func (s *Scanner) Protocol() string {
-	return "ldap"
-}
-
-// Init initializes the Scanner with the command-line flags.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// GetName returns the configured name for the Scanner.
-func (s *Scanner) GetName() string {
-	return s.config.Name
-}
-
-// Scan performs the LDAP scan.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
-	conn, err := t.Open(&s.config.BaseFlags)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
-	}
-	defer conn.Close()
-
-	results := ScanResults{}
-	if s.config.ImplicitTLS {
-		tlsConn, err := s.config.TLSFlags.GetTLSConnection(conn)
-		if err != nil {
-			return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error setting up TLS connection: %w", err)
-		}
-		results.TLSLog = tlsConn.GetLog()
-		err = tlsConn.Handshake()
-		if err != nil {
-			return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("TLS handshake failed: %w", err)
-		}
-		conn = tlsConn
-	}
-
-	// Construct a simple BindRequest
-	bindRequest := []byte{
-		0x30, 0x0c, // SEQUENCE
-		0x02, 0x01, 0x01, // INTEGER (1) - messageID
-		0x60, 0x07, // [APPLICATION 0] - bindRequest
-		0x02, 0x01, 0x03, // INTEGER (3) - version
-		0x04, 0x00, // OCTET STRING (0) - name (empty)
-		0x80, 0x00, // [0] - simple auth (empty)
-	}
-
-	_, err = conn.Write(bindRequest)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), &results, fmt.Errorf("error sending BindRequest: %w", err)
-	}
-
-	// Read the response
-	packet, err := ber.ReadPacket(conn)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), &results, fmt.Errorf("error reading BindResponse: %w", err)
-	}
-
-	results.RawResponse = ber.DecodeString(packet.Bytes())
-
-	var buffer bytes.Buffer
-	ber.WritePacket(&buffer, packet)
-	results.BindResponse = buffer.String()
-
-	// Validate the response
-	if len(packet.Children) < 2 {
-		return zgrab2.SCAN_UNKNOWN_ERROR, &results, fmt.Errorf("unexpected response format")
-	}
-
-	// Extract the resultCode
-	resultCode, ok := packet.Children[1].Children[0].Value.(int64)
-	if !ok {
-		return zgrab2.SCAN_UNKNOWN_ERROR, &results, fmt.Errorf("error parsing resultCode")
-	}
-
-	// Check if the resultCode indicates a valid LDAP response
-	if resultCode >= 0 && resultCode <= 80 { // Valid LDAP result codes
-		return zgrab2.SCAN_SUCCESS, &results, nil
-	}
-
-	return zgrab2.SCAN_PROTOCOL_ERROR, &results, fmt.Errorf("unexpected LDAP result code: %d", resultCode)
-}
-
-// GetTrigger returns the Trigger defined in the Flags.
-func (s *Scanner) GetTrigger() string {
-	return s.config.Trigger
-}
+package ldap
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// oidStartTLS is the LDAPOID of the RFC 2830 StartTLS extended operation.
+const oidStartTLS = "1.3.6.1.4.1.1466.20037"
+
+// LDAP protocolOp application tags, per RFC 4511 section 4.2.
+const (
+	applicationBindRequest        = ber.Tag(0)
+	applicationSearchRequest      = ber.Tag(3)
+	applicationSearchResultEntry  = ber.Tag(4)
+	applicationSearchResultDone   = ber.Tag(5)
+	applicationExtendedRequest    = ber.Tag(23)
+	applicationSASLAuthentication = ber.Tag(3)
+)
+
+// rootDSEAttributes are the operational attributes requested from the
+// anonymous RootDSE search.
+var rootDSEAttributes = []string{
+	"supportedSASLMechanisms",
+	"supportedLDAPVersion",
+	"supportedExtension",
+	"supportedControl",
+	"namingContexts",
+	"vendorName",
+	"vendorVersion",
+}
+
+// ScanResults contains the output of the LDAP scan.
+type ScanResults struct {
+	BindResponse string         `json:"bind_response,omitempty"`
+	RawResponse  string         `json:"raw_response,omitempty"`
+	TLSLog       *zgrab2.TLSLog `json:"tls,omitempty"`
+
+	// Commands is an ordered transcript of every request sent and
+	// response received over the connection, including the StartTLS
+	// ExtendedRequest/Response if --starttls was set.
+	Commands zgrab2.CommandLog `json:"commands,omitempty"`
+
+	// RootDSE holds every attribute the anonymous RootDSE search
+	// returned, keyed by attribute description.
+	RootDSE map[string][]string `json:"root_dse,omitempty"`
+
+	// SASLMechanisms is RootDSE's supportedSASLMechanisms attribute,
+	// surfaced as its own field for convenience.
+	SASLMechanisms []string `json:"sasl_mechanisms,omitempty"`
+
+	// SASLBindResponse is the raw LDAPResult of a SASL Bind probe sent
+	// with an empty mechanism, if --sasl-bind was set. Servers that
+	// don't expose supportedSASLMechanisms in their RootDSE often still
+	// advertise supported mechanisms in the error this provokes.
+	SASLBindResponse string `json:"sasl_bind_response,omitempty"`
+}
+
+// Flags contains LDAP-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+	zgrab2.TLSFlags
+
+	Verbose     bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+	ImplicitTLS bool `long:"tls" description:"Attempt to connect via a TLS wrapped connection"`
+
+	StartTLS bool `long:"starttls" description:"Send an RFC 2830 StartTLS extended request and upgrade to TLS before binding"`
+	SASLBind bool `long:"sasl-bind" description:"Send a SASL Bind with an empty mechanism, to probe mechanism advertisement"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct{}
+
+// Scanner implements the zgrab2.Scanner interface.
+type Scanner struct {
+	config *Flags
+}
+
+// Connection holds the state for a single connection to the LDAP server.
+type Connection struct {
+	config    *Flags
+	conn      net.Conn
+	results   ScanResults
+	messageID int64
+}
+
+// RegisterModule registers the ldap zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("ldap", "LDAP", module.Description(), 389, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns a default Flags object.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Probe for LDAP servers"
+}
+
+// Validate checks the flags for consistency.
+func (f *Flags) Validate(args []string) error {
+	return nil
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (s *Scanner) Protocol() string {
+	return "ldap"
+}
+
+// Init initializes the Scanner with the command-line flags.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// nextMessageID returns the next LDAPMessage messageID for this
+// connection, starting at 1.
+func (c *Connection) nextMessageID() int64 {
+	c.messageID++
+	return c.messageID
+}
+
+// wrapMessage wraps protocolOp in an LDAPMessage SEQUENCE with a fresh
+// messageID.
+func (c *Connection) wrapMessage(protocolOp *ber.Packet) *ber.Packet {
+	msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.nextMessageID(), "Message ID"))
+	msg.AppendChild(protocolOp)
+	return msg
+}
+
+// sendMessage wraps and writes protocolOp, then reads and returns the
+// server's single-packet response, recording both to results.Commands.
+func (c *Connection) sendMessage(protocolOp *ber.Packet) (*ber.Packet, error) {
+	var buf bytes.Buffer
+	if err := ber.WritePacket(&buf, c.wrapMessage(protocolOp)); err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	c.results.Commands.Sent(buf.Bytes())
+
+	packet, err := ber.ReadPacket(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	c.results.Commands.Received(packet.Bytes())
+	return packet, nil
+}
+
+// ldapResultCode extracts the resultCode and diagnosticMessage from an
+// LDAPResult (the first three children shared by BindResponse,
+// SearchResultDone, and ExtendedResponse).
+func ldapResultCode(op *ber.Packet) (code int64, diagnosticMessage string, err error) {
+	if len(op.Children) < 3 {
+		return 0, "", fmt.Errorf("unexpected LDAPResult format")
+	}
+	code, ok := op.Children[0].Value.(int64)
+	if !ok {
+		return 0, "", fmt.Errorf("error parsing resultCode")
+	}
+	return code, ber.DecodeString(op.Children[2].Bytes()), nil
+}
+
+// attributeValues decodes a SET OF AttributeValue into strings.
+func attributeValues(valueSet *ber.Packet) []string {
+	values := make([]string, 0, len(valueSet.Children))
+	for _, v := range valueSet.Children {
+		values = append(values, ber.DecodeString(v.Bytes()))
+	}
+	return values
+}
+
+// parseSearchResultEntry decodes a SearchResultEntry's PartialAttributeList
+// into attrs, keyed by attribute description.
+func parseSearchResultEntry(entry *ber.Packet, attrs map[string][]string) {
+	if len(entry.Children) < 2 {
+		return
+	}
+	for _, attr := range entry.Children[1].Children {
+		if len(attr.Children) < 2 {
+			continue
+		}
+		name := ber.DecodeString(attr.Children[0].Bytes())
+		attrs[name] = append(attrs[name], attributeValues(attr.Children[1])...)
+	}
+}
+
+// sendStartTLS issues the RFC 2830 StartTLS ExtendedRequest via the
+// shared zgrab2.StartTLSUpgrader and reports an error if the server's
+// ExtendedResponse doesn't indicate success.
+func (c *Connection) sendStartTLS() error {
+	extReq := ber.Encode(ber.ClassApplication, ber.TypeConstructed, applicationExtendedRequest, nil, "Extended Request")
+	extReq.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, oidStartTLS, "Request Name"))
+
+	var buf bytes.Buffer
+	if err := ber.WritePacket(&buf, c.wrapMessage(extReq)); err != nil {
+		return fmt.Errorf("error encoding StartTLS extended request: %w", err)
+	}
+
+	upgrader := &zgrab2.StartTLSUpgrader{Log: &c.results.Commands}
+	var code int64
+	var diagnosticMessage string
+	err := upgrader.Negotiate(c.conn, nil, 0,
+		func() error {
+			return upgrader.Send(c.conn, buf.Bytes())
+		},
+		func(response []byte) bool {
+			packet, err := ber.ReadPacket(bytes.NewReader(response))
+			if err != nil || len(packet.Children) < 2 {
+				return false
+			}
+			code, diagnosticMessage, err = ldapResultCode(packet.Children[1])
+			return err == nil
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("error negotiating StartTLS: %w", err)
+	}
+	if code != 0 {
+		return fmt.Errorf("server rejected StartTLS: result code %d (%s)", code, diagnosticMessage)
+	}
+	return nil
+}
+
+// sendSimpleBind issues a simple BindRequest for name/password and
+// returns the resultCode the server replied with.
+func (c *Connection) sendSimpleBind(name, password string) (resultCode int64, err error) {
+	bindRequest := ber.Encode(ber.ClassApplication, ber.TypeConstructed, applicationBindRequest, nil, "Bind Request")
+	bindRequest.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(3), "Version"))
+	bindRequest.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Name"))
+	bindRequest.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, password, "Simple Authentication"))
+
+	packet, err := c.sendMessage(bindRequest)
+	if err != nil {
+		return 0, fmt.Errorf("error sending BindRequest: %w", err)
+	}
+
+	c.results.RawResponse = ber.DecodeString(packet.Bytes())
+	var buffer bytes.Buffer
+	ber.WritePacket(&buffer, packet)
+	c.results.BindResponse = buffer.String()
+
+	if len(packet.Children) < 2 {
+		return 0, fmt.Errorf("unexpected BindResponse format")
+	}
+	code, _, err := ldapResultCode(packet.Children[1])
+	return code, err
+}
+
+// sendRootDSESearch issues an anonymous baseObject SearchRequest for
+// rootDSEAttributes and records every SearchResultEntry attribute until
+// SearchResultDone.
+func (c *Connection) sendRootDSESearch() error {
+	filter := ber.NewString(ber.ClassContext, ber.TypePrimitive, 7, "objectClass", "Filter - Present")
+
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, a := range rootDSEAttributes {
+		attributes.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, a, "Attribute"))
+	}
+
+	search := ber.Encode(ber.ClassApplication, ber.TypeConstructed, applicationSearchRequest, nil, "Search Request")
+	search.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Base DN"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(0), "Scope - baseObject"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(0), "DerefAliases - never"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "SizeLimit"))
+	search.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "TimeLimit"))
+	search.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "TypesOnly"))
+	search.AppendChild(filter)
+	search.AppendChild(attributes)
+
+	var buf bytes.Buffer
+	if err := ber.WritePacket(&buf, c.wrapMessage(search)); err != nil {
+		return fmt.Errorf("error encoding SearchRequest: %w", err)
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("error sending SearchRequest: %w", err)
+	}
+	c.results.Commands.Sent(buf.Bytes())
+
+	attrs := make(map[string][]string)
+	for {
+		packet, err := ber.ReadPacket(c.conn)
+		if err != nil {
+			return fmt.Errorf("error reading SearchResponse: %w", err)
+		}
+		c.results.Commands.Received(packet.Bytes())
+		if len(packet.Children) < 2 {
+			return fmt.Errorf("unexpected SearchResponse format")
+		}
+		op := packet.Children[1]
+		switch op.Tag {
+		case applicationSearchResultEntry:
+			parseSearchResultEntry(op, attrs)
+		case applicationSearchResultDone:
+			code, diagnosticMessage, err := ldapResultCode(op)
+			if err != nil {
+				return err
+			}
+			if code != 0 {
+				return fmt.Errorf("RootDSE search failed with result code %d (%s)", code, diagnosticMessage)
+			}
+			c.results.RootDSE = attrs
+			c.results.SASLMechanisms = attrs["supportedSASLMechanisms"]
+			return nil
+		default:
+			return fmt.Errorf("unexpected search response application tag: %d", op.Tag)
+		}
+	}
+}
+
+// sendSASLBindProbe issues a SASL BindRequest with an empty mechanism
+// name. It doesn't treat a non-zero resultCode as an error: the point is
+// to provoke the server into disclosing its supported mechanisms in the
+// rejection, for servers that don't expose supportedSASLMechanisms to
+// unauthenticated RootDSE searches.
+func (c *Connection) sendSASLBindProbe() error {
+	bindRequest := ber.Encode(ber.ClassApplication, ber.TypeConstructed, applicationBindRequest, nil, "Bind Request")
+	bindRequest.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(3), "Version"))
+	bindRequest.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Name"))
+
+	sasl := ber.Encode(ber.ClassContext, ber.TypeConstructed, applicationSASLAuthentication, nil, "SASL Authentication")
+	sasl.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Mechanism"))
+	bindRequest.AppendChild(sasl)
+
+	packet, err := c.sendMessage(bindRequest)
+	if err != nil {
+		return fmt.Errorf("error sending SASL BindRequest: %w", err)
+	}
+
+	var buffer bytes.Buffer
+	ber.WritePacket(&buffer, packet)
+	c.results.SASLBindResponse = buffer.String()
+	return nil
+}
+
+// upgradeTLS wraps conn.conn in a TLS connection, performs the
+// handshake, and records the resulting log.
+func (c *Connection) upgradeTLS() error {
+	tlsConn, err := c.config.TLSFlags.GetTLSConnection(c.conn)
+	if err != nil {
+		return fmt.Errorf("error setting up TLS connection: %w", err)
+	}
+	c.results.TLSLog = tlsConn.GetLog()
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	c.conn = tlsConn
+	return nil
+}
+
+// Scan performs the LDAP scan.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	netConn, err := t.Open(&s.config.BaseFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	defer netConn.Close()
+
+	conn := &Connection{config: s.config, conn: netConn}
+
+	if s.config.ImplicitTLS {
+		if err := conn.upgradeTLS(); err != nil {
+			return zgrab2.TryGetScanStatus(err), &conn.results, err
+		}
+	}
+
+	if s.config.StartTLS {
+		if err := conn.sendStartTLS(); err != nil {
+			return zgrab2.TryGetScanStatus(err), &conn.results, err
+		}
+		if err := conn.upgradeTLS(); err != nil {
+			return zgrab2.TryGetScanStatus(err), &conn.results, fmt.Errorf("error upgrading after StartTLS: %w", err)
+		}
+	}
+
+	resultCode, err := conn.sendSimpleBind("", "")
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), &conn.results, err
+	}
+	if resultCode != 0 {
+		return zgrab2.SCAN_APPLICATION_ERROR, &conn.results, fmt.Errorf("bind failed with LDAP result code %d", resultCode)
+	}
+
+	if err := conn.sendRootDSESearch(); err != nil {
+		return zgrab2.TryGetScanStatus(err), &conn.results, err
+	}
+
+	if s.config.SASLBind {
+		if err := conn.sendSASLBindProbe(); err != nil {
+			return zgrab2.TryGetScanStatus(err), &conn.results, err
+		}
+	}
+
+	return zgrab2.SCAN_SUCCESS, &conn.results, nil
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (s *Scanner) GetTrigger() string {
+	return s.config.Trigger
+}
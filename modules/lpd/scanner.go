@@ -1,173 +1,314 @@
-// Package lpd contains the zgrab2 Module implementation for LPD (Line Printer Daemon).
-//
-// The scan performs a banner grab by sending a "Receive a printer job" command to the LPD service.
-//
-// The output includes the raw response from the server.
-
-package lpd
-
-import (
-	"fmt"
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-	"net"
-)
-
-// ScanResults is the output of the scan.
-type ScanResults struct {
-	// Response is the raw data received from the server.
-	Response string `json:"response,omitempty"`
-
-	// IsLPD indicates if the response confirms an LPD service.
-	// This field is only included if the get_info flag is not set.
-	IsLPD *bool `json:"is_lpd,omitempty"`
-}
-
-// Flags are the LPD-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-
-	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
-	GetInfo bool `long:"get_info" description:"If true, send a different command to gather additional information from the LPD service."`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct {
-}
-
-// Scanner implements the zgrab2.Scanner interface, and holds the state for a single scan.
-type Scanner struct {
-	config *Flags
-}
-
-// Connection holds the state for a single connection to the LPD server.
-type Connection struct {
-	conn    net.Conn
-	config  *Flags
-	results ScanResults
-}
-
-// RegisterModule registers the lpd zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("lpd", "LPD", module.Description(), 515, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns the default flags object to be filled in with the command-line arguments.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns an overview of this module.
-func (m *Module) Description() string {
-	return "Grab an LPD banner"
-}
-
-// Validate flags
-func (f *Flags) Validate(args []string) (err error) {
-	// No specific validation required for LPD flags
-	return nil
-}
-
-// Help returns this module's help string.
-func (f *Flags) Help() string {
-	return ""
-}
-
-// Protocol returns the protocol identifier for the scanner.
-func (s *Scanner) Protocol() string {
-	return "lpd"
-}
-
-// Init initializes the Scanner instance with the flags from the command line.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// GetName returns the configured name for the Scanner.
-func (s *Scanner) GetName() string {
-	return s.config.Name
-}
-
-// GetTrigger returns the Trigger defined in the Flags.
-func (scanner *Scanner) GetTrigger() string {
-	return scanner.config.Trigger
-}
-
-// readResponse reads the LPD response from the server.
-func (lpd *Connection) readResponse() (string, error) {
-	buffer := make([]byte, 1024)
-	n, err := lpd.conn.Read(buffer)
-	if err != nil {
-		return "", err
-	}
-	return string(buffer[:n]), nil
-}
-
-// sendCommand sends a command to the LPD server.
-func (lpd *Connection) sendCommand(cmd string) error {
-	_, err := lpd.conn.Write([]byte(cmd + "\n"))
-	return err
-}
-
-// GetLPDResponse sends the appropriate command based on the flags and captures the response.
-func (lpd *Connection) GetLPDResponse() error {
-	var command string
-	if lpd.config.GetInfo {
-		command = "\x03queue:LPT1 \x01"
-	} else {
-		command = "\x02default"
-	}
-
-	err := lpd.sendCommand(command)
-	if err != nil {
-		return fmt.Errorf("error sending LPD command: %w", err)
-	}
-
-	response, err := lpd.readResponse()
-	if err != nil {
-		return fmt.Errorf("error reading LPD response: %w", err)
-	}
-
-	lpd.results.Response = response
-
-	if !lpd.config.GetInfo {
-		isLPD := len(response) > 0 && (response[0] == '\x00' || response[0] == '\x01')
-		lpd.results.IsLPD = &isLPD
-	}
-
-	return nil
-}
-
-// Scan performs the configured scan on the LPD server.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
-	var err error
-	conn, err := t.Open(&s.config.BaseFlags)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
-	}
-	defer conn.Close()
-
-	lpd := Connection{conn: conn, config: s.config}
-	err = lpd.GetLPDResponse()
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), &lpd.results, fmt.Errorf("error getting LPD response: %w", err)
-	}
-
-	return zgrab2.SCAN_SUCCESS, &lpd.results, nil
-}
+// Package lpd contains the zgrab2 Module implementation for LPD (Line Printer Daemon).
+//
+// The scan drives the RFC 1179 command set against the server: it can probe
+// the default queue, list queue state in short or long form, and optionally
+// request removal of a job when destructive operations are explicitly
+// enabled. Job/queue information is parsed into structured results rather
+// than returned as a raw banner.
+package lpd
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// RFC 1179 command codes.
+const (
+	cmdPrintWaitingJobs byte = 0x01
+	cmdReceiveJob       byte = 0x02
+	cmdSendShortState   byte = 0x03
+	cmdSendLongState    byte = 0x04
+	cmdRemoveJobs       byte = 0x05
+)
+
+// JobEntry is a single entry parsed out of a long-form ("\x04") queue listing.
+type JobEntry struct {
+	Rank      string `json:"rank,omitempty"`
+	Owner     string `json:"owner,omitempty"`
+	JobID     string `json:"job_id,omitempty"`
+	Files     string `json:"files,omitempty"`
+	TotalSize string `json:"total_size,omitempty"`
+}
+
+// CommandResult records a single RFC 1179 command/response round-trip.
+type CommandResult struct {
+	// Command is the command byte that was sent, e.g. "0x03".
+	Command string `json:"command,omitempty"`
+
+	// Ack is the first acknowledgement byte returned (0 = positive, non-zero = error per RFC 1179 §6).
+	Ack *byte `json:"ack,omitempty"`
+
+	// Response is the raw text that followed the acknowledgement byte, if any.
+	Response string `json:"response,omitempty"`
+}
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	// Response is the raw data received from the server for the default probe.
+	Response string `json:"response,omitempty"`
+
+	// IsLPD indicates if at least one RFC 1179 command produced a valid-shaped response.
+	IsLPD *bool `json:"is_lpd,omitempty"`
+
+	// Queue holds the parsed long-form job listing, if --list-long was requested.
+	Queue []JobEntry `json:"queue,omitempty"`
+
+	// Commands records each RFC 1179 command issued and its acknowledgement.
+	Commands []CommandResult `json:"commands,omitempty"`
+}
+
+// Flags are the LPD-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+
+	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+	GetInfo bool `long:"get_info" description:"If true, send a different command to gather additional information from the LPD service."`
+
+	Queue            string `long:"queue" default:"lp" description:"Printer queue name to use for RFC 1179 commands"`
+	ListShort        bool   `long:"list-short" description:"Send a Send Queue State (short) command for the configured queue"`
+	ListLong         bool   `long:"list-long" description:"Send a Send Queue State (long) command for the configured queue"`
+	PrintWaiting     bool   `long:"print-waiting" description:"Send a Print any waiting jobs command for the configured queue"`
+	RemoveJob        string `long:"remove-job" description:"Agent/job list to pass to a Remove Jobs command (requires --allow-destructive)"`
+	AllowDestructive bool   `long:"allow-destructive" description:"Permit the --remove-job command to actually be sent"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface, and holds the state for a single scan.
+type Scanner struct {
+	config *Flags
+}
+
+// Connection holds the state for a single connection to the LPD server.
+type Connection struct {
+	conn    net.Conn
+	config  *Flags
+	results ScanResults
+}
+
+// RegisterModule registers the lpd zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("lpd", "LPD", module.Description(), 515, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object to be filled in with the command-line arguments.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Grab an LPD banner and optionally enumerate queue/job state"
+}
+
+// Validate flags
+func (f *Flags) Validate(args []string) (err error) {
+	if f.RemoveJob != "" && !f.AllowDestructive {
+		return fmt.Errorf("--remove-job requires --allow-destructive")
+	}
+	return nil
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (s *Scanner) Protocol() string {
+	return "lpd"
+}
+
+// Init initializes the Scanner instance with the flags from the command line.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// readUntilIdle reads from the connection until a read deadline elapses, so
+// long listings are not truncated by a single fixed-size read.
+func (lpd *Connection) readUntilIdle() (string, error) {
+	data, err := zgrab2.ReadAvailable(lpd.conn)
+	if err != nil && len(data) == 0 {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// sendCommand sends a raw RFC 1179 command (already including its trailing
+// arguments and newline) and returns the acknowledgement byte plus whatever
+// followed it.
+func (lpd *Connection) sendCommand(cmd []byte) (*CommandResult, error) {
+	if _, err := lpd.conn.Write(cmd); err != nil {
+		return nil, fmt.Errorf("error sending LPD command: %w", err)
+	}
+	resp, err := lpd.readUntilIdle()
+	result := &CommandResult{Command: fmt.Sprintf("0x%02x", cmd[0])}
+	if err != nil {
+		return result, err
+	}
+	if len(resp) > 0 {
+		ack := resp[0]
+		result.Ack = &ack
+		result.Response = resp[1:]
+	}
+	return result, nil
+}
+
+// jobLineRegex matches a long-form queue listing line, e.g.:
+// "1st  root    123  (stdin)  1024 bytes"
+var jobLineRegex = regexp.MustCompile(`^(\S+)\s+(\S+)\s+(\d+)\s+(.+?)\s+(\d+)\s+bytes`)
+
+// parseQueue parses a long-form queue listing into JobEntry values.
+func parseQueue(listing string) []JobEntry {
+	var jobs []JobEntry
+	for _, line := range strings.Split(listing, "\n") {
+		line = strings.TrimRight(line, "\r")
+		matches := jobLineRegex.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+		jobs = append(jobs, JobEntry{
+			Rank:      matches[1],
+			Owner:     matches[2],
+			JobID:     matches[3],
+			Files:     matches[4],
+			TotalSize: matches[5],
+		})
+	}
+	return jobs
+}
+
+// GetLPDResponse drives the configured RFC 1179 commands and records their
+// results, marking IsLPD true only once a command has produced a
+// valid-shaped (ack byte present) response.
+func (lpd *Connection) GetLPDResponse() error {
+	isLPD := false
+
+	runCommand := func(code byte, queue string) (*CommandResult, error) {
+		cmd := append([]byte{code}, []byte(queue+"\n")...)
+		res, err := lpd.sendCommand(cmd)
+		if res != nil {
+			lpd.results.Commands = append(lpd.results.Commands, *res)
+			if res.Ack != nil {
+				isLPD = true
+			}
+		}
+		return res, err
+	}
+
+	queue := lpd.config.Queue
+	if queue == "" {
+		queue = "lp"
+	}
+
+	if lpd.config.GetInfo {
+		res, err := runCommand(cmdSendLongState, queue)
+		if err != nil {
+			return fmt.Errorf("error reading LPD response: %w", err)
+		}
+		if res != nil {
+			lpd.results.Response = res.Response
+			lpd.results.Queue = parseQueue(res.Response)
+		}
+	} else {
+		res, err := runCommand(cmdReceiveJob, "default")
+		if err != nil {
+			return fmt.Errorf("error reading LPD response: %w", err)
+		}
+		if res != nil {
+			lpd.results.Response = res.Response
+		}
+	}
+
+	if lpd.config.PrintWaiting {
+		if _, err := runCommand(cmdPrintWaitingJobs, queue); err != nil {
+			return fmt.Errorf("error sending print-waiting command: %w", err)
+		}
+	}
+
+	if lpd.config.ListShort {
+		res, err := runCommand(cmdSendShortState, queue)
+		if err != nil {
+			return fmt.Errorf("error sending list-short command: %w", err)
+		}
+		if res != nil && lpd.results.Response == "" {
+			lpd.results.Response = res.Response
+		}
+	}
+
+	if lpd.config.ListLong {
+		res, err := runCommand(cmdSendLongState, queue)
+		if err != nil {
+			return fmt.Errorf("error sending list-long command: %w", err)
+		}
+		if res != nil {
+			lpd.results.Queue = parseQueue(res.Response)
+		}
+	}
+
+	if lpd.config.RemoveJob != "" && lpd.config.AllowDestructive {
+		cmd := append([]byte{cmdRemoveJobs}, []byte(queue+" "+lpd.config.RemoveJob+"\n")...)
+		res, err := lpd.sendCommand(cmd)
+		if err != nil {
+			return fmt.Errorf("error sending remove-job command: %w", err)
+		}
+		lpd.results.Commands = append(lpd.results.Commands, *res)
+		if res.Ack != nil {
+			isLPD = true
+		}
+	}
+
+	lpd.results.IsLPD = &isLPD
+	return nil
+}
+
+// Scan performs the configured scan on the LPD server.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	var err error
+	conn, err := t.Open(&s.config.BaseFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	defer conn.Close()
+
+	lpd := Connection{conn: conn, config: s.config}
+	err = lpd.GetLPDResponse()
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), &lpd.results, fmt.Errorf("error getting LPD response: %w", err)
+	}
+
+	return zgrab2.SCAN_SUCCESS, &lpd.results, nil
+}
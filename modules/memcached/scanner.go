@@ -1,152 +1,662 @@
-// Package memcached contains the zgrab2 Module implementation for Memcached.
-package memcached
-
-import (
-	"fmt"
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-	"net"
-	"regexp"
-)
-
-// ScanResults is the output of the scan.
-type ScanResults struct {
-	// Version is the version string returned by the server.
-	Version string `json:"version,omitempty"`
-}
-
-// Flags are the Memcached-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-
-	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct {
-}
-
-// Scanner implements the zgrab2.Scanner interface, and holds the state
-// for a single scan.
-type Scanner struct {
-	config *Flags
-}
-
-// Connection holds the state for a single connection to the Memcached server.
-type Connection struct {
-	config  *Flags
-	results ScanResults
-	conn    net.Conn
-}
-
-// RegisterModule registers the Memcached zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("memcached", "Memcached", module.Description(), 11211, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns the default flags object to be filled in with the
-// command-line arguments.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns an overview of this module.
-func (m *Module) Description() string {
-	return "Grab a Memcached version"
-}
-
-// Validate flags
-func (f *Flags) Validate(args []string) (err error) {
-	return
-}
-
-// Help returns this module's help string.
-func (f *Flags) Help() string {
-	return ""
-}
-
-// Protocol returns the protocol identifier for the scanner.
-func (s *Scanner) Protocol() string {
-	return "memcached"
-}
-
-// Init initializes the Scanner instance with the flags from the command
-// line.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// GetName returns the configured name for the Scanner.
-func (s *Scanner) GetName() string {
-	return s.config.Name
-}
-
-// GetTrigger returns the Trigger defined in the Flags.
-func (scanner *Scanner) GetTrigger() string {
-	return scanner.config.Trigger
-}
-
-// memcachedEndRegex matches zero or more lines followed by "VERSION" and the version string.
-var memcachedEndRegex = regexp.MustCompile(`^VERSION (\S+)\r\n$`)
-
-// readResponse reads a response from the server.
-func (mem *Connection) readResponse() (string, error) {
-	buffer := make([]byte, 256)
-	n, err := mem.conn.Read(buffer)
-	if err != nil {
-		return "", err
-	}
-	return string(buffer[:n]), nil
-}
-
-// sendCommand sends a command and waits for / reads / returns the response.
-func (mem *Connection) sendCommand(cmd string) (string, error) {
-	mem.conn.Write([]byte(cmd + "\r\n"))
-	return mem.readResponse()
-}
-
-// GetMemcachedVersion sends the version command to the server and reads the response.
-func (mem *Connection) GetMemcachedVersion() error {
-	resp, err := mem.sendCommand("version")
-	if err != nil {
-		return err
-	}
-	matches := memcachedEndRegex.FindStringSubmatch(resp)
-	if len(matches) < 2 {
-		return fmt.Errorf("invalid response: %s", resp)
-	}
-	mem.results.Version = matches[1]
-	return nil
-}
-
-// Scan performs the configured scan on the Memcached server.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
-	conn, err := t.Open(&s.config.BaseFlags)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
-	}
-	defer conn.Close()
-
-	mem := Connection{conn: conn, config: s.config}
-	err = mem.GetMemcachedVersion()
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), &mem.results, fmt.Errorf("error getting memcached version: %w", err)
-	}
-	return zgrab2.SCAN_SUCCESS, &mem.results, nil
-}
+// Package memcached contains the zgrab2 Module implementation for Memcached.
+//
+// The scan supports both the ASCII and binary protocols (--protocol), and
+// goes well beyond a bare version grab: it enumerates the ASCII "stats"
+// family and, over the binary protocol, issues Version/Stat/SASL List
+// Mechs requests using the 24-byte binary header framing, optionally
+// attempting a SASL PLAIN auth with --sasl-user/--sasl-pass.
+package memcached
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+	"github.com/zmap/zgrab2/framing"
+	"github.com/zmap/zgrab2/script"
+)
+
+// defaultScriptMaxFileSize bounds how large a --script file is allowed to be.
+const defaultScriptMaxFileSize = 1 << 20
+
+// defaultScriptReadSize bounds a best-effort script step response read.
+const defaultScriptReadSize = 4096
+
+// responseReadDeadline bounds how long a single ASCII command response read may take.
+const responseReadDeadline = 10 * time.Second
+
+// maxResponseSize bounds how large a single ASCII command response may be.
+const maxResponseSize = 1 << 20
+
+// Binary protocol magics and opcodes, per the memcached binary protocol spec.
+const (
+	magicRequest  = 0x80
+	magicResponse = 0x81
+
+	opVersion       = 0x0b
+	opStat          = 0x10
+	opSASLListMechs = 0x20
+	opSASLAuth      = 0x21
+
+	statusSuccess = 0x0000
+)
+
+// SlabInfo holds one slab class's stats, parsed from "stats slabs".
+type SlabInfo struct {
+	ClassID int               `json:"class_id"`
+	Stats   map[string]string `json:"stats,omitempty"`
+}
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	// Protocol records which protocol(s) were spoken: ascii, binary, or both.
+	Protocol string `json:"protocol,omitempty"`
+
+	// Version is the version string returned by the server.
+	Version string `json:"version,omitempty"`
+
+	// Stats holds the general "stats" command's STAT key/value pairs.
+	Stats map[string]string `json:"stats,omitempty"`
+
+	// ItemStats holds "stats items".
+	ItemStats map[string]string `json:"item_stats,omitempty"`
+
+	// SlabClasses holds "stats slabs", grouped by slab class ID.
+	SlabClasses []SlabInfo `json:"slab_classes,omitempty"`
+
+	// SettingsStats holds "stats settings".
+	SettingsStats map[string]string `json:"settings_stats,omitempty"`
+
+	// SizeStats holds "stats sizes".
+	SizeStats map[string]string `json:"size_stats,omitempty"`
+
+	// SASLMechs lists the mechanisms returned by a binary SASL List Mechs request.
+	SASLMechs []string `json:"sasl_mechs,omitempty"`
+
+	// AuthSuccess reports whether a binary SASL Auth (PLAIN) attempt
+	// succeeded, if --sasl-user/--sasl-pass were set.
+	AuthSuccess *bool `json:"auth_success,omitempty"`
+
+	// UDPProbes holds the results of the --udp amplification probes.
+	UDPProbes []UDPProbeResult `json:"udp_probes,omitempty"`
+
+	// LikelyAbusableReflector is true if any UDP probe's amplification
+	// factor exceeded --amplification-threshold.
+	LikelyAbusableReflector bool `json:"likely_abusable_reflector,omitempty"`
+
+	// ScriptLog holds the per-step results of --script, if set.
+	ScriptLog []script.StepResult `json:"script_log,omitempty"`
+
+	// SavedGroups holds the named captures recorded by --script steps'
+	// save_group, if any were set.
+	SavedGroups map[string]string `json:"saved_groups,omitempty"`
+}
+
+// UDPProbeResult is the outcome of a single UDP amplification probe.
+type UDPProbeResult struct {
+	// Probe names the command that was sent (e.g. "version", "stats").
+	Probe string `json:"probe"`
+
+	// BytesSent is the size of the request datagram, including the
+	// 8-byte memcached UDP frame header.
+	BytesSent int `json:"bytes_sent"`
+
+	// BytesReceived is the total payload size across all response
+	// datagrams, excluding their 8-byte frame headers.
+	BytesReceived int `json:"bytes_received"`
+
+	// Datagrams is the number of response datagrams received.
+	Datagrams int `json:"datagrams"`
+
+	// Body is the reassembled response body.
+	Body string `json:"body,omitempty"`
+
+	// AmplificationFactor is BytesReceived / BytesSent.
+	AmplificationFactor float64 `json:"amplification_factor"`
+}
+
+// Flags are the Memcached-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+	zgrab2.UDPFlags
+
+	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+
+	Protocol string `long:"protocol" default:"ascii" description:"Protocol to speak: ascii, binary, or both"`
+
+	SASLUser string `long:"sasl-user" description:"Username for a binary protocol SASL PLAIN auth attempt"`
+	SASLPass string `long:"sasl-pass" description:"Password for a binary protocol SASL PLAIN auth attempt"`
+
+	UDP                    bool    `long:"udp" description:"Probe for UDP/11211 reflection amplification instead of connecting over TCP"`
+	AmplificationThreshold float64 `long:"amplification-threshold" default:"10.0" description:"Flag the target as a likely-abusable reflector if any probe's amplification factor exceeds this value"`
+
+	Script string `long:"script" description:"Path to a JSON or YAML ProbeScript run on the connection after the built-in probe"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface, and holds the state
+// for a single scan.
+type Scanner struct {
+	config *Flags
+	script *script.ProbeScript
+}
+
+// Connection holds the state for a single connection to the Memcached server.
+type Connection struct {
+	config  *Flags
+	results *ScanResults
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+// RegisterModule registers the Memcached zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("memcached", "Memcached", module.Description(), 11211, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object to be filled in with the
+// command-line arguments.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Grab a Memcached version"
+}
+
+// Validate flags
+func (f *Flags) Validate(args []string) (err error) {
+	switch f.Protocol {
+	case "ascii", "binary", "both":
+	default:
+		return fmt.Errorf("invalid --protocol %q: must be one of ascii, binary, both", f.Protocol)
+	}
+	return nil
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (s *Scanner) Protocol() string {
+	return "memcached"
+}
+
+// Init initializes the Scanner instance with the flags from the command
+// line.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+
+	if f.Script != "" {
+		ps, err := script.Load(f.Script, defaultScriptMaxFileSize)
+		if err != nil {
+			return fmt.Errorf("error loading --script: %w", err)
+		}
+		s.script = ps
+	}
+
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// memcachedEndRegex matches zero or more lines followed by "VERSION" and the version string.
+var memcachedEndRegex = regexp.MustCompile(`^VERSION (\S+)\r\n$`)
+
+// sendCommand sends an ASCII command and returns the raw response, looping
+// on Read until the CRLF-terminated "VERSION ...\r\n" reply has fully
+// arrived rather than assuming it lands in a single TCP segment.
+func (mem *Connection) sendCommand(cmd string) (string, error) {
+	if _, err := mem.conn.Write([]byte(cmd + "\r\n")); err != nil {
+		return "", err
+	}
+	resp, err := framing.ReadLineCRLF(mem.conn, maxResponseSize, responseReadDeadline)
+	return string(resp), err
+}
+
+// GetMemcachedVersion sends the version command to the server and reads the response.
+func (mem *Connection) GetMemcachedVersion() error {
+	resp, err := mem.sendCommand("version")
+	if err != nil {
+		return err
+	}
+	matches := memcachedEndRegex.FindStringSubmatch(resp)
+	if len(matches) < 2 {
+		return fmt.Errorf("invalid response: %s", resp)
+	}
+	mem.results.Version = matches[1]
+	return nil
+}
+
+// runStats issues "stats" or "stats <arg>" and parses the "STAT key
+// value\r\n" lines up to the terminating "END\r\n".
+func (mem *Connection) runStats(arg string) (map[string]string, error) {
+	cmd := "stats"
+	if arg != "" {
+		cmd = "stats " + arg
+	}
+	if _, err := mem.conn.Write([]byte(cmd + "\r\n")); err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]string)
+	for {
+		line, err := mem.reader.ReadString('\n')
+		if err != nil {
+			return stats, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "END" {
+			return stats, nil
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 || fields[0] != "STAT" {
+			continue
+		}
+		stats[fields[1]] = fields[2]
+	}
+}
+
+// groupSlabStats splits the flat "stats slabs" key/value pairs (keyed
+// "<classID>:<field>", plus some global keys with no class prefix) into
+// per-class SlabInfo entries.
+func groupSlabStats(raw map[string]string) []SlabInfo {
+	byClass := make(map[int]map[string]string)
+	var classIDs []int
+	for key, value := range raw {
+		parts := strings.SplitN(key, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		classID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		if _, ok := byClass[classID]; !ok {
+			byClass[classID] = make(map[string]string)
+			classIDs = append(classIDs, classID)
+		}
+		byClass[classID][parts[1]] = value
+	}
+	sortInts(classIDs)
+
+	slabs := make([]SlabInfo, 0, len(classIDs))
+	for _, id := range classIDs {
+		slabs = append(slabs, SlabInfo{ClassID: id, Stats: byClass[id]})
+	}
+	return slabs
+}
+
+// sortInts sorts a []int in place with a straightforward insertion sort;
+// the slab class count is small enough that this is simpler than pulling
+// in "sort" for one call site.
+func sortInts(a []int) {
+	for i := 1; i < len(a); i++ {
+		for j := i; j > 0 && a[j-1] > a[j]; j-- {
+			a[j-1], a[j] = a[j], a[j-1]
+		}
+	}
+}
+
+// runASCIIProbe issues version and the full "stats" family over the ASCII protocol.
+func (mem *Connection) runASCIIProbe() error {
+	if err := mem.GetMemcachedVersion(); err != nil {
+		return fmt.Errorf("error getting memcached version: %w", err)
+	}
+
+	mem.reader = bufio.NewReader(mem.conn)
+
+	var err error
+	if mem.results.Stats, err = mem.runStats(""); err != nil {
+		return fmt.Errorf("error running stats: %w", err)
+	}
+	if mem.results.ItemStats, err = mem.runStats("items"); err != nil {
+		return fmt.Errorf("error running stats items: %w", err)
+	}
+	slabStats, err := mem.runStats("slabs")
+	if err != nil {
+		return fmt.Errorf("error running stats slabs: %w", err)
+	}
+	mem.results.SlabClasses = groupSlabStats(slabStats)
+	if mem.results.SettingsStats, err = mem.runStats("settings"); err != nil {
+		return fmt.Errorf("error running stats settings: %w", err)
+	}
+	if mem.results.SizeStats, err = mem.runStats("sizes"); err != nil {
+		return fmt.Errorf("error running stats sizes: %w", err)
+	}
+	return nil
+}
+
+// encodeBinaryRequest builds a 24-byte binary protocol request header
+// followed by extras, key, and value.
+func encodeBinaryRequest(opcode byte, extras, key, value []byte) []byte {
+	totalBody := len(extras) + len(key) + len(value)
+	buf := make([]byte, 24+totalBody)
+	buf[0] = magicRequest
+	buf[1] = opcode
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = byte(len(extras))
+	// buf[5] data type, buf[6:8] vbucket id: both left zero
+	binary.BigEndian.PutUint32(buf[8:12], uint32(totalBody))
+	// buf[12:16] opaque, buf[16:24] CAS: both left zero
+
+	offset := 24
+	offset += copy(buf[offset:], extras)
+	offset += copy(buf[offset:], key)
+	copy(buf[offset:], value)
+	return buf
+}
+
+// binaryResponse is a decoded binary protocol response.
+type binaryResponse struct {
+	Opcode byte
+	Status uint16
+	Key    []byte
+	Extras []byte
+	Value  []byte
+}
+
+// readBinaryResponse reads and decodes a single binary protocol response.
+func readBinaryResponse(r io.Reader) (*binaryResponse, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != magicResponse {
+		return nil, fmt.Errorf("invalid response magic 0x%02x", header[0])
+	}
+	keyLen := binary.BigEndian.Uint16(header[2:4])
+	extrasLen := header[4]
+	status := binary.BigEndian.Uint16(header[6:8])
+	bodyLen := binary.BigEndian.Uint32(header[8:12])
+
+	body := make([]byte, bodyLen)
+	if bodyLen > 0 {
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+	}
+
+	return &binaryResponse{
+		Opcode: header[1],
+		Status: status,
+		Extras: body[:extrasLen],
+		Key:    body[extrasLen : int(extrasLen)+int(keyLen)],
+		Value:  body[int(extrasLen)+int(keyLen):],
+	}, nil
+}
+
+// binaryVersion issues a binary Version request.
+func (mem *Connection) binaryVersion() error {
+	if _, err := mem.conn.Write(encodeBinaryRequest(opVersion, nil, nil, nil)); err != nil {
+		return err
+	}
+	resp, err := readBinaryResponse(mem.conn)
+	if err != nil {
+		return err
+	}
+	if resp.Status != statusSuccess {
+		return fmt.Errorf("binary Version failed with status 0x%04x", resp.Status)
+	}
+	mem.results.Version = string(resp.Value)
+	return nil
+}
+
+// binaryStats issues a binary Stat request and reads packets until the
+// server's empty-key terminator packet.
+func (mem *Connection) binaryStats() (map[string]string, error) {
+	if _, err := mem.conn.Write(encodeBinaryRequest(opStat, nil, nil, nil)); err != nil {
+		return nil, err
+	}
+	stats := make(map[string]string)
+	for {
+		resp, err := readBinaryResponse(mem.conn)
+		if err != nil {
+			return stats, err
+		}
+		if resp.Status != statusSuccess {
+			return stats, fmt.Errorf("binary Stat failed with status 0x%04x", resp.Status)
+		}
+		if len(resp.Key) == 0 {
+			return stats, nil
+		}
+		stats[string(resp.Key)] = string(resp.Value)
+	}
+}
+
+// binarySASLListMechs issues a binary SASL List Mechs request.
+func (mem *Connection) binarySASLListMechs() error {
+	if _, err := mem.conn.Write(encodeBinaryRequest(opSASLListMechs, nil, nil, nil)); err != nil {
+		return err
+	}
+	resp, err := readBinaryResponse(mem.conn)
+	if err != nil {
+		return err
+	}
+	if resp.Status != statusSuccess {
+		return fmt.Errorf("binary SASL List Mechs failed with status 0x%04x", resp.Status)
+	}
+	mem.results.SASLMechs = strings.Fields(string(resp.Value))
+	return nil
+}
+
+// binarySASLAuth attempts a binary SASL PLAIN auth with the configured
+// --sasl-user/--sasl-pass.
+func (mem *Connection) binarySASLAuth() error {
+	value := []byte("\x00" + mem.config.SASLUser + "\x00" + mem.config.SASLPass)
+	if _, err := mem.conn.Write(encodeBinaryRequest(opSASLAuth, nil, []byte("PLAIN"), value)); err != nil {
+		return err
+	}
+	resp, err := readBinaryResponse(mem.conn)
+	if err != nil {
+		return err
+	}
+	success := resp.Status == statusSuccess
+	mem.results.AuthSuccess = &success
+	return nil
+}
+
+// runBinaryProbe issues Version, Stat, and SASL List Mechs over the binary
+// protocol, and optionally a SASL PLAIN Auth attempt.
+func (mem *Connection) runBinaryProbe() error {
+	if err := mem.binaryVersion(); err != nil {
+		return fmt.Errorf("error getting binary version: %w", err)
+	}
+	stats, err := mem.binaryStats()
+	if err != nil {
+		return fmt.Errorf("error running binary stat: %w", err)
+	}
+	if mem.results.Stats == nil {
+		mem.results.Stats = stats
+	}
+	if err := mem.binarySASLListMechs(); err != nil {
+		return fmt.Errorf("error running binary SASL list mechs: %w", err)
+	}
+	if mem.config.SASLUser != "" {
+		if err := mem.binarySASLAuth(); err != nil {
+			return fmt.Errorf("error running binary SASL auth: %w", err)
+		}
+	}
+	return nil
+}
+
+// udpFrameHeader builds the 8-byte memcached UDP frame header: request id,
+// sequence number, total number of datagrams, and a reserved field, all
+// big-endian uint16s.
+func udpFrameHeader(requestID, seqNum, total uint16) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint16(buf[0:2], requestID)
+	binary.BigEndian.PutUint16(buf[2:4], seqNum)
+	binary.BigEndian.PutUint16(buf[4:6], total)
+	// buf[6:8] reserved, left zero
+	return buf
+}
+
+// sendUDPProbe sends a single ASCII command as a one-datagram memcached UDP
+// request, then reads datagrams until the read times out, reassembling the
+// response body by sequence number. It re-arms sock's read deadline itself
+// so that a prior probe's elapsed deadline on the same socket doesn't
+// starve this one.
+func sendUDPProbe(sock net.Conn, name, command string, timeout time.Duration) UDPProbeResult {
+	sock.SetReadDeadline(time.Now().Add(timeout))
+
+	request := append(udpFrameHeader(1, 0, 1), []byte(command+"\r\n")...)
+
+	result := UDPProbeResult{Probe: name, BytesSent: len(request)}
+	if _, err := sock.Write(request); err != nil {
+		return result
+	}
+
+	chunks := make(map[uint16][]byte)
+	var maxSeq uint16
+	buf := make([]byte, 65507)
+	for {
+		n, err := sock.Read(buf)
+		if err != nil {
+			break
+		}
+		if n < 8 {
+			continue
+		}
+		seqNum := binary.BigEndian.Uint16(buf[2:4])
+		total := binary.BigEndian.Uint16(buf[4:6])
+		payload := make([]byte, n-8)
+		copy(payload, buf[8:n])
+		chunks[seqNum] = payload
+		result.BytesReceived += len(payload)
+		result.Datagrams++
+		if total > maxSeq {
+			maxSeq = total
+		}
+	}
+
+	var body strings.Builder
+	for seq := uint16(0); seq < maxSeq || len(chunks[seq]) > 0; seq++ {
+		chunk, ok := chunks[seq]
+		if !ok {
+			break
+		}
+		body.Write(chunk)
+	}
+	result.Body = body.String()
+
+	if result.BytesSent > 0 {
+		result.AmplificationFactor = float64(result.BytesReceived) / float64(result.BytesSent)
+	}
+	return result
+}
+
+// runUDPProbes issues the version and stats probes over UDP and records
+// their amplification factors.
+func (s *Scanner) runUDPProbes(t zgrab2.ScanTarget) (*ScanResults, zgrab2.ScanStatus, error) {
+	sock, err := t.OpenUDP(&s.config.BaseFlags, &s.config.UDPFlags)
+	if err != nil {
+		return nil, zgrab2.TryGetScanStatus(err), fmt.Errorf("error opening UDP connection: %w", err)
+	}
+	defer sock.Close()
+
+	timeout := time.Duration(s.config.Timeout) * time.Second
+	results := &ScanResults{Protocol: "udp"}
+	results.UDPProbes = []UDPProbeResult{
+		sendUDPProbe(sock, "version", "version", timeout),
+		sendUDPProbe(sock, "stats", "stats", timeout),
+	}
+	for _, probe := range results.UDPProbes {
+		if probe.AmplificationFactor > s.config.AmplificationThreshold {
+			results.LikelyAbusableReflector = true
+		}
+	}
+	return results, zgrab2.SCAN_SUCCESS, nil
+}
+
+// Scan performs the configured scan on the Memcached server.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	if s.config.UDP {
+		results, status, err := s.runUDPProbes(t)
+		if err != nil {
+			return status, nil, err
+		}
+		return status, results, nil
+	}
+
+	results := &ScanResults{Protocol: s.config.Protocol}
+
+	if s.config.Protocol == "ascii" || s.config.Protocol == "both" {
+		conn, err := t.Open(&s.config.BaseFlags)
+		if err != nil {
+			return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+		}
+		mem := Connection{conn: conn, config: s.config, results: results}
+		err = mem.runASCIIProbe()
+		conn.Close()
+		if err != nil {
+			return zgrab2.TryGetScanStatus(err), results, err
+		}
+	}
+
+	if s.config.Protocol == "binary" || s.config.Protocol == "both" {
+		conn, err := t.Open(&s.config.BaseFlags)
+		if err != nil {
+			return zgrab2.TryGetScanStatus(err), results, fmt.Errorf("error opening connection: %w", err)
+		}
+		mem := Connection{conn: conn, config: s.config, results: results}
+		err = mem.runBinaryProbe()
+		conn.Close()
+		if err != nil {
+			return zgrab2.TryGetScanStatus(err), results, err
+		}
+	}
+
+	if s.script != nil {
+		conn, err := t.Open(&s.config.BaseFlags)
+		if err != nil {
+			return zgrab2.TryGetScanStatus(err), results, fmt.Errorf("error opening connection for --script: %w", err)
+		}
+		scriptLog, savedGroups, err := script.Run(conn, s.script.Steps, defaultScriptReadSize, 0)
+		conn.Close()
+		results.ScriptLog = scriptLog
+		results.SavedGroups = savedGroups
+		if err != nil {
+			log.Infof("memcached script run ended early: %v", err)
+		}
+	}
+
+	return zgrab2.SCAN_SUCCESS, results, nil
+}
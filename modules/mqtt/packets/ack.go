@@ -0,0 +1,68 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// PUBACK, PUBREC, PUBREL, and PUBCOMP (sections 3.4-3.7) all share the
+// same wire shape: a 2-byte Packet Identifier, and -- v5 only, and only
+// if something needs saying -- a Reason Code and a Properties block.
+// packAck/unpackAck hold that shared shape; each packet type's own file
+// just supplies its PacketType/flags and field names.
+
+func packAck(w io.Writer, packetType PacketType, flags byte, version Version, packetID uint16, reasonCode byte, properties Properties) error {
+	variableHeader := []byte{byte(packetID >> 8), byte(packetID)}
+
+	// Per MQTT-3.4.2.1 (and its PUBREC/PUBREL/PUBCOMP equivalents), the
+	// Reason Code and Properties are omitted entirely when the Reason
+	// Code is 0x00 (Success) and there are no Properties to send.
+	if version == Version5 && (reasonCode != 0x00 || hasAnyProperty(&properties)) {
+		variableHeader = append(variableHeader, reasonCode)
+		variableHeader = append(variableHeader, properties.Pack()...)
+	}
+
+	header := FixedHeader{Type: packetType, Flags: flags, RemainingLength: len(variableHeader)}
+	if err := header.Pack(w); err != nil {
+		return err
+	}
+	_, err := w.Write(variableHeader)
+	return err
+}
+
+func unpackAck(r io.Reader, header FixedHeader, version Version) (packetID uint16, reasonCode byte, properties Properties, err error) {
+	body := make([]byte, header.RemainingLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, Properties{}, err
+	}
+	if len(body) < 2 {
+		return 0, 0, Properties{}, fmt.Errorf("invalid packet: missing packet identifier")
+	}
+	packetID = uint16(body[0])<<8 | uint16(body[1])
+
+	if version == Version5 && len(body) > 2 {
+		reasonCode = body[2]
+		if len(body) > 3 {
+			properties, _, err = DecodePropertiesAt(body, 3)
+			if err != nil {
+				return 0, 0, Properties{}, fmt.Errorf("invalid properties: %w", err)
+			}
+		}
+	}
+
+	return packetID, reasonCode, properties, nil
+}
+
+// hasAnyProperty reports whether p has at least one field set, i.e.
+// whether Pack would emit a non-empty Properties block.
+func hasAnyProperty(p *Properties) bool {
+	return p.PayloadFormatIndicator != nil || p.MessageExpiryInterval != nil || p.ContentType != "" ||
+		p.ResponseTopic != "" || p.CorrelationData != nil || p.SubscriptionIdentifier != nil ||
+		p.SessionExpiryInterval != nil || p.AssignedClientIdentifier != "" || p.ServerKeepAlive != nil ||
+		p.AuthenticationMethod != "" || p.AuthenticationData != nil || p.RequestProblemInformation != nil ||
+		p.WillDelayInterval != nil || p.RequestResponseInformation != nil || p.ResponseInformation != "" ||
+		p.ServerReference != "" || p.ReasonString != "" || p.ReceiveMaximum != nil || p.TopicAliasMaximum != nil ||
+		p.TopicAlias != nil || p.MaximumQoS != nil || p.RetainAvailable != nil || len(p.UserProperties) > 0 ||
+		p.MaximumPacketSize != nil || p.WildcardSubscriptionAvailable != nil || p.SubscriptionIDsAvailable != nil ||
+		p.SharedSubscriptionAvailable != nil
+}
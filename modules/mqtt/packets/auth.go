@@ -0,0 +1,52 @@
+package packets
+
+import "io"
+
+// Auth is the AUTH packet (section 3.15), introduced in MQTT v5 to
+// carry extended authentication exchanges (e.g. SCRAM) and
+// re-authentication, identified by the Authentication Method property.
+type Auth struct {
+	ReasonCode byte
+	Properties Properties
+}
+
+// Pack writes a to w as a complete AUTH packet.
+func (a *Auth) Pack(w io.Writer) error {
+	var variableHeader []byte
+	// Per MQTT-3.15.2.1, the Reason Code and Properties are omitted
+	// entirely when the Reason Code is 0x00 (Success) and there are no
+	// Properties to send.
+	if a.ReasonCode != 0x00 || hasAnyProperty(&a.Properties) {
+		variableHeader = append(variableHeader, a.ReasonCode)
+		variableHeader = append(variableHeader, a.Properties.Pack()...)
+	}
+
+	header := FixedHeader{Type: TypeAuth, RemainingLength: len(variableHeader)}
+	if err := header.Pack(w); err != nil {
+		return err
+	}
+	_, err := w.Write(variableHeader)
+	return err
+}
+
+// Unpack reads an AUTH packet's variable header from r, given its
+// already-read fixed header.
+func (a *Auth) Unpack(r io.Reader, header FixedHeader) error {
+	body := make([]byte, header.RemainingLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+
+	if len(body) > 0 {
+		a.ReasonCode = body[0]
+	}
+	if len(body) > 1 {
+		props, _, err := DecodePropertiesAt(body, 1)
+		if err != nil {
+			return err
+		}
+		a.Properties = props
+	}
+
+	return nil
+}
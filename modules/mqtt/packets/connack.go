@@ -0,0 +1,60 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// ConnAck is the CONNACK packet (section 3.2) a server sends in response
+// to CONNECT. ReasonCode is the v3.1.1 "Connect Return Code" or the v5
+// "Connect Reason Code" -- the two share 0x00 ("accepted"/"success") and
+// overlap on most non-zero values.
+type ConnAck struct {
+	Version        Version
+	SessionPresent bool
+	ReasonCode     byte
+	Properties     Properties // v5 only
+}
+
+// Pack writes c to w as a complete CONNACK packet.
+func (c *ConnAck) Pack(w io.Writer) error {
+	variableHeader := []byte{0x00, c.ReasonCode}
+	if c.SessionPresent {
+		variableHeader[0] = 0x01
+	}
+	if c.Version == Version5 {
+		variableHeader = append(variableHeader, c.Properties.Pack()...)
+	}
+
+	header := FixedHeader{Type: TypeConnAck, RemainingLength: len(variableHeader)}
+	if err := header.Pack(w); err != nil {
+		return err
+	}
+	_, err := w.Write(variableHeader)
+	return err
+}
+
+// Unpack reads a CONNACK packet's variable header from r, given its
+// already-read fixed header.
+func (c *ConnAck) Unpack(r io.Reader, header FixedHeader) error {
+	body := make([]byte, header.RemainingLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	if len(body) < 2 {
+		return fmt.Errorf("invalid CONNACK packet length")
+	}
+
+	c.SessionPresent = body[0]&0x01 == 0x01
+	c.ReasonCode = body[1]
+
+	if c.Version == Version5 && len(body) > 2 {
+		props, _, err := DecodePropertiesAt(body, 2)
+		if err != nil {
+			return fmt.Errorf("invalid CONNACK properties: %w", err)
+		}
+		c.Properties = props
+	}
+
+	return nil
+}
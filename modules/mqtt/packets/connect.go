@@ -0,0 +1,184 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// Connect is an MQTT CONNECT packet (section 3.1): the first packet a
+// client sends on a connection.
+type Connect struct {
+	Version    Version
+	CleanStart bool // Clean Start (v5) / Clean Session (v3.1/v3.1.1)
+	KeepAlive  uint16
+	Properties Properties // v5 only; the zero value sends no properties
+
+	ClientID string
+
+	// Will is set iff the client wants the server to publish a Last
+	// Will and Testament message on ungraceful disconnect.
+	Will           bool
+	WillProperties Properties // v5 only
+	WillTopic      string
+	WillPayload    []byte
+	WillQoS        byte
+	WillRetain     bool
+
+	Username string // only sent if non-empty
+	Password string // only sent if non-empty
+}
+
+// protocolName/protocolLevel return the variable header's Protocol Name
+// and Protocol Level fields (section 3.1.2.1-2) for c.Version.
+func (c *Connect) protocolName() string {
+	if c.Version == Version31 {
+		return "MQIsdp"
+	}
+	return "MQTT"
+}
+
+func (c *Connect) protocolLevel() byte {
+	return byte(c.Version)
+}
+
+// Pack writes c to w as a complete CONNECT packet, fixed header included.
+func (c *Connect) Pack(w io.Writer) error {
+	hasWill := c.Will
+	hasUsername := c.Username != ""
+	hasPassword := c.Password != ""
+
+	connectFlags := byte(0)
+	if c.CleanStart {
+		connectFlags |= 0x02
+	}
+	if hasWill {
+		connectFlags |= 0x04
+		connectFlags |= (c.WillQoS & 0x03) << 3
+		if c.WillRetain {
+			connectFlags |= 0x20
+		}
+	}
+	if hasUsername {
+		connectFlags |= 0x80
+	}
+	if hasPassword {
+		connectFlags |= 0x40
+	}
+
+	variableHeader := EncodeUTF8String(c.protocolName())
+	variableHeader = append(variableHeader, c.protocolLevel(), connectFlags, byte(c.KeepAlive>>8), byte(c.KeepAlive))
+	if c.Version == Version5 {
+		variableHeader = append(variableHeader, c.Properties.Pack()...)
+	}
+
+	payload := EncodeUTF8String(c.ClientID)
+	if hasWill {
+		if c.Version == Version5 {
+			payload = append(payload, c.WillProperties.Pack()...)
+		}
+		payload = append(payload, EncodeUTF8String(c.WillTopic)...)
+		payload = append(payload, EncodeBinary(c.WillPayload)...)
+	}
+	if hasUsername {
+		payload = append(payload, EncodeUTF8String(c.Username)...)
+	}
+	if hasPassword {
+		payload = append(payload, EncodeBinary([]byte(c.Password))...)
+	}
+
+	header := FixedHeader{Type: TypeConnect, RemainingLength: len(variableHeader) + len(payload)}
+	if err := header.Pack(w); err != nil {
+		return err
+	}
+	if _, err := w.Write(variableHeader); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// Unpack reads a CONNECT packet's variable header and payload from r,
+// given its already-read fixed header.
+func (c *Connect) Unpack(r io.Reader, header FixedHeader) error {
+	body := make([]byte, header.RemainingLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+
+	name, offset, err := DecodeUTF8String(body, 0)
+	if err != nil {
+		return fmt.Errorf("invalid CONNECT protocol name: %w", err)
+	}
+	if offset+2 > len(body) {
+		return fmt.Errorf("invalid CONNECT packet: too short")
+	}
+	level := body[offset]
+	connectFlags := body[offset+1]
+	offset += 2
+
+	if offset+2 > len(body) {
+		return fmt.Errorf("invalid CONNECT packet: missing keep alive")
+	}
+	c.KeepAlive = uint16(body[offset])<<8 | uint16(body[offset+1])
+	offset += 2
+
+	c.Version = Version(level)
+	if name == "MQIsdp" {
+		c.Version = Version31
+	}
+	c.CleanStart = connectFlags&0x02 != 0
+	c.Will = connectFlags&0x04 != 0
+	c.WillQoS = (connectFlags >> 3) & 0x03
+	c.WillRetain = connectFlags&0x20 != 0
+	hasUsername := connectFlags&0x80 != 0
+	hasPassword := connectFlags&0x40 != 0
+
+	if c.Version == Version5 {
+		props, next, err := DecodePropertiesAt(body, offset)
+		if err != nil {
+			return fmt.Errorf("invalid CONNECT properties: %w", err)
+		}
+		c.Properties = props
+		offset = next
+	}
+
+	c.ClientID, offset, err = DecodeUTF8String(body, offset)
+	if err != nil {
+		return fmt.Errorf("invalid CONNECT client identifier: %w", err)
+	}
+
+	if c.Will {
+		if c.Version == Version5 {
+			props, next, err := DecodePropertiesAt(body, offset)
+			if err != nil {
+				return fmt.Errorf("invalid CONNECT will properties: %w", err)
+			}
+			c.WillProperties = props
+			offset = next
+		}
+		c.WillTopic, offset, err = DecodeUTF8String(body, offset)
+		if err != nil {
+			return fmt.Errorf("invalid CONNECT will topic: %w", err)
+		}
+		c.WillPayload, offset, err = DecodeBinary(body, offset)
+		if err != nil {
+			return fmt.Errorf("invalid CONNECT will payload: %w", err)
+		}
+	}
+
+	if hasUsername {
+		c.Username, offset, err = DecodeUTF8String(body, offset)
+		if err != nil {
+			return fmt.Errorf("invalid CONNECT username: %w", err)
+		}
+	}
+	if hasPassword {
+		password, _, err := DecodeBinary(body, offset)
+		if err != nil {
+			return fmt.Errorf("invalid CONNECT password: %w", err)
+		}
+		c.Password = string(password)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package packets
+
+import "io"
+
+// Disconnect is the DISCONNECT packet (section 3.14). In v3.1.1 it is
+// client-to-server only and carries no variable header; v5 allows
+// either direction and adds a Reason Code and Properties.
+type Disconnect struct {
+	Version    Version
+	ReasonCode byte       // v5 only
+	Properties Properties // v5 only
+}
+
+// Pack writes d to w as a complete DISCONNECT packet.
+func (d *Disconnect) Pack(w io.Writer) error {
+	var variableHeader []byte
+	// Per MQTT-3.14.2.1, the Reason Code and Properties are omitted
+	// entirely when the Reason Code is 0x00 (Normal disconnection) and
+	// there are no Properties to send.
+	if d.Version == Version5 && (d.ReasonCode != 0x00 || hasAnyProperty(&d.Properties)) {
+		variableHeader = append(variableHeader, d.ReasonCode)
+		variableHeader = append(variableHeader, d.Properties.Pack()...)
+	}
+
+	header := FixedHeader{Type: TypeDisconnect, RemainingLength: len(variableHeader)}
+	if err := header.Pack(w); err != nil {
+		return err
+	}
+	_, err := w.Write(variableHeader)
+	return err
+}
+
+// Unpack reads a DISCONNECT packet's variable header from r, given its
+// already-read fixed header.
+func (d *Disconnect) Unpack(r io.Reader, header FixedHeader) error {
+	body := make([]byte, header.RemainingLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+
+	if len(body) > 0 {
+		d.ReasonCode = body[0]
+	}
+	if len(body) > 1 {
+		props, _, err := DecodePropertiesAt(body, 1)
+		if err != nil {
+			return err
+		}
+		d.Properties = props
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+// Package packets implements the wire encoding of the MQTT control
+// packets (MQTT v3.1, v3.1.1, and v5.0), independent of net.Conn or any
+// zgrab2 scanner state. It exists so that scanner.go -- and any future
+// MQTT probe -- can Pack/Unpack packets without hand-rolling byte
+// layout in the scanner itself.
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Version identifies the MQTT protocol level/version carried in a
+// CONNECT packet's variable header.
+type Version byte
+
+// The MQTT protocol versions this package understands.
+const (
+	Version31  Version = 3 // MQTT 3.1 ("MQIsdp")
+	Version311 Version = 4 // MQTT 3.1.1
+	Version5   Version = 5 // MQTT 5.0
+)
+
+// PacketType identifies an MQTT control packet type, carried in the top
+// nibble of the fixed header's first byte (section 2.1.2).
+type PacketType byte
+
+// The 15 MQTT control packet types. Named Type* to avoid colliding with
+// the identically-named packet struct in each packet type's own file
+// (e.g. TypePublish the PacketType vs. Publish the struct).
+const (
+	TypeConnect     PacketType = 1
+	TypeConnAck     PacketType = 2
+	TypePublish     PacketType = 3
+	TypePubAck      PacketType = 4
+	TypePubRec      PacketType = 5
+	TypePubRel      PacketType = 6
+	TypePubComp     PacketType = 7
+	TypeSubscribe   PacketType = 8
+	TypeSubAck      PacketType = 9
+	TypeUnsubscribe PacketType = 10
+	TypeUnsubAck    PacketType = 11
+	TypePingReq     PacketType = 12
+	TypePingResp    PacketType = 13
+	TypeDisconnect  PacketType = 14
+	TypeAuth        PacketType = 15
+)
+
+// FixedHeader is the first part of every MQTT control packet (section
+// 2.1): a packet type and flags nibble, followed by the Remaining
+// Length of everything after it.
+type FixedHeader struct {
+	Type            PacketType
+	Flags           byte
+	RemainingLength int
+}
+
+// Pack writes the fixed header to w: one byte of type<<4|flags,
+// followed by RemainingLength encoded as a variable byte integer.
+func (h FixedHeader) Pack(w io.Writer) error {
+	if _, err := w.Write([]byte{byte(h.Type)<<4 | (h.Flags & 0x0F)}); err != nil {
+		return err
+	}
+	_, err := w.Write(EncodeVarByteInt(h.RemainingLength))
+	return err
+}
+
+// DecodeFixedHeader reads a fixed header from r. Unlike reading the
+// remaining length as raw bytes and reinterpreting them with
+// encoding/binary's LEB128 Uvarint, this decodes the variable byte
+// integer per section 1.5.5 directly: each byte contributes 7 bits,
+// least significant group first, with the continuation bit (0x80)
+// cleared in the final byte, and at most 4 bytes / 268,435,455.
+func DecodeFixedHeader(r io.Reader) (FixedHeader, error) {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		return FixedHeader{}, err
+	}
+
+	length, err := DecodeVarByteInt(r)
+	if err != nil {
+		return FixedHeader{}, err
+	}
+
+	return FixedHeader{
+		Type:            PacketType(first[0] >> 4),
+		Flags:           first[0] & 0x0F,
+		RemainingLength: length,
+	}, nil
+}
+
+// EncodeVarByteInt encodes length as an MQTT variable byte integer
+// (section 1.5.5): seven bits per byte, least significant group first,
+// with the top bit of each byte set if another byte follows.
+func EncodeVarByteInt(length int) []byte {
+	var out []byte
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if length == 0 {
+			return out
+		}
+	}
+}
+
+// DecodeVarByteInt reads an MQTT variable byte integer from r: each
+// byte's low 7 bits are added in, weighted by an increasing power of
+// 128, until a byte with the continuation bit (0x80) clear is read. A
+// fifth continuation byte is malformed, since the spec caps the encoded
+// value at 4 bytes (268,435,455).
+func DecodeVarByteInt(r io.Reader) (int, error) {
+	value := 0
+	multiplier := 1
+	b := make([]byte, 1)
+	for i := 0; i < 4; i++ {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, err
+		}
+		value += int(b[0]&0x7F) * multiplier
+		if b[0]&0x80 == 0 {
+			return value, nil
+		}
+		multiplier *= 128
+	}
+	return 0, fmt.Errorf("malformed variable byte integer: more than 4 continuation bytes")
+}
+
+// EncodeUTF8String encodes s as an MQTT UTF-8 Encoded String (section
+// 1.5.4): a 2-byte big-endian length prefix followed by its bytes.
+func EncodeUTF8String(s string) []byte {
+	return EncodeBinary([]byte(s))
+}
+
+// EncodeBinary encodes b as MQTT Binary Data (section 1.5.6): a 2-byte
+// big-endian length prefix followed by the raw bytes. UTF-8 strings use
+// the same framing (section 1.5.4).
+func EncodeBinary(b []byte) []byte {
+	out := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(out, uint16(len(b)))
+	return append(out, b...)
+}
+
+// DecodeUTF8String reads an MQTT UTF-8 Encoded String from data at
+// offset, returning the string and the offset following it. Per
+// MQTT-3.1.3-4, a Client Identifier (and UTF-8 strings generally) must
+// not be truncated by a length prefix that overruns data.
+func DecodeUTF8String(data []byte, offset int) (string, int, error) {
+	b, next, err := DecodeBinary(data, offset)
+	if err != nil {
+		return "", 0, err
+	}
+	return string(b), next, nil
+}
+
+// DecodeBinary reads MQTT Binary Data from data at offset, returning the
+// bytes (a copy, safe to retain) and the offset following it.
+func DecodeBinary(data []byte, offset int) ([]byte, int, error) {
+	if offset+2 > len(data) {
+		return nil, 0, fmt.Errorf("unexpected end of packet reading length prefix")
+	}
+	length := int(binary.BigEndian.Uint16(data[offset : offset+2]))
+	offset += 2
+	if offset+length > len(data) {
+		return nil, 0, fmt.Errorf("unexpected end of packet reading %d bytes", length)
+	}
+	b := append([]byte(nil), data[offset:offset+length]...)
+	return b, offset + length, nil
+}
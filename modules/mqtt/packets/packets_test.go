@@ -0,0 +1,123 @@
+package packets
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVarByteIntRoundTrip(t *testing.T) {
+	for _, length := range []int{0, 1, 127, 128, 16383, 16384, 2097151, 2097152, 268435455} {
+		encoded := EncodeVarByteInt(length)
+		got, err := DecodeVarByteInt(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("DecodeVarByteInt(%d): %v", length, err)
+		}
+		if got != length {
+			t.Fatalf("DecodeVarByteInt(EncodeVarByteInt(%d)) = %d", length, got)
+		}
+	}
+}
+
+func TestDecodeVarByteIntTooLong(t *testing.T) {
+	// Five continuation bytes is malformed: the spec caps the encoding at 4.
+	malformed := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x01}
+	if _, err := DecodeVarByteInt(bytes.NewReader(malformed)); err == nil {
+		t.Fatal("expected an error decoding a 5-byte variable byte integer, got nil")
+	}
+}
+
+func TestFixedHeaderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	want := FixedHeader{Type: TypePublish, Flags: 0x0B, RemainingLength: 321}
+	if err := want.Pack(&buf); err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	got, err := DecodeFixedHeader(&buf)
+	if err != nil {
+		t.Fatalf("DecodeFixedHeader: %v", err)
+	}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestUTF8StringRoundTrip(t *testing.T) {
+	encoded := EncodeUTF8String("hello mqtt")
+	got, next, err := DecodeUTF8String(encoded, 0)
+	if err != nil {
+		t.Fatalf("DecodeUTF8String: %v", err)
+	}
+	if got != "hello mqtt" || next != len(encoded) {
+		t.Fatalf("got %q, %d; want %q, %d", got, next, "hello mqtt", len(encoded))
+	}
+}
+
+func TestDecodeBinaryTruncated(t *testing.T) {
+	// A length prefix claiming more bytes than are actually present must
+	// error instead of slicing out of bounds.
+	data := []byte{0x00, 0x05, 'h', 'i'}
+	if _, _, err := DecodeBinary(data, 0); err == nil {
+		t.Fatal("expected an error decoding a truncated binary field, got nil")
+	}
+}
+
+func TestConnectRoundTrip(t *testing.T) {
+	want := Connect{
+		Version:    Version311,
+		CleanStart: true,
+		KeepAlive:  60,
+		ClientID:   "zgrab2-scan",
+		Username:   "user",
+		Password:   "pass",
+	}
+
+	var buf bytes.Buffer
+	if err := want.Pack(&buf); err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+
+	header, err := DecodeFixedHeader(&buf)
+	if err != nil {
+		t.Fatalf("DecodeFixedHeader: %v", err)
+	}
+	if header.Type != TypeConnect {
+		t.Fatalf("got packet type %v, want TypeConnect", header.Type)
+	}
+
+	var got Connect
+	if err := got.Unpack(&buf, header); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if got.ClientID != want.ClientID || got.KeepAlive != want.KeepAlive ||
+		got.CleanStart != want.CleanStart || got.Username != want.Username || got.Password != want.Password {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPublishRoundTrip(t *testing.T) {
+	want := Publish{
+		Version:  Version311,
+		QoS:      1,
+		Topic:    "sensors/temp",
+		PacketID: 42,
+		Payload:  []byte("21.5"),
+	}
+
+	var buf bytes.Buffer
+	if err := want.Pack(&buf); err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+
+	header, err := DecodeFixedHeader(&buf)
+	if err != nil {
+		t.Fatalf("DecodeFixedHeader: %v", err)
+	}
+
+	got := Publish{Version: Version311}
+	if err := got.Unpack(&buf, header); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if got.Topic != want.Topic || got.PacketID != want.PacketID || !bytes.Equal(got.Payload, want.Payload) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
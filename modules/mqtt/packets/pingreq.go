@@ -0,0 +1,20 @@
+package packets
+
+import "io"
+
+// PingReq is the PINGREQ packet (section 3.12): a keep-alive probe sent
+// by the client. It has no variable header or payload.
+type PingReq struct{}
+
+// Pack writes the fixed PINGREQ packet (0xC0, 0x00) to w.
+func (PingReq) Pack(w io.Writer) error {
+	_, err := w.Write([]byte{0xC0, 0x00})
+	return err
+}
+
+// Unpack consumes PINGREQ's (empty) variable header and payload from r,
+// given its already-read fixed header.
+func (PingReq) Unpack(r io.Reader, header FixedHeader) error {
+	_, err := io.CopyN(io.Discard, r, int64(header.RemainingLength))
+	return err
+}
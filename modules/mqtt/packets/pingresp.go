@@ -0,0 +1,20 @@
+package packets
+
+import "io"
+
+// PingResp is the PINGRESP packet (section 3.13): the server's reply to
+// PINGREQ. It has no variable header or payload.
+type PingResp struct{}
+
+// Pack writes the fixed PINGRESP packet (0xD0, 0x00) to w.
+func (PingResp) Pack(w io.Writer) error {
+	_, err := w.Write([]byte{0xD0, 0x00})
+	return err
+}
+
+// Unpack consumes PINGRESP's (empty) variable header and payload from r,
+// given its already-read fixed header.
+func (PingResp) Unpack(r io.Reader, header FixedHeader) error {
+	_, err := io.CopyN(io.Discard, r, int64(header.RemainingLength))
+	return err
+}
@@ -0,0 +1,451 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Property identifiers (section 2.2.2.2), shared across every MQTT v5
+// packet that carries a Properties block.
+const (
+	PayloadFormatIndicator        byte = 0x01
+	MessageExpiryInterval         byte = 0x02
+	ContentType                   byte = 0x03
+	ResponseTopic                 byte = 0x08
+	CorrelationData               byte = 0x09
+	SubscriptionIdentifier        byte = 0x0B
+	SessionExpiryInterval         byte = 0x11
+	AssignedClientIdentifier      byte = 0x12
+	ServerKeepAlive               byte = 0x13
+	AuthenticationMethod          byte = 0x15
+	AuthenticationData            byte = 0x16
+	RequestProblemInformation     byte = 0x17
+	WillDelayInterval             byte = 0x18
+	RequestResponseInformation    byte = 0x19
+	ResponseInformation           byte = 0x1A
+	ServerReference               byte = 0x1C
+	ReasonString                  byte = 0x1F
+	ReceiveMaximum                byte = 0x21
+	TopicAliasMaximum             byte = 0x22
+	TopicAlias                    byte = 0x23
+	MaximumQoS                    byte = 0x24
+	RetainAvailable               byte = 0x25
+	UserProperty                  byte = 0x26
+	MaximumPacketSize             byte = 0x27
+	WildcardSubscriptionAvailable byte = 0x28
+	SubscriptionIDsAvailable      byte = 0x29
+	SharedSubscriptionAvailable   byte = 0x2A
+)
+
+// Properties is a decoded (or to-be-encoded) MQTT v5 Properties block
+// (section 2.2.2), keyed by property identifier. Only the fields a
+// packet actually set are non-nil/non-empty; Pack emits exactly those.
+type Properties struct {
+	PayloadFormatIndicator *byte
+	MessageExpiryInterval  *uint32
+	ContentType            string
+	ResponseTopic          string
+	CorrelationData        []byte
+	SubscriptionIdentifier *int
+
+	SessionExpiryInterval    *uint32
+	AssignedClientIdentifier string
+	ServerKeepAlive          *uint16
+	AuthenticationMethod     string
+	AuthenticationData       []byte
+
+	RequestProblemInformation  *byte
+	WillDelayInterval          *uint32
+	RequestResponseInformation *byte
+	ResponseInformation        string
+	ServerReference            string
+	ReasonString               string
+
+	ReceiveMaximum    *uint16
+	TopicAliasMaximum *uint16
+	TopicAlias        *uint16
+	MaximumQoS        *byte
+	RetainAvailable   *bool
+
+	// UserProperties holds every User Property (0x26), keyed by name;
+	// MQTT allows the same name to appear more than once.
+	UserProperties map[string][]string
+
+	MaximumPacketSize             *uint32
+	WildcardSubscriptionAvailable *bool
+	SubscriptionIDsAvailable      *bool
+	SharedSubscriptionAvailable   *bool
+}
+
+// Pack encodes p as a Properties block, including its own Property
+// Length prefix (a variable byte integer) per section 2.2.2.1.
+func (p *Properties) Pack() []byte {
+	var body []byte
+	putByte := func(id byte, v *byte) {
+		if v != nil {
+			body = append(body, id, *v)
+		}
+	}
+	putBool := func(id byte, v *bool) {
+		if v != nil {
+			b := byte(0)
+			if *v {
+				b = 1
+			}
+			body = append(body, id, b)
+		}
+	}
+	putUint16 := func(id byte, v *uint16) {
+		if v != nil {
+			buf := make([]byte, 2)
+			binary.BigEndian.PutUint16(buf, *v)
+			body = append(append(body, id), buf...)
+		}
+	}
+	putUint32 := func(id byte, v *uint32) {
+		if v != nil {
+			buf := make([]byte, 4)
+			binary.BigEndian.PutUint32(buf, *v)
+			body = append(append(body, id), buf...)
+		}
+	}
+	putString := func(id byte, v string) {
+		if v != "" {
+			body = append(append(body, id), EncodeUTF8String(v)...)
+		}
+	}
+	putBinary := func(id byte, v []byte) {
+		if v != nil {
+			body = append(append(body, id), EncodeBinary(v)...)
+		}
+	}
+	putVarInt := func(id byte, v *int) {
+		if v != nil {
+			body = append(append(body, id), EncodeVarByteInt(*v)...)
+		}
+	}
+
+	putByte(PayloadFormatIndicator, p.PayloadFormatIndicator)
+	putUint32(MessageExpiryInterval, p.MessageExpiryInterval)
+	putString(ContentType, p.ContentType)
+	putString(ResponseTopic, p.ResponseTopic)
+	putBinary(CorrelationData, p.CorrelationData)
+	putVarInt(SubscriptionIdentifier, p.SubscriptionIdentifier)
+	putUint32(SessionExpiryInterval, p.SessionExpiryInterval)
+	putString(AssignedClientIdentifier, p.AssignedClientIdentifier)
+	putUint16(ServerKeepAlive, p.ServerKeepAlive)
+	putString(AuthenticationMethod, p.AuthenticationMethod)
+	putBinary(AuthenticationData, p.AuthenticationData)
+	putByte(RequestProblemInformation, p.RequestProblemInformation)
+	putUint32(WillDelayInterval, p.WillDelayInterval)
+	putByte(RequestResponseInformation, p.RequestResponseInformation)
+	putString(ResponseInformation, p.ResponseInformation)
+	putString(ServerReference, p.ServerReference)
+	putString(ReasonString, p.ReasonString)
+	putUint16(ReceiveMaximum, p.ReceiveMaximum)
+	putUint16(TopicAliasMaximum, p.TopicAliasMaximum)
+	putUint16(TopicAlias, p.TopicAlias)
+	putByte(MaximumQoS, p.MaximumQoS)
+	putBool(RetainAvailable, p.RetainAvailable)
+	for key, values := range p.UserProperties {
+		for _, value := range values {
+			body = append(body, UserProperty)
+			body = append(body, EncodeUTF8String(key)...)
+			body = append(body, EncodeUTF8String(value)...)
+		}
+	}
+	putUint32(MaximumPacketSize, p.MaximumPacketSize)
+	putBool(WildcardSubscriptionAvailable, p.WildcardSubscriptionAvailable)
+	putBool(SubscriptionIDsAvailable, p.SubscriptionIDsAvailable)
+	putBool(SharedSubscriptionAvailable, p.SharedSubscriptionAvailable)
+
+	return append(EncodeVarByteInt(len(body)), body...)
+}
+
+// DecodeProperties walks an MQTT v5 Properties block's body (the bytes
+// following the Property Length, up to but not including its end) and
+// returns the decoded Properties. Property identifiers not listed here
+// are rejected, since their wire length can't be determined without
+// knowing their type.
+func DecodeProperties(data []byte) (Properties, error) {
+	var p Properties
+	offset := 0
+
+	readByte := func() (byte, error) {
+		if offset >= len(data) {
+			return 0, fmt.Errorf("unexpected end of properties")
+		}
+		b := data[offset]
+		offset++
+		return b, nil
+	}
+	readUint16 := func() (uint16, error) {
+		if offset+2 > len(data) {
+			return 0, fmt.Errorf("unexpected end of properties")
+		}
+		v := binary.BigEndian.Uint16(data[offset : offset+2])
+		offset += 2
+		return v, nil
+	}
+	readUint32 := func() (uint32, error) {
+		if offset+4 > len(data) {
+			return 0, fmt.Errorf("unexpected end of properties")
+		}
+		v := binary.BigEndian.Uint32(data[offset : offset+4])
+		offset += 4
+		return v, nil
+	}
+	readUTF8 := func() (string, error) {
+		s, next, err := DecodeUTF8String(data, offset)
+		if err != nil {
+			return "", err
+		}
+		offset = next
+		return s, nil
+	}
+	readBinary := func() ([]byte, error) {
+		b, next, err := DecodeBinary(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next
+		return b, nil
+	}
+
+	for offset < len(data) {
+		identifier, err := readByte()
+		if err != nil {
+			return Properties{}, err
+		}
+
+		switch identifier {
+		case PayloadFormatIndicator:
+			v, err := readByte()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.PayloadFormatIndicator = &v
+		case MessageExpiryInterval:
+			v, err := readUint32()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.MessageExpiryInterval = &v
+		case ContentType:
+			v, err := readUTF8()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.ContentType = v
+		case ResponseTopic:
+			v, err := readUTF8()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.ResponseTopic = v
+		case CorrelationData:
+			v, err := readBinary()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.CorrelationData = v
+		case SubscriptionIdentifier:
+			v, err := decodeVarByteIntFromSlice(data, &offset)
+			if err != nil {
+				return Properties{}, err
+			}
+			p.SubscriptionIdentifier = &v
+		case SessionExpiryInterval:
+			v, err := readUint32()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.SessionExpiryInterval = &v
+		case AssignedClientIdentifier:
+			v, err := readUTF8()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.AssignedClientIdentifier = v
+		case ServerKeepAlive:
+			v, err := readUint16()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.ServerKeepAlive = &v
+		case AuthenticationMethod:
+			v, err := readUTF8()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.AuthenticationMethod = v
+		case AuthenticationData:
+			v, err := readBinary()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.AuthenticationData = v
+		case RequestProblemInformation:
+			v, err := readByte()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.RequestProblemInformation = &v
+		case WillDelayInterval:
+			v, err := readUint32()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.WillDelayInterval = &v
+		case RequestResponseInformation:
+			v, err := readByte()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.RequestResponseInformation = &v
+		case ResponseInformation:
+			v, err := readUTF8()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.ResponseInformation = v
+		case ServerReference:
+			v, err := readUTF8()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.ServerReference = v
+		case ReasonString:
+			v, err := readUTF8()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.ReasonString = v
+		case ReceiveMaximum:
+			v, err := readUint16()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.ReceiveMaximum = &v
+		case TopicAliasMaximum:
+			v, err := readUint16()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.TopicAliasMaximum = &v
+		case TopicAlias:
+			v, err := readUint16()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.TopicAlias = &v
+		case MaximumQoS:
+			v, err := readByte()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.MaximumQoS = &v
+		case RetainAvailable:
+			v, err := readByte()
+			if err != nil {
+				return Properties{}, err
+			}
+			b := v != 0
+			p.RetainAvailable = &b
+		case UserProperty:
+			key, err := readUTF8()
+			if err != nil {
+				return Properties{}, err
+			}
+			value, err := readUTF8()
+			if err != nil {
+				return Properties{}, err
+			}
+			if p.UserProperties == nil {
+				p.UserProperties = make(map[string][]string)
+			}
+			p.UserProperties[key] = append(p.UserProperties[key], value)
+		case MaximumPacketSize:
+			v, err := readUint32()
+			if err != nil {
+				return Properties{}, err
+			}
+			p.MaximumPacketSize = &v
+		case WildcardSubscriptionAvailable:
+			v, err := readByte()
+			if err != nil {
+				return Properties{}, err
+			}
+			b := v != 0
+			p.WildcardSubscriptionAvailable = &b
+		case SubscriptionIDsAvailable:
+			v, err := readByte()
+			if err != nil {
+				return Properties{}, err
+			}
+			b := v != 0
+			p.SubscriptionIDsAvailable = &b
+		case SharedSubscriptionAvailable:
+			v, err := readByte()
+			if err != nil {
+				return Properties{}, err
+			}
+			b := v != 0
+			p.SharedSubscriptionAvailable = &b
+		default:
+			return Properties{}, fmt.Errorf("unrecognized property identifier 0x%02X", identifier)
+		}
+	}
+
+	return p, nil
+}
+
+// DecodePropertiesAt reads a Properties block out of data starting at
+// offset (which must point at the Property Length, not its body),
+// returning the decoded Properties and the offset following the block.
+func DecodePropertiesAt(data []byte, offset int) (Properties, int, error) {
+	length, next, err := decodeVarByteIntAt(data, offset)
+	if err != nil {
+		return Properties{}, 0, err
+	}
+	if next+length > len(data) {
+		return Properties{}, 0, fmt.Errorf("invalid properties length")
+	}
+	p, err := DecodeProperties(data[next : next+length])
+	if err != nil {
+		return Properties{}, 0, err
+	}
+	return p, next + length, nil
+}
+
+// decodeVarByteIntAt decodes a variable byte integer out of data
+// starting at offset, returning the value and the offset following it.
+func decodeVarByteIntAt(data []byte, offset int) (int, int, error) {
+	value, err := decodeVarByteIntFromSlice(data, &offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	return value, offset, nil
+}
+
+// decodeVarByteIntFromSlice decodes a variable byte integer out of data
+// starting at *offset, advancing *offset past it. Used for properties
+// (e.g. Subscription Identifier) whose value is itself a VBI rather
+// than a fixed-width integer.
+func decodeVarByteIntFromSlice(data []byte, offset *int) (int, error) {
+	value := 0
+	multiplier := 1
+	for i := 0; i < 4; i++ {
+		if *offset >= len(data) {
+			return 0, fmt.Errorf("unexpected end of properties")
+		}
+		b := data[*offset]
+		*offset++
+		value += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			return value, nil
+		}
+		multiplier *= 128
+	}
+	return 0, fmt.Errorf("malformed variable byte integer property")
+}
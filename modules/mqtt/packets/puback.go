@@ -0,0 +1,27 @@
+package packets
+
+import "io"
+
+// PubAck is the PUBACK packet (section 3.4): the response to a QoS 1 PUBLISH.
+type PubAck struct {
+	Version    Version
+	PacketID   uint16
+	ReasonCode byte       // v5 only
+	Properties Properties // v5 only
+}
+
+// Pack writes a to w as a complete PUBACK packet.
+func (a *PubAck) Pack(w io.Writer) error {
+	return packAck(w, TypePubAck, 0, a.Version, a.PacketID, a.ReasonCode, a.Properties)
+}
+
+// Unpack reads a PUBACK packet's variable header from r, given its
+// already-read fixed header.
+func (a *PubAck) Unpack(r io.Reader, header FixedHeader) error {
+	packetID, reasonCode, properties, err := unpackAck(r, header, a.Version)
+	if err != nil {
+		return err
+	}
+	a.PacketID, a.ReasonCode, a.Properties = packetID, reasonCode, properties
+	return nil
+}
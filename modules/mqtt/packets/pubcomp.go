@@ -0,0 +1,28 @@
+package packets
+
+import "io"
+
+// PubComp is the PUBCOMP packet (section 3.7): the final packet of the
+// QoS 2 flow.
+type PubComp struct {
+	Version    Version
+	PacketID   uint16
+	ReasonCode byte       // v5 only
+	Properties Properties // v5 only
+}
+
+// Pack writes p to w as a complete PUBCOMP packet.
+func (p *PubComp) Pack(w io.Writer) error {
+	return packAck(w, TypePubComp, 0, p.Version, p.PacketID, p.ReasonCode, p.Properties)
+}
+
+// Unpack reads a PUBCOMP packet's variable header from r, given its
+// already-read fixed header.
+func (p *PubComp) Unpack(r io.Reader, header FixedHeader) error {
+	packetID, reasonCode, properties, err := unpackAck(r, header, p.Version)
+	if err != nil {
+		return err
+	}
+	p.PacketID, p.ReasonCode, p.Properties = packetID, reasonCode, properties
+	return nil
+}
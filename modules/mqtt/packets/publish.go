@@ -0,0 +1,88 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// Publish is the PUBLISH packet (section 3.3), carrying application
+// data from/to a topic.
+type Publish struct {
+	Version    Version
+	Dup        bool
+	QoS        byte
+	Retain     bool
+	Topic      string
+	PacketID   uint16     // only present/meaningful when QoS > 0
+	Properties Properties // v5 only
+	Payload    []byte
+}
+
+// Pack writes p to w as a complete PUBLISH packet.
+func (p *Publish) Pack(w io.Writer) error {
+	flags := byte(0)
+	if p.Dup {
+		flags |= 0x08
+	}
+	flags |= (p.QoS & 0x03) << 1
+	if p.Retain {
+		flags |= 0x01
+	}
+
+	variableHeader := EncodeUTF8String(p.Topic)
+	if p.QoS > 0 {
+		variableHeader = append(variableHeader, byte(p.PacketID>>8), byte(p.PacketID))
+	}
+	if p.Version == Version5 {
+		variableHeader = append(variableHeader, p.Properties.Pack()...)
+	}
+
+	header := FixedHeader{Type: TypePublish, Flags: flags, RemainingLength: len(variableHeader) + len(p.Payload)}
+	if err := header.Pack(w); err != nil {
+		return err
+	}
+	if _, err := w.Write(variableHeader); err != nil {
+		return err
+	}
+	_, err := w.Write(p.Payload)
+	return err
+}
+
+// Unpack reads a PUBLISH packet's variable header and payload from r,
+// given its already-read fixed header.
+func (p *Publish) Unpack(r io.Reader, header FixedHeader) error {
+	body := make([]byte, header.RemainingLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+
+	p.Dup = header.Flags&0x08 != 0
+	p.QoS = (header.Flags >> 1) & 0x03
+	p.Retain = header.Flags&0x01 != 0
+
+	topic, offset, err := DecodeUTF8String(body, 0)
+	if err != nil {
+		return fmt.Errorf("invalid PUBLISH topic: %w", err)
+	}
+	p.Topic = topic
+
+	if p.QoS > 0 {
+		if offset+2 > len(body) {
+			return fmt.Errorf("invalid PUBLISH packet identifier")
+		}
+		p.PacketID = uint16(body[offset])<<8 | uint16(body[offset+1])
+		offset += 2
+	}
+
+	if p.Version == Version5 {
+		props, next, err := DecodePropertiesAt(body, offset)
+		if err != nil {
+			return fmt.Errorf("invalid PUBLISH properties: %w", err)
+		}
+		p.Properties = props
+		offset = next
+	}
+
+	p.Payload = body[offset:]
+	return nil
+}
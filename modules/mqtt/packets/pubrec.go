@@ -0,0 +1,28 @@
+package packets
+
+import "io"
+
+// PubRec is the PUBREC packet (section 3.5): the first response to a
+// QoS 2 PUBLISH.
+type PubRec struct {
+	Version    Version
+	PacketID   uint16
+	ReasonCode byte       // v5 only
+	Properties Properties // v5 only
+}
+
+// Pack writes p to w as a complete PUBREC packet.
+func (p *PubRec) Pack(w io.Writer) error {
+	return packAck(w, TypePubRec, 0, p.Version, p.PacketID, p.ReasonCode, p.Properties)
+}
+
+// Unpack reads a PUBREC packet's variable header from r, given its
+// already-read fixed header.
+func (p *PubRec) Unpack(r io.Reader, header FixedHeader) error {
+	packetID, reasonCode, properties, err := unpackAck(r, header, p.Version)
+	if err != nil {
+		return err
+	}
+	p.PacketID, p.ReasonCode, p.Properties = packetID, reasonCode, properties
+	return nil
+}
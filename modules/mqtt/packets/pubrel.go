@@ -0,0 +1,29 @@
+package packets
+
+import "io"
+
+// PubRel is the PUBREL packet (section 3.6): the response to PUBREC in
+// the QoS 2 flow. Its fixed header reserves flags 0b0010 (section
+// 3.6.1).
+type PubRel struct {
+	Version    Version
+	PacketID   uint16
+	ReasonCode byte       // v5 only
+	Properties Properties // v5 only
+}
+
+// Pack writes p to w as a complete PUBREL packet.
+func (p *PubRel) Pack(w io.Writer) error {
+	return packAck(w, TypePubRel, 0x02, p.Version, p.PacketID, p.ReasonCode, p.Properties)
+}
+
+// Unpack reads a PUBREL packet's variable header from r, given its
+// already-read fixed header.
+func (p *PubRel) Unpack(r io.Reader, header FixedHeader) error {
+	packetID, reasonCode, properties, err := unpackAck(r, header, p.Version)
+	if err != nil {
+		return err
+	}
+	p.PacketID, p.ReasonCode, p.Properties = packetID, reasonCode, properties
+	return nil
+}
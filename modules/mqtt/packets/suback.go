@@ -0,0 +1,61 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// SubAck is the SUBACK packet (section 3.9): the server's response to
+// SUBSCRIBE, carrying one reason/return code per topic filter requested,
+// in the same order. A code of 0x80 or above means the subscription
+// failed.
+type SubAck struct {
+	Version     Version
+	PacketID    uint16
+	Properties  Properties // v5 only
+	ReasonCodes []byte
+}
+
+// Pack writes s to w as a complete SUBACK packet.
+func (s *SubAck) Pack(w io.Writer) error {
+	variableHeader := []byte{byte(s.PacketID >> 8), byte(s.PacketID)}
+	if s.Version == Version5 {
+		variableHeader = append(variableHeader, s.Properties.Pack()...)
+	}
+
+	header := FixedHeader{Type: TypeSubAck, RemainingLength: len(variableHeader) + len(s.ReasonCodes)}
+	if err := header.Pack(w); err != nil {
+		return err
+	}
+	if _, err := w.Write(variableHeader); err != nil {
+		return err
+	}
+	_, err := w.Write(s.ReasonCodes)
+	return err
+}
+
+// Unpack reads a SUBACK packet's variable header and payload from r,
+// given its already-read fixed header.
+func (s *SubAck) Unpack(r io.Reader, header FixedHeader) error {
+	body := make([]byte, header.RemainingLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	if len(body) < 2 {
+		return fmt.Errorf("invalid SUBACK packet: missing packet identifier")
+	}
+	s.PacketID = uint16(body[0])<<8 | uint16(body[1])
+	offset := 2
+
+	if s.Version == Version5 {
+		props, next, err := DecodePropertiesAt(body, offset)
+		if err != nil {
+			return fmt.Errorf("invalid SUBACK properties: %w", err)
+		}
+		s.Properties = props
+		offset = next
+	}
+
+	s.ReasonCodes = append([]byte(nil), body[offset:]...)
+	return nil
+}
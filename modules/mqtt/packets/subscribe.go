@@ -0,0 +1,110 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// Subscription is one topic filter/options pair within a SUBSCRIBE
+// packet's payload (section 3.8.3).
+type Subscription struct {
+	Topic string
+	QoS   byte
+
+	// The following subscription options are v5 only.
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte // 0-2
+}
+
+func (s Subscription) optionsByte() byte {
+	b := s.QoS & 0x03
+	if s.NoLocal {
+		b |= 0x04
+	}
+	if s.RetainAsPublished {
+		b |= 0x08
+	}
+	b |= (s.RetainHandling & 0x03) << 4
+	return b
+}
+
+// Subscribe is the SUBSCRIBE packet (section 3.8): a client's request to
+// receive PUBLISH packets for one or more topic filters. Its fixed
+// header reserves flags 0b0010 (section 3.8.1).
+type Subscribe struct {
+	Version       Version
+	PacketID      uint16
+	Properties    Properties // v5 only
+	Subscriptions []Subscription
+}
+
+// Pack writes s to w as a complete SUBSCRIBE packet.
+func (s *Subscribe) Pack(w io.Writer) error {
+	variableHeader := []byte{byte(s.PacketID >> 8), byte(s.PacketID)}
+	if s.Version == Version5 {
+		variableHeader = append(variableHeader, s.Properties.Pack()...)
+	}
+
+	var payload []byte
+	for _, sub := range s.Subscriptions {
+		payload = append(payload, EncodeUTF8String(sub.Topic)...)
+		payload = append(payload, sub.optionsByte())
+	}
+
+	header := FixedHeader{Type: TypeSubscribe, Flags: 0x02, RemainingLength: len(variableHeader) + len(payload)}
+	if err := header.Pack(w); err != nil {
+		return err
+	}
+	if _, err := w.Write(variableHeader); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// Unpack reads a SUBSCRIBE packet's variable header and payload from r,
+// given its already-read fixed header.
+func (s *Subscribe) Unpack(r io.Reader, header FixedHeader) error {
+	body := make([]byte, header.RemainingLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	if len(body) < 2 {
+		return fmt.Errorf("invalid SUBSCRIBE packet: missing packet identifier")
+	}
+	s.PacketID = uint16(body[0])<<8 | uint16(body[1])
+	offset := 2
+
+	if s.Version == Version5 {
+		props, next, err := DecodePropertiesAt(body, offset)
+		if err != nil {
+			return fmt.Errorf("invalid SUBSCRIBE properties: %w", err)
+		}
+		s.Properties = props
+		offset = next
+	}
+
+	s.Subscriptions = nil
+	for offset < len(body) {
+		topic, next, err := DecodeUTF8String(body, offset)
+		if err != nil {
+			return fmt.Errorf("invalid SUBSCRIBE topic filter: %w", err)
+		}
+		offset = next
+		if offset >= len(body) {
+			return fmt.Errorf("invalid SUBSCRIBE packet: missing subscription options")
+		}
+		options := body[offset]
+		offset++
+		s.Subscriptions = append(s.Subscriptions, Subscription{
+			Topic:             topic,
+			QoS:               options & 0x03,
+			NoLocal:           options&0x04 != 0,
+			RetainAsPublished: options&0x08 != 0,
+			RetainHandling:    (options >> 4) & 0x03,
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// UnsubAck is the UNSUBACK packet (section 3.11): the server's response
+// to UNSUBSCRIBE. In v3.1.1 it carries only a Packet Identifier; v5
+// adds Properties and one reason code per topic filter unsubscribed.
+type UnsubAck struct {
+	Version     Version
+	PacketID    uint16
+	Properties  Properties // v5 only
+	ReasonCodes []byte     // v5 only
+}
+
+// Pack writes u to w as a complete UNSUBACK packet.
+func (u *UnsubAck) Pack(w io.Writer) error {
+	variableHeader := []byte{byte(u.PacketID >> 8), byte(u.PacketID)}
+	var payload []byte
+	if u.Version == Version5 {
+		variableHeader = append(variableHeader, u.Properties.Pack()...)
+		payload = u.ReasonCodes
+	}
+
+	header := FixedHeader{Type: TypeUnsubAck, RemainingLength: len(variableHeader) + len(payload)}
+	if err := header.Pack(w); err != nil {
+		return err
+	}
+	if _, err := w.Write(variableHeader); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// Unpack reads an UNSUBACK packet's variable header and payload from r,
+// given its already-read fixed header.
+func (u *UnsubAck) Unpack(r io.Reader, header FixedHeader) error {
+	body := make([]byte, header.RemainingLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	if len(body) < 2 {
+		return fmt.Errorf("invalid UNSUBACK packet: missing packet identifier")
+	}
+	u.PacketID = uint16(body[0])<<8 | uint16(body[1])
+	offset := 2
+
+	if u.Version == Version5 {
+		props, next, err := DecodePropertiesAt(body, offset)
+		if err != nil {
+			return fmt.Errorf("invalid UNSUBACK properties: %w", err)
+		}
+		u.Properties = props
+		offset = next
+		u.ReasonCodes = append([]byte(nil), body[offset:]...)
+	}
+
+	return nil
+}
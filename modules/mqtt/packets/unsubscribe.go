@@ -0,0 +1,74 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// Unsubscribe is the UNSUBSCRIBE packet (section 3.10): a client's
+// request to stop receiving PUBLISH packets for one or more topic
+// filters. Its fixed header reserves flags 0b0010 (section 3.10.1).
+type Unsubscribe struct {
+	Version    Version
+	PacketID   uint16
+	Properties Properties // v5 only
+	Topics     []string
+}
+
+// Pack writes u to w as a complete UNSUBSCRIBE packet.
+func (u *Unsubscribe) Pack(w io.Writer) error {
+	variableHeader := []byte{byte(u.PacketID >> 8), byte(u.PacketID)}
+	if u.Version == Version5 {
+		variableHeader = append(variableHeader, u.Properties.Pack()...)
+	}
+
+	var payload []byte
+	for _, topic := range u.Topics {
+		payload = append(payload, EncodeUTF8String(topic)...)
+	}
+
+	header := FixedHeader{Type: TypeUnsubscribe, Flags: 0x02, RemainingLength: len(variableHeader) + len(payload)}
+	if err := header.Pack(w); err != nil {
+		return err
+	}
+	if _, err := w.Write(variableHeader); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// Unpack reads an UNSUBSCRIBE packet's variable header and payload from
+// r, given its already-read fixed header.
+func (u *Unsubscribe) Unpack(r io.Reader, header FixedHeader) error {
+	body := make([]byte, header.RemainingLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	if len(body) < 2 {
+		return fmt.Errorf("invalid UNSUBSCRIBE packet: missing packet identifier")
+	}
+	u.PacketID = uint16(body[0])<<8 | uint16(body[1])
+	offset := 2
+
+	if u.Version == Version5 {
+		props, next, err := DecodePropertiesAt(body, offset)
+		if err != nil {
+			return fmt.Errorf("invalid UNSUBSCRIBE properties: %w", err)
+		}
+		u.Properties = props
+		offset = next
+	}
+
+	u.Topics = nil
+	for offset < len(body) {
+		topic, next, err := DecodeUTF8String(body, offset)
+		if err != nil {
+			return fmt.Errorf("invalid UNSUBSCRIBE topic filter: %w", err)
+		}
+		offset = next
+		u.Topics = append(u.Topics, topic)
+	}
+
+	return nil
+}
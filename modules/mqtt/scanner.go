@@ -1,21 +1,81 @@
 package mqtt
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/zmap/zgrab2"
+	"github.com/zmap/zgrab2/modules/mqtt/packets"
 )
 
+// ErrPacketTooLarge is returned when a server-advertised Remaining
+// Length exceeds --max-packet-size, instead of allocating a buffer of
+// that (attacker-controlled) size.
+var ErrPacketTooLarge = errors.New("mqtt: packet exceeds --max-packet-size")
+
 // ScanResults is the output of the scan.
 type ScanResults struct {
 	SessionPresent    bool           `json:"session_present,omitempty"`
 	ConnectReturnCode byte           `json:"connect_return_code,omitempty"`
 	Response          string         `json:"response,omitempty"`
 	TLSLog            *zgrab2.TLSLog `json:"tls,omitempty"`
+
+	// The following fields are decoded from the MQTT v5 property block
+	// of the CONNACK (or, where noted, DISCONNECT) packet. They are only
+	// populated when --v5 is set and the server sent the corresponding
+	// property.
+	AssignedClientIdentifier string  `json:"assigned_client_identifier,omitempty"`
+	ServerKeepAlive          *uint16 `json:"server_keep_alive,omitempty"`
+	AuthenticationMethod     string  `json:"authentication_method,omitempty"`
+	AuthenticationData       []byte  `json:"authentication_data,omitempty"`
+	ResponseInformation      string  `json:"response_information,omitempty"`
+	ServerReference          string  `json:"server_reference,omitempty"`
+	ReasonString             string  `json:"reason_string,omitempty"`
+	ReceiveMaximum           *uint16 `json:"receive_maximum,omitempty"`
+	TopicAliasMaximum        *uint16 `json:"topic_alias_maximum,omitempty"`
+	MaximumQoS               *byte   `json:"maximum_qos,omitempty"`
+	RetainAvailable          *bool   `json:"retain_available,omitempty"`
+
+	// UserProperties holds every User Property (0x26) sent, keyed by
+	// name; MQTT allows the same name to appear more than once.
+	UserProperties map[string][]string `json:"user_properties,omitempty"`
+
+	MaximumPacketSize             *uint32 `json:"maximum_packet_size,omitempty"`
+	WildcardSubscriptionAvailable *bool   `json:"wildcard_subscription_available,omitempty"`
+	SubscriptionIDsAvailable      *bool   `json:"subscription_identifiers_available,omitempty"`
+	SharedSubscriptionAvailable   *bool   `json:"shared_subscription_available,omitempty"`
+	SessionExpiryInterval         *uint32 `json:"session_expiry_interval,omitempty"`
+
+	// DisconnectReasonCode is the reason code byte of a DISCONNECT
+	// packet, if the server sent one instead of a CONNACK.
+	DisconnectReasonCode *byte `json:"disconnect_reason_code,omitempty"`
+
+	// The following fields are populated when --websocket is set.
+	WebSocketUpgradeStatus string      `json:"websocket_upgrade_status,omitempty"`
+	WebSocketSubprotocol   string      `json:"websocket_subprotocol,omitempty"`
+	WebSocketHeaders       http.Header `json:"websocket_headers,omitempty"`
+
+	// AuthAttempts and AcceptedCredential are populated when
+	// --credentials-file is set. AcceptedCredential is only set once an
+	// attempt's CONNACK return code is 0x00.
+	AuthAttempts       []AuthAttempt `json:"auth_attempts,omitempty"`
+	AcceptedCredential string        `json:"accepted_credential,omitempty"`
+
+	// Probes holds the results of every --probe run after a successful CONNACK.
+	Probes []ProbeResult `json:"probes,omitempty"`
 }
 
 // Flags are the MQTT-specific command-line flags.
@@ -28,6 +88,91 @@ type Flags struct {
 	UseTLS   bool   `long:"tls" description:"Use TLS for the MQTT connection"`
 	Username string `long:"username" description:"Username for MQTT authentication"`
 	Password string `long:"password" description:"Password for MQTT authentication"`
+
+	// WebSocket, if set, reaches the broker over an HTTP/1.1 Upgrade to
+	// RFC 6455 WebSockets (ws://, or wss:// via --tls) instead of a raw
+	// TCP connection, as used by NATS, HiveMQ, Mosquitto, and EMQX for
+	// browser/edge MQTT clients.
+	WebSocket     bool   `long:"websocket" description:"Reach the broker over a WebSocket (RFC 6455) upgrade instead of a raw TCP connection"`
+	WebSocketPath string `long:"websocket-path" default:"/mqtt" description:"HTTP path to request for the WebSocket upgrade"`
+
+	// The following control the CONNECT packet's variable header and
+	// payload.
+	ClientID   string `long:"client-id" default:"MQTTClient" description:"Client Identifier to send in the CONNECT packet"`
+	KeepAlive  uint16 `long:"keep-alive" default:"60" description:"Keep Alive, in seconds, to send in the CONNECT packet"`
+	CleanStart bool   `long:"clean-start" default:"true" description:"Set the Clean Start (v5) / Clean Session (v3.1.1) connect flag"`
+
+	// WillTopic, if set, sends a Will Message alongside CONNECT.
+	WillTopic         string `long:"will-topic" description:"Will Message topic; if set, a Will Message is included in the CONNECT packet"`
+	WillPayload       string `long:"will-payload" description:"Will Message payload"`
+	WillQoS           uint8  `long:"will-qos" default:"0" description:"Will Message QoS (0-2)"`
+	WillRetain        bool   `long:"will-retain" description:"Set the Will Retain connect flag"`
+	WillDelayInterval uint32 `long:"will-delay-interval" description:"Will Delay Interval property, in seconds (MQTT v5 only)"`
+
+	// CredentialsFile, if set, makes Scan try each "username:password"
+	// line in turn (one fresh connection per attempt) instead of the
+	// single CONNECT that --username/--password send, stopping at the
+	// first return code 0x00 or once the list/--max-attempts is
+	// exhausted.
+	CredentialsFile string        `long:"credentials-file" description:"Newline-delimited username:password wordlist to brute-force CONNECT with"`
+	MaxAttempts     int           `long:"max-attempts" default:"0" description:"Maximum number of --credentials-file attempts (0 = try every entry)"`
+	AttemptDelay    time.Duration `long:"attempt-delay" default:"0s" description:"Delay between --credentials-file attempts"`
+
+	// Probe runs one or more post-CONNECT probes after a successful
+	// CONNACK: subscribe-wildcard, sys-tree, publish-echo, pingreq.
+	Probe        []string      `long:"probe" description:"Post-CONNECT probe to run (subscribe-wildcard, sys-tree, publish-echo, pingreq); repeatable"`
+	ProbeTimeout time.Duration `long:"probe-timeout" default:"3s" description:"How long to wait for PUBLISH messages during a probe"`
+
+	// MaxPacketSize bounds how large a buffer every packet read is
+	// allowed to allocate for its Remaining Length, which is otherwise
+	// entirely attacker-controlled (up to 268,435,455 bytes).
+	MaxPacketSize int `long:"max-packet-size" default:"65536" description:"Maximum packet size, in bytes, to accept from the server"`
+}
+
+// AuthAttempt records the outcome of a single credential attempt made
+// while brute-forcing with --credentials-file.
+type AuthAttempt struct {
+	Username   string        `json:"username"`
+	Password   string        `json:"password,omitempty"`
+	ReturnCode *byte         `json:"return_code,omitempty"`
+	Accepted   bool          `json:"accepted"`
+	Error      string        `json:"error,omitempty"`
+	StartedAt  time.Time     `json:"started_at"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// ProbeResult records the outcome of a single --probe run after a
+// successful CONNACK.
+type ProbeResult struct {
+	Name string `json:"name"`
+	// Topic is the filter subscribed to (sys-tree, subscribe-wildcard)
+	// or the topic generated for a publish-echo round trip.
+	Topic string `json:"topic,omitempty"`
+
+	// SubscribeReasonCode is the SUBACK reason/return code for Topic.
+	SubscribeReasonCode *byte `json:"subscribe_reason_code,omitempty"`
+
+	// Messages holds every PUBLISH observed during the probe window,
+	// each truncated to probeMessagePreviewBytes.
+	Messages []ProbeMessage `json:"messages,omitempty"`
+
+	// PingResponse is true if a PINGRESP was read back for the pingreq probe.
+	PingResponse bool `json:"ping_response,omitempty"`
+
+	// Classification summarizes the probe outcome for survey tooling:
+	// "open/read" (we received data we weren't supposed to see),
+	// "open/write" (our own publish looped back to us), "auth-only" (the
+	// broker refused the subscription), or "no-data" (subscribed fine
+	// but nothing arrived within --probe-timeout).
+	Classification string `json:"classification,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// ProbeMessage is a single PUBLISH observed during a probe.
+type ProbeMessage struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
 }
 
 // Module implements the zgrab2.Module interface.
@@ -45,8 +190,28 @@ type Connection struct {
 	conn    net.Conn
 	config  *Flags
 	results ScanResults
+
+	// username/password default to config.Username/config.Password but
+	// can be overridden per-connection, e.g. to try each credential in
+	// --credentials-file without mutating the shared Flags.
+	username string
+	password string
+
+	// gotConnAck is true once a CONNACK (rather than a DISCONNECT) has
+	// been read, so callers can tell results.ConnectReturnCode's
+	// zero-value apart from an actual "Connection Accepted" (0x00).
+	gotConnAck bool
+
+	// packetID hands out ascending packet identifiers for SUBSCRIBE/
+	// PUBLISH(QoS>0) probes.
+	packetID uint16
 }
 
+// probeMessagePreviewBytes bounds how much of each probed PUBLISH
+// payload is recorded, to keep probe results small on chatty topics
+// like $SYS/#.
+const probeMessagePreviewBytes = 256
+
 // RegisterModule registers the MQTT zgrab2 module.
 func RegisterModule() {
 	var module Module
@@ -109,268 +274,697 @@ func (scanner *Scanner) GetTrigger() string {
 	return scanner.config.Trigger
 }
 
+// protocolVersion returns the packets.Version to use given --v5.
+func (mqtt *Connection) protocolVersion() packets.Version {
+	if mqtt.config.V5 {
+		return packets.Version5
+	}
+	return packets.Version311
+}
+
 // SendMQTTConnectPacket constructs and sends an MQTT CONNECT packet to the server.
 func (mqtt *Connection) SendMQTTConnectPacket(v5 bool) error {
-	var packet []byte
-
-	if v5 {
-		// MQTT v5 CONNECT packet (unchanged from the original)
-		packet = []byte{
-			// Fixed Header
-			0x10, // Control Packet Type (CONNECT) and flags
-			0x17, // Remaining Length (23 bytes)
-
-			// Variable Header
-			0x00, 0x04, 'M', 'Q', 'T', 'T', // Protocol Name
-			0x05,       // Protocol Level (MQTT v5.0)
-			0x02,       // Connect Flags (Clean Start)
-			0x00, 0x3C, // Keep Alive (60 seconds)
-
-			// Properties
-			0x00, // Properties Length (0)
-
-			// Payload
-			0x00, 0x0A, 'M', 'Q', 'T', 'T', 'C', 'l', 'i', 'e', 'n', 't', // Client Identifier
-		}
-	} else {
-		// MQTT v3.1.1 Connect Packet with Username and Password
-		usernameFlag := 0
-		passwordFlag := 0
-		var usernameField []byte
-		var passwordField []byte
-		clientID := "MQTTClient" // Replace with the actual client identifier
-
-		if mqtt.config.Username != "" {
-			usernameFlag = 1
-			usernameField = []byte(mqtt.config.Username)
-		}
+	connect := &packets.Connect{
+		Version:    mqtt.protocolVersion(),
+		CleanStart: mqtt.config.CleanStart,
+		KeepAlive:  mqtt.config.KeepAlive,
+		ClientID:   mqtt.config.ClientID,
+		Username:   mqtt.username,
+		Password:   mqtt.password,
+	}
 
-		if mqtt.config.Password != "" {
-			passwordFlag = 1
-			passwordField = []byte(mqtt.config.Password)
+	if mqtt.config.WillTopic != "" {
+		connect.Will = true
+		connect.WillTopic = mqtt.config.WillTopic
+		connect.WillPayload = []byte(mqtt.config.WillPayload)
+		connect.WillQoS = mqtt.config.WillQoS
+		connect.WillRetain = mqtt.config.WillRetain
+
+		// Of the Will Properties the spec defines (Will Delay Interval,
+		// Payload Format Indicator, Message Expiry Interval, Content
+		// Type, Response Topic, Correlation Data), only Will Delay
+		// Interval has a corresponding command-line flag today.
+		if v5 && mqtt.config.WillDelayInterval != 0 {
+			delay := mqtt.config.WillDelayInterval
+			connect.WillProperties.WillDelayInterval = &delay
 		}
+	}
 
-		// Calculate the remaining length
-		remainingLength := 10 + 2 + len(clientID) // 10 bytes for fixed fields + 2 bytes for clientID length + clientID length
-		if usernameFlag == 1 {
-			remainingLength += 2 + len(usernameField) // Add 2 bytes for username length + username length
-		}
-		if passwordFlag == 1 {
-			remainingLength += 2 + len(passwordField) // Add 2 bytes for password length + password length
-		}
+	return connect.Pack(mqtt.conn)
+}
 
-		connectFlags := byte(0x02) // Clean Start flag
+// readConnectResponse reads and decodes the CONNACK (or DISCONNECT)
+// packet the server sends in response to CONNECT, populating
+// mqtt.results.
+func (mqtt *Connection) readConnectResponse() error {
+	var captured bytes.Buffer
+	header, body, err := mqtt.readControlPacket(time.Duration(mqtt.config.Timeout)*time.Second, &captured)
+	if err != nil {
+		return err
+	}
+	mqtt.results.Response = fmt.Sprintf("%X", captured.Bytes())
 
-		if usernameFlag == 1 {
-			connectFlags |= 0x80 // Set the Username flag
+	switch header.Type {
+	case packets.TypeConnAck:
+		connAck := packets.ConnAck{Version: mqtt.protocolVersion()}
+		if err := connAck.Unpack(bytes.NewReader(body), header); err != nil {
+			return fmt.Errorf("error decoding CONNACK packet: %w", err)
 		}
-		if passwordFlag == 1 {
-			connectFlags |= 0x40 // Set the Password flag
+		mqtt.gotConnAck = true
+		mqtt.results.SessionPresent = connAck.SessionPresent
+		mqtt.results.ConnectReturnCode = connAck.ReasonCode
+		mqtt.applyProperties(connAck.Properties)
+	case packets.TypeDisconnect:
+		disconnect := packets.Disconnect{Version: mqtt.protocolVersion()}
+		if err := disconnect.Unpack(bytes.NewReader(body), header); err != nil {
+			return fmt.Errorf("error decoding DISCONNECT packet: %w", err)
 		}
+		reasonCode := disconnect.ReasonCode
+		mqtt.results.DisconnectReasonCode = &reasonCode
+		mqtt.applyProperties(disconnect.Properties)
+	default:
+		return fmt.Errorf("unexpected packet type: %d", header.Type)
+	}
 
-		packet = []byte{
-			// Fixed Header
-			0x10, byte(remainingLength), // Control Packet Type (CONNECT) and remaining length
+	return nil
+}
 
-			// Variable Header
-			0x00, 0x04, 'M', 'Q', 'T', 'T', // Protocol Name
-			0x04,         // Protocol Level (MQTT v3.1.1)
-			connectFlags, // Connect Flags (set Username and Password flags accordingly)
-			0x00, 0x3C,   // Keep Alive (60 seconds)
+// applyProperties copies the fields of a decoded v5 Properties block
+// onto mqtt.results; it's called once per connection, against a
+// zero-valued ScanResults, so a plain overwrite (rather than an
+// additive merge) is correct for every field.
+func (mqtt *Connection) applyProperties(p packets.Properties) {
+	results := &mqtt.results
+	results.AssignedClientIdentifier = p.AssignedClientIdentifier
+	results.ServerKeepAlive = p.ServerKeepAlive
+	results.AuthenticationMethod = p.AuthenticationMethod
+	results.AuthenticationData = p.AuthenticationData
+	results.ResponseInformation = p.ResponseInformation
+	results.ServerReference = p.ServerReference
+	results.ReasonString = p.ReasonString
+	results.ReceiveMaximum = p.ReceiveMaximum
+	results.TopicAliasMaximum = p.TopicAliasMaximum
+	results.MaximumQoS = p.MaximumQoS
+	results.RetainAvailable = p.RetainAvailable
+	results.UserProperties = p.UserProperties
+	results.MaximumPacketSize = p.MaximumPacketSize
+	results.WildcardSubscriptionAvailable = p.WildcardSubscriptionAvailable
+	results.SubscriptionIDsAvailable = p.SubscriptionIDsAvailable
+	results.SharedSubscriptionAvailable = p.SharedSubscriptionAvailable
+	results.SessionExpiryInterval = p.SessionExpiryInterval
+}
 
-			// Payload
-			0x00, 0x0A, 'M', 'Q', 'T', 'T', 'C', 'l', 'i', 'e', 'n', 't', // Client Identifier
-		}
+// nextPacketID returns the next ascending packet identifier, for use in
+// SUBSCRIBE and QoS>0 PUBLISH packets.
+func (mqtt *Connection) nextPacketID() uint16 {
+	mqtt.packetID++
+	return mqtt.packetID
+}
 
-		// Add Username to Payload
-		if usernameFlag == 1 {
-			usernameLen := make([]byte, 2)
-			binary.BigEndian.PutUint16(usernameLen, uint16(len(usernameField)))
-			packet = append(packet, usernameLen...)
-			packet = append(packet, usernameField...)
-		}
+// SendSubscribe sends a SUBSCRIBE for a single topic filter at the given
+// QoS and returns the packet identifier used, so the caller can match it
+// against the SUBACK.
+func (mqtt *Connection) SendSubscribe(topic string, qos byte) (uint16, error) {
+	packetID := mqtt.nextPacketID()
+	subscribe := &packets.Subscribe{
+		Version:       mqtt.protocolVersion(),
+		PacketID:      packetID,
+		Subscriptions: []packets.Subscription{{Topic: topic, QoS: qos & 0x03}},
+	}
+	return packetID, subscribe.Pack(mqtt.conn)
+}
 
-		// Add Password to Payload
-		if passwordFlag == 1 {
-			passwordLen := make([]byte, 2)
-			binary.BigEndian.PutUint16(passwordLen, uint16(len(passwordField)))
-			packet = append(packet, passwordLen...)
-			packet = append(packet, passwordField...)
-		}
+// SendPublish sends a PUBLISH to topic. Only QoS 0 is supported, since
+// probing doesn't need delivery guarantees or the PUBACK/PUBREC/PUBREL/
+// PUBCOMP flows QoS>0 would require.
+func (mqtt *Connection) SendPublish(topic string, payload []byte, retain bool) error {
+	publish := &packets.Publish{
+		Version: mqtt.protocolVersion(),
+		Topic:   topic,
+		Payload: payload,
+		Retain:  retain,
 	}
+	return publish.Pack(mqtt.conn)
+}
 
-	_, err := mqtt.conn.Write(packet)
-	return err
+// SendPingReq sends a PINGREQ.
+func (mqtt *Connection) SendPingReq() error {
+	return (packets.PingReq{}).Pack(mqtt.conn)
 }
 
-// ReadMQTTv3Packet reads and parses the CONNACK packet from the server.
-func (mqtt *Connection) ReadMQTTv3Packet() error {
-	response := make([]byte, 4)
-	_, err := mqtt.conn.Read(response)
-	if err != nil {
-		return err
+// SendDisconnect sends a DISCONNECT with the default (0x00, "Normal
+// disconnection") reason.
+func (mqtt *Connection) SendDisconnect() error {
+	disconnect := &packets.Disconnect{Version: mqtt.protocolVersion()}
+	return disconnect.Pack(mqtt.conn)
+}
+
+// readControlPacket reads a single MQTT control packet within timeout,
+// returning its decoded fixed header and the bytes following the
+// remaining-length field. If captured is non-nil, every byte read (the
+// fixed header and the body) is also appended to it, for callers that
+// want the packet's raw wire representation.
+//
+// The read is bounded to --max-packet-size: the server's Remaining
+// Length is attacker-controlled and, left unchecked, could otherwise be
+// used to force an allocation of up to 268,435,455 bytes per scanned
+// target.
+func (mqtt *Connection) readControlPacket(timeout time.Duration, captured *bytes.Buffer) (header packets.FixedHeader, body []byte, err error) {
+	mqtt.conn.SetReadDeadline(time.Now().Add(timeout))
+
+	var r io.Reader = mqtt.conn
+	if captured != nil {
+		r = io.TeeReader(r, captured)
 	}
+	limited := io.LimitReader(r, int64(mqtt.config.MaxPacketSize)+5) // +5: the fixed header's own first byte and up to 4 VBI bytes
 
-	mqtt.results.Response = fmt.Sprintf("%X", response)
+	header, err = packets.DecodeFixedHeader(limited)
+	if err != nil {
+		return packets.FixedHeader{}, nil, err
+	}
+	if header.RemainingLength > mqtt.config.MaxPacketSize {
+		return packets.FixedHeader{}, nil, ErrPacketTooLarge
+	}
 
-	// DISCONNECT packet
-	if ((response[0] & 0xF0) == 0xE0) && (response[1] == 0x00) {
-		return nil
+	body = make([]byte, header.RemainingLength)
+	if _, err := io.ReadFull(limited, body); err != nil {
+		return packets.FixedHeader{}, nil, err
 	}
+	return header, body, nil
+}
 
-	// Check if the response is a valid CONNACK packet
-	if response[0] != 0x20 || response[1] != 0x02 {
-		return fmt.Errorf("invalid CONNACK packet")
+// parsePublish extracts the topic and payload from a PUBLISH packet's
+// body, given its already-decoded fixed header.
+func parsePublish(header packets.FixedHeader, body []byte, v5 bool) (topic string, payload []byte, err error) {
+	version := packets.Version311
+	if v5 {
+		version = packets.Version5
 	}
+	publish := &packets.Publish{Version: version}
+	if err := publish.Unpack(bytes.NewReader(body), header); err != nil {
+		return "", nil, err
+	}
+	return publish.Topic, publish.Payload, nil
+}
 
-	mqtt.results.SessionPresent = (response[2] & 0x01) == 0x01
-	mqtt.results.ConnectReturnCode = response[3]
+// previewPayload truncates payload to probeMessagePreviewBytes and
+// renders it for the JSON results: as UTF-8 text if valid, otherwise as
+// a hex string.
+func previewPayload(payload []byte) string {
+	if len(payload) > probeMessagePreviewBytes {
+		payload = payload[:probeMessagePreviewBytes]
+	}
+	for _, b := range payload {
+		if b < 0x09 || (b > 0x0D && b < 0x20) {
+			return hex.EncodeToString(payload)
+		}
+	}
+	return string(payload)
+}
 
-	return nil
+// collectProbeMessages reads packets until deadline, recording every
+// PUBLISH whose topic matches filter (a "#"/"$SYS/#"-style MQTT topic
+// filter is already satisfied server-side by the SUBSCRIBE, so any
+// PUBLISH seen here is in scope) and acking none of them, since probes
+// don't need QoS>0 delivery guarantees.
+func (mqtt *Connection) collectProbeMessages(deadline time.Time, v5 bool) []ProbeMessage {
+	var messages []ProbeMessage
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return messages
+		}
+		header, body, err := mqtt.readControlPacket(remaining, nil)
+		if err != nil {
+			return messages
+		}
+		if header.Type != packets.TypePublish {
+			continue
+		}
+		topic, payload, err := parsePublish(header, body, v5)
+		if err != nil {
+			continue
+		}
+		messages = append(messages, ProbeMessage{Topic: topic, Payload: previewPayload(payload)})
+	}
 }
 
-// ReadMQTTv5Packet reads and parses the CONNACK or DISCONNECT packet from the server for MQTT v5.0.
-func (mqtt *Connection) ReadMQTTv5Packet() error {
-	// Read the first byte to determine the packet type
-	firstByte := make([]byte, 1)
-	_, err := io.ReadFull(mqtt.conn, firstByte)
+// runSubscribeProbe subscribes to topic at QoS 0, reads the SUBACK, then
+// collects PUBLISH messages for the scanner's --probe-timeout.
+func (s *Scanner) runSubscribeProbe(mqtt *Connection, name, topic string) ProbeResult {
+	result := ProbeResult{Name: name, Topic: topic}
+
+	packetID, err := mqtt.SendSubscribe(topic, 0)
 	if err != nil {
-		return err
+		result.Error = fmt.Sprintf("error sending SUBSCRIBE: %s", err)
+		return result
 	}
 
-	packetType := firstByte[0] >> 4
+	header, body, err := mqtt.readControlPacket(s.config.ProbeTimeout, nil)
+	if err != nil || header.Type != packets.TypeSubAck {
+		result.Error = "did not receive a matching SUBACK"
+		return result
+	}
+	subAck := packets.SubAck{Version: mqtt.protocolVersion()}
+	if err := subAck.Unpack(bytes.NewReader(body), header); err != nil || subAck.PacketID != packetID || len(subAck.ReasonCodes) == 0 {
+		result.Error = "did not receive a matching SUBACK"
+		return result
+	}
+	reasonCode := subAck.ReasonCodes[0]
+	result.SubscribeReasonCode = &reasonCode
 
-	// Read the remaining length
-	remainingLengthBytes, err := readVariableByteInteger(mqtt.conn)
-	if err != nil {
-		return err
+	if reasonCode >= 0x80 {
+		result.Classification = "auth-only"
+		return result
+	}
+
+	result.Messages = mqtt.collectProbeMessages(time.Now().Add(s.config.ProbeTimeout), s.config.V5)
+	if len(result.Messages) > 0 {
+		result.Classification = "open/read"
+	} else {
+		result.Classification = "no-data"
 	}
+	return result
+}
 
-	// Convert remaining length bytes to integer
-	remainingLength, _ := binary.Uvarint(remainingLengthBytes)
+// runPublishEchoProbe subscribes to a freshly generated topic, publishes
+// a marker to it, and checks whether the broker loops the publish back
+// to us -- evidence that publishing to arbitrary topics is unauthenticated.
+func (s *Scanner) runPublishEchoProbe(mqtt *Connection) ProbeResult {
+	topicSuffix := make([]byte, 8)
+	if _, err := rand.Read(topicSuffix); err != nil {
+		return ProbeResult{Name: "publish-echo", Error: fmt.Sprintf("error generating probe topic: %s", err)}
+	}
+	topic := "zgrab2-probe/" + hex.EncodeToString(topicSuffix)
+	marker := "zgrab2-" + hex.EncodeToString(topicSuffix)
 
-	// Allocate the packet buffer with the correct size
-	packet := make([]byte, 1+len(remainingLengthBytes)+int(remainingLength))
-	packet[0] = firstByte[0]
-	copy(packet[1:], remainingLengthBytes)
+	result := s.runSubscribeProbe(mqtt, "publish-echo", topic)
+	if result.SubscribeReasonCode == nil || *result.SubscribeReasonCode >= 0x80 {
+		return result
+	}
 
-	// Read the rest of the packet
-	_, err = io.ReadFull(mqtt.conn, packet[1+len(remainingLengthBytes):])
-	if err != nil {
-		return err
+	if err := mqtt.SendPublish(topic, []byte(marker), false); err != nil {
+		result.Error = fmt.Sprintf("error sending PUBLISH: %s", err)
+		return result
 	}
 
-	// Store the original response
-	mqtt.results.Response = fmt.Sprintf("%X", packet)
+	result.Messages = append(result.Messages, mqtt.collectProbeMessages(time.Now().Add(s.config.ProbeTimeout), s.config.V5)...)
+	for _, message := range result.Messages {
+		if message.Topic == topic && message.Payload == marker {
+			result.Classification = "open/write"
+			return result
+		}
+	}
+	result.Classification = "no-data"
+	return result
+}
 
-	// Process the packet based on its type
-	switch packetType {
-	case 2: // CONNACK
-		return mqtt.processConnAck(packet)
-	case 14: // DISCONNECT
-		return mqtt.processDisconnect(packet)
-	default:
-		return fmt.Errorf("unexpected packet type: %d", packetType)
+// runPingReqProbe sends a PINGREQ and records whether a PINGRESP came back.
+func (s *Scanner) runPingReqProbe(mqtt *Connection) ProbeResult {
+	result := ProbeResult{Name: "pingreq"}
+	if err := mqtt.SendPingReq(); err != nil {
+		result.Error = fmt.Sprintf("error sending PINGREQ: %s", err)
+		return result
+	}
+	header, _, err := mqtt.readControlPacket(s.config.ProbeTimeout, nil)
+	if err != nil {
+		result.Error = fmt.Sprintf("error reading PINGRESP: %s", err)
+		return result
 	}
+	result.PingResponse = header.Type == packets.TypePingResp
+	return result
 }
 
-func (mqtt *Connection) processConnAck(packet []byte) error {
-	if len(packet) < 4 {
-		return fmt.Errorf("invalid CONNACK packet length")
+// runProbes executes every configured --probe against an already
+// CONNACK'd connection, appending each result to mqtt.results.Probes.
+func (s *Scanner) runProbes(mqtt *Connection) {
+	for _, probe := range s.config.Probe {
+		var result ProbeResult
+		switch probe {
+		case "subscribe-wildcard":
+			result = s.runSubscribeProbe(mqtt, probe, "#")
+		case "sys-tree":
+			result = s.runSubscribeProbe(mqtt, probe, "$SYS/#")
+		case "publish-echo":
+			result = s.runPublishEchoProbe(mqtt)
+		case "pingreq":
+			result = s.runPingReqProbe(mqtt)
+		default:
+			result = ProbeResult{Name: probe, Error: fmt.Sprintf("unknown probe %q", probe)}
+		}
+		mqtt.results.Probes = append(mqtt.results.Probes, result)
 	}
+}
 
-	mqtt.results.SessionPresent = (packet[2] & 0x01) == 0x01
-	mqtt.results.ConnectReturnCode = packet[3]
+// wsConn wraps a connection already upgraded to a WebSocket, presenting
+// a net.Conn interface so SendMQTTConnectPacket/ReadMQTTv*Packet can
+// operate unchanged: Write frames each call as a single masked binary
+// frame, and Read unwraps frames (replying to pings, skipping other
+// control frames) and returns their payload.
+type wsConn struct {
+	net.Conn
+	reader  io.Reader // wraps Conn; may have buffered bytes read past the HTTP upgrade response
+	pending []byte    // unread payload remaining from the current data frame
+}
 
-	// Process properties if present
-	if len(packet) > 4 {
-		propertiesLength, n := binary.Uvarint(packet[4:])
-		propertiesStart := 4 + n
-		propertiesEnd := propertiesStart + int(propertiesLength)
+func newWebSocketConn(conn net.Conn, reader io.Reader) *wsConn {
+	return &wsConn{Conn: conn, reader: reader}
+}
 
-		if propertiesEnd > len(packet) {
-			return fmt.Errorf("invalid properties length in CONNACK")
-		}
+func (w *wsConn) Write(p []byte) (int, error) {
+	if err := writeWSFrame(w.Conn, 0x2, p); err != nil {
+		return 0, err
 	}
+	return len(p), nil
+}
 
-	return nil
+func (w *wsConn) Read(p []byte) (int, error) {
+	for len(w.pending) == 0 {
+		opcode, payload, err := readWSFrame(w.reader)
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case 0x9: // ping
+			if err := writeWSFrame(w.Conn, 0xA, payload); err != nil {
+				return 0, err
+			}
+		case 0x8: // close
+			return 0, io.EOF
+		case 0xA: // pong
+		default: // text/binary/continuation
+			w.pending = payload
+		}
+	}
+	n := copy(p, w.pending)
+	w.pending = w.pending[n:]
+	return n, nil
 }
 
-func (mqtt *Connection) processDisconnect(packet []byte) error {
-	if len(packet) < 2 {
-		return fmt.Errorf("invalid DISCONNECT packet length")
+// writeWSFrame writes a single, final, client-masked RFC 6455 frame.
+func writeWSFrame(conn net.Conn, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode} // FIN + opcode
+
+	const maskBit = byte(0x80)
+	length := len(payload)
+	switch {
+	case length <= 125:
+		header = append(header, maskBit|byte(length))
+	case length <= 0xFFFF:
+		lenBytes := make([]byte, 2)
+		binary.BigEndian.PutUint16(lenBytes, uint16(length))
+		header = append(header, maskBit|126)
+		header = append(header, lenBytes...)
+	default:
+		lenBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(lenBytes, uint64(length))
+		header = append(header, maskBit|127)
+		header = append(header, lenBytes...)
 	}
 
-	// Process properties if present
-	if len(packet) > 3 {
-		propertiesLength, n := binary.Uvarint(packet[3:])
-		propertiesStart := 3 + n
-		propertiesEnd := propertiesStart + int(propertiesLength)
+	mask := make([]byte, 4)
+	if _, err := rand.Read(mask); err != nil {
+		return err
+	}
+	header = append(header, mask...)
 
-		if propertiesEnd > len(packet) {
-			return fmt.Errorf("invalid properties length in DISCONNECT")
-		}
+	masked := make([]byte, length)
+	for i, b := range payload {
+		masked[i] = b ^ mask[i%4]
 	}
 
-	return nil
+	if _, err := conn.Write(header); err != nil {
+		return err
+	}
+	_, err := conn.Write(masked)
+	return err
 }
 
-func readVariableByteInteger(r io.Reader) ([]byte, error) {
-	var result []byte
-	for i := 0; i < 4; i++ {
-		b := make([]byte, 1)
-		_, err := r.Read(b)
-		if err != nil {
-			return nil, err
+// readWSFrame reads a single RFC 6455 frame from a server, which MUST
+// NOT mask its frames. Fragmented messages aren't reassembled here since
+// MQTT brokers send each control packet as a single WebSocket message.
+func readWSFrame(reader io.Reader) (opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(reader, ext); err != nil {
+			return 0, nil, err
 		}
-		result = append(result, b[0])
-		if b[0]&0x80 == 0 {
-			break
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(reader, ext); err != nil {
+			return 0, nil, err
 		}
+		length = binary.BigEndian.Uint64(ext)
 	}
-	if len(result) == 4 && result[3]&0x80 != 0 {
-		return nil, fmt.Errorf("invalid variable byte integer")
+
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(reader, mask); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, nil, err
 	}
-	return result, nil
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
 }
 
-// Scan performs the configured scan on the MQTT server.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+// upgradeWebSocket performs the HTTP/1.1 Upgrade handshake for MQTT over
+// WebSockets, offering both the current "mqtt" subprotocol and the older
+// draft's "mqttv3.1" as a fallback, then wraps conn in the RFC 6455
+// framing layer. Results are recorded on results regardless of outcome.
+func upgradeWebSocket(conn net.Conn, host, path string, results *ScanResults) (net.Conn, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("error generating WebSocket key: %w", err)
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+
+	request := fmt.Sprintf(
+		"GET %s HTTP/1.1\r\n"+
+			"Host: %s\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Key: %s\r\n"+
+			"Sec-WebSocket-Version: 13\r\n"+
+			"Sec-WebSocket-Protocol: mqtt, mqttv3.1\r\n"+
+			"\r\n",
+		path, host, encodedKey)
+
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return nil, fmt.Errorf("error sending WebSocket upgrade request: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading WebSocket upgrade response: %w", err)
+	}
+	defer response.Body.Close()
+
+	results.WebSocketUpgradeStatus = response.Status
+	results.WebSocketHeaders = response.Header
+	results.WebSocketSubprotocol = response.Header.Get("Sec-WebSocket-Protocol")
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("server did not upgrade to WebSocket: %s", response.Status)
+	}
+
+	// reader may already have buffered bytes read past the blank line
+	// terminating the response headers; keep using it rather than
+	// switching back to raw conn reads.
+	return newWebSocketConn(conn, reader), nil
+}
+
+// openConnection dials t, performs the optional TLS handshake and
+// WebSocket upgrade, and returns a Connection ready for
+// SendMQTTConnectPacket. The caller is responsible for closing the
+// returned Connection's conn.
+func (s *Scanner) openConnection(t zgrab2.ScanTarget) (*Connection, zgrab2.ScanStatus, error) {
 	conn, err := t.Open(&s.config.BaseFlags)
 	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+		return nil, zgrab2.TryGetScanStatus(err), fmt.Errorf("error opening connection: %w", err)
 	}
-	defer conn.Close()
 
-	mqtt := Connection{conn: conn, config: s.config}
+	mqtt := &Connection{conn: conn, config: s.config, username: s.config.Username, password: s.config.Password}
 
 	if s.config.UseTLS {
 		tlsConn, err := s.config.TLSFlags.GetTLSConnection(conn)
 		if err != nil {
-			return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error getting TLS connection: %w", err)
+			conn.Close()
+			return nil, zgrab2.TryGetScanStatus(err), fmt.Errorf("error getting TLS connection: %w", err)
 		}
 		mqtt.results.TLSLog = tlsConn.GetLog()
 
 		if err := tlsConn.Handshake(); err != nil {
-			return zgrab2.TryGetScanStatus(err), &mqtt.results, fmt.Errorf("error during TLS handshake: %w", err)
+			conn.Close()
+			return mqtt, zgrab2.TryGetScanStatus(err), fmt.Errorf("error during TLS handshake: %w", err)
 		}
 
 		mqtt.conn = tlsConn
 	}
 
+	if s.config.WebSocket {
+		host := t.IP.String()
+		if t.Domain != "" {
+			host = t.Domain
+		}
+		upgraded, err := upgradeWebSocket(mqtt.conn, host, s.config.WebSocketPath, &mqtt.results)
+		if err != nil {
+			conn.Close()
+			return mqtt, zgrab2.TryGetScanStatus(err), fmt.Errorf("error upgrading to WebSocket: %w", err)
+		}
+		mqtt.conn = upgraded
+	}
+
+	return mqtt, zgrab2.SCAN_SUCCESS, nil
+}
+
+// connect sends the CONNECT packet and reads the resulting CONNACK (or
+// DISCONNECT), populating mqtt.results.
+func (s *Scanner) connect(mqtt *Connection) error {
 	if err := mqtt.SendMQTTConnectPacket(s.config.V5); err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error sending CONNECT packet: %w", err)
+		return fmt.Errorf("error sending CONNECT packet: %w", err)
 	}
 
-	if s.config.V5 {
-		err = mqtt.ReadMQTTv5Packet()
-	} else {
-		err = mqtt.ReadMQTTv3Packet()
+	if err := mqtt.readConnectResponse(); err != nil {
+		return fmt.Errorf("error reading CONNACK packet: %w", err)
+	}
+	return nil
+}
+
+// readCredentials parses a --credentials-file into username/password
+// pairs, one "username:password" line each.
+func readCredentials(path string) ([][2]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var credentials [][2]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		username, password, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed credentials line (want username:password): %q", line)
+		}
+		credentials = append(credentials, [2]string{username, password})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// bruteForceCredentials tries each credential in s.config.CredentialsFile
+// in turn, one fresh connection per attempt, stopping at the first
+// CONNACK return code 0x00 or once the list/--max-attempts is exhausted.
+func (s *Scanner) bruteForceCredentials(t zgrab2.ScanTarget) (zgrab2.ScanStatus, *ScanResults, error) {
+	credentials, err := readCredentials(s.config.CredentialsFile)
+	if err != nil {
+		return zgrab2.SCAN_APPLICATION_ERROR, nil, fmt.Errorf("error reading --credentials-file: %w", err)
+	}
+	if s.config.MaxAttempts > 0 && len(credentials) > s.config.MaxAttempts {
+		credentials = credentials[:s.config.MaxAttempts]
+	}
+
+	results := &ScanResults{}
+	for i, credential := range credentials {
+		username, password := credential[0], credential[1]
+		if i > 0 && s.config.AttemptDelay > 0 {
+			time.Sleep(s.config.AttemptDelay)
+		}
+
+		attempt := AuthAttempt{Username: username, Password: password, StartedAt: time.Now()}
+
+		mqtt, _, err := s.openConnection(t)
+		if err != nil {
+			attempt.Error = err.Error()
+			attempt.Duration = time.Since(attempt.StartedAt)
+			results.AuthAttempts = append(results.AuthAttempts, attempt)
+			if mqtt != nil {
+				mqtt.conn.Close()
+			}
+			continue
+		}
+		mqtt.username, mqtt.password = username, password
+
+		err = s.connect(mqtt)
+		mqtt.conn.Close()
+		attempt.Duration = time.Since(attempt.StartedAt)
+		if err != nil {
+			attempt.Error = err.Error()
+			results.AuthAttempts = append(results.AuthAttempts, attempt)
+			continue
+		}
+
+		if mqtt.gotConnAck {
+			returnCode := mqtt.results.ConnectReturnCode
+			attempt.ReturnCode = &returnCode
+			attempt.Accepted = returnCode == 0x00
+		}
+		results.AuthAttempts = append(results.AuthAttempts, attempt)
+
+		if attempt.Accepted {
+			attempts := results.AuthAttempts
+			*results = mqtt.results
+			results.AuthAttempts = attempts
+			results.AcceptedCredential = username + ":" + password
+			return zgrab2.SCAN_SUCCESS, results, nil
+		}
+	}
+
+	return zgrab2.SCAN_SUCCESS, results, nil
+}
+
+// Scan performs the configured scan on the MQTT server.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	if s.config.CredentialsFile != "" {
+		status, results, err := s.bruteForceCredentials(t)
+		return status, results, err
 	}
 
+	mqtt, status, err := s.openConnection(t)
+	if mqtt != nil {
+		defer mqtt.conn.Close()
+	}
 	if err != nil {
-		return zgrab2.TryGetScanStatus(err), &mqtt.results, fmt.Errorf("error reading CONNACK packet: %w", err)
+		if mqtt == nil {
+			return status, nil, err
+		}
+		return status, &mqtt.results, err
+	}
+
+	if err := s.connect(mqtt); err != nil {
+		return zgrab2.TryGetScanStatus(err), &mqtt.results, err
+	}
+
+	if len(s.config.Probe) > 0 && mqtt.gotConnAck && mqtt.results.ConnectReturnCode == 0x00 {
+		s.runProbes(mqtt)
 	}
 
 	return zgrab2.SCAN_SUCCESS, &mqtt.results, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,385 @@
+// Package oracle contains the zgrab2 Module implementation for Oracle's TNS
+// (Transparent Network Substrate) protocol.
+//
+// The scan sends a TNS Connect packet and decodes whatever the listener
+// sends back (Accept, Refuse, Resend, or Redirect) far enough to fingerprint
+// the service; it does not attempt to complete a full database login.
+package oracle
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// TNS packet types. See the TNS wire protocol as implemented by SQL*Net.
+const (
+	tnsTypeConnect  byte = 1
+	tnsTypeAccept   byte = 2
+	tnsTypeRefuse   byte = 4
+	tnsTypeRedirect byte = 5
+	tnsTypeResend   byte = 11
+)
+
+// tnsPacketTypeNames maps TNS packet type bytes to human-readable names.
+var tnsPacketTypeNames = map[byte]string{
+	tnsTypeConnect:  "Connect",
+	tnsTypeAccept:   "Accept",
+	tnsTypeRefuse:   "Refuse",
+	tnsTypeRedirect: "Redirect",
+	tnsTypeResend:   "Resend",
+}
+
+// maxRedirects bounds how many Redirect responses we will follow.
+const maxRedirects = 3
+
+// HandshakeLog records what the TNS listener said during the handshake.
+type HandshakeLog struct {
+	// PacketType is the name of the final TNS packet type received (Accept, Refuse, ...).
+	PacketType string `json:"packet_type,omitempty"`
+
+	// NegotiatedVersion is the version field of an Accept packet.
+	NegotiatedVersion int `json:"negotiated_version,omitempty"`
+
+	// ServiceOptions is the global service options bitfield of an Accept packet.
+	ServiceOptions int `json:"service_options,omitempty"`
+
+	// UserReason and SystemReason are the two reason bytes of a Refuse packet.
+	UserReason   int `json:"user_reason,omitempty"`
+	SystemReason int `json:"system_reason,omitempty"`
+
+	// RefuseReason is the ASCII reason string that came with a Refuse packet,
+	// which frequently leaks the server's version.
+	RefuseReason string `json:"refuse_reason,omitempty"`
+
+	// RedirectData is the connect descriptor returned by a Redirect packet.
+	RedirectData string `json:"redirect_data,omitempty"`
+
+	// RedirectsFollowed counts how many Redirect responses were followed.
+	RedirectsFollowed int `json:"redirects_followed,omitempty"`
+
+	TLSLog *zgrab2.TLSLog `json:"tls,omitempty"`
+}
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	HandshakeLog *HandshakeLog `json:"handshake,omitempty"`
+}
+
+// Flags are the Oracle TNS-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+	zgrab2.TLSFlags
+
+	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+
+	Version              int    `long:"version" default:"312" description:"TNS version to advertise in the Connect packet"`
+	MinVersion           int    `long:"min-version" default:"300" description:"Minimum TNS version to advertise in the Connect packet"`
+	ReleaseVersion       string `long:"release-version" default:"11.2.0.4.0" description:"Dotted five-part release version string to advertise in CONNECT_DATA"`
+	GlobalServiceOptions int    `long:"global-service-options" default:"0" description:"Global service options bitfield to advertise"`
+	SDU                  int    `long:"sdu" default:"8192" description:"Session data unit size to advertise"`
+	TDU                  int    `long:"tdu" default:"8192" description:"Transport data unit size to advertise"`
+
+	ServiceName string `long:"service-name" description:"SERVICE_NAME to request in CONNECT_DATA"`
+	SID         string `long:"sid" description:"SID to request in CONNECT_DATA"`
+	Program     string `long:"program" default:"zgrab2" description:"PROGRAM value to advertise in CONNECT_DATA"`
+	CID         string `long:"cid" description:"CID program name to advertise in CONNECT_DATA"`
+
+	FollowRedirects bool `long:"follow-redirects" description:"Follow a Redirect response and retry the Connect against the returned address"`
+	TLS             bool `long:"tls" description:"Wrap the connection in TLS (TCPS)"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface, and holds the state for a single scan.
+type Scanner struct {
+	config *Flags
+}
+
+// Connection holds the state for a single connection to the Oracle listener.
+type Connection struct {
+	conn    net.Conn
+	config  *Flags
+	results ScanResults
+	tlsLog  *zgrab2.TLSLog
+}
+
+// RegisterModule registers the oracle zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("oracle", "Oracle", module.Description(), 1521, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object to be filled in with the command-line arguments.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Fingerprint an Oracle TNS listener via the Connect/Accept/Refuse handshake"
+}
+
+// Validate flags
+func (f *Flags) Validate(args []string) error {
+	return nil
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (s *Scanner) Protocol() string {
+	return "oracle"
+}
+
+// Init initializes the Scanner instance with the flags from the command line.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// connectDataString builds the CONNECT_DATA portion of a TNS Connect packet
+// from the configured flags.
+func connectDataString(f *Flags) string {
+	data := "(DESCRIPTION=(CONNECT_DATA="
+	if f.ServiceName != "" {
+		data += fmt.Sprintf("(SERVICE_NAME=%s)", f.ServiceName)
+	}
+	if f.SID != "" {
+		data += fmt.Sprintf("(SID=%s)", f.SID)
+	}
+	data += fmt.Sprintf("(PROGRAM=%s)", f.Program)
+	if f.ReleaseVersion != "" {
+		data += fmt.Sprintf("(RELEASE_VERSION=%s)", f.ReleaseVersion)
+	}
+	if f.CID != "" {
+		data += fmt.Sprintf("(CID=(PROGRAM=%s)(HOST=__jdbc__)(USER=%s))", f.Program, f.CID)
+	}
+	data += "))"
+	return data
+}
+
+// buildConnectPacket builds a full TNS packet (8-byte header plus body)
+// containing a Connect request.
+func buildConnectPacket(f *Flags) []byte {
+	connectData := []byte(connectDataString(f))
+
+	const connectBodyLen = 26
+	packetLen := tnsHeaderLen + connectBodyLen + len(connectData)
+
+	packet := make([]byte, packetLen)
+	writeTNSHeader(packet, tnsTypeConnect, uint16(packetLen))
+
+	body := packet[tnsHeaderLen:]
+	binary.BigEndian.PutUint16(body[0:2], uint16(f.Version))
+	binary.BigEndian.PutUint16(body[2:4], uint16(f.MinVersion))
+	binary.BigEndian.PutUint16(body[4:6], uint16(f.GlobalServiceOptions))
+	binary.BigEndian.PutUint16(body[6:8], uint16(f.SDU))
+	binary.BigEndian.PutUint16(body[8:10], uint16(f.TDU))
+	binary.BigEndian.PutUint16(body[10:12], 0x7f08) // NT protocol characteristics
+	binary.BigEndian.PutUint16(body[12:14], 0)      // line turnaround
+	binary.BigEndian.PutUint16(body[14:16], 1)      // value of 1 in hardware
+	binary.BigEndian.PutUint16(body[16:18], uint16(len(connectData)))
+	binary.BigEndian.PutUint16(body[18:20], uint16(connectBodyLen+tnsHeaderLen))
+	binary.BigEndian.PutUint32(body[20:24], 0) // max receivable connect data
+	body[24] = 0                               // connect flags 0
+	body[25] = 0                               // connect flags 1
+
+	copy(packet[tnsHeaderLen+connectBodyLen:], connectData)
+	return packet
+}
+
+// tnsHeaderLen is the size of the fixed TNS packet header.
+const tnsHeaderLen = 8
+
+// writeTNSHeader fills in the 8-byte TNS header at the start of packet.
+func writeTNSHeader(packet []byte, packetType byte, length uint16) {
+	binary.BigEndian.PutUint16(packet[0:2], length)
+	binary.BigEndian.PutUint16(packet[2:4], 0) // packet checksum
+	packet[4] = packetType
+	packet[5] = 0                              // reserved
+	binary.BigEndian.PutUint16(packet[6:8], 0) // header checksum
+}
+
+// readTNSPacket reads a single length-prefixed TNS packet and returns its
+// type byte and body (the bytes after the 8-byte header).
+func (o *Connection) readTNSPacket() (byte, []byte, error) {
+	header := make([]byte, tnsHeaderLen)
+	if _, err := readFull(o.conn, header); err != nil {
+		return 0, nil, fmt.Errorf("error reading TNS header: %w", err)
+	}
+
+	length := binary.BigEndian.Uint16(header[0:2])
+	packetType := header[4]
+	if length < tnsHeaderLen {
+		return packetType, nil, fmt.Errorf("invalid TNS packet length %d", length)
+	}
+
+	body := make([]byte, length-tnsHeaderLen)
+	if len(body) > 0 {
+		if _, err := readFull(o.conn, body); err != nil {
+			return packetType, nil, fmt.Errorf("error reading TNS body: %w", err)
+		}
+	}
+	return packetType, body, nil
+}
+
+// readFull reads exactly len(buf) bytes from conn.
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// parseAccept parses an Accept packet body into the handshake log.
+func parseAccept(body []byte, hs *HandshakeLog) error {
+	if len(body) < 8 {
+		return fmt.Errorf("Accept packet body too short (%d bytes)", len(body))
+	}
+	hs.NegotiatedVersion = int(binary.BigEndian.Uint16(body[0:2]))
+	hs.ServiceOptions = int(binary.BigEndian.Uint16(body[2:4]))
+	return nil
+}
+
+// parseRefuse parses a Refuse packet body into the handshake log.
+func parseRefuse(body []byte, hs *HandshakeLog) error {
+	if len(body) < 4 {
+		return fmt.Errorf("Refuse packet body too short (%d bytes)", len(body))
+	}
+	hs.UserReason = int(body[0])
+	hs.SystemReason = int(body[1])
+	dataLen := int(binary.BigEndian.Uint16(body[2:4]))
+	if 4+dataLen > len(body) {
+		dataLen = len(body) - 4
+	}
+	hs.RefuseReason = string(body[4 : 4+dataLen])
+	return nil
+}
+
+// parseRedirect parses a Redirect packet body into the handshake log.
+func parseRedirect(body []byte, hs *HandshakeLog) error {
+	if len(body) < 2 {
+		return fmt.Errorf("Redirect packet body too short (%d bytes)", len(body))
+	}
+	dataLen := int(binary.BigEndian.Uint16(body[0:2]))
+	if 2+dataLen > len(body) {
+		dataLen = len(body) - 2
+	}
+	hs.RedirectData = string(body[2 : 2+dataLen])
+	return nil
+}
+
+// Handshake drives the TNS Connect/Accept/Refuse/Resend/Redirect exchange,
+// retransmitting on Resend and, if configured, following one level of
+// Redirect.
+func (o *Connection) Handshake() error {
+	hs := &HandshakeLog{TLSLog: o.tlsLog}
+	o.results.HandshakeLog = hs
+
+	packet := buildConnectPacket(o.config)
+
+	for redirects := 0; ; {
+		if _, err := o.conn.Write(packet); err != nil {
+			return fmt.Errorf("error sending Connect packet: %w", err)
+		}
+
+		packetType, body, err := o.readTNSPacket()
+		if err != nil {
+			return err
+		}
+
+		hs.PacketType = tnsPacketTypeNames[packetType]
+
+		switch packetType {
+		case tnsTypeAccept:
+			return parseAccept(body, hs)
+		case tnsTypeRefuse:
+			return parseRefuse(body, hs)
+		case tnsTypeResend:
+			continue
+		case tnsTypeRedirect:
+			if err := parseRedirect(body, hs); err != nil {
+				return err
+			}
+			if !o.config.FollowRedirects || redirects >= maxRedirects {
+				return nil
+			}
+			redirects++
+			hs.RedirectsFollowed = redirects
+			continue
+		default:
+			return fmt.Errorf("unexpected TNS packet type 0x%02x", packetType)
+		}
+	}
+}
+
+// Scan performs the configured scan on the Oracle TNS listener.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	conn, err := t.Open(&s.config.BaseFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	defer conn.Close()
+
+	o := Connection{conn: conn, config: s.config}
+
+	if s.config.TLS {
+		tlsConn, err := s.config.TLSFlags.GetTLSConnection(conn)
+		if err != nil {
+			return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error setting up TLS connection: %w", err)
+		}
+		o.tlsLog = tlsConn.GetLog()
+		if err := tlsConn.Handshake(); err != nil {
+			return zgrab2.TryGetScanStatus(err), &o.results, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		o.conn = tlsConn
+	}
+
+	if err := o.Handshake(); err != nil {
+		return zgrab2.TryGetScanStatus(err), &o.results, fmt.Errorf("error during TNS handshake: %w", err)
+	}
+
+	if o.results.HandshakeLog != nil && o.results.HandshakeLog.PacketType == "Refuse" {
+		return zgrab2.SCAN_APPLICATION_ERROR, &o.results, nil
+	}
+
+	return zgrab2.SCAN_SUCCESS, &o.results, nil
+}
@@ -1,284 +1,438 @@
-// Package radius provides a zgrab2 module that probes for the RADIUS service.
-package radius
-
-import (
-	"encoding/binary"
-	"errors"
-	"fmt"
-	"net"
-	"time"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-const (
-	AccessRequest   = 1
-	AccessAccept    = 2
-	AccessReject    = 3
-	AccessChallenge = 11
-	RadiusPort      = 1812
-)
-
-var (
-	ErrInvalidCode      = errors.New("invalid RADIUS code")
-	ErrInvalidResponse  = errors.New("invalid RADIUS response")
-	ErrTooShortResponse = errors.New("response is too short")
-)
-
-type RADIUSHeader struct {
-	Code          uint8
-	Identifier    uint8
-	Length        uint16
-	Authenticator [16]byte
-}
-
-func (hdr *RADIUSHeader) Encode() ([]byte, error) {
-	buf := make([]byte, 20)
-	buf[0] = hdr.Code
-	buf[1] = hdr.Identifier
-	binary.BigEndian.PutUint16(buf[2:4], hdr.Length)
-	copy(buf[4:20], hdr.Authenticator[:])
-	return buf, nil
-}
-
-type RADIUSAttribute struct {
-	Type   uint8
-	Length uint8
-	Value  []byte
-}
-
-func (attr *RADIUSAttribute) Encode() ([]byte, error) {
-	buf := make([]byte, 2+len(attr.Value))
-	buf[0] = attr.Type
-	buf[1] = attr.Length
-	copy(buf[2:], attr.Value)
-	return buf, nil
-}
-
-// Flags holds the command-line flags for the scanner.
-type Flags struct {
-	zgrab2.BaseFlags
-	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
-}
-
-// Help returns the module's help string, which is required to implement zgrab2.ScanFlags.
-func (f *Flags) Help() string {
-	return "Module to scan RADIUS servers"
-}
-
-// Validate checks that the flags are valid, required to implement zgrab2.ScanFlags.
-func (f *Flags) Validate(args []string) error {
-	return nil
-}
-
-// Module is the zgrab2 module implementation.
-type Module struct{}
-
-// Scanner holds the state for a single scan.
-type Scanner struct {
-	config *Flags
-}
-
-// RegisterModule registers the module with zgrab2.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("radius", "RADIUS", module.Description(), RadiusPort, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns a flags instance to be populated with the command line args.
-func (module *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new RADIUS scanner instance.
-func (module *Module) NewScanner() zgrab2.Scanner {
-	return &Scanner{}
-}
-
-// Description returns an overview of this module.
-func (module *Module) Description() string {
-	return "Scan for RADIUS"
-}
-
-// Init initializes the scanner.
-func (scanner *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, ok := flags.(*Flags)
-	if !ok {
-		return errors.New("invalid flags type")
-	}
-	scanner.config = f
-	return nil
-}
-
-// InitPerSender initializes the scanner for a given sender.
-func (scanner *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// Protocol returns the protocol identifier for the scanner.
-func (s *Scanner) Protocol() string {
-	return "radius"
-}
-
-// GetName returns the module's name.
-func (scanner *Scanner) GetName() string {
-	return "radius"
-}
-
-// GetTrigger returns an empty trigger since no specific trigger is used for this scan.
-func (scanner *Scanner) GetTrigger() string {
-	return ""
-}
-
-// buildAccessRequest constructs the Access-Request packet with required attributes.
-func buildAccessRequest(identifier uint8, ipAddr net.IP, port uint16) ([]byte, error) {
-	// Build the Access-Request header
-	header := &RADIUSHeader{
-		Code:          AccessRequest,
-		Identifier:    identifier,
-		Authenticator: generateRandomAuthenticator(),
-	}
-
-	// Build attributes
-	userNameAttr := RADIUSAttribute{
-		Type:   1,
-		Length: uint8(2 + len("test")),
-		Value:  []byte("test"),
-	}
-
-	nasIPAttr := RADIUSAttribute{
-		Type:   4,
-		Length: 6,
-		Value:  ipAddr.To4(),
-	}
-
-	nasPortAttr := RADIUSAttribute{
-		Type:   5,
-		Length: 6,
-		Value:  []byte{0, 0, byte(port >> 8), byte(port & 0xff)},
-	}
-
-	// Encode the header and attributes
-	headerBytes, err := header.Encode()
-	if err != nil {
-		return nil, err
-	}
-
-	userNameBytes, err := userNameAttr.Encode()
-	if err != nil {
-		return nil, err
-	}
-
-	nasIPBytes, err := nasIPAttr.Encode()
-	if err != nil {
-		return nil, err
-	}
-
-	nasPortBytes, err := nasPortAttr.Encode()
-	if err != nil {
-		return nil, err
-	}
-
-	// Combine everything into one packet
-	packet := append(headerBytes, userNameBytes...)
-	packet = append(packet, nasIPBytes...)
-	packet = append(packet, nasPortBytes...)
-
-	// Set the final packet length
-	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
-
-	return packet, nil
-}
-
-// SendAccessRequest sends an Access-Request to the RADIUS server and waits for a response.
-func (scanner *Scanner) SendAccessRequest(sock net.Conn) (*RADIUSHeader, error) {
-	identifier := generateRandomIdentifier()
-	ipAddr := net.ParseIP("192.168.0.1") // Placeholder, replace with actual client IP
-
-	packet, err := buildAccessRequest(identifier, ipAddr, RadiusPort)
-	if err != nil {
-		return nil, err
-	}
-
-	_, err = sock.Write(packet)
-	if err != nil {
-		return nil, err
-	}
-
-	// Read the response
-	buf := make([]byte, 512)
-	n, err := sock.Read(buf)
-	if err != nil {
-		return nil, err
-	}
-
-	// Ensure the response is at least 20 bytes (minimum RADIUS packet size)
-	if n < 20 {
-		return nil, ErrTooShortResponse
-	}
-
-	// Parse the RADIUS response
-	response := &RADIUSHeader{}
-	response.Code = buf[0]
-	response.Identifier = buf[1]
-	response.Length = binary.BigEndian.Uint16(buf[2:4])
-	copy(response.Authenticator[:], buf[4:20])
-
-	return response, nil
-}
-
-// ValidateResponse checks if the response is valid and logs the outcome.
-func (scanner *Scanner) ValidateResponse(header *RADIUSHeader) error {
-	switch header.Code {
-	case AccessAccept:
-		log.Info("Received Access-Accept")
-	case AccessReject:
-		log.Info("Received Access-Reject")
-	case AccessChallenge:
-		log.Info("Received Access-Challenge")
-	default:
-		return fmt.Errorf("%w: received code %d", ErrInvalidCode, header.Code)
-	}
-	return nil
-}
-
-// Scan scans the target for RADIUS service.
-func (scanner *Scanner) Scan(t zgrab2.ScanTarget) (zgrab2.ScanStatus, interface{}, error) {
-	sock, err := t.OpenUDP(&scanner.config.BaseFlags, nil)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, err
-	}
-	defer sock.Close()
-
-	// Send the Access-Request
-	respHeader, err := scanner.SendAccessRequest(sock)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, err
-	}
-
-	// Validate the response
-	err = scanner.ValidateResponse(respHeader)
-	if err != nil {
-		return zgrab2.SCAN_PROTOCOL_ERROR, nil, err
-	}
-
-	return zgrab2.SCAN_SUCCESS, respHeader, nil
-}
-
-// generateRandomAuthenticator generates a random 16-byte authenticator.
-func generateRandomAuthenticator() [16]byte {
-	var authenticator [16]byte
-	for i := range authenticator {
-		authenticator[i] = byte(time.Now().UnixNano() % 256)
-	}
-	return authenticator
-}
-
-// generateRandomIdentifier generates a random identifier for RADIUS request.
-func generateRandomIdentifier() uint8 {
-	return uint8(time.Now().UnixNano() % 256)
-}
+// Package radius provides a zgrab2 module that probes for the RADIUS service.
+package radius
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+const (
+	AccessRequest   = 1
+	AccessAccept    = 2
+	AccessReject    = 3
+	AccessChallenge = 11
+	RadiusPort      = 1812
+	RadSecPort      = 2083
+)
+
+var (
+	ErrInvalidCode      = errors.New("invalid RADIUS code")
+	ErrInvalidResponse  = errors.New("invalid RADIUS response")
+	ErrTooShortResponse = errors.New("response is too short")
+)
+
+type RADIUSHeader struct {
+	Code          uint8
+	Identifier    uint8
+	Length        uint16
+	Authenticator [16]byte
+}
+
+func (hdr *RADIUSHeader) Encode() ([]byte, error) {
+	buf := make([]byte, 20)
+	buf[0] = hdr.Code
+	buf[1] = hdr.Identifier
+	binary.BigEndian.PutUint16(buf[2:4], hdr.Length)
+	copy(buf[4:20], hdr.Authenticator[:])
+	return buf, nil
+}
+
+type RADIUSAttribute struct {
+	Type   uint8  `json:"type"`
+	Length uint8  `json:"length"`
+	Value  []byte `json:"value"`
+}
+
+func (attr *RADIUSAttribute) Encode() ([]byte, error) {
+	buf := make([]byte, 2+len(attr.Value))
+	buf[0] = attr.Type
+	buf[1] = attr.Length
+	copy(buf[2:], attr.Value)
+	return buf, nil
+}
+
+// parseAttributes decodes the TLV attributes following a RADIUS header.
+func parseAttributes(data []byte) ([]RADIUSAttribute, error) {
+	var attrs []RADIUSAttribute
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return attrs, fmt.Errorf("truncated attribute")
+		}
+		length := data[1]
+		if length < 2 || int(length) > len(data) {
+			return attrs, fmt.Errorf("invalid attribute length %d", length)
+		}
+		attrs = append(attrs, RADIUSAttribute{
+			Type:   data[0],
+			Length: length,
+			Value:  append([]byte{}, data[2:length]...),
+		})
+		data = data[length:]
+	}
+	return attrs, nil
+}
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	// Code is the RADIUS response code (Access-Accept, Access-Reject, Access-Challenge).
+	Code uint8 `json:"code"`
+
+	// Identifier is the response's echoed packet identifier.
+	Identifier uint8 `json:"identifier"`
+
+	// AuthenticatorValid reports whether the response authenticator matched
+	// the value computed from the shared secret. Always false if no secret
+	// was configured, since the authenticator cannot be verified without one.
+	AuthenticatorValid bool `json:"authenticator_valid"`
+
+	// Attributes holds the parsed TLV attributes from the response.
+	Attributes []RADIUSAttribute `json:"attributes,omitempty"`
+
+	// Raw is the raw response packet as received on the wire.
+	Raw []byte `json:"raw,omitempty"`
+
+	// TLSLog is the standard shared TLS handshake log. Only present when
+	// --radsec is set.
+	TLSLog *zgrab2.TLSLog `json:"tls,omitempty"`
+}
+
+// Flags holds the command-line flags for the scanner.
+type Flags struct {
+	zgrab2.BaseFlags
+	zgrab2.TLSFlags
+	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+
+	Secret     string `long:"secret" description:"Shared secret used to verify the response authenticator"`
+	SecretFile string `long:"secret-file" description:"File containing the shared secret used to verify the response authenticator"`
+
+	Strict bool `long:"strict" description:"Downgrade the scan status to protocol-error if the response authenticator fails to verify"`
+
+	RadSec     bool `long:"radsec" description:"Speak RADIUS-over-TLS (RFC 6614) instead of plain UDP"`
+	RadSecPort uint `long:"radsec-port" default:"2083" description:"TCP port to use for --radsec"`
+}
+
+// Module is the zgrab2 module implementation.
+type Module struct{}
+
+// Scanner holds the state for a single scan.
+type Scanner struct {
+	config *Flags
+	secret []byte
+}
+
+// RegisterModule registers the module with zgrab2.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("radius", "RADIUS", module.Description(), RadiusPort, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns a flags instance to be populated with the command line args.
+func (module *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new RADIUS scanner instance.
+func (module *Module) NewScanner() zgrab2.Scanner {
+	return &Scanner{}
+}
+
+// Description returns an overview of this module.
+func (module *Module) Description() string {
+	return "Scan for RADIUS"
+}
+
+// Validate checks that the flags are valid, required to implement zgrab2.ScanFlags.
+func (f *Flags) Validate(args []string) error {
+	if f.Secret != "" && f.SecretFile != "" {
+		return errors.New("only one of --secret or --secret-file may be set")
+	}
+	return nil
+}
+
+// Help returns the module's help string, which is required to implement zgrab2.ScanFlags.
+func (f *Flags) Help() string {
+	return "Module to scan RADIUS servers"
+}
+
+// Init initializes the scanner.
+func (scanner *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, ok := flags.(*Flags)
+	if !ok {
+		return errors.New("invalid flags type")
+	}
+	scanner.config = f
+
+	if f.SecretFile != "" {
+		data, err := os.ReadFile(f.SecretFile)
+		if err != nil {
+			return fmt.Errorf("error reading --secret-file: %w", err)
+		}
+		scanner.secret = []byte(strings.TrimRight(string(data), "\r\n"))
+	} else if f.Secret != "" {
+		scanner.secret = []byte(f.Secret)
+	}
+
+	return nil
+}
+
+// InitPerSender initializes the scanner for a given sender.
+func (scanner *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (s *Scanner) Protocol() string {
+	return "radius"
+}
+
+// GetName returns the module's name.
+func (scanner *Scanner) GetName() string {
+	return scanner.config.Name
+}
+
+// GetTrigger returns an empty trigger since no specific trigger is used for this scan.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// buildAccessRequest constructs the Access-Request packet with required attributes.
+func buildAccessRequest(identifier uint8, authenticator [16]byte, ipAddr net.IP, port uint16) ([]byte, error) {
+	// Build the Access-Request header
+	header := &RADIUSHeader{
+		Code:          AccessRequest,
+		Identifier:    identifier,
+		Authenticator: authenticator,
+	}
+
+	// Build attributes
+	userNameAttr := RADIUSAttribute{
+		Type:   1,
+		Length: uint8(2 + len("test")),
+		Value:  []byte("test"),
+	}
+
+	nasIPAttr := RADIUSAttribute{
+		Type:   4,
+		Length: 6,
+		Value:  ipAddr.To4(),
+	}
+
+	nasPortAttr := RADIUSAttribute{
+		Type:   5,
+		Length: 6,
+		Value:  []byte{0, 0, byte(port >> 8), byte(port & 0xff)},
+	}
+
+	// Encode the header and attributes
+	headerBytes, err := header.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	userNameBytes, err := userNameAttr.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	nasIPBytes, err := nasIPAttr.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	nasPortBytes, err := nasPortAttr.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	// Combine everything into one packet
+	packet := append(headerBytes, userNameBytes...)
+	packet = append(packet, nasIPBytes...)
+	packet = append(packet, nasPortBytes...)
+
+	// Set the final packet length
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+
+	return packet, nil
+}
+
+// verifyResponseAuthenticator checks the response authenticator per RFC 2865
+// section 3: MD5(Code + ID + Length + RequestAuthenticator + Attributes + Secret).
+func verifyResponseAuthenticator(resp []byte, reqAuthenticator [16]byte, secret []byte) bool {
+	if len(resp) < 20 || len(secret) == 0 {
+		return false
+	}
+	h := md5.New()
+	h.Write(resp[0:4])
+	h.Write(reqAuthenticator[:])
+	h.Write(resp[20:])
+	h.Write(secret)
+	expected := h.Sum(nil)
+	return string(expected) == string(resp[4:20])
+}
+
+// SendAccessRequest sends an Access-Request to the RADIUS server and waits
+// for a response, returning the parsed response header, the raw response
+// bytes, and the request authenticator we sent (needed to verify the reply).
+func (scanner *Scanner) SendAccessRequest(sock net.Conn) (response *RADIUSHeader, raw []byte, sentAuthenticator [16]byte, err error) {
+	identifier, err := generateRandomIdentifier()
+	if err != nil {
+		return nil, nil, sentAuthenticator, err
+	}
+	sentAuthenticator, err = generateRandomAuthenticator()
+	if err != nil {
+		return nil, nil, sentAuthenticator, err
+	}
+	ipAddr := net.ParseIP("192.168.0.1") // Placeholder, replace with actual client IP
+
+	packet, err := buildAccessRequest(identifier, sentAuthenticator, ipAddr, RadiusPort)
+	if err != nil {
+		return nil, nil, sentAuthenticator, err
+	}
+
+	if _, err = sock.Write(packet); err != nil {
+		return nil, nil, sentAuthenticator, err
+	}
+
+	// Read the response
+	buf := make([]byte, 512)
+	n, err := sock.Read(buf)
+	if err != nil {
+		return nil, nil, sentAuthenticator, err
+	}
+	raw = buf[:n]
+
+	// Ensure the response is at least 20 bytes (minimum RADIUS packet size)
+	if n < 20 {
+		return nil, raw, sentAuthenticator, ErrTooShortResponse
+	}
+
+	// Parse the RADIUS response
+	response = &RADIUSHeader{}
+	response.Code = raw[0]
+	response.Identifier = raw[1]
+	response.Length = binary.BigEndian.Uint16(raw[2:4])
+	copy(response.Authenticator[:], raw[4:20])
+
+	return response, raw, sentAuthenticator, nil
+}
+
+// ValidateResponse checks if the response is valid and logs the outcome.
+func (scanner *Scanner) ValidateResponse(header *RADIUSHeader) error {
+	switch header.Code {
+	case AccessAccept:
+		log.Info("Received Access-Accept")
+	case AccessReject:
+		log.Info("Received Access-Reject")
+	case AccessChallenge:
+		log.Info("Received Access-Challenge")
+	default:
+		return fmt.Errorf("%w: received code %d", ErrInvalidCode, header.Code)
+	}
+	return nil
+}
+
+// dialRadSec opens a TCP connection to the target on --radsec-port (unless
+// overridden by the target itself) and wraps it in TLS, per RFC 6614.
+func (scanner *Scanner) dialRadSec(t zgrab2.ScanTarget) (net.Conn, *zgrab2.TLSLog, error) {
+	bf := scanner.config.BaseFlags
+	if t.Port == nil {
+		bf.Port = scanner.config.RadSecPort
+	}
+
+	conn, err := t.Open(&bf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening RadSec connection: %w", err)
+	}
+
+	tlsConn, err := scanner.config.TLSFlags.GetTLSConnection(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("error setting up TLS connection: %w", err)
+	}
+	tlsLog := tlsConn.GetLog()
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, tlsLog, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return tlsConn, tlsLog, nil
+}
+
+// Scan scans the target for RADIUS service.
+func (scanner *Scanner) Scan(t zgrab2.ScanTarget) (zgrab2.ScanStatus, interface{}, error) {
+	var sock net.Conn
+	var tlsLog *zgrab2.TLSLog
+	var err error
+
+	if scanner.config.RadSec {
+		sock, tlsLog, err = scanner.dialRadSec(t)
+	} else {
+		sock, err = t.OpenUDP(&scanner.config.BaseFlags, nil)
+	}
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), &ScanResults{TLSLog: tlsLog}, err
+	}
+	defer sock.Close()
+
+	respHeader, raw, sentAuthenticator, err := scanner.SendAccessRequest(sock)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), &ScanResults{TLSLog: tlsLog}, err
+	}
+
+	results := &ScanResults{
+		Code:       respHeader.Code,
+		Identifier: respHeader.Identifier,
+		Raw:        raw,
+		TLSLog:     tlsLog,
+	}
+
+	attrs, attrErr := parseAttributes(raw[20:])
+	results.Attributes = attrs
+
+	if scanner.secret != nil {
+		results.AuthenticatorValid = verifyResponseAuthenticator(raw, sentAuthenticator, scanner.secret)
+		if scanner.config.Strict && !results.AuthenticatorValid {
+			return zgrab2.SCAN_PROTOCOL_ERROR, results, fmt.Errorf("response authenticator failed to verify")
+		}
+	}
+
+	if attrErr != nil {
+		return zgrab2.SCAN_PROTOCOL_ERROR, results, attrErr
+	}
+
+	if err := scanner.ValidateResponse(respHeader); err != nil {
+		return zgrab2.SCAN_PROTOCOL_ERROR, results, err
+	}
+
+	return zgrab2.SCAN_SUCCESS, results, nil
+}
+
+// generateRandomAuthenticator generates a random 16-byte authenticator, as
+// required by RFC 2865 section 3.
+func generateRandomAuthenticator() ([16]byte, error) {
+	var authenticator [16]byte
+	if _, err := rand.Read(authenticator[:]); err != nil {
+		return authenticator, fmt.Errorf("error generating request authenticator: %w", err)
+	}
+	return authenticator, nil
+}
+
+// generateRandomIdentifier generates a random identifier for the RADIUS request.
+func generateRandomIdentifier() (uint8, error) {
+	var b [1]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, fmt.Errorf("error generating packet identifier: %w", err)
+	}
+	return b[0], nil
+}
@@ -0,0 +1,37 @@
+package radius
+
+import (
+	"crypto/md5"
+	"testing"
+)
+
+func TestVerifyResponseAuthenticator(t *testing.T) {
+	secret := []byte("testing123")
+	reqAuthenticator := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	resp := append([]byte{AccessAccept, 7, 0, 20}, make([]byte, 16)...)
+	h := md5.New()
+	h.Write(resp[0:4])
+	h.Write(reqAuthenticator[:])
+	h.Write(resp[20:])
+	h.Write(secret)
+	copy(resp[4:20], h.Sum(nil))
+
+	if !verifyResponseAuthenticator(resp, reqAuthenticator, secret) {
+		t.Fatal("expected a correctly computed response authenticator to verify")
+	}
+
+	tampered := append([]byte(nil), resp...)
+	tampered[4] ^= 0xFF
+	if verifyResponseAuthenticator(tampered, reqAuthenticator, secret) {
+		t.Fatal("expected a tampered response authenticator to fail verification")
+	}
+
+	if verifyResponseAuthenticator(resp[:19], reqAuthenticator, secret) {
+		t.Fatal("expected a too-short response to fail verification")
+	}
+
+	if verifyResponseAuthenticator(resp, reqAuthenticator, nil) {
+		t.Fatal("expected verification to fail with no shared secret")
+	}
+}
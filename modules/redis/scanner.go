@@ -0,0 +1,342 @@
+// Package redis contains the zgrab2 Module implementation for Redis.
+//
+// The scan runs a small built-in probe (PING, INFO, CONFIG GET maxmemory,
+// CLIENT GETNAME) over RESP, then optionally an operator-supplied sequence
+// of custom commands. Command names in the built-in probe can be remapped
+// to survive `rename-command` hardening, and commands can be sent as
+// inline text instead of RESP arrays for servers that reject multi-bulk
+// input before authentication.
+package redis
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+	"gopkg.in/yaml.v2"
+)
+
+// builtinProbe is the ordered set of commands the scan always attempts,
+// keyed by their canonical (unrenamed) command name.
+var builtinProbe = []struct {
+	Name string
+	Args []string
+}{
+	{"PING", nil},
+	{"INFO", nil},
+	{"CONFIG", []string{"GET", "maxmemory"}},
+	{"CLIENT", []string{"GETNAME"}},
+}
+
+// CustomCommand is a single entry in a --custom-commands file: a labeled,
+// ordered RESP command to run after the built-in probe.
+type CustomCommand struct {
+	Label   string   `json:"label" yaml:"label"`
+	Command []string `json:"command" yaml:"command"`
+}
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	// AuthResponse is the server's reply to AUTH, if --password was set.
+	AuthResponse string `json:"auth_response,omitempty"`
+
+	// Responses holds the built-in probe's replies, keyed by canonical
+	// command name (PING, INFO, CONFIG, CLIENT) regardless of any
+	// --mappings rename applied on the wire.
+	Responses map[string]string `json:"responses,omitempty"`
+
+	// CustomResponses holds the --custom-commands replies, keyed by label.
+	CustomResponses map[string]string `json:"custom_responses,omitempty"`
+}
+
+// Flags are the Redis-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+
+	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+
+	Password       string `long:"password" description:"Password to send via AUTH before any other command"`
+	Inline         bool   `long:"inline" description:"Send inline commands instead of RESP multi-bulk arrays"`
+	CustomCommands string `long:"custom-commands" description:"Path to a JSON or YAML file listing an ordered sequence of labeled RESP commands to run after the built-in probe"`
+	Mappings       string `long:"mappings" description:"Path to a JSON or YAML file mapping built-in command names (INFO, CONFIG, CLIENT) to their renamed equivalents"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface, and holds the state for a single scan.
+type Scanner struct {
+	config         *Flags
+	customCommands []CustomCommand
+	mappings       map[string]string
+}
+
+// Connection holds the state for a single connection to the Redis server.
+type Connection struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	config  *Flags
+	scanner *Scanner
+	results ScanResults
+}
+
+// RegisterModule registers the redis zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("redis", "Redis", module.Description(), 6379, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object to be filled in with the command-line arguments.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Probe a Redis server over RESP, with support for renamed/custom commands"
+}
+
+// Validate flags
+func (f *Flags) Validate(args []string) error {
+	return nil
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (s *Scanner) Protocol() string {
+	return "redis"
+}
+
+// loadStructuredFile decodes path into v, trying JSON first for a ".json"
+// extension and YAML otherwise.
+func loadStructuredFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		if err := json.Unmarshal(data, v); err != nil {
+			return fmt.Errorf("error parsing %s as JSON: %w", path, err)
+		}
+		return nil
+	}
+	if err := yaml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error parsing %s as YAML: %w", path, err)
+	}
+	return nil
+}
+
+// Init initializes the Scanner instance with the flags from the command line.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+
+	if f.CustomCommands != "" {
+		var commands []CustomCommand
+		if err := loadStructuredFile(f.CustomCommands, &commands); err != nil {
+			return fmt.Errorf("error loading --custom-commands: %w", err)
+		}
+		s.customCommands = commands
+	}
+
+	if f.Mappings != "" {
+		mappings := make(map[string]string)
+		if err := loadStructuredFile(f.Mappings, &mappings); err != nil {
+			return fmt.Errorf("error loading --mappings: %w", err)
+		}
+		s.mappings = mappings
+	}
+
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// encodeRESPArray encodes args as a RESP multi-bulk array command.
+func encodeRESPArray(args []string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return []byte(b.String())
+}
+
+// encodeInline encodes args as an inline command.
+func encodeInline(args []string) []byte {
+	return []byte(strings.Join(args, " ") + "\r\n")
+}
+
+// readRESPReply reads a single RESP reply from r, returning its raw
+// (non-parsed) text representation.
+func readRESPReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return "", fmt.Errorf("empty RESP reply")
+	}
+
+	switch line[0] {
+	case '+', '-', ':':
+		return line, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return line, fmt.Errorf("invalid bulk string length: %w", err)
+		}
+		if n < 0 {
+			return line, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return line, err
+		}
+		return line + "\r\n" + string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return line, fmt.Errorf("invalid array length: %w", err)
+		}
+		parts := []string{line}
+		for i := 0; i < n; i++ {
+			elem, err := readRESPReply(r)
+			if err != nil {
+				return strings.Join(parts, "\r\n"), err
+			}
+			parts = append(parts, elem)
+		}
+		return strings.Join(parts, "\r\n"), nil
+	default:
+		return line, nil
+	}
+}
+
+// runCommand sends args (as a RESP array, or inline if --inline is set) and
+// returns the raw text of the server's reply.
+func (r *Connection) runCommand(args []string) (string, error) {
+	var payload []byte
+	if r.config.Inline {
+		payload = encodeInline(args)
+	} else {
+		payload = encodeRESPArray(args)
+	}
+
+	if _, err := r.conn.Write(payload); err != nil {
+		return "", fmt.Errorf("error sending command: %w", err)
+	}
+
+	reply, err := readRESPReply(r.reader)
+	if err != nil {
+		return reply, fmt.Errorf("error reading reply: %w", err)
+	}
+	return reply, nil
+}
+
+// resolveCommand returns the (possibly renamed) command name for name,
+// according to the loaded --mappings file.
+func (r *Connection) resolveCommand(name string) string {
+	if r.scanner.mappings != nil {
+		if mapped, ok := r.scanner.mappings[name]; ok {
+			return mapped
+		}
+	}
+	return name
+}
+
+// authenticate sends AUTH with the configured password and records the
+// server's reply; the password itself is never included in ScanResults.
+func (r *Connection) authenticate() error {
+	reply, err := r.runCommand([]string{"AUTH", r.config.Password})
+	r.results.AuthResponse = reply
+	if err != nil {
+		return fmt.Errorf("error sending AUTH: %w", err)
+	}
+	return nil
+}
+
+// runBuiltinProbe runs the fixed PING/INFO/CONFIG/CLIENT probe, applying
+// any --mappings rename to the command actually sent on the wire.
+func (r *Connection) runBuiltinProbe() {
+	r.results.Responses = make(map[string]string, len(builtinProbe))
+	for _, cmd := range builtinProbe {
+		args := append([]string{r.resolveCommand(cmd.Name)}, cmd.Args...)
+		reply, err := r.runCommand(args)
+		if err != nil {
+			reply = fmt.Sprintf("ERROR: %v", err)
+		}
+		r.results.Responses[cmd.Name] = reply
+	}
+}
+
+// runCustomCommands runs the operator-supplied --custom-commands sequence.
+func (r *Connection) runCustomCommands() {
+	if len(r.scanner.customCommands) == 0 {
+		return
+	}
+	r.results.CustomResponses = make(map[string]string, len(r.scanner.customCommands))
+	for _, custom := range r.scanner.customCommands {
+		reply, err := r.runCommand(custom.Command)
+		if err != nil {
+			reply = fmt.Sprintf("ERROR: %v", err)
+		}
+		r.results.CustomResponses[custom.Label] = reply
+	}
+}
+
+// Scan performs the configured scan on the Redis server.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	conn, err := t.Open(&s.config.BaseFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	defer conn.Close()
+
+	rdb := Connection{conn: conn, reader: bufio.NewReader(conn), config: s.config, scanner: s}
+
+	if s.config.Password != "" {
+		if err := rdb.authenticate(); err != nil {
+			return zgrab2.TryGetScanStatus(err), &rdb.results, err
+		}
+	}
+
+	rdb.runBuiltinProbe()
+	rdb.runCustomCommands()
+
+	return zgrab2.SCAN_SUCCESS, &rdb.results, nil
+}
@@ -1,170 +1,341 @@
-// Package rethinkdb contains the zgrab2 Module implementation for RethinkDB.
-//
-// The scan performs a handshake with the RethinkDB server and retrieves the
-// initial response message.
-package rethinkdb
-
-import (
-	"encoding/json"
-	"fmt"
-	"net"
-	"strings"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-// ScanResults is the output of the scan.
-type ScanResults struct {
-	// Banner is the initial data sent by the server.
-	Banner string `json:"banner,omitempty"`
-
-	// HandshakeResponse is the response to the initial handshake message.
-	HandshakeResponse string `json:"handshake_response,omitempty"`
-}
-
-// Flags are the RethinkDB-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct {
-}
-
-// Scanner implements the zgrab2.Scanner interface, and holds the state
-// for a single scan.
-type Scanner struct {
-	config *Flags
-}
-
-// Connection holds the state for a single connection to the RethinkDB server.
-type Connection struct {
-	buffer  [10000]byte
-	config  *Flags
-	results ScanResults
-	conn    net.Conn
-}
-
-// RegisterModule registers the rethinkdb zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("rethinkdb", "RethinkDB", module.Description(), 28015, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns the default flags object to be filled in with the
-// command-line arguments.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns an overview of this module.
-func (m *Module) Description() string {
-	return "Perform a handshake with a RethinkDB server and retrieve the initial response message."
-}
-
-// Validate flags
-func (f *Flags) Validate(args []string) error {
-	return nil
-}
-
-// Help returns this module's help string.
-func (f *Flags) Help() string {
-	return ""
-}
-
-// Protocol returns the protocol identifier for the scanner.
-func (s *Scanner) Protocol() string {
-	return "rethinkdb"
-}
-
-// Init initializes the Scanner instance with the flags from the command
-// line.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// GetName returns the configured name for the Scanner.
-func (s *Scanner) GetName() string {
-	return s.config.Name
-}
-
-// GetTrigger returns the Trigger defined in the Flags.
-func (scanner *Scanner) GetTrigger() string {
-	return scanner.config.Trigger
-}
-
-// readResponse reads a response from the RethinkDB server until null character.
-func (rdb *Connection) readResponse() (string, error) {
-	var response []byte
-	buffer := make([]byte, 1)
-	for {
-		_, err := rdb.conn.Read(buffer)
-		if err != nil {
-			return "", err
-		}
-		if buffer[0] == 0 {
-			break
-		}
-		response = append(response, buffer[0])
-	}
-	return string(response), nil
-}
-
-// sendHandshake sends the initial handshake message to the RethinkDB server.
-func (rdb *Connection) sendHandshake() error {
-	// Send the magic number: c3 bd c2 34
-	magicNumber := []byte{0xc3, 0xbd, 0xc2, 0x34}
-	_, err := rdb.conn.Write(magicNumber)
-	return err
-}
-
-// Scan performs the configured scan on the RethinkDB server, as follows:
-//   - Send the initial handshake message.
-//   - Read and validate the response.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
-	var err error
-	conn, err := t.Open(&s.config.BaseFlags)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
-	}
-	defer conn.Close()
-
-	rdb := Connection{conn: conn, config: s.config}
-	if err := rdb.sendHandshake(); err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error sending handshake: %w", err)
-	}
-
-	response, err := rdb.readResponse()
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error reading response: %w", err)
-	}
-
-	rdb.results.HandshakeResponse = response
-
-	var jsonResponse map[string]interface{}
-	if err := json.Unmarshal([]byte(response), &jsonResponse); err != nil {
-		return zgrab2.SCAN_PROTOCOL_ERROR, &rdb.results, fmt.Errorf("error parsing JSON response: %w", err)
-	}
-
-	if strings.Contains(response, "success") {
-		return zgrab2.SCAN_SUCCESS, &rdb.results, nil
-	}
-	return zgrab2.SCAN_APPLICATION_ERROR, &rdb.results, nil
-}
+// Package rethinkdb contains the zgrab2 Module implementation for RethinkDB.
+//
+// The scan performs the V1_0 handshake with the RethinkDB server: it sends
+// the magic number, parses the resulting JSON status message, and,
+// optionally, continues into the SCRAM-SHA-256 client-first exchange far
+// enough to recover the server's salt/iteration-count/nonce challenge.
+package rethinkdb
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// maxHandshakeResponse bounds how much of a reply we will buffer before
+// giving up on ever seeing a NUL terminator.
+const maxHandshakeResponse = 16 * 1024
+
+// readTimeout bounds how long we will wait for any single handshake message.
+const readTimeout = 5 * time.Second
+
+// magicNumbers maps the --magic-version flag values to the four magic bytes
+// RethinkDB expects at the start of a connection.
+var magicNumbers = map[string][4]byte{
+	"V0_3": {0x3f, 0x61, 0xba, 0x5e},
+	"V0_4": {0x20, 0x2d, 0x0c, 0x40},
+	"V1_0": {0xc3, 0xbd, 0xc2, 0x34},
+}
+
+// scramChallengeRegex extracts the nonce, salt, and iteration count out of a
+// SCRAM-SHA-256 server-first-message, e.g. "r=<nonce>,s=<salt>,i=<iterations>".
+var scramChallengeRegex = regexp.MustCompile(`r=([^,]+),s=([^,]+),i=(\d+)`)
+
+// ScramChallenge records the parameters returned in a SCRAM-SHA-256
+// server-first-message, without necessarily completing authentication.
+type ScramChallenge struct {
+	// ServerNonce is the combined client/server nonce ("r=" field).
+	ServerNonce string `json:"server_nonce,omitempty"`
+
+	// Salt is the base64-encoded salt ("s=" field).
+	Salt string `json:"salt,omitempty"`
+
+	// Iterations is the SCRAM iteration count ("i=" field).
+	Iterations int `json:"iterations,omitempty"`
+}
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	// Banner is the initial data sent by the server.
+	Banner string `json:"banner,omitempty"`
+
+	// HandshakeResponse is the response to the initial handshake message.
+	HandshakeResponse string `json:"handshake_response,omitempty"`
+
+	// Success is the "success" field of the handshake response.
+	Success *bool `json:"success,omitempty"`
+
+	// MinProtocolVersion is the lowest protocol version the server supports.
+	MinProtocolVersion *int `json:"min_protocol_version,omitempty"`
+
+	// MaxProtocolVersion is the highest protocol version the server supports.
+	MaxProtocolVersion *int `json:"max_protocol_version,omitempty"`
+
+	// ServerVersion is the server's self-reported version string.
+	ServerVersion string `json:"server_version,omitempty"`
+
+	// MagicVersionAccepted records whether the probed --magic-version was accepted.
+	MagicVersionAccepted *bool `json:"magic_version_accepted,omitempty"`
+
+	// Scram holds the SCRAM-SHA-256 challenge parameters, if --scram-user was set.
+	Scram *ScramChallenge `json:"scram,omitempty"`
+}
+
+// Flags are the RethinkDB-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+
+	MagicVersion string `long:"magic-version" default:"V1_0" description:"Magic handshake version to probe: V0_3, V0_4, or V1_0"`
+	ScramUser    string `long:"scram-user" description:"If set, continue the handshake into a SCRAM-SHA-256 client-first message for this username and record the server's challenge"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface, and holds the state
+// for a single scan.
+type Scanner struct {
+	config *Flags
+}
+
+// Connection holds the state for a single connection to the RethinkDB server.
+type Connection struct {
+	buffer  [10000]byte
+	config  *Flags
+	results ScanResults
+	conn    net.Conn
+}
+
+// RegisterModule registers the rethinkdb zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("rethinkdb", "RethinkDB", module.Description(), 28015, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object to be filled in with the
+// command-line arguments.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Perform a handshake with a RethinkDB server and retrieve the initial response message."
+}
+
+// Validate flags
+func (f *Flags) Validate(args []string) error {
+	if _, ok := magicNumbers[f.MagicVersion]; !ok {
+		return fmt.Errorf("invalid --magic-version %q: must be one of V0_3, V0_4, V1_0", f.MagicVersion)
+	}
+	return nil
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (s *Scanner) Protocol() string {
+	return "rethinkdb"
+}
+
+// Init initializes the Scanner instance with the flags from the command
+// line.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// readUntilNUL reads a NUL-terminated message from the RethinkDB server,
+// bounded by maxHandshakeResponse and readTimeout so a server that never
+// sends a NUL (or goes silent) can't hang the scan forever.
+func (rdb *Connection) readUntilNUL() (string, error) {
+	if err := rdb.conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+		return "", fmt.Errorf("error setting read deadline: %w", err)
+	}
+	var response []byte
+	buffer := make([]byte, 1)
+	for len(response) < maxHandshakeResponse {
+		_, err := rdb.conn.Read(buffer)
+		if err != nil {
+			return "", err
+		}
+		if buffer[0] == 0 {
+			return string(response), nil
+		}
+		response = append(response, buffer[0])
+	}
+	return "", fmt.Errorf("handshake response exceeded %d bytes without a NUL terminator", maxHandshakeResponse)
+}
+
+// sendHandshake sends the magic number for the configured --magic-version.
+func (rdb *Connection) sendHandshake() error {
+	magic := magicNumbers[rdb.config.MagicVersion]
+	_, err := rdb.conn.Write(magic[:])
+	return err
+}
+
+// handshakeMessage is the JSON status message RethinkDB sends (and expects)
+// during the V1_0 handshake.
+type handshakeMessage struct {
+	Success              *bool  `json:"success"`
+	MinProtocolVersion   *int   `json:"min_protocol_version"`
+	MaxProtocolVersion   *int   `json:"max_protocol_version"`
+	ServerVersion        string `json:"server_version"`
+	Authentication       string `json:"authentication"`
+	ProtocolVersion      *int   `json:"protocol_version"`
+	AuthenticationMethod string `json:"authentication_method,omitempty"`
+}
+
+// parseHandshakeResponse parses the server's first JSON status message and
+// records its fields into ScanResults.
+func (rdb *Connection) parseHandshakeResponse(raw string) error {
+	rdb.results.HandshakeResponse = raw
+
+	var msg handshakeMessage
+	if err := json.Unmarshal([]byte(raw), &msg); err != nil {
+		return fmt.Errorf("error parsing JSON response: %w", err)
+	}
+
+	rdb.results.Success = msg.Success
+	rdb.results.MinProtocolVersion = msg.MinProtocolVersion
+	rdb.results.MaxProtocolVersion = msg.MaxProtocolVersion
+	rdb.results.ServerVersion = msg.ServerVersion
+	rdb.results.MagicVersionAccepted = msg.Success
+	return nil
+}
+
+// scramNonce generates a random, base64-encoded client nonce for the
+// SCRAM-SHA-256 client-first-message.
+func scramNonce() (string, error) {
+	raw := make([]byte, 18)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("error generating SCRAM nonce: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// sendScramClientFirst sends a SCRAM-SHA-256 client-first-message for the
+// given username and returns the client nonce used, so the server's reply
+// can be checked for consistency if desired.
+func (rdb *Connection) sendScramClientFirst(user string) (string, error) {
+	nonce, err := scramNonce()
+	if err != nil {
+		return "", err
+	}
+
+	clientFirst := fmt.Sprintf("n,,n=%s,r=%s", user, nonce)
+	msg, err := json.Marshal(map[string]interface{}{
+		"protocol_version":      0,
+		"authentication_method": "SCRAM-SHA-256",
+		"authentication":        clientFirst,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error building SCRAM client-first message: %w", err)
+	}
+
+	if _, err := rdb.conn.Write(append(msg, 0)); err != nil {
+		return "", fmt.Errorf("error sending SCRAM client-first message: %w", err)
+	}
+	return nonce, nil
+}
+
+// readScramChallenge reads the server's reply to a SCRAM client-first
+// message and records the salt/iteration-count/server-nonce it reveals.
+func (rdb *Connection) readScramChallenge() error {
+	raw, err := rdb.readUntilNUL()
+	if err != nil {
+		return fmt.Errorf("error reading SCRAM challenge: %w", err)
+	}
+
+	var msg handshakeMessage
+	if err := json.Unmarshal([]byte(raw), &msg); err != nil {
+		return fmt.Errorf("error parsing SCRAM challenge JSON: %w", err)
+	}
+
+	matches := scramChallengeRegex.FindStringSubmatch(msg.Authentication)
+	if matches == nil {
+		return fmt.Errorf("server-first-message did not contain r=/s=/i= fields: %q", msg.Authentication)
+	}
+
+	iterations, err := strconv.Atoi(matches[3])
+	if err != nil {
+		return fmt.Errorf("error parsing SCRAM iteration count: %w", err)
+	}
+
+	rdb.results.Scram = &ScramChallenge{
+		ServerNonce: matches[1],
+		Salt:        matches[2],
+		Iterations:  iterations,
+	}
+	return nil
+}
+
+// Scan performs the configured scan on the RethinkDB server, as follows:
+//   - Send the magic number for the configured --magic-version.
+//   - Read and parse the JSON handshake response.
+//   - If --scram-user is set and the handshake succeeded, send a
+//     SCRAM-SHA-256 client-first message and record the server's challenge.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	var err error
+	conn, err := t.Open(&s.config.BaseFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	defer conn.Close()
+
+	rdb := Connection{conn: conn, config: s.config}
+	if err := rdb.sendHandshake(); err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error sending handshake: %w", err)
+	}
+
+	response, err := rdb.readUntilNUL()
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error reading response: %w", err)
+	}
+
+	if err := rdb.parseHandshakeResponse(response); err != nil {
+		return zgrab2.SCAN_PROTOCOL_ERROR, &rdb.results, err
+	}
+
+	if rdb.results.Success == nil || !*rdb.results.Success {
+		return zgrab2.SCAN_APPLICATION_ERROR, &rdb.results, nil
+	}
+
+	if s.config.ScramUser != "" {
+		if _, err := rdb.sendScramClientFirst(s.config.ScramUser); err != nil {
+			return zgrab2.TryGetScanStatus(err), &rdb.results, err
+		}
+		if err := rdb.readScramChallenge(); err != nil {
+			return zgrab2.TryGetScanStatus(err), &rdb.results, err
+		}
+	}
+
+	return zgrab2.SCAN_SUCCESS, &rdb.results, nil
+}
@@ -1,154 +1,298 @@
-// Package rfb contains the zgrab2 Module implementation for RFB (Remote Framebuffer).
-//
-// The scan performs a banner grab and validates the received banner.
-//
-// The output is the banner and a validation status.
-package rfb
-
-import (
-	"fmt"
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-	"net"
-	"regexp"
-)
-
-// ScanResults is the output of the scan.
-type ScanResults struct {
-	// Banner is the initial data banner sent by the server.
-	Banner string `json:"banner,omitempty"`
-}
-
-// Flags are the RFB-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-
-	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct {
-}
-
-// Scanner implements the zgrab2.Scanner interface, and holds the state
-// for a single scan.
-type Scanner struct {
-	config *Flags
-}
-
-// Connection holds the state for a single connection to the RFB server.
-type Connection struct {
-	buffer  [10000]byte
-	config  *Flags
-	results ScanResults
-	conn    net.Conn
-}
-
-// RegisterModule registers the rfb zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("rfb", "RFB", module.Description(), 5900, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns the default flags object to be filled in with the
-// command-line arguments.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns an overview of this module.
-func (m *Module) Description() string {
-	return "Grab an RFB banner"
-}
-
-// Validate flags
-func (f *Flags) Validate(args []string) error {
-	return nil
-}
-
-// Help returns this module's help string.
-func (f *Flags) Help() string {
-	return ""
-}
-
-// Protocol returns the protocol identifer for the scanner.
-func (s *Scanner) Protocol() string {
-	return "rfb"
-}
-
-// Init initializes the Scanner instance with the flags from the command
-// line.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// GetName returns the configured name for the Scanner.
-func (s *Scanner) GetName() string {
-	return s.config.Name
-}
-
-// GetTrigger returns the Trigger defined in the Flags.
-func (scanner *Scanner) GetTrigger() string {
-	return scanner.config.Trigger
-}
-
-// rfbBannerRegex matches the RFB banner format "RFB xxx.yyy\n".
-var rfbBannerRegex = regexp.MustCompile(`^RFB (\d{3})\.(\d{3})\n$`)
-
-// readResponse reads the RFB banner from the server.
-func (rfb *Connection) readResponse() (string, error) {
-	respLen, err := zgrab2.ReadUntilRegex(rfb.conn, rfb.buffer[:], rfbBannerRegex)
-	if err != nil {
-		return "", err
-	}
-	ret := string(rfb.buffer[0:respLen])
-	return ret, nil
-}
-
-// GetRFBanner reads the data sent by the server immediately after connecting.
-// Returns true if and only if the server returns a valid RFB banner.
-func (rfb *Connection) GetRFBanner() (bool, error) {
-	banner, err := rfb.readResponse()
-	if err != nil {
-		return false, err
-	}
-	rfb.results.Banner = banner
-	return rfbBannerRegex.MatchString(banner), nil
-}
-
-// Scan performs the configured scan on the RFB server.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
-	var err error
-	conn, err := t.Open(&s.config.BaseFlags)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
-	}
-	defer conn.Close()
-
-	results := ScanResults{}
-	rfb := Connection{conn: conn, config: s.config, results: results}
-
-	isValidBanner, err := rfb.GetRFBanner()
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), &rfb.results, fmt.Errorf("error reading RFB banner: %w", err)
-	}
-	if !isValidBanner {
-		return zgrab2.SCAN_APPLICATION_ERROR, &rfb.results, fmt.Errorf("invalid RFB banner: %s", rfb.results.Banner)
-	}
-	return zgrab2.SCAN_SUCCESS, &rfb.results, nil
-}
+// Package rfb contains the zgrab2 Module implementation for RFB (Remote Framebuffer).
+//
+// The scan performs a banner grab and validates the received banner.
+//
+// The output is the banner and a validation status.
+package rfb
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+	"io"
+	"net"
+	"regexp"
+)
+
+// secTypeVNCAuth is the RFB security type for classic VNC (DES challenge)
+// authentication.
+const secTypeVNCAuth = 2
+
+// vncChallengeLength is the length in bytes of the VNC Authentication
+// challenge the server sends once VNC Authentication is selected.
+const vncChallengeLength = 16
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	// Banner is the initial data banner sent by the server.
+	Banner string `json:"banner,omitempty"`
+
+	// ProtocolVersion is the version zgrab2 echoed back to the server
+	// after parsing Banner, e.g. "003.008".
+	ProtocolVersion string `json:"protocol_version,omitempty"`
+
+	// SecurityTypes lists the security types the server offered (RFB
+	// 3.7+) or the single type it selected unilaterally (RFB 3.3).
+	SecurityTypes []uint8 `json:"security_types,omitempty"`
+
+	// SecurityFailureReason holds the server's explanation when it
+	// sends a security-handshake failure instead of a type list.
+	SecurityFailureReason string `json:"security_failure_reason,omitempty"`
+
+	// VNCChallenge is the 16-byte DES challenge sent by the server once
+	// VNC Authentication (security type 2) is selected, hex-encoded.
+	// zgrab2 records it without attempting to answer it.
+	VNCChallenge string `json:"vnc_challenge,omitempty"`
+}
+
+// Flags are the RFB-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+
+	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface, and holds the state
+// for a single scan.
+type Scanner struct {
+	config *Flags
+}
+
+// Connection holds the state for a single connection to the RFB server.
+type Connection struct {
+	buffer  [10000]byte
+	config  *Flags
+	results ScanResults
+	conn    net.Conn
+}
+
+// RegisterModule registers the rfb zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("rfb", "RFB", module.Description(), 5900, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object to be filled in with the
+// command-line arguments.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Grab an RFB banner"
+}
+
+// Validate flags
+func (f *Flags) Validate(args []string) error {
+	return nil
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifer for the scanner.
+func (s *Scanner) Protocol() string {
+	return "rfb"
+}
+
+// Init initializes the Scanner instance with the flags from the command
+// line.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// rfbBannerRegex matches the RFB banner format "RFB xxx.yyy\n".
+var rfbBannerRegex = regexp.MustCompile(`^RFB (\d{3})\.(\d{3})\n$`)
+
+// readResponse reads the RFB banner from the server.
+func (rfb *Connection) readResponse() (string, error) {
+	respLen, err := zgrab2.ReadUntilRegex(rfb.conn, rfb.buffer[:], rfbBannerRegex)
+	if err != nil {
+		return "", err
+	}
+	ret := string(rfb.buffer[0:respLen])
+	return ret, nil
+}
+
+// GetRFBanner reads the data sent by the server immediately after connecting.
+// Returns true if and only if the server returns a valid RFB banner.
+func (rfb *Connection) GetRFBanner() (bool, error) {
+	banner, err := rfb.readResponse()
+	if err != nil {
+		return false, err
+	}
+	rfb.results.Banner = banner
+	return rfbBannerRegex.MatchString(banner), nil
+}
+
+// readN reads exactly len(buf) bytes from the connection, looping on short reads.
+func (rfb *Connection) readN(buf []byte) error {
+	_, err := io.ReadFull(rfb.conn, buf)
+	return err
+}
+
+// NegotiateVersion echoes the server's protocol version back to it, as
+// RFB 3.3 section 6.1.1 requires of the client, and records it in the
+// results. The server's offered version is trusted as-is rather than
+// capped to a version zgrab2 "understands", since the rest of this
+// handshake only needs to parse the generic security-type and
+// VNC-challenge framing that is stable across 3.3 through 3.8.
+func (rfb *Connection) NegotiateVersion() error {
+	match := rfbBannerRegex.FindStringSubmatch(rfb.results.Banner)
+	if match == nil {
+		return fmt.Errorf("invalid RFB banner: %s", rfb.results.Banner)
+	}
+	version := match[1] + "." + match[2]
+	rfb.results.ProtocolVersion = version
+	_, err := rfb.conn.Write([]byte(fmt.Sprintf("RFB %s\n", version)))
+	return err
+}
+
+// ReadSecurityTypes reads the server's security-type handshake, per RFB
+// section 6.1.2. RFB 3.7 and later send a U8 count followed by that many
+// U8 type bytes (count == 0 means failure, followed by a U32 reason
+// length and the reason string); RFB 3.3 instead sends a single U32 type
+// directly (value 0 means failure, with the same reason framing).
+func (rfb *Connection) ReadSecurityTypes(minor int) error {
+	if minor >= 7 {
+		var count [1]byte
+		if err := rfb.readN(count[:]); err != nil {
+			return err
+		}
+		if count[0] == 0 {
+			return rfb.readSecurityFailureReason()
+		}
+		types := make([]byte, count[0])
+		if err := rfb.readN(types); err != nil {
+			return err
+		}
+		rfb.results.SecurityTypes = types
+		return nil
+	}
+
+	var raw [4]byte
+	if err := rfb.readN(raw[:]); err != nil {
+		return err
+	}
+	secType := binary.BigEndian.Uint32(raw[:])
+	if secType == 0 {
+		return rfb.readSecurityFailureReason()
+	}
+	rfb.results.SecurityTypes = []uint8{uint8(secType)}
+	return nil
+}
+
+// readSecurityFailureReason reads the U32 length-prefixed reason string
+// that follows a security-handshake failure.
+func (rfb *Connection) readSecurityFailureReason() error {
+	var lengthBytes [4]byte
+	if err := rfb.readN(lengthBytes[:]); err != nil {
+		return err
+	}
+	reason := make([]byte, binary.BigEndian.Uint32(lengthBytes[:]))
+	if err := rfb.readN(reason); err != nil {
+		return err
+	}
+	rfb.results.SecurityFailureReason = string(reason)
+	return nil
+}
+
+// offersVNCAuth reports whether SecurityTypes includes VNC Authentication.
+func (rfb *Connection) offersVNCAuth() bool {
+	for _, t := range rfb.results.SecurityTypes {
+		if t == secTypeVNCAuth {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadVNCChallenge selects VNC Authentication (sending the client's choice
+// byte first when the server offered a list, per RFB 3.7+) and reads the
+// 16-byte DES challenge, without attempting to answer it.
+func (rfb *Connection) ReadVNCChallenge(minor int) error {
+	if minor >= 7 {
+		if _, err := rfb.conn.Write([]byte{secTypeVNCAuth}); err != nil {
+			return err
+		}
+	}
+	challenge := make([]byte, vncChallengeLength)
+	if err := rfb.readN(challenge); err != nil {
+		return err
+	}
+	rfb.results.VNCChallenge = hex.EncodeToString(challenge)
+	return nil
+}
+
+// Scan performs the configured scan on the RFB server.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	var err error
+	conn, err := t.Open(&s.config.BaseFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	defer conn.Close()
+
+	results := ScanResults{}
+	rfb := Connection{conn: conn, config: s.config, results: results}
+
+	isValidBanner, err := rfb.GetRFBanner()
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), &rfb.results, fmt.Errorf("error reading RFB banner: %w", err)
+	}
+	if !isValidBanner {
+		return zgrab2.SCAN_APPLICATION_ERROR, &rfb.results, fmt.Errorf("invalid RFB banner: %s", rfb.results.Banner)
+	}
+
+	match := rfbBannerRegex.FindStringSubmatch(rfb.results.Banner)
+	minor := 0
+	fmt.Sscanf(match[2], "%d", &minor)
+
+	if err := rfb.NegotiateVersion(); err != nil {
+		return zgrab2.TryGetScanStatus(err), &rfb.results, fmt.Errorf("error negotiating RFB version: %w", err)
+	}
+	if err := rfb.ReadSecurityTypes(minor); err != nil {
+		return zgrab2.TryGetScanStatus(err), &rfb.results, fmt.Errorf("error reading RFB security types: %w", err)
+	}
+	if rfb.offersVNCAuth() {
+		if err := rfb.ReadVNCChallenge(minor); err != nil {
+			return zgrab2.TryGetScanStatus(err), &rfb.results, fmt.Errorf("error reading VNC auth challenge: %w", err)
+		}
+	}
+
+	return zgrab2.SCAN_SUCCESS, &rfb.results, nil
+}
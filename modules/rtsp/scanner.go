@@ -1,140 +1,599 @@
-package rtsp
-
-import (
-	"fmt"
-	"net"
-	"strings"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-// ScanResults is the output of the scan, including the OPTIONS response.
-type ScanResults struct {
-	// OptionsResponse captures the response to the OPTIONS request.
-	OptionsResponse string `json:"options_response,omitempty"`
-}
-
-// Flags define RTSP-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-	Verbose bool `long:"verbose" description:"More verbose logging"`
-}
-
-// Module implements the zgrab2.Module interface for RTSP.
-type Module struct{}
-
-// Scanner implements the zgrab2.Scanner interface.
-type Scanner struct {
-	config *Flags
-}
-
-// Connection holds the state for a single connection to the RTSP server.
-type Connection struct {
-	conn    net.Conn
-	config  *Flags
-	results ScanResults
-}
-
-// RegisterModule registers the RTSP module with zgrab2.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("rtsp", "RTSP", module.Description(), 554, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns the default flag settings.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description provides an overview of this module.
-func (m *Module) Description() string {
-	return "Grab an RTSP OPTIONS response"
-}
-
-// Validate flags.
-func (f *Flags) Validate(args []string) error {
-	return nil
-}
-
-// Help provides module-specific help.
-func (f *Flags) Help() string {
-	return ""
-}
-
-// Protocol returns the protocol identifier.
-func (s *Scanner) Protocol() string {
-	return "rtsp"
-}
-
-// Init initializes the Scanner instance.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// GetName returns the Scanner name.
-func (s *Scanner) GetName() string {
-	return s.config.Name
-}
-
-// GetTrigger returns the trigger, if set.
-func (scanner *Scanner) GetTrigger() string {
-	return scanner.config.Trigger
-}
-
-// readResponse reads a response from the server.
-func (rtsp *Connection) readResponse() (string, error) {
-	buffer := make([]byte, 4096)
-	n, err := rtsp.conn.Read(buffer)
-	if err != nil {
-		return "", err
-	}
-	return string(buffer[:n]), nil
-}
-
-// sendOptionsRequest sends the OPTIONS request and returns the response.
-func (rtsp *Connection) sendOptionsRequest() (string, error) {
-	optionsRequest := "OPTIONS * RTSP/1.0\r\nCSeq: 1\r\nUser-Agent: RTSPScanner/1.0\r\n\r\n"
-	_, err := rtsp.conn.Write([]byte(optionsRequest))
-	if err != nil {
-		return "", err
-	}
-	return rtsp.readResponse()
-}
-
-// Scan performs the actual RTSP scan.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, err error) {
-	conn, err := t.Open(&s.config.BaseFlags)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
-	}
-	defer conn.Close()
-
-	rtsp := &Connection{conn: conn, config: s.config}
-	response, err := rtsp.sendOptionsRequest()
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error sending OPTIONS request: %w", err)
-	}
-
-	rtsp.results.OptionsResponse = response
-	// Consider the scan successful as long as there is a valid RTSP response
-	if strings.HasPrefix(response, "RTSP/1.0") {
-		return zgrab2.SCAN_SUCCESS, &rtsp.results, nil
-	}
-	return zgrab2.SCAN_APPLICATION_ERROR, &rtsp.results, fmt.Errorf("unexpected RTSP response: %s", response)
-}
+// Package rtsp contains the zgrab2 Module implementation for RTSP.
+//
+// The scan issues OPTIONS to discover the server's supported methods, then
+// DESCRIBEs a configurable list of candidate stream paths, following
+// Basic/Digest authentication challenges when --username/--password are
+// set. SDP bodies returned by a successful DESCRIBE are parsed for their
+// media types, codecs, control URLs, and track count.
+package rtsp
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+	"github.com/zmap/zgrab2/framing"
+	"github.com/zmap/zgrab2/script"
+	"gopkg.in/yaml.v2"
+)
+
+// responseReadDeadline bounds how long a single RTSP response read may take.
+const responseReadDeadline = 10 * time.Second
+
+// maxResponseSize bounds how large a single RTSP response may be, guarding
+// against a server that never sends the body-terminating blank line.
+const maxResponseSize = 1 << 20
+
+// defaultScriptMaxFileSize bounds how large a --script file is allowed to be.
+const defaultScriptMaxFileSize = 1 << 20
+
+// defaultScriptReadSize bounds a best-effort script step response read.
+const defaultScriptReadSize = 8192
+
+// defaultPaths is the built-in list of candidate stream paths tried when
+// --paths-file is not set.
+var defaultPaths = []string{"", "live", "live.sdp", "stream1", "h264", "media.amp", "cam/realmonitor"}
+
+// SDPMedia describes one "m=" section of an SDP body.
+type SDPMedia struct {
+	Type       string `json:"type,omitempty"`
+	Codec      string `json:"codec,omitempty"`
+	ControlURL string `json:"control_url,omitempty"`
+}
+
+// SDPInfo is the parsed SDP body from a successful DESCRIBE.
+type SDPInfo struct {
+	Media      []SDPMedia `json:"media,omitempty"`
+	TrackCount int        `json:"track_count,omitempty"`
+}
+
+// DescribeResult is the outcome of a DESCRIBE issued for a single path.
+type DescribeResult struct {
+	Path       string   `json:"path"`
+	StatusCode int      `json:"status_code,omitempty"`
+	SDP        *SDPInfo `json:"sdp,omitempty"`
+}
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	// OptionsResponse captures the response to the OPTIONS request.
+	OptionsResponse string `json:"options_response,omitempty"`
+
+	// SupportedMethods lists the methods advertised in the OPTIONS
+	// response's Public header.
+	SupportedMethods []string `json:"supported_methods,omitempty"`
+
+	// Server is the response's Server header, if present.
+	Server string `json:"server,omitempty"`
+
+	// Session is the most recently observed Session header.
+	Session string `json:"session,omitempty"`
+
+	// AuthScheme is the scheme ("Basic" or "Digest") offered by a 401
+	// response's WWW-Authenticate header.
+	AuthScheme string `json:"auth_scheme,omitempty"`
+
+	// AuthRealm is the realm offered by a 401 response's WWW-Authenticate header.
+	AuthRealm string `json:"auth_realm,omitempty"`
+
+	// Describes holds the per-path DESCRIBE results.
+	Describes []DescribeResult `json:"describes,omitempty"`
+
+	// TLSLog is the standard shared TLS handshake log. Only present if
+	// --rtsps or --starttls is set and a TLS handshake was attempted.
+	TLSLog *zgrab2.TLSLog `json:"tls,omitempty"`
+
+	// StartTLSUpgraded indicates --starttls successfully upgraded the
+	// connection to TLS.
+	StartTLSUpgraded bool `json:"starttls_upgraded,omitempty"`
+
+	// ScriptLog holds the per-step results of --script, if set.
+	ScriptLog []script.StepResult `json:"script_log,omitempty"`
+
+	// SavedGroups holds the named captures recorded by --script steps'
+	// save_group, if any were set.
+	SavedGroups map[string]string `json:"saved_groups,omitempty"`
+}
+
+// Flags define RTSP-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+	zgrab2.TLSFlags
+	Verbose bool `long:"verbose" description:"More verbose logging"`
+
+	Username string `long:"username" description:"Username to use for Basic/Digest authentication"`
+	Password string `long:"password" description:"Password to use for Basic/Digest authentication"`
+
+	PathsFile string `long:"paths-file" description:"Path to a JSON or YAML file listing candidate stream paths to DESCRIBE"`
+
+	RTSPS    bool `long:"rtsps" description:"Connect via a TLS wrapped connection (RTSPS) instead of plaintext"`
+	StartTLS bool `long:"starttls" description:"Attempt an opportunistic TLS upgrade on the plaintext connection after OPTIONS succeeds"`
+
+	Script string `long:"script" description:"Path to a JSON or YAML ProbeScript run on the connection after the built-in probe"`
+}
+
+// RTSPSPort is the conventional RTSPS (RTSP-over-TLS) port.
+const RTSPSPort = 322
+
+// Module implements the zgrab2.Module interface for RTSP.
+type Module struct{}
+
+// Scanner implements the zgrab2.Scanner interface.
+type Scanner struct {
+	config *Flags
+	paths  []string
+	script *script.ProbeScript
+}
+
+// Connection holds the state for a single connection to the RTSP server.
+type Connection struct {
+	conn    net.Conn
+	config  *Flags
+	scanner *Scanner
+	cseq    int
+	// digestNonce is the nonce from the most recent WWW-Authenticate
+	// challenge, used to build subsequent Digest Authorization headers.
+	digestNonce string
+	results     ScanResults
+}
+
+// RegisterModule registers the RTSP module with zgrab2.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("rtsp", "RTSP", module.Description(), 554, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flag settings.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description provides an overview of this module.
+func (m *Module) Description() string {
+	return "Grab an RTSP OPTIONS response"
+}
+
+// Validate flags.
+func (f *Flags) Validate(args []string) error {
+	return nil
+}
+
+// Help provides module-specific help.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifier.
+func (s *Scanner) Protocol() string {
+	return "rtsp"
+}
+
+// loadStructuredFile decodes path into v, trying JSON first for a ".json"
+// extension and YAML otherwise.
+func loadStructuredFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		if err := json.Unmarshal(data, v); err != nil {
+			return fmt.Errorf("error parsing %s as JSON: %w", path, err)
+		}
+		return nil
+	}
+	if err := yaml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error parsing %s as YAML: %w", path, err)
+	}
+	return nil
+}
+
+// Init initializes the Scanner instance.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+
+	s.paths = defaultPaths
+	if f.PathsFile != "" {
+		var paths []string
+		if err := loadStructuredFile(f.PathsFile, &paths); err != nil {
+			return fmt.Errorf("error loading --paths-file: %w", err)
+		}
+		s.paths = paths
+	}
+
+	if f.Script != "" {
+		ps, err := script.Load(f.Script, defaultScriptMaxFileSize)
+		if err != nil {
+			return fmt.Errorf("error loading --script: %w", err)
+		}
+		s.script = ps
+	}
+
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the Scanner name.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the trigger, if set.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// readResponse reads a single RTSP response from the server: the
+// status line and headers (up to the blank line), then the body if a
+// Content-Length header says one follows. Looping on the framing package's
+// helpers, rather than a single fixed-size Read, avoids truncating
+// responses that arrive in more than one TCP segment.
+func (rtsp *Connection) readResponse() (string, error) {
+	head, err := framing.ReadUntil(rtsp.conn, []byte("\r\n\r\n"), maxResponseSize, responseReadDeadline)
+	if err != nil {
+		return string(head), err
+	}
+
+	_, headers := parseHeaders(string(head))
+	contentLength, _ := strconv.Atoi(headers["content-length"])
+	if contentLength <= 0 {
+		return string(head), nil
+	}
+
+	body := make([]byte, contentLength)
+	read := 0
+	for read < contentLength {
+		n, err := rtsp.conn.Read(body[read:])
+		read += n
+		if err != nil {
+			return string(head) + string(body[:read]), err
+		}
+	}
+	return string(head) + string(body), nil
+}
+
+// parseHeaders splits a raw RTSP response into its status line and a
+// case-insensitive header map.
+func parseHeaders(response string) (statusLine string, headers map[string]string) {
+	headers = make(map[string]string)
+	lines := strings.Split(strings.ReplaceAll(response, "\r\n", "\n"), "\n")
+	if len(lines) == 0 {
+		return "", headers
+	}
+	statusLine = lines[0]
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		headers[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+	}
+	return statusLine, headers
+}
+
+// statusCode extracts the numeric status code from an RTSP status line
+// such as "RTSP/1.0 401 Unauthorized".
+func statusCode(statusLine string) int {
+	fields := strings.Fields(statusLine)
+	if len(fields) < 2 {
+		return 0
+	}
+	code, _ := strconv.Atoi(fields[1])
+	return code
+}
+
+// digestResponse computes the RFC 2617 digest response value for the given
+// method and URI.
+func digestResponse(username, password, realm, nonce, method, uri string) string {
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", username, realm, password))
+	ha2 := md5Hex(fmt.Sprintf("%s:%s", method, uri))
+	return md5Hex(fmt.Sprintf("%s:%s:%s", ha1, nonce, ha2))
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseWWWAuthenticate extracts the scheme and quoted parameters (realm,
+// nonce) from a WWW-Authenticate header value.
+func parseWWWAuthenticate(header string) (scheme string, params map[string]string) {
+	params = make(map[string]string)
+	fields := strings.SplitN(header, " ", 2)
+	scheme = fields[0]
+	if len(fields) < 2 {
+		return scheme, params
+	}
+	for _, pair := range strings.Split(fields[1], ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+	}
+	return scheme, params
+}
+
+// buildAuthorization builds the Authorization header value for a request,
+// using whichever scheme the server last challenged with.
+func (rtsp *Connection) buildAuthorization(method, uri string) string {
+	if rtsp.config.Username == "" {
+		return ""
+	}
+	switch rtsp.results.AuthScheme {
+	case "Digest":
+		nonce := rtsp.digestNonce
+		response := digestResponse(rtsp.config.Username, rtsp.config.Password, rtsp.results.AuthRealm, nonce, method, uri)
+		return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+			rtsp.config.Username, rtsp.results.AuthRealm, nonce, uri, response)
+	case "Basic":
+		creds := rtsp.config.Username + ":" + rtsp.config.Password
+		return "Basic " + basicEncode(creds)
+	default:
+		return ""
+	}
+}
+
+// basicEncode base64-encodes creds for a Basic Authorization header.
+func basicEncode(creds string) string {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+	var out strings.Builder
+	data := []byte(creds)
+	for i := 0; i < len(data); i += 3 {
+		var chunk [3]byte
+		n := copy(chunk[:], data[i:])
+		out.WriteByte(alphabet[chunk[0]>>2])
+		out.WriteByte(alphabet[(chunk[0]&0x03)<<4|chunk[1]>>4])
+		if n > 1 {
+			out.WriteByte(alphabet[(chunk[1]&0x0f)<<2|chunk[2]>>6])
+		} else {
+			out.WriteByte('=')
+		}
+		if n > 2 {
+			out.WriteByte(alphabet[chunk[2]&0x3f])
+		} else {
+			out.WriteByte('=')
+		}
+	}
+	return out.String()
+}
+
+// sendRequest sends an RTSP request with an incrementing CSeq and an
+// Authorization header if one applies, and returns the parsed response.
+func (rtsp *Connection) sendRequest(method, uri string, extraHeaders map[string]string) (statusLine string, headers map[string]string, body string, raw string, err error) {
+	rtsp.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\n", method, uri)
+	fmt.Fprintf(&b, "CSeq: %d\r\n", rtsp.cseq)
+	b.WriteString("User-Agent: RTSPScanner/1.0\r\n")
+	if rtsp.results.Session != "" {
+		fmt.Fprintf(&b, "Session: %s\r\n", rtsp.results.Session)
+	}
+	if auth := rtsp.buildAuthorization(method, uri); auth != "" {
+		fmt.Fprintf(&b, "Authorization: %s\r\n", auth)
+	}
+	for k, v := range extraHeaders {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	b.WriteString("\r\n")
+
+	if _, err = rtsp.conn.Write([]byte(b.String())); err != nil {
+		return "", nil, "", "", err
+	}
+
+	raw, err = rtsp.readResponse()
+	if err != nil {
+		return "", nil, "", "", err
+	}
+
+	statusLine, headers = parseHeaders(raw)
+	if idx := strings.Index(raw, "\r\n\r\n"); idx >= 0 {
+		body = raw[idx+4:]
+	}
+
+	if server, ok := headers["server"]; ok {
+		rtsp.results.Server = server
+	}
+	if session, ok := headers["session"]; ok {
+		rtsp.results.Session = strings.SplitN(session, ";", 2)[0]
+	}
+	if wwwAuth, ok := headers["www-authenticate"]; ok {
+		scheme, params := parseWWWAuthenticate(wwwAuth)
+		rtsp.results.AuthScheme = scheme
+		rtsp.results.AuthRealm = params["realm"]
+		rtsp.digestNonce = params["nonce"]
+	}
+
+	return statusLine, headers, body, raw, nil
+}
+
+// parsePublicHeader splits a comma-separated Public header into its list
+// of supported methods.
+func parsePublicHeader(header string) []string {
+	var methods []string
+	for _, m := range strings.Split(header, ",") {
+		m = strings.TrimSpace(m)
+		if m != "" {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+// parseSDP extracts media types, codecs, and control URLs from an SDP body.
+func parseSDP(body string) *SDPInfo {
+	info := &SDPInfo{}
+	var current *SDPMedia
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			if current != nil {
+				info.Media = append(info.Media, *current)
+			}
+			fields := strings.Fields(strings.TrimPrefix(line, "m="))
+			current = &SDPMedia{}
+			if len(fields) > 0 {
+				current.Type = fields[0]
+			}
+			info.TrackCount++
+		case strings.HasPrefix(line, "a=rtpmap:") && current != nil:
+			parts := strings.SplitN(line[len("a=rtpmap:"):], " ", 2)
+			if len(parts) == 2 {
+				current.Codec = strings.SplitN(parts[1], "/", 2)[0]
+			}
+		case strings.HasPrefix(line, "a=control:") && current != nil:
+			current.ControlURL = strings.TrimPrefix(line, "a=control:")
+		}
+	}
+	if current != nil {
+		info.Media = append(info.Media, *current)
+	}
+	return info
+}
+
+// sendOptionsRequest sends the OPTIONS request, recording the supported
+// methods advertised in the Public header, and returns the raw response.
+func (rtsp *Connection) sendOptionsRequest(uri string) (string, error) {
+	_, headers, _, raw, err := rtsp.sendRequest("OPTIONS", uri, nil)
+	if err != nil {
+		return "", err
+	}
+	if public, ok := headers["public"]; ok {
+		rtsp.results.SupportedMethods = parsePublicHeader(public)
+	}
+	return raw, nil
+}
+
+// describePath issues DESCRIBE for path, retrying with authentication if
+// challenged and credentials are configured.
+func (rtsp *Connection) describePath(baseURI, path string) DescribeResult {
+	uri := baseURI
+	if path != "" {
+		uri = strings.TrimRight(baseURI, "/") + "/" + path
+	}
+
+	statusLine, _, body, _, err := rtsp.sendRequest("DESCRIBE", uri, map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return DescribeResult{Path: path}
+	}
+	code := statusCode(statusLine)
+
+	if code == 401 && rtsp.config.Username != "" {
+		statusLine, _, body, _, err = rtsp.sendRequest("DESCRIBE", uri, map[string]string{"Accept": "application/sdp"})
+		if err != nil {
+			return DescribeResult{Path: path, StatusCode: code}
+		}
+		code = statusCode(statusLine)
+	}
+
+	result := DescribeResult{Path: path, StatusCode: code}
+	if code == 200 && body != "" {
+		result.SDP = parseSDP(body)
+	}
+	return result
+}
+
+// Scan performs the actual RTSP scan.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, err error) {
+	bf := s.config.BaseFlags
+	if s.config.RTSPS && t.Port == nil {
+		bf.Port = RTSPSPort
+	}
+
+	conn, err := t.Open(&bf)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	defer conn.Close()
+
+	rtsp := &Connection{conn: conn, config: s.config, scanner: s}
+
+	port := bf.Port
+	if t.Port != nil {
+		port = uint(*t.Port)
+	}
+	baseURI := fmt.Sprintf("rtsp://%s:%d", t.IP.String(), port)
+
+	if s.config.RTSPS {
+		if err := rtsp.setupTLS(); err != nil {
+			log.Infof("RTSPS TLS setup failed, falling back to plaintext: %v", err)
+		}
+	}
+
+	statusLine, err := rtsp.sendOptionsRequest(baseURI)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error sending OPTIONS request: %w", err)
+	}
+	rtsp.results.OptionsResponse = statusLine
+
+	if !strings.HasPrefix(statusLine, "RTSP/1.0") {
+		return zgrab2.SCAN_APPLICATION_ERROR, &rtsp.results, fmt.Errorf("unexpected RTSP response: %s", statusLine)
+	}
+
+	if s.config.StartTLS && !s.config.RTSPS {
+		// Best-effort: the connection has already spoken plaintext
+		// OPTIONS successfully, so only attempt the upgrade if the
+		// server advertised it is willing to negotiate TLS.
+		if err := rtsp.setupTLS(); err != nil {
+			log.Infof("opportunistic TLS upgrade failed, continuing in plaintext: %v", err)
+		} else {
+			rtsp.results.StartTLSUpgraded = true
+			if statusLine, err = rtsp.sendOptionsRequest(baseURI); err == nil {
+				rtsp.results.OptionsResponse = statusLine
+			}
+		}
+	}
+
+	for _, path := range s.paths {
+		rtsp.results.Describes = append(rtsp.results.Describes, rtsp.describePath(baseURI, path))
+	}
+
+	if s.script != nil {
+		scriptLog, savedGroups, err := script.Run(rtsp.conn, s.script.Steps, defaultScriptReadSize, 0)
+		rtsp.results.ScriptLog = scriptLog
+		rtsp.results.SavedGroups = savedGroups
+		if err != nil {
+			log.Infof("rtsp script run ended early: %v", err)
+		}
+	}
+
+	return zgrab2.SCAN_SUCCESS, &rtsp.results, nil
+}
+
+// setupTLS wraps rtsp.conn in a TLS connection, recording the handshake log.
+func (rtsp *Connection) setupTLS() error {
+	tlsConn, err := rtsp.config.TLSFlags.GetTLSConnection(rtsp.conn)
+	if err != nil {
+		return fmt.Errorf("error setting up TLS connection: %w", err)
+	}
+	rtsp.results.TLSLog = tlsConn.GetLog()
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	rtsp.conn = tlsConn
+	return nil
+}
@@ -1,276 +1,548 @@
-// Package sip contains the zgrab2 Module implementation for SIP.
-//
-// The scan performs an OPTIONS request to query the SIP server's capabilities.
-// It supports both UDP and TCP connections.
-//
-// The output includes the server's response and any supported methods or capabilities.
-package sip
-
-import (
-	"fmt"
-	"net"
-	"regexp"
-	"strings"
-	"time"
-	"unicode/utf8"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-// ScanResults contains the output of the SIP scan.
-type ScanResults struct {
-	// RawResponse is the full, raw response from the SIP server, decoded as UTF-8.
-	RawResponse string `json:"raw_response,omitempty"`
-
-	// StatusCode is the numeric status code from the response.
-	StatusCode string `json:"status_code,omitempty"`
-
-	// StatusLine is the full status line from the response.
-	StatusLine string `json:"status_line,omitempty"`
-
-	// Methods is a list of supported methods reported by the server.
-	Methods []string `json:"methods,omitempty"`
-
-	// Headers contains all headers from the response.
-	Headers map[string]string `json:"headers,omitempty"`
-
-	// TLSLog is the standard shared TLS handshake log.
-	TLSLog *zgrab2.TLSLog `json:"tls,omitempty"`
-}
-
-// Flags defines the SIP-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-	zgrab2.TLSFlags
-
-	Verbose     bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
-	UseTCP      bool `long:"tcp" description:"Use TCP instead of UDP for SIP scanning"`
-	ImplicitTLS bool `long:"tls" description:"Attempt to connect via a TLS wrapped connection"`
-	Timeout     uint `long:"tcp-timeout" default:"5" description:"Set connection timeout in seconds"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct {
-}
-
-// Scanner implements the zgrab2.Scanner interface.
-type Scanner struct {
-	config *Flags
-}
-
-// RegisterModule registers the sip zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("sip", "SIP", module.Description(), 5060, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns a default Flags object.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns an overview of this module.
-func (m *Module) Description() string {
-	return "Probe for SIP (Session Initiation Protocol) servers using UDP or TCP"
-}
-
-// Validate checks that the flags are valid.
-func (f *Flags) Validate(args []string) error {
-	return nil
-}
-
-// Help returns this module's help string.
-func (f *Flags) Help() string {
-	return ""
-}
-
-// Protocol returns the protocol identifier for the scanner.
-func (s *Scanner) Protocol() string {
-	return "sip"
-}
-
-// Init initializes the Scanner with the command-line flags.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// InitPerSender initializes the scanner for a given sender.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// GetName returns the scanner name defined in the Flags.
-func (s *Scanner) GetName() string {
-	return s.config.Name
-}
-
-// GetTrigger returns the Trigger defined in the Flags.
-func (scanner *Scanner) GetTrigger() string {
-	return scanner.config.Trigger
-}
-
-// Scan performs the SIP scan.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (zgrab2.ScanStatus, interface{}, error) {
-	results := &ScanResults{}
-
-	var port uint
-	if t.Port != nil {
-		port = *t.Port
-	} else {
-		port = s.config.Port
-	}
-
-	var conn net.Conn
-	var err error
-
-	if s.config.UseTCP {
-		conn, err = s.dialTCP(t.IP, int(port))
-		if err != nil {
-			return zgrab2.TryGetScanStatus(err), results, fmt.Errorf("error dialing: %w", err)
-		}
-		if s.config.ImplicitTLS {
-			tlsConn, err := s.config.TLSFlags.GetTLSConnection(conn)
-			if err != nil {
-				return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error setting up TLS connection: %w", err)
-			}
-			results.TLSLog = tlsConn.GetLog()
-			err = tlsConn.Handshake()
-			if err != nil {
-				return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("TLS handshake failed: %w", err)
-			}
-			conn = tlsConn
-		}
-	} else {
-		conn, err = s.dialUDP(t.IP, int(port))
-		if err != nil {
-			return zgrab2.TryGetScanStatus(err), results, fmt.Errorf("error dialing: %w", err)
-		}
-	}
-
-	defer conn.Close()
-
-	// Craft and send OPTIONS request
-	request := s.craftOptionsRequest(t)
-	_, err = conn.Write([]byte(request))
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), results, fmt.Errorf("error sending OPTIONS request: %w", err)
-	}
-
-	// Read response
-	buffer := make([]byte, 4096)
-	conn.SetReadDeadline(time.Now().Add(time.Duration(s.config.Timeout) * time.Second))
-	n, err := conn.Read(buffer)
-
-	// Decode response as UTF-8
-	decodedResponse := s.decodeUTF8(buffer[:n])
-	results.RawResponse = decodedResponse
-
-	if err != nil {
-		// Even if there's an error, we still return the raw response
-		return zgrab2.TryGetScanStatus(err), results, fmt.Errorf("error reading response: %w", err)
-	}
-
-	s.parseResponse(decodedResponse, results)
-
-	return zgrab2.SCAN_SUCCESS, results, nil
-}
-
-// dialUDP establishes a UDP connection.
-func (s *Scanner) dialUDP(ip net.IP, port int) (net.Conn, error) {
-	return net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: port})
-}
-
-// dialTCP establishes a TCP connection.
-func (s *Scanner) dialTCP(ip net.IP, port int) (net.Conn, error) {
-	return net.DialTimeout("tcp", fmt.Sprintf("%s:%d", ip.String(), port), time.Duration(s.config.Timeout)*time.Second)
-}
-
-// decodeUTF8 decodes the input bytes as UTF-8, replacing invalid sequences.
-func (s *Scanner) decodeUTF8(input []byte) string {
-	if utf8.Valid(input) {
-		return string(input)
-	}
-
-	// If input is not valid UTF-8, replace invalid sequences
-	return string(utf8.RuneError)
-}
-
-// parseResponse extracts relevant information from the SIP response.
-func (s *Scanner) parseResponse(response string, results *ScanResults) {
-	lines := strings.Split(response, "\r\n")
-	if len(lines) > 0 {
-		results.StatusLine = lines[0]
-		statusRegex := regexp.MustCompile(`SIP/2.0 (\d{3})`)
-		if matches := statusRegex.FindStringSubmatch(lines[0]); len(matches) > 1 {
-			results.StatusCode = matches[1]
-		}
-	}
-
-	results.Headers = make(map[string]string)
-	for _, line := range lines[1:] {
-		if line == "" {
-			break
-		}
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) == 2 {
-			key := strings.TrimSpace(parts[0])
-			value := strings.TrimSpace(parts[1])
-			results.Headers[key] = value
-
-			if strings.ToLower(key) == "allow" {
-				results.Methods = strings.Split(value, ",")
-				for i, method := range results.Methods {
-					results.Methods[i] = strings.TrimSpace(method)
-				}
-			}
-		}
-	}
-}
-
-// craftOptionsRequest creates a SIP OPTIONS request.
-func (s *Scanner) craftOptionsRequest(t zgrab2.ScanTarget) string {
-	// Craft the necessary fields
-	callID := fmt.Sprintf("%d", time.Now().UnixNano())
-	branch := fmt.Sprintf("z9hG4bK-%d", time.Now().UnixNano())
-	tag := fmt.Sprintf("%d", time.Now().UnixNano())
-
-	protocol := "UDP"
-	if s.config.UseTCP {
-		protocol = "TCP"
-	}
-
-	// Construct the request
-	request := fmt.Sprintf(
-		"OPTIONS sip:%s SIP/2.0\r\n"+
-			"Via: SIP/2.0/%s %s:%d;branch=%s;rport\r\n"+
-			"Max-Forwards: 70\r\n"+
-			"To: <sip:%s>\r\n"+
-			"From: <sip:zgrab2@localhost>;tag=%s\r\n"+
-			"Call-ID: %s\r\n"+
-			"CSeq: 1 OPTIONS\r\n"+
-			"Contact: <sip:zgrab2@localhost>\r\n"+
-			"Accept: application/sdp\r\n"+
-			"Content-Length: 0\r\n"+
-			"User-Agent: zgrab2/0.1\r\n"+
-			"\r\n",
-		t.Domain,
-		protocol, t.IP.String(), t.Port,
-		branch,
-		t.Domain,
-		tag,
-		callID,
-	)
-
-	return request
-}
+// Package sip contains the zgrab2 Module implementation for SIP.
+//
+// The scan sends a primary SIP request (OPTIONS, REGISTER, or INVITE) to
+// query the server's capabilities, followed by a credential-less REGISTER
+// probe to collect an auth challenge even when the primary method doesn't
+// provoke one. It supports both UDP and TCP connections.
+//
+// The output includes the server's response and any supported methods or
+// capabilities.
+package sip
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// AuthChallenge is a parsed WWW-Authenticate/Proxy-Authenticate challenge.
+type AuthChallenge struct {
+	Scheme    string `json:"scheme,omitempty"`
+	Realm     string `json:"realm,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	Opaque    string `json:"opaque,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Qop       string `json:"qop,omitempty"`
+	Stale     bool   `json:"stale,omitempty"`
+}
+
+// ContactInfo is parsed from the response's Via header rport/received
+// parameters, fingerprinting the transport/address the server actually
+// observed the request arriving from.
+type ContactInfo struct {
+	Transport string `json:"transport,omitempty"`
+	RPort     string `json:"rport,omitempty"`
+	Received  string `json:"received,omitempty"`
+}
+
+// ScanResults contains the output of the SIP scan.
+type ScanResults struct {
+	// RawResponse is the full, raw response from the SIP server, decoded as UTF-8.
+	RawResponse string `json:"raw_response,omitempty"`
+
+	// StatusCode is the numeric status code from the response.
+	StatusCode string `json:"status_code,omitempty"`
+
+	// StatusLine is the full status line from the response.
+	StatusLine string `json:"status_line,omitempty"`
+
+	// Methods is a list of supported methods reported by the server.
+	Methods []string `json:"methods,omitempty"`
+
+	// Headers contains all headers from the response.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// AuthChallenge is the parsed WWW-Authenticate/Proxy-Authenticate
+	// challenge from a 401/407 response to the primary request, if any.
+	AuthChallenge *AuthChallenge `json:"auth_challenge,omitempty"`
+
+	Server      string   `json:"server,omitempty"`
+	UserAgent   string   `json:"user_agent,omitempty"`
+	Supported   []string `json:"supported,omitempty"`
+	Require     []string `json:"require,omitempty"`
+	AllowEvents []string `json:"allow_events,omitempty"`
+
+	// Contact is parsed from the response's Via header.
+	Contact *ContactInfo `json:"contact,omitempty"`
+
+	// RegisterRawResponse/RegisterStatusCode/RegisterAuthChallenge hold
+	// the result of a follow-up, credential-less REGISTER probe sent
+	// after the primary request, to collect an auth challenge even when
+	// --method requested something else.
+	RegisterRawResponse   string         `json:"register_raw_response,omitempty"`
+	RegisterStatusCode    string         `json:"register_status_code,omitempty"`
+	RegisterAuthChallenge *AuthChallenge `json:"register_auth_challenge,omitempty"`
+
+	// TLSLog is the standard shared TLS handshake log.
+	TLSLog *zgrab2.TLSLog `json:"tls,omitempty"`
+
+	// Commands is an ordered transcript of every request sent and
+	// response received over the connection, including the STARTTLS
+	// probe and its response if --starttls was set.
+	Commands zgrab2.CommandLog `json:"commands,omitempty"`
+}
+
+// Flags defines the SIP-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+	zgrab2.TLSFlags
+
+	Verbose     bool   `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+	UseTCP      bool   `long:"tcp" description:"Use TCP instead of UDP for SIP scanning"`
+	ImplicitTLS bool   `long:"tls" description:"Attempt to connect via a TLS wrapped connection"`
+	Timeout     uint   `long:"tcp-timeout" default:"5" description:"Set connection timeout in seconds"`
+	Method      string `long:"method" default:"OPTIONS" description:"SIP method to send as the primary probe (OPTIONS, REGISTER, INVITE)"`
+
+	// StartTLS advertises TLS in the Via transport of the primary
+	// request and, if the server answers 200 OK, upgrades the TCP
+	// connection to TLS before sending the real probe(s), per RFC 3261
+	// section 26.2.2.
+	StartTLS bool `long:"starttls" description:"Advertise TLS in the Via transport, and upgrade the TCP connection to TLS on a 200 OK before probing"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface.
+type Scanner struct {
+	config *Flags
+}
+
+// RegisterModule registers the sip zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("sip", "SIP", module.Description(), 5060, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns a default Flags object.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Probe for SIP (Session Initiation Protocol) servers using UDP or TCP"
+}
+
+// Validate checks that the flags are valid.
+func (f *Flags) Validate(args []string) error {
+	switch strings.ToUpper(f.Method) {
+	case "OPTIONS", "REGISTER", "INVITE":
+	default:
+		return fmt.Errorf("invalid --method %q: must be OPTIONS, REGISTER, or INVITE", f.Method)
+	}
+	if f.StartTLS {
+		if !f.UseTCP {
+			return fmt.Errorf("--starttls requires --tcp")
+		}
+		if f.ImplicitTLS {
+			return fmt.Errorf("--starttls cannot be combined with --tls")
+		}
+	}
+	return nil
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (s *Scanner) Protocol() string {
+	return "sip"
+}
+
+// Init initializes the Scanner with the command-line flags.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+	return nil
+}
+
+// InitPerSender initializes the scanner for a given sender.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the scanner name defined in the Flags.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// Scan performs the SIP scan.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (zgrab2.ScanStatus, interface{}, error) {
+	results := &ScanResults{}
+
+	var port uint
+	if t.Port != nil {
+		port = *t.Port
+	} else {
+		port = s.config.Port
+	}
+
+	var conn net.Conn
+	var err error
+
+	if s.config.UseTCP {
+		conn, err = s.dialTCP(t.IP, int(port))
+		if err != nil {
+			return zgrab2.TryGetScanStatus(err), results, fmt.Errorf("error dialing: %w", err)
+		}
+		if s.config.ImplicitTLS {
+			tlsConn, err := s.config.TLSFlags.GetTLSConnection(conn)
+			if err != nil {
+				return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error setting up TLS connection: %w", err)
+			}
+			results.TLSLog = tlsConn.GetLog()
+			err = tlsConn.Handshake()
+			if err != nil {
+				return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("TLS handshake failed: %w", err)
+			}
+			conn = tlsConn
+		}
+	} else {
+		conn, err = s.dialUDP(t.IP, int(port))
+		if err != nil {
+			return zgrab2.TryGetScanStatus(err), results, fmt.Errorf("error dialing: %w", err)
+		}
+	}
+
+	defer conn.Close()
+
+	var reader *bufio.Reader
+	if s.config.UseTCP {
+		reader = bufio.NewReader(conn)
+	}
+
+	transport := "UDP"
+	if s.config.UseTCP {
+		transport = "TCP"
+	}
+
+	if s.config.StartTLS {
+		conn, err = s.performStartTLS(conn, t, results)
+		if err != nil {
+			return zgrab2.TryGetScanStatus(err), results, err
+		}
+		// The connection underneath reader is now encrypted; a fresh
+		// bufio.Reader is required since the old one wraps the raw conn.
+		reader = bufio.NewReader(conn)
+		transport = "TLS"
+	}
+
+	method := strings.ToUpper(s.config.Method)
+	request := s.craftRequest(method, t, transport)
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return zgrab2.TryGetScanStatus(err), results, fmt.Errorf("error sending %s request: %w", method, err)
+	}
+	results.Commands.Sent([]byte(request))
+
+	raw, err := s.readSIPResponse(conn, reader)
+	results.RawResponse = raw
+	results.Commands.Received([]byte(raw))
+	if err != nil {
+		// Even if there's an error, we still return the raw response
+		return zgrab2.TryGetScanStatus(err), results, fmt.Errorf("error reading response: %w", err)
+	}
+
+	s.parseResponse(raw, results)
+
+	if method != "REGISTER" {
+		registerRequest := s.craftRequest("REGISTER", t, transport)
+		if _, err := conn.Write([]byte(registerRequest)); err == nil {
+			results.Commands.Sent([]byte(registerRequest))
+			if registerRaw, err := s.readSIPResponse(conn, reader); err == nil {
+				results.Commands.Received([]byte(registerRaw))
+				results.RegisterRawResponse = registerRaw
+				registerResults := &ScanResults{}
+				s.parseResponse(registerRaw, registerResults)
+				results.RegisterStatusCode = registerResults.StatusCode
+				results.RegisterAuthChallenge = registerResults.AuthChallenge
+			}
+		}
+	}
+
+	return zgrab2.SCAN_SUCCESS, results, nil
+}
+
+// performStartTLS sends an OPTIONS request advertising a TLS Via transport
+// and, if the server answers 200 OK, upgrades conn to TLS. It uses
+// zgrab2.StartTLSUpgrader rather than readSIPResponse because no
+// bufio.Reader has been established on conn yet at this point in Scan.
+func (s *Scanner) performStartTLS(conn net.Conn, t zgrab2.ScanTarget, results *ScanResults) (net.Conn, error) {
+	request := s.craftRequest("OPTIONS", t, "TLS")
+	upgrader := &zgrab2.StartTLSUpgrader{Log: &results.Commands}
+
+	var probeResults ScanResults
+	err := upgrader.Negotiate(conn, nil, time.Duration(s.config.Timeout)*time.Second,
+		func() error {
+			return upgrader.Send(conn, []byte(request))
+		},
+		func(response []byte) bool {
+			probeResults = ScanResults{}
+			s.parseResponse(s.decodeUTF8(response), &probeResults)
+			return probeResults.StatusCode != ""
+		},
+	)
+	if err != nil {
+		return conn, fmt.Errorf("error probing STARTTLS: %w", err)
+	}
+	if probeResults.StatusCode != "200" {
+		return conn, fmt.Errorf("server did not accept TLS upgrade (status %s)", probeResults.StatusCode)
+	}
+
+	tlsConn, err := s.config.TLSFlags.GetTLSConnection(conn)
+	if err != nil {
+		return conn, fmt.Errorf("error setting up TLS connection: %w", err)
+	}
+	results.TLSLog = tlsConn.GetLog()
+	if err := tlsConn.Handshake(); err != nil {
+		return conn, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// dialUDP establishes a UDP connection.
+func (s *Scanner) dialUDP(ip net.IP, port int) (net.Conn, error) {
+	return net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: port})
+}
+
+// dialTCP establishes a TCP connection.
+func (s *Scanner) dialTCP(ip net.IP, port int) (net.Conn, error) {
+	return net.DialTimeout("tcp", fmt.Sprintf("%s:%d", ip.String(), port), time.Duration(s.config.Timeout)*time.Second)
+}
+
+// decodeUTF8 decodes the input bytes as UTF-8, replacing invalid sequences.
+func (s *Scanner) decodeUTF8(input []byte) string {
+	if utf8.Valid(input) {
+		return string(input)
+	}
+
+	// If input is not valid UTF-8, replace invalid sequences
+	return string(utf8.RuneError)
+}
+
+// readSIPResponse reads a single SIP response from conn. For UDP, a
+// single read is sufficient since each datagram is one message; for TCP,
+// reader frames the response by reading headers up to the blank line and
+// then exactly Content-Length bytes of body.
+func (s *Scanner) readSIPResponse(conn net.Conn, reader *bufio.Reader) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(time.Duration(s.config.Timeout) * time.Second))
+
+	if reader == nil {
+		buffer := make([]byte, 4096)
+		n, err := conn.Read(buffer)
+		return s.decodeUTF8(buffer[:n]), err
+	}
+
+	var message bytes.Buffer
+	contentLength := 0
+	for {
+		line, err := reader.ReadString('\n')
+		message.WriteString(line)
+		if err != nil {
+			return s.decodeUTF8(message.Bytes()), err
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			break
+		}
+		if idx := strings.Index(trimmed, ":"); idx >= 0 {
+			key := strings.TrimSpace(trimmed[:idx])
+			if strings.EqualFold(key, "Content-Length") {
+				if n, err := strconv.Atoi(strings.TrimSpace(trimmed[idx+1:])); err == nil {
+					contentLength = n
+				}
+			}
+		}
+	}
+
+	if contentLength > 0 {
+		body := make([]byte, contentLength)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return s.decodeUTF8(message.Bytes()), err
+		}
+		message.Write(body)
+	}
+
+	return s.decodeUTF8(message.Bytes()), nil
+}
+
+// authParamPattern matches key=value or key="value" pairs within a
+// WWW-Authenticate/Proxy-Authenticate challenge.
+var authParamPattern = regexp.MustCompile(`(\w+)=("([^"]*)"|[^,\s]+)`)
+
+// parseAuthChallenge parses a WWW-Authenticate/Proxy-Authenticate header
+// value, e.g. `Digest realm="example.com", nonce="abc", algorithm=MD5`.
+func parseAuthChallenge(header string) *AuthChallenge {
+	header = strings.TrimSpace(header)
+	fields := strings.SplitN(header, " ", 2)
+	if len(fields) == 0 || fields[0] == "" {
+		return nil
+	}
+	challenge := &AuthChallenge{Scheme: fields[0]}
+	if len(fields) < 2 {
+		return challenge
+	}
+	for _, match := range authParamPattern.FindAllStringSubmatch(fields[1], -1) {
+		key := strings.ToLower(match[1])
+		value := match[3]
+		if value == "" && match[2] != "" {
+			value = match[2]
+		}
+		switch key {
+		case "realm":
+			challenge.Realm = value
+		case "nonce":
+			challenge.Nonce = value
+		case "opaque":
+			challenge.Opaque = value
+		case "algorithm":
+			challenge.Algorithm = value
+		case "qop":
+			challenge.Qop = value
+		case "stale":
+			challenge.Stale = strings.EqualFold(value, "true")
+		}
+	}
+	return challenge
+}
+
+// viaParamPattern matches a single ;key=value Via parameter.
+var viaRPortPattern = regexp.MustCompile(`rport=(\d+)`)
+var viaReceivedPattern = regexp.MustCompile(`received=([^;\s]+)`)
+
+// parseContactInfo extracts transport/rport/received from a response's
+// top Via header.
+func parseContactInfo(via string) *ContactInfo {
+	info := &ContactInfo{}
+	if idx := strings.IndexAny(via, " ;"); idx >= 0 {
+		if parts := strings.Split(via[:idx], "/"); len(parts) == 3 {
+			info.Transport = parts[2]
+		}
+	}
+	if m := viaRPortPattern.FindStringSubmatch(via); len(m) > 1 {
+		info.RPort = m[1]
+	}
+	if m := viaReceivedPattern.FindStringSubmatch(via); len(m) > 1 {
+		info.Received = m[1]
+	}
+	return info
+}
+
+// splitCommaList splits a comma-separated header value into trimmed
+// fields.
+func splitCommaList(value string) []string {
+	parts := strings.Split(value, ",")
+	list := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// parseResponse extracts relevant information from the SIP response.
+func (s *Scanner) parseResponse(response string, results *ScanResults) {
+	lines := strings.Split(response, "\r\n")
+	if len(lines) > 0 {
+		results.StatusLine = lines[0]
+		statusRegex := regexp.MustCompile(`SIP/2.0 (\d{3})`)
+		if matches := statusRegex.FindStringSubmatch(lines[0]); len(matches) > 1 {
+			results.StatusCode = matches[1]
+		}
+	}
+
+	results.Headers = make(map[string]string)
+	for _, line := range lines[1:] {
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		results.Headers[key] = value
+
+		switch strings.ToLower(key) {
+		case "allow":
+			results.Methods = splitCommaList(value)
+		case "server":
+			results.Server = value
+		case "user-agent":
+			results.UserAgent = value
+		case "supported":
+			results.Supported = splitCommaList(value)
+		case "require":
+			results.Require = splitCommaList(value)
+		case "allow-events":
+			results.AllowEvents = splitCommaList(value)
+		case "www-authenticate", "proxy-authenticate":
+			results.AuthChallenge = parseAuthChallenge(value)
+		case "via":
+			if results.Contact == nil {
+				results.Contact = parseContactInfo(value)
+			}
+		}
+	}
+}
+
+// craftRequest creates a SIP request for method, advertising transport
+// in the Via header (independent of the connection's actual transport,
+// to support the STARTTLS advertise-then-upgrade flow).
+func (s *Scanner) craftRequest(method string, t zgrab2.ScanTarget, transport string) string {
+	callID := fmt.Sprintf("%d", time.Now().UnixNano())
+	branch := fmt.Sprintf("z9hG4bK-%d", time.Now().UnixNano())
+	tag := fmt.Sprintf("%d", time.Now().UnixNano())
+
+	request := fmt.Sprintf(
+		"%s sip:%s SIP/2.0\r\n"+
+			"Via: SIP/2.0/%s %s:%d;branch=%s;rport\r\n"+
+			"Max-Forwards: 70\r\n"+
+			"To: <sip:%s>\r\n"+
+			"From: <sip:zgrab2@localhost>;tag=%s\r\n"+
+			"Call-ID: %s\r\n"+
+			"CSeq: 1 %s\r\n"+
+			"Contact: <sip:zgrab2@localhost>\r\n"+
+			"Accept: application/sdp\r\n"+
+			"Content-Length: 0\r\n"+
+			"User-Agent: zgrab2/0.1\r\n"+
+			"\r\n",
+		method, t.Domain,
+		transport, t.IP.String(), t.Port,
+		branch,
+		t.Domain,
+		tag,
+		callID,
+		method,
+	)
+
+	return request
+}
@@ -1,157 +1,300 @@
-// Package tacacs contains the zgrab2 Module implementation for TACACS+.
-package tacacs
-
-import (
-	"encoding/binary"
-	"fmt"
-	"math/rand"
-	"net"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-// ScanResults is the output of the scan.
-type ScanResults struct {
-	// Banner is the initial data banner sent by the server.
-	Banner string `json:"banner,omitempty"`
-
-	// RawResp is the raw response from the TACACS+ server.
-	RawResp []byte `json:"raw_resp,omitempty"`
-}
-
-// Flags are the TACACS+-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-
-	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct {
-}
-
-// Scanner implements the zgrab2.Scanner interface, and holds the state
-// for a single scan.
-type Scanner struct {
-	config *Flags
-}
-
-// Connection holds the state for a single connection to the TACACS+ server.
-type Connection struct {
-	conn    net.Conn
-	config  *Flags
-	results ScanResults
-}
-
-// RegisterModule registers the TACACS+ zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("tacacs", "TACACS+", module.Description(), 49, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns the default flags object to be filled in with the
-// command-line arguments.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns an overview of this module.
-func (m *Module) Description() string {
-	return "Perform a TACACS+ handshake and retrieve the server's response"
-}
-
-// Validate flags
-func (f *Flags) Validate(args []string) (err error) {
-	return nil
-}
-
-// Help returns this module's help string.
-func (f *Flags) Help() string {
-	return ""
-}
-
-// Protocol returns the protocol identifier for the scanner.
-func (s *Scanner) Protocol() string {
-	return "tacacs"
-}
-
-// Init initializes the Scanner instance with the flags from the command line.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// GetName returns the configured name for the Scanner.
-func (s *Scanner) GetName() string {
-	return s.config.Name
-}
-
-// GetTrigger returns the Trigger defined in the Flags.
-func (scanner *Scanner) GetTrigger() string {
-	return scanner.config.Trigger
-}
-
-// sendTACACSPacket constructs and sends a minimal TACACS+ Authentication START packet.
-func (c *Connection) sendTACACSPacket() ([]byte, error) {
-	// Construct the TACACS+ Authentication START packet
-	packet := make([]byte, 12) // 12 bytes for the header
-
-	// Header fields
-	packet[0] = 0xc0                                      // major_version
-	packet[1] = 0x01                                      // type (Authentication)
-	packet[2] = 0x01                                      // seq_no
-	packet[3] = 0x00                                      // flags
-	binary.BigEndian.PutUint32(packet[4:], rand.Uint32()) // session_id
-	binary.BigEndian.PutUint32(packet[8:], uint32(0))     // length (0 for now)
-
-	// Send the packet
-	_, err := c.conn.Write(packet)
-	if err != nil {
-		return nil, err
-	}
-
-	// Read the response
-	response := make([]byte, 1024)
-	n, err := c.conn.Read(response)
-	if err != nil {
-		return nil, err
-	}
-
-	return response[:n], nil
-}
-
-// Scan performs the configured scan on the TACACS+ server.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
-	conn, err := t.Open(&s.config.BaseFlags)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
-	}
-	defer conn.Close()
-
-	c := Connection{conn: conn, config: s.config}
-
-	// Send the TACACS+ packet
-	response, err := c.sendTACACSPacket()
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), &c.results, fmt.Errorf("error sending TACACS+ packet: %w", err)
-	}
-
-	// Log the server response
-	c.results.RawResp = response
-	return zgrab2.SCAN_SUCCESS, &c.results, nil
-}
+// Package tacacs contains the zgrab2 Module implementation for TACACS+.
+package tacacs
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// TACACS+ header fields, per RFC 8907.
+const (
+	tacPlusMajorVersion = 0xc0 // high nibble of the version byte
+	tacPlusMinorVersion = 0x01 // ASCII login uses minor version 1
+
+	tacPlusTypeAuthen = 1 // Authentication packet type
+
+	authenActionLogin      = 1 // TAC_PLUS_AUTHEN_LOGIN
+	authenTypeASCII        = 1 // TAC_PLUS_AUTHEN_TYPE_ASCII
+	authenServiceLogin     = 1 // TAC_PLUS_AUTHEN_SVC_LOGIN
+	tacPlusUnencryptedFlag = 0x01
+)
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	// Banner is the initial data banner sent by the server.
+	Banner string `json:"banner,omitempty"`
+
+	// Status is the Authentication REPLY status field.
+	Status uint8 `json:"status,omitempty"`
+
+	// Flags is the Authentication REPLY flags field.
+	Flags uint8 `json:"flags,omitempty"`
+
+	// ServerMsg is the REPLY's server_msg field, shown to the user during login.
+	ServerMsg string `json:"server_msg,omitempty"`
+
+	// Data is the REPLY's data field.
+	Data []byte `json:"data,omitempty"`
+
+	// Unencrypted is true if the server's REPLY header had
+	// TAC_PLUS_UNENCRYPTED_FLAG set, indicating the body was sent in the
+	// clear rather than obfuscated with the shared secret.
+	Unencrypted bool `json:"unencrypted,omitempty"`
+
+	// RawResp is the raw response from the TACACS+ server.
+	RawResp []byte `json:"raw_resp,omitempty"`
+}
+
+// Flags are the TACACS+-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+
+	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+
+	User     string `long:"user" default:"test" description:"Username to send in the Authentication START body"`
+	PortName string `long:"port-name" default:"tty0" description:"Port name to send in the Authentication START body"`
+	RemAddr  string `long:"rem-addr" default:"zgrab2" description:"Remote address to send in the Authentication START body"`
+
+	Secret string `long:"secret" description:"Shared secret used to obfuscate the request and deobfuscate the reply, per RFC 8907 section 4.5"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface, and holds the state
+// for a single scan.
+type Scanner struct {
+	config *Flags
+}
+
+// Connection holds the state for a single connection to the TACACS+ server.
+type Connection struct {
+	conn    net.Conn
+	config  *Flags
+	results ScanResults
+}
+
+// RegisterModule registers the TACACS+ zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("tacacs", "TACACS+", module.Description(), 49, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object to be filled in with the
+// command-line arguments.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Perform a TACACS+ handshake and retrieve the server's response"
+}
+
+// Validate flags
+func (f *Flags) Validate(args []string) (err error) {
+	return nil
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (s *Scanner) Protocol() string {
+	return "tacacs"
+}
+
+// Init initializes the Scanner instance with the flags from the command line.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// pad generates the RFC 8907 section 4.5 pseudo_pad stream used to
+// obfuscate/deobfuscate a body of the given length:
+//
+//	pad_1 = MD5(session_id || secret || version || seq_no)
+//	pad_n = MD5(session_id || secret || version || seq_no || pad_{n-1})
+//	pad   = pad_1 || pad_2 || ...
+func pad(sessionID uint32, secret []byte, version, seqNo uint8, length int) []byte {
+	var sessionIDBuf [4]byte
+	binary.BigEndian.PutUint32(sessionIDBuf[:], sessionID)
+
+	out := make([]byte, 0, length+md5.Size)
+	var prev []byte
+	for len(out) < length {
+		h := md5.New()
+		h.Write(sessionIDBuf[:])
+		h.Write(secret)
+		h.Write([]byte{version, seqNo})
+		h.Write(prev)
+		prev = h.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
+
+// obfuscate XORs body in place with the shared-secret pad stream.
+func obfuscate(body []byte, sessionID uint32, secret []byte, version, seqNo uint8) {
+	if len(secret) == 0 {
+		return
+	}
+	p := pad(sessionID, secret, version, seqNo, len(body))
+	for i := range body {
+		body[i] ^= p[i]
+	}
+}
+
+// buildAuthenStartBody builds the Authentication START packet body, per
+// RFC 8907 section 5.1.
+func buildAuthenStartBody(user, port, remAddr string) []byte {
+	body := make([]byte, 8, 8+len(user)+len(port)+len(remAddr))
+	body[0] = authenActionLogin
+	body[1] = 1 // priv_lvl
+	body[2] = authenTypeASCII
+	body[3] = authenServiceLogin
+	body[4] = uint8(len(user))
+	body[5] = uint8(len(port))
+	body[6] = uint8(len(remAddr))
+	body[7] = 0 // data_len
+	body = append(body, user...)
+	body = append(body, port...)
+	body = append(body, remAddr...)
+	return body
+}
+
+// sendTACACSPacket constructs and sends a real TACACS+ Authentication START
+// packet, obfuscating the body with --secret if one was provided.
+func (c *Connection) sendTACACSPacket() ([]byte, error) {
+	var sessionID uint32
+	if err := binary.Read(rand.Reader, binary.BigEndian, &sessionID); err != nil {
+		return nil, fmt.Errorf("error generating session_id: %w", err)
+	}
+
+	const seqNo = 1
+	version := uint8(tacPlusMajorVersion | tacPlusMinorVersion)
+	secret := []byte(c.config.Secret)
+
+	body := buildAuthenStartBody(c.config.User, c.config.PortName, c.config.RemAddr)
+	obfuscate(body, sessionID, secret, version, seqNo)
+
+	header := make([]byte, 12)
+	header[0] = version
+	header[1] = tacPlusTypeAuthen
+	header[2] = seqNo
+	if len(secret) == 0 {
+		header[3] = tacPlusUnencryptedFlag
+	}
+	binary.BigEndian.PutUint32(header[4:8], sessionID)
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(body)))
+
+	packet := append(header, body...)
+
+	if _, err := c.conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	// Read the response
+	response := make([]byte, 4096)
+	n, err := c.conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	response = response[:n]
+
+	if len(response) >= 12 {
+		respSessionID := binary.BigEndian.Uint32(response[4:8])
+		respVersion := response[0]
+		respSeqNo := response[2]
+		respFlags := response[3]
+		bodyLen := binary.BigEndian.Uint32(response[8:12])
+		if int(bodyLen) <= len(response)-12 {
+			replyBody := response[12 : 12+bodyLen]
+			c.results.Unencrypted = respFlags&tacPlusUnencryptedFlag != 0
+			if !c.results.Unencrypted {
+				obfuscate(replyBody, respSessionID, secret, respVersion, respSeqNo)
+			}
+			if err := c.parseAuthenReply(replyBody); err != nil {
+				return response, fmt.Errorf("error parsing REPLY body: %w", err)
+			}
+		}
+	}
+
+	return response, nil
+}
+
+// parseAuthenReply parses an Authentication REPLY body, per RFC 8907
+// section 5.2, into the scan results.
+func (c *Connection) parseAuthenReply(body []byte) error {
+	if len(body) < 6 {
+		return errors.New("REPLY body too short")
+	}
+	c.results.Status = body[0]
+	c.results.Flags = body[1]
+	serverMsgLen := binary.BigEndian.Uint16(body[2:4])
+	dataLen := binary.BigEndian.Uint16(body[4:6])
+
+	offset := 6
+	if offset+int(serverMsgLen)+int(dataLen) > len(body) {
+		return errors.New("REPLY server_msg/data length exceeds body")
+	}
+	c.results.ServerMsg = string(body[offset : offset+int(serverMsgLen)])
+	offset += int(serverMsgLen)
+	c.results.Data = body[offset : offset+int(dataLen)]
+	return nil
+}
+
+// Scan performs the configured scan on the TACACS+ server.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	conn, err := t.Open(&s.config.BaseFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	defer conn.Close()
+
+	c := Connection{conn: conn, config: s.config}
+
+	// Send the TACACS+ packet
+	response, err := c.sendTACACSPacket()
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), &c.results, fmt.Errorf("error sending TACACS+ packet: %w", err)
+	}
+
+	// Log the server response
+	c.results.RawResp = response
+	return zgrab2.SCAN_SUCCESS, &c.results, nil
+}
@@ -1,190 +1,455 @@
-package terraria
-
-import (
-	"encoding/binary"
-	"fmt"
-	"net"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-// Terraria version string
-const terrariaVersion = "Terraria244"
-
-// ScanResults is the output of the scan.
-type ScanResults struct {
-	ServerResponse string `json:"server_response,omitempty"`
-}
-
-// Flags are the Terraria-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-	Verbose bool `long:"verbose" description:"More verbose logging"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct {
-}
-
-// Scanner implements the zgrab2.Scanner interface.
-type Scanner struct {
-	config *Flags
-}
-
-// Connection holds the state for a single connection to the Terraria server.
-type Connection struct {
-	conn    net.Conn
-	config  *Flags
-	results ScanResults
-}
-
-// RegisterModule registers the terraria zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("terraria", "Terraria", module.Description(), 7777, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns the default flags object to be filled in with the command-line arguments.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns an overview of this module.
-func (m *Module) Description() string {
-	return "Scan a Terraria server by sending a Connect Request and checking for valid responses."
-}
-
-// Init initializes the Scanner instance with the flags from the command line.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// GetName returns the configured name for the Scanner.
-func (s *Scanner) GetName() string {
-	return s.config.Name
-}
-
-// GetTrigger returns the Trigger defined in the Flags.
-func (s *Scanner) GetTrigger() string {
-	return s.config.Trigger
-}
-
-// Help returns this module's help string.
-func (f *Flags) Help() string {
-	return "This module scans Terraria servers by sending a Connect Request."
-}
-
-// Validate ensures that the flag values are valid.
-func (f *Flags) Validate(args []string) error {
-	return nil
-}
-
-// Protocol returns the protocol identifier for the scanner (Terraria).
-func (s *Scanner) Protocol() string {
-	return "terraria"
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// Scan performs the configured scan on the Terraria server.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
-	conn, err := t.Open(&s.config.BaseFlags)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
-	}
-	defer conn.Close()
-
-	terraria := Connection{conn: conn, config: s.config}
-
-	// Step 1: Send the Connect Request
-	if err := terraria.SendConnectRequest(); err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error sending Connect Request: %w", err)
-	}
-
-	// Step 2: Wait for and validate the response
-	if err := terraria.ReadAndValidateResponse(); err != nil {
-		return zgrab2.TryGetScanStatus(err), &terraria.results, fmt.Errorf("error reading server response: %w", err)
-	}
-
-	// Step 3: Return scan success and results
-	return zgrab2.SCAN_SUCCESS, &terraria.results, nil
-}
-
-// SendConnectRequest sends a Terraria Connect Request to the server.
-func (terraria *Connection) SendConnectRequest() error {
-	versionBytes := []byte(terrariaVersion)
-	packetLength := uint16(len(versionBytes) + 1 + 2) // +1 for the Packet ID, +2 for the length itself
-
-	packetID := byte(1) // Packet ID for Connect Request
-
-	// Build the packet
-	packet := make([]byte, 2+len(versionBytes)+1)       // 2 bytes for length, 1 byte for packet ID
-	binary.LittleEndian.PutUint16(packet, packetLength) // First 2 bytes: packet length (including itself)
-	packet[2] = packetID                                // Next byte: packet ID
-	copy(packet[3:], versionBytes)                      // Remaining bytes: version string
-
-	// Send the packet
-	_, err := terraria.conn.Write(packet)
-	return err
-}
-
-// ReadAndValidateResponse reads the server's response and validates it.
-func (terraria *Connection) ReadAndValidateResponse() error {
-	buffer := make([]byte, 1024)
-	n, err := terraria.conn.Read(buffer)
-	if err != nil {
-		return err
-	}
-
-	response := buffer[:n]
-	terraria.results.ServerResponse = string(response)
-
-	// Validate the response based on Terraria protocol
-	if err := terraria.ValidateResponse(response); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// ValidateResponse checks the format of the server's response.
-func (terraria *Connection) ValidateResponse(response []byte) error {
-	if len(response) < 3 {
-		return fmt.Errorf("invalid response length")
-	}
-
-	// First two bytes: Packet Length
-	packetLength := binary.LittleEndian.Uint16(response[:2])
-
-	// Adjust for protocol differences: We expect the server's packet length to include its own size (2 bytes).
-	if int(packetLength) != len(response) {
-		return fmt.Errorf("invalid packet length: expected %d, got %d", len(response), packetLength)
-	}
-
-	// Third byte: Packet ID
-	packetID := response[2]
-	switch packetID {
-	case 2: // Password Required
-		log.Info("Server requires a password.")
-	case 3: // Continue Connecting
-		log.Info("Server allows continued connection.")
-	default:
-		return fmt.Errorf("unknown Packet ID: %d", packetID)
-	}
-
-	return nil
-}
+package terraria
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+	"github.com/zmap/zgrab2/framing"
+	"github.com/zmap/zgrab2/script"
+)
+
+// defaultScriptMaxFileSize bounds how large a --script file is allowed to be.
+const defaultScriptMaxFileSize = 1 << 20
+
+// defaultScriptReadSize bounds a best-effort script step response read.
+const defaultScriptReadSize = 4096
+
+// packetReadDeadline bounds how long a single Terraria packet read may take.
+const packetReadDeadline = 10 * time.Second
+
+// maxPacketSize bounds how large a single Terraria packet body may be.
+const maxPacketSize = 1 << 16
+
+// Terraria packet IDs relevant to this scan.
+const (
+	packetConnectRequest     = 1 // Connect Request
+	packetDisconnect         = 2 // Disconnect / Password Required
+	packetContinueConnecting = 3 // Continue Connecting, carries the player slot
+	packetPasswordResponse   = 0x26
+	packetWorldInfo          = 0x07
+)
+
+// WorldSize holds the maximum tile dimensions of a Terraria world.
+type WorldSize struct {
+	MaxTilesX int `json:"max_tiles_x"`
+	MaxTilesY int `json:"max_tiles_y"`
+}
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	ServerResponse string `json:"server_response,omitempty"`
+
+	// PasswordRequired is true if the server responded to the Connect
+	// Request with a Password Required packet.
+	PasswordRequired bool `json:"password_required,omitempty"`
+
+	// PasswordAccepted is set if --password was supplied and a Password
+	// Response was sent: true if the server continued the handshake,
+	// false if it disconnected us instead.
+	PasswordAccepted *bool `json:"password_accepted,omitempty"`
+
+	// PlayerSlot is the player slot assigned in the Continue Connecting packet.
+	PlayerSlot int `json:"player_slot,omitempty"`
+
+	// WorldName, WorldSize, SpawnX/SpawnY, WorldID, TimeOfDay, MoonPhase,
+	// and Difficulty are parsed from the server's World Info packet.
+	WorldName string     `json:"world_name,omitempty"`
+	WorldSize *WorldSize `json:"world_size,omitempty"`
+	SpawnX    int        `json:"spawn_x,omitempty"`
+	SpawnY    int        `json:"spawn_y,omitempty"`
+	WorldID   int32      `json:"world_id,omitempty"`
+	TimeOfDay int32      `json:"time_of_day,omitempty"`
+	MoonPhase int        `json:"moon_phase,omitempty"`
+
+	// Difficulty holds the game-mode/difficulty bitflags byte that
+	// follows the world name in the World Info packet.
+	Difficulty int `json:"difficulty,omitempty"`
+
+	// ScriptLog holds the per-step results of --script, if set.
+	ScriptLog []script.StepResult `json:"script_log,omitempty"`
+
+	// SavedGroups holds the named captures recorded by --script steps'
+	// save_group, if any were set.
+	SavedGroups map[string]string `json:"saved_groups,omitempty"`
+}
+
+// Flags are the Terraria-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+	Verbose bool `long:"verbose" description:"More verbose logging"`
+
+	ClientVersion string `long:"client-version" default:"Terraria244" description:"Client version string to send in the Connect Request, e.g. Terraria230, Terraria238"`
+	Password      string `long:"password" description:"Password to send if the server requires one"`
+
+	Script string `long:"script" description:"Path to a JSON or YAML ProbeScript run on the connection after the built-in probe"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface.
+type Scanner struct {
+	config *Flags
+	script *script.ProbeScript
+}
+
+// Connection holds the state for a single connection to the Terraria server.
+type Connection struct {
+	conn    net.Conn
+	config  *Flags
+	results ScanResults
+}
+
+// RegisterModule registers the terraria zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("terraria", "Terraria", module.Description(), 7777, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object to be filled in with the command-line arguments.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Scan a Terraria server by sending a Connect Request and checking for valid responses."
+}
+
+// Init initializes the Scanner instance with the flags from the command line.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+
+	if f.Script != "" {
+		ps, err := script.Load(f.Script, defaultScriptMaxFileSize)
+		if err != nil {
+			return fmt.Errorf("error loading --script: %w", err)
+		}
+		s.script = ps
+	}
+
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (s *Scanner) GetTrigger() string {
+	return s.config.Trigger
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return "This module scans Terraria servers by sending a Connect Request."
+}
+
+// Validate ensures that the flag values are valid.
+func (f *Flags) Validate(args []string) error {
+	return nil
+}
+
+// Protocol returns the protocol identifier for the scanner (Terraria).
+func (s *Scanner) Protocol() string {
+	return "terraria"
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// Scan performs the configured scan on the Terraria server.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	conn, err := t.Open(&s.config.BaseFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	defer conn.Close()
+
+	terraria := Connection{conn: conn, config: s.config}
+
+	// Step 1: Send the Connect Request
+	if err := terraria.SendConnectRequest(); err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error sending Connect Request: %w", err)
+	}
+
+	// Step 2: Wait for and validate the response
+	if err := terraria.ReadAndValidateResponse(); err != nil {
+		return zgrab2.TryGetScanStatus(err), &terraria.results, fmt.Errorf("error reading server response: %w", err)
+	}
+
+	// Step 3: Drive the handshake further, through Password Response
+	// (if required and configured), player slot, and World Info.
+	if err := terraria.ContinueHandshake(); err != nil {
+		return zgrab2.TryGetScanStatus(err), &terraria.results, fmt.Errorf("error continuing handshake: %w", err)
+	}
+
+	if s.script != nil {
+		scriptLog, savedGroups, err := script.Run(terraria.conn, s.script.Steps, defaultScriptReadSize, 0)
+		terraria.results.ScriptLog = scriptLog
+		terraria.results.SavedGroups = savedGroups
+		if err != nil {
+			log.Infof("terraria script run ended early: %v", err)
+		}
+	}
+
+	return zgrab2.SCAN_SUCCESS, &terraria.results, nil
+}
+
+// write7BitEncodedInt encodes an integer using the .NET BinaryWriter 7-bit
+// variable-length encoding: the low 7 bits of each byte carry data, and the
+// high bit signals whether another byte follows.
+func write7BitEncodedInt(value int) []byte {
+	var buf []byte
+	v := uint32(value)
+	for v >= 0x80 {
+		buf = append(buf, byte(v&0x7f)|0x80)
+		v >>= 7
+	}
+	buf = append(buf, byte(v))
+	return buf
+}
+
+// read7BitEncodedInt reads a .NET 7-bit variable-length encoded integer.
+func read7BitEncodedInt(r *bytes.Reader) (int, error) {
+	var result int
+	var shift uint
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		result |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	return result, nil
+}
+
+// writeTerrariaString encodes a string the way .NET's BinaryWriter.Write(string)
+// does: a 7-bit encoded length prefix followed by the UTF-8 bytes.
+func writeTerrariaString(s string) []byte {
+	buf := write7BitEncodedInt(len(s))
+	return append(buf, []byte(s)...)
+}
+
+// buildPacket wraps a payload in the standard Terraria packet framing: a
+// 2-byte little-endian length (including the length field and packet ID
+// itself), followed by the packet ID and the payload.
+func buildPacket(packetID byte, payload []byte) []byte {
+	length := uint16(2 + 1 + len(payload))
+	packet := make([]byte, 2, 2+1+len(payload))
+	binary.LittleEndian.PutUint16(packet, length)
+	packet = append(packet, packetID)
+	packet = append(packet, payload...)
+	return packet
+}
+
+// SendConnectRequest sends a Terraria Connect Request to the server.
+func (terraria *Connection) SendConnectRequest() error {
+	payload := writeTerrariaString(terraria.config.ClientVersion)
+	_, err := terraria.conn.Write(buildPacket(packetConnectRequest, payload))
+	return err
+}
+
+// SendPasswordResponse sends a Password Response packet containing the
+// configured --password.
+func (terraria *Connection) SendPasswordResponse() error {
+	payload := writeTerrariaString(terraria.config.Password)
+	_, err := terraria.conn.Write(buildPacket(packetPasswordResponse, payload))
+	return err
+}
+
+// readPacket reads a single length-prefixed Terraria packet from the
+// connection: the 2-byte little-endian length (which counts itself),
+// followed by exactly that many further bytes. Looping via the framing
+// package, rather than a single fixed-size Read, avoids missing
+// follow-up packets that arrive in more than one TCP segment.
+func (terraria *Connection) readPacket() ([]byte, error) {
+	return framing.ReadLengthPrefixed(terraria.conn, 2, true, true, maxPacketSize, packetReadDeadline)
+}
+
+// ReadAndValidateResponse reads the server's response and validates it.
+func (terraria *Connection) ReadAndValidateResponse() error {
+	response, err := terraria.readPacket()
+	if err != nil {
+		return err
+	}
+
+	terraria.results.ServerResponse = string(response)
+
+	// Validate the response based on Terraria protocol
+	if err := terraria.ValidateResponse(response); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ValidateResponse checks the format of the server's response.
+func (terraria *Connection) ValidateResponse(response []byte) error {
+	if len(response) < 3 {
+		return fmt.Errorf("invalid response length")
+	}
+
+	// First two bytes: Packet Length
+	packetLength := binary.LittleEndian.Uint16(response[:2])
+
+	// Adjust for protocol differences: We expect the server's packet length to include its own size (2 bytes).
+	if int(packetLength) != len(response) {
+		return fmt.Errorf("invalid packet length: expected %d, got %d", len(response), packetLength)
+	}
+
+	// Third byte: Packet ID
+	packetID := response[2]
+	switch packetID {
+	case packetDisconnect: // Password Required
+		log.Info("Server requires a password.")
+	case packetContinueConnecting: // Continue Connecting
+		log.Info("Server allows continued connection.")
+	default:
+		return fmt.Errorf("unknown Packet ID: %d", packetID)
+	}
+
+	return nil
+}
+
+// ContinueHandshake drives the handshake past the initial Connect Request
+// response: it handles a Password Required challenge (if --password is
+// set), then follows Continue Connecting through to World Info.
+func (terraria *Connection) ContinueHandshake() error {
+	response := []byte(terraria.results.ServerResponse)
+	packetID := response[2]
+
+	if packetID == packetDisconnect {
+		terraria.results.PasswordRequired = true
+		if terraria.config.Password == "" {
+			return nil
+		}
+
+		if err := terraria.SendPasswordResponse(); err != nil {
+			return fmt.Errorf("error sending Password Response: %w", err)
+		}
+
+		resp, err := terraria.readPacket()
+		if err != nil {
+			return fmt.Errorf("error reading Password Response reply: %w", err)
+		}
+		if err := terraria.ValidateResponse(resp); err != nil {
+			accepted := false
+			terraria.results.PasswordAccepted = &accepted
+			return nil
+		}
+		accepted := resp[2] == packetContinueConnecting
+		terraria.results.PasswordAccepted = &accepted
+		if !accepted {
+			return nil
+		}
+		response = resp
+		packetID = resp[2]
+	}
+
+	if packetID != packetContinueConnecting {
+		return nil
+	}
+	if len(response) < 4 {
+		return fmt.Errorf("Continue Connecting packet too short")
+	}
+	terraria.results.PlayerSlot = int(response[3])
+
+	worldInfo, err := terraria.readPacket()
+	if err != nil {
+		return fmt.Errorf("error reading World Info packet: %w", err)
+	}
+	if len(worldInfo) < 3 || worldInfo[2] != packetWorldInfo {
+		return nil
+	}
+	return terraria.parseWorldInfo(worldInfo[3:])
+}
+
+// parseWorldInfo decodes the handful of World Info fields useful for
+// fingerprinting a server. The real packet carries many further fields
+// (biome backgrounds, tree styles, and so on) that aren't needed here and
+// are left unparsed.
+func (terraria *Connection) parseWorldInfo(body []byte) error {
+	r := bytes.NewReader(body)
+
+	var timeOfDay int32
+	if err := binary.Read(r, binary.LittleEndian, &timeOfDay); err != nil {
+		return fmt.Errorf("error reading time of day: %w", err)
+	}
+	terraria.results.TimeOfDay = timeOfDay
+
+	dayMoonFlags, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("error reading day/moon flags: %w", err)
+	}
+	_ = dayMoonFlags
+
+	moonPhase, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("error reading moon phase: %w", err)
+	}
+	terraria.results.MoonPhase = int(moonPhase)
+
+	var maxTilesX, maxTilesY, spawnX, spawnY int16
+	for _, field := range []*int16{&maxTilesX, &maxTilesY, &spawnX, &spawnY} {
+		if err := binary.Read(r, binary.LittleEndian, field); err != nil {
+			return fmt.Errorf("error reading world geometry: %w", err)
+		}
+	}
+	terraria.results.WorldSize = &WorldSize{MaxTilesX: int(maxTilesX), MaxTilesY: int(maxTilesY)}
+	terraria.results.SpawnX = int(spawnX)
+	terraria.results.SpawnY = int(spawnY)
+
+	// worldSurface, rockLayer
+	var worldSurface, rockLayer int16
+	if err := binary.Read(r, binary.LittleEndian, &worldSurface); err != nil {
+		return fmt.Errorf("error reading world surface: %w", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &rockLayer); err != nil {
+		return fmt.Errorf("error reading rock layer: %w", err)
+	}
+
+	var worldID int32
+	if err := binary.Read(r, binary.LittleEndian, &worldID); err != nil {
+		return fmt.Errorf("error reading world ID: %w", err)
+	}
+	terraria.results.WorldID = worldID
+
+	nameLen, err := read7BitEncodedInt(r)
+	if err != nil {
+		return fmt.Errorf("error reading world name length: %w", err)
+	}
+	nameBytes := make([]byte, nameLen)
+	if _, err := r.Read(nameBytes); err != nil {
+		return fmt.Errorf("error reading world name: %w", err)
+	}
+	terraria.results.WorldName = string(nameBytes)
+
+	if difficulty, err := r.ReadByte(); err == nil {
+		terraria.results.Difficulty = int(difficulty)
+	}
+
+	return nil
+}
@@ -1,189 +1,300 @@
-// Package tftp provides a zgrab2 module that probes for the TFTP service.
-package tftp
-
-import (
-	"encoding/binary"
-	"errors"
-	"fmt"
-	"net"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-// TFTP Opcodes
-const (
-	TFTP_RRQ   uint16 = 1 // Opcode for Read Request
-	TFTP_DATA  uint16 = 3 // Opcode for Data Packet
-	TFTP_ERROR uint16 = 5 // Opcode for Error Packet
-)
-
-// Flags holds the command-line flags for the scanner.
-type Flags struct {
-	zgrab2.BaseFlags
-	zgrab2.UDPFlags
-	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct {
-}
-
-// Scanner implements the zgrab2.Scanner interface.
-type Scanner struct {
-	config *Flags
-}
-
-// Results is the struct that is returned to the zgrab2 framework from Scan().
-type Results struct {
-	ResponseMessage string `json:"response_message,omitempty"`
-}
-
-// RegisterModule registers the TFTP module with zgrab2.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("tftp", "TFTP", module.Description(), 69, &module) // TFTP uses port 69
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns a new Flags instance for the module.
-func (module *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (module *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns an overview of the module.
-func (module *Module) Description() string {
-	return "Scan for TFTP"
-}
-
-// Validate checks the flags are valid.
-func (cfg *Flags) Validate(args []string) error {
-	return nil
-}
-
-// Help returns the module's help string (needed to implement zgrab2.ScanFlags).
-func (cfg *Flags) Help() string {
-	return "This module scans for TFTP services."
-}
-
-// Init initializes the scanner.
-func (scanner *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, ok := flags.(*Flags)
-	if !ok {
-		return fmt.Errorf("invalid flag type")
-	}
-	scanner.config = f
-	return nil
-}
-
-// InitPerSender initializes the scanner for a given sender.
-func (scanner *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// Protocol returns the protocol identifier for the scanner.
-func (scanner *Scanner) Protocol() string {
-	return "tftp"
-}
-
-// GetName returns the scanner's name (needed to implement zgrab2.Scanner).
-func (scanner *Scanner) GetName() string {
-	return "tftp"
-}
-
-// GetTrigger returns an empty string as TFTP does not need a special trigger.
-func (scanner *Scanner) GetTrigger() string {
-	return ""
-}
-
-// createRRQMessage creates the RRQ (Read Request) message for the TFTP protocol.
-func createRRQMessage(filename, mode string) []byte {
-	// Create a buffer for the RRQ message
-	buf := make([]byte, 2+len(filename)+1+len(mode)+1)
-	// Set opcode to RRQ
-	binary.BigEndian.PutUint16(buf[0:2], TFTP_RRQ)
-	// Append the filename and mode, both followed by a null byte
-	copy(buf[2:], filename)
-	buf[2+len(filename)] = 0
-	copy(buf[3+len(filename):], mode)
-	buf[len(buf)-1] = 0
-	return buf
-}
-
-// SendRRQ sends an RRQ message to the server and waits for a response.
-func (scanner *Scanner) SendRRQ(sock net.Conn, filename, mode string) ([]byte, error) {
-	rrq := createRRQMessage(filename, mode)
-	// Send the RRQ message
-	_, err := sock.Write(rrq)
-	if err != nil {
-		return nil, err
-	}
-
-	// Wait for the response from the server
-	buf := make([]byte, 516) // Maximum TFTP packet size (512 bytes + header)
-	n, err := sock.Read(buf)
-	if err != nil {
-		return nil, err
-	}
-	return buf[:n], nil
-}
-
-// decodeTFTPResponse decodes the response from the server.
-func decodeTFTPResponse(response []byte) (string, error) {
-	if len(response) < 2 {
-		return "", errors.New("invalid response length")
-	}
-	opcode := binary.BigEndian.Uint16(response[0:2])
-	switch opcode {
-	case TFTP_DATA:
-		blockNumber := binary.BigEndian.Uint16(response[2:4])
-		data := response[4:]
-		return fmt.Sprintf("Received DATA block #%d (%d bytes)", blockNumber, len(data)), nil
-	case TFTP_ERROR:
-		errorCode := binary.BigEndian.Uint16(response[2:4])
-		var errorMessage string
-		if len(response) > 4 {
-			errorMessage = string(response[4 : len(response)-1]) // Trim the null byte
-		}
-		return fmt.Sprintf("Received ERROR code %d: %s", errorCode, errorMessage), nil
-	default:
-		return "", fmt.Errorf("Unknown TFTP response opcode: %d", opcode)
-	}
-}
-
-// Scan performs the TFTP scan by sending an RRQ message and receiving the response.
-func (scanner *Scanner) Scan(t zgrab2.ScanTarget) (zgrab2.ScanStatus, interface{}, error) {
-	// Open a UDP connection to the target
-	sock, err := t.OpenUDP(&scanner.config.BaseFlags, &scanner.config.UDPFlags)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, err
-	}
-	defer sock.Close()
-
-	// Send the RRQ message for a dummy file
-	response, err := scanner.SendRRQ(sock, "dummyfile", "octet")
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, err
-	}
-
-	// Decode and log the response
-	resultMessage, err := decodeTFTPResponse(response)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, err
-	}
-
-	log.Info(resultMessage)
-
-	// Return success status with the response message
-	result := &Results{
-		ResponseMessage: resultMessage,
-	}
-	return zgrab2.SCAN_SUCCESS, result, nil
-}
+// Package tftp provides a zgrab2 module that probes for the TFTP service.
+package tftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// TFTP Opcodes
+const (
+	TFTP_RRQ   uint16 = 1 // Opcode for Read Request
+	TFTP_DATA  uint16 = 3 // Opcode for Data Packet
+	TFTP_ACK   uint16 = 4 // Opcode for Acknowledgment
+	TFTP_ERROR uint16 = 5 // Opcode for Error Packet
+	TFTP_OACK  uint16 = 6 // Opcode for Option Acknowledgment (RFC 2347)
+)
+
+// Flags holds the command-line flags for the scanner.
+type Flags struct {
+	zgrab2.BaseFlags
+	zgrab2.UDPFlags
+	Verbose bool `long:"verbose" description:"More verbose logging, include debug fields in the scan results"`
+
+	Filename string `long:"filename" default:"dummyfile" description:"Filename to request via RRQ"`
+	Mode     string `long:"mode" default:"octet" description:"Transfer mode to request via RRQ (netascii, octet, mail)"`
+
+	BlkSize    uint `long:"blksize" description:"Requested transfer block size, per RFC 2348 (0 to omit)"`
+	TSize      bool `long:"tsize" description:"Request the transfer size option, per RFC 2349"`
+	Timeout    uint `long:"option-timeout" description:"Requested retransmission timeout in seconds, per RFC 2349 (0 to omit)"`
+	WindowSize uint `long:"windowsize" description:"Requested window size, per the TFTP windowsize extension (0 to omit)"`
+
+	Strict bool `long:"strict" description:"Reject responses with an unexpected opcode or a non-NUL-terminated error message"`
+
+	AckData bool `long:"ack-data" description:"ACK a received DATA block once, to see whether the server sends a second packet"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface.
+type Scanner struct {
+	config *Flags
+}
+
+// Results is the struct that is returned to the zgrab2 framework from Scan().
+type Results struct {
+	ResponseMessage string `json:"response_message,omitempty"`
+
+	// Options holds the option/value pairs returned in an OACK, keyed by
+	// option name.
+	Options map[string]string `json:"options,omitempty"`
+
+	// SecondResponseMessage is set when --ack-data is used and the server
+	// sends a further packet after the first DATA block is ACKed.
+	SecondResponseMessage string `json:"second_response_message,omitempty"`
+}
+
+// RegisterModule registers the TFTP module with zgrab2.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("tftp", "TFTP", module.Description(), 69, &module) // TFTP uses port 69
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns a new Flags instance for the module.
+func (module *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (module *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of the module.
+func (module *Module) Description() string {
+	return "Scan for TFTP"
+}
+
+// Validate checks the flags are valid.
+func (cfg *Flags) Validate(args []string) error {
+	return nil
+}
+
+// Help returns the module's help string (needed to implement zgrab2.ScanFlags).
+func (cfg *Flags) Help() string {
+	return "This module scans for TFTP services."
+}
+
+// Init initializes the scanner.
+func (scanner *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, ok := flags.(*Flags)
+	if !ok {
+		return fmt.Errorf("invalid flag type")
+	}
+	scanner.config = f
+	return nil
+}
+
+// InitPerSender initializes the scanner for a given sender.
+func (scanner *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (scanner *Scanner) Protocol() string {
+	return "tftp"
+}
+
+// GetName returns the scanner's name (needed to implement zgrab2.Scanner).
+func (scanner *Scanner) GetName() string {
+	return "tftp"
+}
+
+// GetTrigger returns an empty string as TFTP does not need a special trigger.
+func (scanner *Scanner) GetTrigger() string {
+	return ""
+}
+
+// requestedOptions returns the RFC 2347 option/value pairs to append to the
+// RRQ, in the order they should appear on the wire.
+func (scanner *Scanner) requestedOptions() [][2]string {
+	var opts [][2]string
+	if scanner.config.BlkSize != 0 {
+		opts = append(opts, [2]string{"blksize", strconv.FormatUint(uint64(scanner.config.BlkSize), 10)})
+	}
+	if scanner.config.TSize {
+		opts = append(opts, [2]string{"tsize", "0"})
+	}
+	if scanner.config.Timeout != 0 {
+		opts = append(opts, [2]string{"timeout", strconv.FormatUint(uint64(scanner.config.Timeout), 10)})
+	}
+	if scanner.config.WindowSize != 0 {
+		opts = append(opts, [2]string{"windowsize", strconv.FormatUint(uint64(scanner.config.WindowSize), 10)})
+	}
+	return opts
+}
+
+// createRRQMessage creates the RRQ (Read Request) message for the TFTP
+// protocol, appending any RFC 2347 option/value pairs after the mode.
+func createRRQMessage(filename, mode string, options [][2]string) []byte {
+	var buf []byte
+	buf = binary.BigEndian.AppendUint16(buf, TFTP_RRQ)
+	buf = append(buf, filename...)
+	buf = append(buf, 0)
+	buf = append(buf, mode...)
+	buf = append(buf, 0)
+	for _, opt := range options {
+		buf = append(buf, opt[0]...)
+		buf = append(buf, 0)
+		buf = append(buf, opt[1]...)
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// createACKMessage creates an ACK message for the given block number.
+func createACKMessage(blockNumber uint16) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint16(buf[0:2], TFTP_ACK)
+	binary.BigEndian.PutUint16(buf[2:4], blockNumber)
+	return buf
+}
+
+// SendRRQ sends an RRQ message to the server and waits for a response.
+func (scanner *Scanner) SendRRQ(sock net.Conn, filename, mode string, options [][2]string) ([]byte, error) {
+	rrq := createRRQMessage(filename, mode, options)
+	// Send the RRQ message
+	_, err := sock.Write(rrq)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for the response from the server
+	buf := make([]byte, 65507) // Maximum UDP payload size; a large --blksize can exceed 516 bytes
+	n, err := sock.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// parseOACKOptions parses the null-separated option/value pairs following
+// the OACK opcode, per RFC 2347.
+func parseOACKOptions(body []byte) (map[string]string, error) {
+	options := make(map[string]string)
+	parts := strings.Split(string(body), "\x00")
+	// The final split element is the trailing empty string after the last NUL.
+	if len(parts) > 0 && parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts)%2 != 0 {
+		return options, errors.New("malformed OACK: odd number of option/value fields")
+	}
+	for i := 0; i < len(parts); i += 2 {
+		options[parts[i]] = parts[i+1]
+	}
+	return options, nil
+}
+
+// decodeTFTPResponse decodes the response from the server, optionally
+// enforcing --strict checks on the opcode and error-message framing.
+func decodeTFTPResponse(response []byte, strict bool) (string, map[string]string, uint16, error) {
+	if len(response) < 2 {
+		return "", nil, 0, errors.New("invalid response length")
+	}
+	opcode := binary.BigEndian.Uint16(response[0:2])
+
+	if strict {
+		switch opcode {
+		case TFTP_DATA, TFTP_ERROR, TFTP_OACK:
+		default:
+			return "", nil, 0, fmt.Errorf("unexpected opcode in strict mode: %d", opcode)
+		}
+	}
+
+	switch opcode {
+	case TFTP_DATA:
+		if len(response) < 4 {
+			return "", nil, 0, errors.New("invalid DATA packet length")
+		}
+		blockNumber := binary.BigEndian.Uint16(response[2:4])
+		data := response[4:]
+		return fmt.Sprintf("Received DATA block #%d (%d bytes)", blockNumber, len(data)), nil, blockNumber, nil
+	case TFTP_ERROR:
+		errorCode := binary.BigEndian.Uint16(response[2:4])
+		var errorMessage string
+		if len(response) > 4 {
+			if strict && response[len(response)-1] != 0 {
+				return "", nil, 0, errors.New("ERROR message is not NUL-terminated")
+			}
+			errorMessage = strings.TrimRight(string(response[4:]), "\x00")
+		}
+		return fmt.Sprintf("Received ERROR code %d: %s", errorCode, errorMessage), nil, 0, nil
+	case TFTP_OACK:
+		options, err := parseOACKOptions(response[2:])
+		if err != nil {
+			return "", nil, 0, err
+		}
+		return fmt.Sprintf("Received OACK with %d option(s)", len(options)), options, 0, nil
+	default:
+		return "", nil, 0, fmt.Errorf("unknown TFTP response opcode: %d", opcode)
+	}
+}
+
+// Scan performs the TFTP scan by sending an RRQ message and receiving the response.
+func (scanner *Scanner) Scan(t zgrab2.ScanTarget) (zgrab2.ScanStatus, interface{}, error) {
+	// Open a UDP connection to the target
+	sock, err := t.OpenUDP(&scanner.config.BaseFlags, &scanner.config.UDPFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, err
+	}
+	defer sock.Close()
+
+	// Send the RRQ message, with any requested options
+	response, err := scanner.SendRRQ(sock, scanner.config.Filename, scanner.config.Mode, scanner.requestedOptions())
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, err
+	}
+
+	// Decode and log the response
+	resultMessage, options, blockNumber, err := decodeTFTPResponse(response, scanner.config.Strict)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, err
+	}
+
+	log.Info(resultMessage)
+
+	result := &Results{
+		ResponseMessage: resultMessage,
+		Options:         options,
+	}
+
+	if scanner.config.AckData && blockNumber != 0 {
+		if _, err := sock.Write(createACKMessage(blockNumber)); err != nil {
+			return zgrab2.SCAN_SUCCESS, result, nil
+		}
+		second := make([]byte, 65507)
+		n, err := sock.Read(second)
+		if err == nil {
+			secondMessage, _, _, decodeErr := decodeTFTPResponse(second[:n], scanner.config.Strict)
+			if decodeErr == nil {
+				result.SecondResponseMessage = secondMessage
+			}
+		}
+	}
+
+	// Return success status with the response message
+	return zgrab2.SCAN_SUCCESS, result, nil
+}
@@ -1,210 +1,481 @@
-// Package x11 implements the zgrab2 Module for scanning X11 services.
-package x11
-
-import (
-	"encoding/binary"
-	"fmt"
-	"net"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-// ScanResults is the output of the scan.
-type ScanResults struct {
-	// Banner holds the initial response from the X11 server.
-	Banner string `json:"banner,omitempty"`
-
-	// ServerMajorVersion holds the major version of the X11 protocol returned by the server.
-	ServerMajorVersion uint16 `json:"server_major_version,omitempty"`
-
-	// ServerMinorVersion holds the minor version of the X11 protocol returned by the server.
-	ServerMinorVersion uint16 `json:"server_minor_version,omitempty"`
-
-	// ByteOrder indicates whether the server is using little-endian (0x6C) or big-endian (0x42).
-	ByteOrder string `json:"byte_order,omitempty"`
-
-	// Error holds any errors encountered during the scan.
-	Error string `json:"error,omitempty"`
-}
-
-// Flags define the X11-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-	Verbose bool `long:"verbose" description:"More verbose logging"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct {
-}
-
-// Scanner implements the zgrab2.Scanner interface, and holds the state
-// for a single scan.
-type Scanner struct {
-	config    *Flags
-	byteOrder byte // Byte order used for the scan (0x42 for big-endian or 0x6C for little-endian)
-}
-
-// Connection holds the state for a single connection to the X11 server.
-type Connection struct {
-	config    *Flags
-	results   ScanResults
-	conn      net.Conn
-	byteOrder byte // Byte order used for parsing the response
-}
-
-// RegisterModule registers the X11 zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("x11", "X11", module.Description(), 6000, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns the default flags object.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns a short description of this module.
-func (m *Module) Description() string {
-	return "Scan for X11 services"
-}
-
-// GetName returns the name of the scan target. This implements the zgrab2.Scanner interface.
-func (s *Scanner) GetName() string {
-	return "x11"
-}
-
-// Protocol returns the protocol identifier for the scanner.
-func (s *Scanner) Protocol() string {
-	return "x11"
-}
-
-// Init initializes the Scanner with the provided flags.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags) // Use type assertion to retrieve the configuration flags
-	s.config = f
-	s.byteOrder = 0x6C // Default to little-endian for this example. You can make this configurable.
-	return nil
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// GetTrigger returns an empty trigger string, as no specific trigger is used.
-func (s *Scanner) GetTrigger() string {
-	return ""
-}
-
-// Scan performs the X11 scan.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
-	conn, err := t.Open(&s.config.BaseFlags)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
-	}
-	defer conn.Close()
-
-	x11 := Connection{conn: conn, config: s.config, byteOrder: s.byteOrder, results: ScanResults{}}
-
-	// Send initial X11 message
-	if err := x11.SendInitialMessage(); err != nil {
-		return zgrab2.TryGetScanStatus(err), &x11.results, fmt.Errorf("error sending initial X11 message: %w", err)
-	}
-
-	// Read and verify the server response
-	if err := x11.ReadServerResponse(); err != nil {
-		return zgrab2.TryGetScanStatus(err), &x11.results, fmt.Errorf("error reading X11 response: %w", err)
-	}
-
-	return zgrab2.SCAN_SUCCESS, &x11.results, nil
-}
-
-// SendInitialMessage constructs and sends the initial X11 connection message.
-func (x11 *Connection) SendInitialMessage() error {
-	// Construct the X11 initial message (based on the byte order set by the scanner)
-	message := make([]byte, 12)
-
-	// Byte-order Byte: use the byte order set in the scanner (little-endian or big-endian)
-	message[0] = x11.byteOrder
-
-	// Protocol Major Version: 16-bit value 0x000B (X11)
-	if x11.byteOrder == 0x42 { // Big-endian
-		binary.BigEndian.PutUint16(message[2:], 0x000B)
-		binary.BigEndian.PutUint16(message[4:], 0x0000)
-	} else { // Little-endian
-		binary.LittleEndian.PutUint16(message[2:], 0x000B)
-		binary.LittleEndian.PutUint16(message[4:], 0x0000)
-	}
-
-	// Authorization Name and Data: Leave empty (0 length)
-	// Authorization Name Length: 16-bit value 0x0000
-	// Authorization Data Length: 16-bit value 0x0000
-
-	// Send the message
-	_, err := x11.conn.Write(message)
-	return err
-}
-
-// ReadServerResponse reads and parses the server response to the initial X11 message.
-func (x11 *Connection) ReadServerResponse() error {
-	// Read the server's response (assuming a basic buffer size)
-	buf := make([]byte, 1024)
-	n, err := x11.conn.Read(buf)
-	if err != nil {
-		return err
-	}
-
-	// Save the response banner
-	x11.results.Banner = string(buf[:n])
-
-	// Parse the response and check the protocol version based on the byte order
-	var majorVersion, minorVersion uint16
-	if x11.byteOrder == 0x42 { // big-endian
-		majorVersion = binary.BigEndian.Uint16(buf[2:4])
-		minorVersion = binary.BigEndian.Uint16(buf[4:6])
-	} else { // little-endian
-		majorVersion = binary.LittleEndian.Uint16(buf[2:4])
-		minorVersion = binary.LittleEndian.Uint16(buf[4:6])
-	}
-
-	x11.results.ServerMajorVersion = majorVersion
-	x11.results.ServerMinorVersion = minorVersion
-
-	// Check if the protocol version is 11 (X11 protocol)
-	if majorVersion != 11 {
-		x11.results.Error = fmt.Sprintf("unexpected X11 major version: %d", majorVersion)
-		// We still consider this a valid response, so the scan is successful.
-		return nil
-	}
-
-	// Handle a successful connection (status byte = 1)
-	if buf[1] == 1 {
-		// Success response; protocol version is valid.
-		return nil
-	}
-
-	// If we reach here, the response is likely an authorization failure or other error.
-	x11.results.Error = fmt.Sprintf("X11 connection failed or unauthorized: %s", x11.results.Banner)
-
-	// Treat the scan as successful since we got a valid protocol response, even if it's a failure.
-	return nil
-}
-
-// Help implements the zgrab2.ScanFlags interface for Flags. It returns the help string for the module.
-func (f *Flags) Help() string {
-	return "Flags for X11 scanner"
-}
-
-// Validate implements the zgrab2.ScanFlags interface, validating the flags.
-func (f *Flags) Validate(args []string) error {
-	return nil
-}
+// Package x11 implements the zgrab2 Module for scanning X11 services.
+package x11
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// maxSetupReplySize bounds how much of the Setup reply's additional-data
+// section (the part whose size the server itself declares, in 4-byte
+// units, in the common header) this scanner will read, to avoid a
+// malicious or buggy server driving an unbounded allocation.
+const maxSetupReplySize = 1 << 20
+
+// PixmapFormat describes one entry of a Setup reply's pixmap-formats
+// list, as defined by the X11 protocol's FORMAT structure.
+type PixmapFormat struct {
+	Depth        uint8 `json:"depth"`
+	BitsPerPixel uint8 `json:"bits_per_pixel"`
+	ScanlinePad  uint8 `json:"scanline_pad"`
+}
+
+// VisualType describes one entry of a DEPTH's visuals list, as defined
+// by the X11 protocol's VISUALTYPE structure.
+type VisualType struct {
+	VisualID        uint32 `json:"visual_id"`
+	Class           uint8  `json:"class"`
+	BitsPerRGBValue uint8  `json:"bits_per_rgb_value"`
+	ColormapEntries uint16 `json:"colormap_entries"`
+	RedMask         uint32 `json:"red_mask"`
+	GreenMask       uint32 `json:"green_mask"`
+	BlueMask        uint32 `json:"blue_mask"`
+}
+
+// Depth describes one entry of a Screen's allowed-depths list, as
+// defined by the X11 protocol's DEPTH structure.
+type Depth struct {
+	Depth       uint8        `json:"depth"`
+	VisualTypes []VisualType `json:"visual_types,omitempty"`
+}
+
+// Screen describes one entry of a Setup reply's roots list, as defined
+// by the X11 protocol's SCREEN structure.
+type Screen struct {
+	Root                uint32  `json:"root"`
+	DefaultColormap     uint32  `json:"default_colormap"`
+	WhitePixel          uint32  `json:"white_pixel"`
+	BlackPixel          uint32  `json:"black_pixel"`
+	CurrentInputMasks   uint32  `json:"current_input_masks"`
+	WidthInPixels       uint16  `json:"width_in_pixels"`
+	HeightInPixels      uint16  `json:"height_in_pixels"`
+	WidthInMillimeters  uint16  `json:"width_in_millimeters"`
+	HeightInMillimeters uint16  `json:"height_in_millimeters"`
+	MinInstalledMaps    uint16  `json:"min_installed_maps"`
+	MaxInstalledMaps    uint16  `json:"max_installed_maps"`
+	RootVisual          uint32  `json:"root_visual"`
+	BackingStores       uint8   `json:"backing_stores"`
+	SaveUnders          uint8   `json:"save_unders"`
+	RootDepth           uint8   `json:"root_depth"`
+	AllowedDepths       []Depth `json:"allowed_depths,omitempty"`
+}
+
+// Setup holds the fully parsed body of a successful (status byte 1)
+// Setup reply, as defined by the X11 protocol's connection setup
+// response.
+type Setup struct {
+	ReleaseNumber        uint32         `json:"release_number"`
+	ResourceIDBase       uint32         `json:"resource_id_base"`
+	ResourceIDMask       uint32         `json:"resource_id_mask"`
+	MotionBufferSize     uint32         `json:"motion_buffer_size"`
+	MaximumRequestLength uint16         `json:"maximum_request_length"`
+	ImageByteOrder       uint8          `json:"image_byte_order"`
+	BitmapBitOrder       uint8          `json:"bitmap_bit_order"`
+	BitmapScanlineUnit   uint8          `json:"bitmap_scanline_unit"`
+	BitmapScanlinePad    uint8          `json:"bitmap_scanline_pad"`
+	MinKeycode           uint8          `json:"min_keycode"`
+	MaxKeycode           uint8          `json:"max_keycode"`
+	Vendor               string         `json:"vendor"`
+	PixmapFormats        []PixmapFormat `json:"pixmap_formats,omitempty"`
+	Screens              []Screen       `json:"screens,omitempty"`
+}
+
+// ScanResults is the output of the scan.
+type ScanResults struct {
+	// Banner holds the initial response from the X11 server.
+	Banner string `json:"banner,omitempty"`
+
+	// ServerMajorVersion holds the major version of the X11 protocol returned by the server.
+	ServerMajorVersion uint16 `json:"server_major_version,omitempty"`
+
+	// ServerMinorVersion holds the minor version of the X11 protocol returned by the server.
+	ServerMinorVersion uint16 `json:"server_minor_version,omitempty"`
+
+	// ByteOrder indicates whether the server is using little-endian (0x6C) or big-endian (0x42).
+	ByteOrder string `json:"byte_order,omitempty"`
+
+	// ConnectionStatus is "Success", "Failed", or "Authenticate",
+	// reflecting the Setup reply's status byte.
+	ConnectionStatus string `json:"connection_status,omitempty"`
+
+	// Setup holds the fully parsed Setup reply body, if ConnectionStatus
+	// is "Success".
+	Setup *Setup `json:"setup,omitempty"`
+
+	// Error holds any errors encountered during the scan, including the
+	// reason string of a Failed or Authenticate response.
+	Error string `json:"error,omitempty"`
+}
+
+// Flags define the X11-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+	Verbose bool `long:"verbose" description:"More verbose logging"`
+
+	// AuthName and AuthData let operators probe a server that requires
+	// MIT-MAGIC-COOKIE-1 (or any other) authorization, instead of always
+	// sending a zero-length authorization-protocol-name/data pair.
+	AuthName string `long:"auth-name" description:"Authorization-protocol-name to send in the connection request, e.g. MIT-MAGIC-COOKIE-1"`
+	AuthData string `long:"auth-data" description:"Hex-encoded authorization-protocol-data (cookie) to send in the connection request"`
+
+	ProtocolVersion string `long:"protocol-version" default:"11.0" description:"protocol-major.protocol-minor version to advertise in the connection request"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct {
+}
+
+// Scanner implements the zgrab2.Scanner interface, and holds the state
+// for a single scan.
+type Scanner struct {
+	config    *Flags
+	byteOrder byte // Byte order used for the scan (0x42 for big-endian or 0x6C for little-endian)
+}
+
+// Connection holds the state for a single connection to the X11 server.
+type Connection struct {
+	config    *Flags
+	results   ScanResults
+	conn      net.Conn
+	byteOrder byte // Byte order used for parsing the response
+}
+
+// RegisterModule registers the X11 zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("x11", "X11", module.Description(), 6000, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns a short description of this module.
+func (m *Module) Description() string {
+	return "Scan for X11 services"
+}
+
+// GetName returns the name of the scan target. This implements the zgrab2.Scanner interface.
+func (s *Scanner) GetName() string {
+	return "x11"
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (s *Scanner) Protocol() string {
+	return "x11"
+}
+
+// Init initializes the Scanner with the provided flags.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags) // Use type assertion to retrieve the configuration flags
+	s.config = f
+	s.byteOrder = 0x6C // Default to little-endian for this example. You can make this configurable.
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetTrigger returns an empty trigger string, as no specific trigger is used.
+func (s *Scanner) GetTrigger() string {
+	return ""
+}
+
+// Scan performs the X11 scan.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	conn, err := t.Open(&s.config.BaseFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	defer conn.Close()
+
+	x11 := Connection{conn: conn, config: s.config, byteOrder: s.byteOrder, results: ScanResults{}}
+
+	// Send initial X11 message
+	if err := x11.SendInitialMessage(); err != nil {
+		return zgrab2.TryGetScanStatus(err), &x11.results, fmt.Errorf("error sending initial X11 message: %w", err)
+	}
+
+	// Read and verify the server response
+	if err := x11.ReadServerResponse(); err != nil {
+		return zgrab2.TryGetScanStatus(err), &x11.results, fmt.Errorf("error reading X11 response: %w", err)
+	}
+
+	return zgrab2.SCAN_SUCCESS, &x11.results, nil
+}
+
+// SendInitialMessage constructs and sends the initial X11 connection
+// message: the 12-byte header (byte order, protocol version, and the
+// authorization-protocol-name/data lengths) followed by the
+// authorization-protocol-name and authorization-protocol-data
+// themselves, each padded to a 4-byte boundary. Authorization defaults
+// to the empty strings zgrab2.BaseFlags assumes unless --auth-name/
+// --auth-data are set, letting operators probe servers that require
+// MIT-MAGIC-COOKIE-1 (or another) authorization.
+func (x11 *Connection) SendInitialMessage() error {
+	major, minor, err := parseProtocolVersion(x11.config.ProtocolVersion)
+	if err != nil {
+		return fmt.Errorf("invalid --protocol-version %q: %w", x11.config.ProtocolVersion, err)
+	}
+	authData, err := hex.DecodeString(x11.config.AuthData)
+	if err != nil {
+		return fmt.Errorf("invalid --auth-data: %w", err)
+	}
+	authName := x11.config.AuthName
+	order := x11.order()
+
+	message := make([]byte, 12)
+	message[0] = x11.byteOrder
+	order.PutUint16(message[2:4], major)
+	order.PutUint16(message[4:6], minor)
+	order.PutUint16(message[6:8], uint16(len(authName)))
+	order.PutUint16(message[8:10], uint16(len(authData)))
+
+	message = append(message, authName...)
+	message = append(message, make([]byte, padLength(len(authName))-len(authName))...)
+	message = append(message, authData...)
+	message = append(message, make([]byte, padLength(len(authData))-len(authData))...)
+
+	_, err = x11.conn.Write(message)
+	return err
+}
+
+// parseProtocolVersion parses a "major.minor" protocol-version flag
+// value into its two 16-bit fields.
+func parseProtocolVersion(version string) (major, minor uint16, err error) {
+	var maj, min int
+	if _, err := fmt.Sscanf(version, "%d.%d", &maj, &min); err != nil {
+		return 0, 0, err
+	}
+	return uint16(maj), uint16(min), nil
+}
+
+// order returns the binary.ByteOrder matching the byte-order byte this
+// connection advertised in its initial message, since the server mirrors
+// that choice for every multi-byte field in the Setup reply.
+func (x11 *Connection) order() binary.ByteOrder {
+	if x11.byteOrder == 0x42 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// ReadServerResponse reads and parses the server's Setup reply: an
+// 8-byte common header (status byte, version fields, and an
+// additional-data length in 4-byte units) followed by a status-specific
+// body, per the X11 protocol. The body is read in exactly the size the
+// header declares, bounded by maxSetupReplySize, rather than into a
+// fixed-size buffer.
+func (x11 *Connection) ReadServerResponse() error {
+	r := bufio.NewReader(x11.conn)
+	order := x11.order()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("error reading setup header: %w", err)
+	}
+	status := header[0]
+	x11.results.ServerMajorVersion = order.Uint16(header[2:4])
+	x11.results.ServerMinorVersion = order.Uint16(header[4:6])
+
+	additionalLength := int(order.Uint16(header[6:8])) * 4
+	if additionalLength > maxSetupReplySize {
+		return fmt.Errorf("setup reply additional data too large: %d bytes", additionalLength)
+	}
+	body := make([]byte, additionalLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return fmt.Errorf("error reading setup body: %w", err)
+	}
+
+	switch status {
+	case 0: // Failed
+		x11.results.ConnectionStatus = "Failed"
+		reasonLength := int(header[1])
+		if reasonLength > len(body) {
+			reasonLength = len(body)
+		}
+		x11.results.Error = string(body[:reasonLength])
+	case 2: // Authenticate
+		x11.results.ConnectionStatus = "Authenticate"
+		x11.results.Error = trimTrailingNUL(string(body))
+	case 1: // Success
+		x11.results.ConnectionStatus = "Success"
+		setup, err := parseSetup(order, body)
+		if err != nil {
+			return fmt.Errorf("error parsing setup reply: %w", err)
+		}
+		x11.results.Setup = setup
+	default:
+		return fmt.Errorf("unexpected setup status byte: %d", status)
+	}
+	return nil
+}
+
+// trimTrailingNUL strips the NUL padding the X11 protocol appends to
+// pad STRING8 fields (such as the Authenticate reason) to a 4-byte
+// boundary.
+func trimTrailingNUL(s string) string {
+	for len(s) > 0 && s[len(s)-1] == 0 {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// padLength rounds n up to the next multiple of 4, as the X11 protocol
+// pads STRING8 and LISTofBYTE fields to a 4-byte boundary.
+func padLength(n int) int {
+	return (n + 3) &^ 3
+}
+
+// parseSetup decodes a successful Setup reply's additional-data section
+// (everything after the 8-byte common header) into a Setup.
+func parseSetup(order binary.ByteOrder, body []byte) (*Setup, error) {
+	if len(body) < 32 {
+		return nil, fmt.Errorf("truncated setup body")
+	}
+
+	setup := &Setup{
+		ReleaseNumber:        order.Uint32(body[0:4]),
+		ResourceIDBase:       order.Uint32(body[4:8]),
+		ResourceIDMask:       order.Uint32(body[8:12]),
+		MotionBufferSize:     order.Uint32(body[12:16]),
+		MaximumRequestLength: order.Uint16(body[18:20]),
+		ImageByteOrder:       body[22],
+		BitmapBitOrder:       body[23],
+		BitmapScanlineUnit:   body[24],
+		BitmapScanlinePad:    body[25],
+		MinKeycode:           body[26],
+		MaxKeycode:           body[27],
+	}
+	vendorLength := int(order.Uint16(body[16:18]))
+	numScreens := int(body[20])
+	numPixmapFormats := int(body[21])
+	// body[28:32] is a 4-byte unused pad field.
+
+	rest := body[32:]
+
+	vendorPadded := padLength(vendorLength)
+	if len(rest) < vendorPadded {
+		return nil, fmt.Errorf("truncated vendor string")
+	}
+	setup.Vendor = string(rest[:vendorLength])
+	rest = rest[vendorPadded:]
+
+	for i := 0; i < numPixmapFormats; i++ {
+		if len(rest) < 8 {
+			return nil, fmt.Errorf("truncated pixmap format")
+		}
+		setup.PixmapFormats = append(setup.PixmapFormats, PixmapFormat{
+			Depth:        rest[0],
+			BitsPerPixel: rest[1],
+			ScanlinePad:  rest[2],
+		})
+		rest = rest[8:]
+	}
+
+	for i := 0; i < numScreens; i++ {
+		screen, remaining, err := parseScreen(order, rest)
+		if err != nil {
+			return nil, err
+		}
+		setup.Screens = append(setup.Screens, *screen)
+		rest = remaining
+	}
+
+	return setup, nil
+}
+
+// parseScreen decodes one SCREEN entry from the front of data, returning
+// it along with the bytes following it.
+func parseScreen(order binary.ByteOrder, data []byte) (*Screen, []byte, error) {
+	if len(data) < 40 {
+		return nil, nil, fmt.Errorf("truncated screen")
+	}
+	screen := &Screen{
+		Root:                order.Uint32(data[0:4]),
+		DefaultColormap:     order.Uint32(data[4:8]),
+		WhitePixel:          order.Uint32(data[8:12]),
+		BlackPixel:          order.Uint32(data[12:16]),
+		CurrentInputMasks:   order.Uint32(data[16:20]),
+		WidthInPixels:       order.Uint16(data[20:22]),
+		HeightInPixels:      order.Uint16(data[22:24]),
+		WidthInMillimeters:  order.Uint16(data[24:26]),
+		HeightInMillimeters: order.Uint16(data[26:28]),
+		MinInstalledMaps:    order.Uint16(data[28:30]),
+		MaxInstalledMaps:    order.Uint16(data[30:32]),
+		RootVisual:          order.Uint32(data[32:36]),
+		BackingStores:       data[36],
+		SaveUnders:          data[37],
+		RootDepth:           data[38],
+	}
+	numDepths := int(data[39])
+	rest := data[40:]
+
+	for i := 0; i < numDepths; i++ {
+		depth, remaining, err := parseDepth(order, rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		screen.AllowedDepths = append(screen.AllowedDepths, *depth)
+		rest = remaining
+	}
+
+	return screen, rest, nil
+}
+
+// parseDepth decodes one DEPTH entry from the front of data, returning
+// it along with the bytes following it.
+func parseDepth(order binary.ByteOrder, data []byte) (*Depth, []byte, error) {
+	if len(data) < 8 {
+		return nil, nil, fmt.Errorf("truncated depth")
+	}
+	depth := &Depth{Depth: data[0]}
+	numVisuals := int(order.Uint16(data[2:4]))
+	rest := data[8:]
+
+	for i := 0; i < numVisuals; i++ {
+		if len(rest) < 24 {
+			return nil, nil, fmt.Errorf("truncated visual type")
+		}
+		depth.VisualTypes = append(depth.VisualTypes, VisualType{
+			VisualID:        order.Uint32(rest[0:4]),
+			Class:           rest[4],
+			BitsPerRGBValue: rest[5],
+			ColormapEntries: order.Uint16(rest[6:8]),
+			RedMask:         order.Uint32(rest[8:12]),
+			GreenMask:       order.Uint32(rest[12:16]),
+			BlueMask:        order.Uint32(rest[16:20]),
+		})
+		rest = rest[24:]
+	}
+
+	return depth, rest, nil
+}
+
+// Help implements the zgrab2.ScanFlags interface for Flags. It returns the help string for the module.
+func (f *Flags) Help() string {
+	return "Flags for X11 scanner"
+}
+
+// Validate implements the zgrab2.ScanFlags interface, validating the flags.
+func (f *Flags) Validate(args []string) error {
+	return nil
+}
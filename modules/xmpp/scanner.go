@@ -1,188 +1,357 @@
-package xmpp
-
-import (
-	"fmt"
-	"net"
-	"regexp"
-	"strings"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/zmap/zgrab2"
-)
-
-// ScanResults holds the output of the scan.
-type ScanResults struct {
-	// Banner is the server's response to the XMPP stream header.
-	Banner string `json:"banner,omitempty"`
-
-	ImplicitTLS bool           `json:"implicit_tls,omitempty"`
-	TLSLog      *zgrab2.TLSLog `json:"tls,omitempty"`
-}
-
-// Flags are the XMPP-specific command-line flags.
-type Flags struct {
-	zgrab2.BaseFlags
-	zgrab2.TLSFlags
-
-	Verbose     bool `long:"verbose" description:"More verbose logging"`
-	ImplicitTLS bool `long:"tls" description:"Attempt to connect via a TLS wrapped connection"`
-}
-
-// Module implements the zgrab2.Module interface.
-type Module struct{}
-
-// Scanner implements the zgrab2.Scanner interface.
-type Scanner struct {
-	config *Flags
-}
-
-// Connection holds the state for a single connection to the XMPP server.
-type Connection struct {
-	buffer  [10000]byte
-	config  *Flags
-	results ScanResults
-	conn    net.Conn
-}
-
-// RegisterModule registers the XMPP zgrab2 module.
-func RegisterModule() {
-	var module Module
-	_, err := zgrab2.AddCommand("xmpp", "XMPP", module.Description(), 5222, &module)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// NewFlags returns the default flags object to be filled in with command-line arguments.
-func (m *Module) NewFlags() interface{} {
-	return new(Flags)
-}
-
-// NewScanner returns a new Scanner instance.
-func (m *Module) NewScanner() zgrab2.Scanner {
-	return new(Scanner)
-}
-
-// Description returns an overview of this module.
-func (m *Module) Description() string {
-	return "Scan for an XMPP service by initiating an XMPP connection"
-}
-
-// Validate ensures that the flags provided are valid.
-func (f *Flags) Validate(args []string) error {
-	return nil
-}
-
-// Help returns this module's help string.
-func (f *Flags) Help() string {
-	return ""
-}
-
-// Protocol returns the protocol identifier for the scanner.
-func (s *Scanner) Protocol() string {
-	return "xmpp"
-}
-
-// Init initializes the Scanner instance with the flags from the command line.
-func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
-	f, _ := flags.(*Flags)
-	s.config = f
-	return nil
-}
-
-// InitPerSender does nothing in this module.
-func (s *Scanner) InitPerSender(senderID int) error {
-	return nil
-}
-
-// GetName returns the configured name for the Scanner.
-func (s *Scanner) GetName() string {
-	return s.config.Name
-}
-
-// GetTrigger returns the Trigger defined in the Flags.
-func (scanner *Scanner) GetTrigger() string {
-	return scanner.config.Trigger
-}
-
-// xmppEndRegex matches the end of an XML response.
-var xmppEndRegex = regexp.MustCompile(`</stream:stream>`)
-
-// readResponse reads the XMPP response from the server.
-func (conn *Connection) readResponse() (string, error) {
-	respLen, err := zgrab2.ReadUntilRegex(conn.conn, conn.buffer[:], xmppEndRegex)
-	if err != nil {
-		return "", err
-	}
-	return string(conn.buffer[0:respLen]), nil
-}
-
-// sendStreamHeader sends the XMPP stream header to initiate communication without xmlns.
-func (conn *Connection) sendStreamHeader(from, to string) error {
-	header := fmt.Sprintf(
-		"<?xml version='1.0'?><stream:stream from='%s' to='%s' version='1.0' xml:lang='en'>",
-		from, to)
-	_, err := conn.conn.Write([]byte(header))
-	return err
-}
-
-// GetXMPPBanner sends the initial stream header and reads the server's response.
-func (conn *Connection) GetXMPPBanner(from, to string) (bool, error) {
-	// Send the initial stream header
-	if err := conn.sendStreamHeader(from, to); err != nil {
-		return false, fmt.Errorf("error sending XMPP stream header: %w", err)
-	}
-
-	// Read the server's response
-	banner, err := conn.readResponse()
-	if err != nil {
-		return false, fmt.Errorf("error reading XMPP response: %w", err)
-	}
-	conn.results.Banner = banner
-
-	// Check if the response includes any valid stream element
-	return strings.Contains(banner, "<stream:stream"), nil
-}
-
-// Scan performs the XMPP scan.
-func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
-	// Open a connection to the target
-	conn, err := t.Open(&s.config.BaseFlags)
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
-	}
-	cn := conn
-	defer cn.Close()
-
-	results := ScanResults{}
-
-	if s.config.ImplicitTLS {
-		tlsConn, err := s.config.TLSFlags.GetTLSConnection(conn)
-		if err != nil {
-			return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error setting up TLS connection: %w", err)
-		}
-		results.ImplicitTLS = true
-		results.TLSLog = tlsConn.GetLog()
-		err = tlsConn.Handshake()
-		if err != nil {
-			return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("TLS handshake failed: %w", err)
-		}
-		cn = tlsConn
-	}
-
-	xmpp := Connection{conn: cn, config: s.config, results: results}
-
-	// Send the XMPP stream header and check the banner
-	success, err := xmpp.GetXMPPBanner("scanner-ip", t.IP.String())
-	if err != nil {
-		return zgrab2.TryGetScanStatus(err), &xmpp.results, fmt.Errorf("error during XMPP banner grab: %w", err)
-	}
-
-	// If there's any valid information (even if an error), return SCAN_SUCCESS
-	if success {
-		return zgrab2.SCAN_SUCCESS, &xmpp.results, nil
-	}
-
-	// Otherwise, log the server response and return the error
-	return zgrab2.SCAN_UNKNOWN_ERROR, &xmpp.results, nil
-}
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zmap/zgrab2"
+)
+
+// StreamFeatures mirrors the RFC 6120 <stream:features/> element returned
+// by the server after the stream header is negotiated.
+type StreamFeatures struct {
+	// Mechanisms lists the SASL mechanisms advertised in <mechanisms/>.
+	Mechanisms []string `json:"mechanisms,omitempty"`
+
+	// StartTLS indicates the server advertised <starttls/>.
+	StartTLS bool `json:"starttls,omitempty"`
+
+	// StartTLSRequired indicates the server's <starttls/> carried <required/>.
+	StartTLSRequired bool `json:"starttls_required,omitempty"`
+
+	// CompressionMethods lists the methods advertised in <compression/>.
+	CompressionMethods []string `json:"compression_methods,omitempty"`
+
+	Bind     bool `json:"bind,omitempty"`
+	Session  bool `json:"session,omitempty"`
+	Register bool `json:"register,omitempty"`
+	Auth     bool `json:"auth,omitempty"`
+
+	// StreamManagement indicates the server advertised the XEP-0198 <sm/> feature.
+	StreamManagement bool `json:"stream_management,omitempty"`
+}
+
+// xmppStreamFeatures is the encoding/xml shape of <stream:features/>, used
+// only to decode the wire format into StreamFeatures.
+type xmppStreamFeatures struct {
+	XMLName    xml.Name `xml:"features"`
+	Mechanisms *struct {
+		Mechanism []string `xml:"mechanism"`
+	} `xml:"mechanisms"`
+	StartTLS *struct {
+		Required *struct{} `xml:"required"`
+	} `xml:"starttls"`
+	Compression *struct {
+		Method []string `xml:"method"`
+	} `xml:"compression"`
+	Bind     *struct{} `xml:"bind"`
+	Session  *struct{} `xml:"session"`
+	Register *struct{} `xml:"register"`
+	Auth     *struct{} `xml:"auth"`
+	SM       *struct{} `xml:"sm"`
+}
+
+// ScanResults holds the output of the scan.
+type ScanResults struct {
+	// Banner is the server's response to the XMPP stream header.
+	Banner string `json:"banner,omitempty"`
+
+	// Features holds the parsed <stream:features/> advertised before STARTTLS.
+	Features *StreamFeatures `json:"features,omitempty"`
+
+	// TLSFeatures holds the <stream:features/> advertised after STARTTLS, if negotiated.
+	TLSFeatures *StreamFeatures `json:"tls_features,omitempty"`
+
+	// StartTLSUpgraded indicates STARTTLS was successfully negotiated.
+	StartTLSUpgraded bool `json:"starttls_upgraded,omitempty"`
+
+	ImplicitTLS bool           `json:"implicit_tls,omitempty"`
+	TLSLog      *zgrab2.TLSLog `json:"tls,omitempty"`
+}
+
+// Flags are the XMPP-specific command-line flags.
+type Flags struct {
+	zgrab2.BaseFlags
+	zgrab2.TLSFlags
+
+	Verbose     bool `long:"verbose" description:"More verbose logging"`
+	ImplicitTLS bool `long:"tls" description:"Attempt to connect via a TLS wrapped connection"`
+	S2S         bool `long:"s2s" description:"Use server-to-server (s2s) namespace instead of client-to-server (c2s)"`
+	StartTLS    bool `long:"starttls" description:"Negotiate STARTTLS if the server advertises it"`
+}
+
+// Module implements the zgrab2.Module interface.
+type Module struct{}
+
+// Scanner implements the zgrab2.Scanner interface.
+type Scanner struct {
+	config *Flags
+}
+
+// Connection holds the state for a single connection to the XMPP server.
+type Connection struct {
+	buffer  [10000]byte
+	config  *Flags
+	results ScanResults
+	conn    net.Conn
+}
+
+// RegisterModule registers the XMPP zgrab2 module.
+func RegisterModule() {
+	var module Module
+	_, err := zgrab2.AddCommand("xmpp", "XMPP", module.Description(), 5222, &module)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewFlags returns the default flags object to be filled in with command-line arguments.
+func (m *Module) NewFlags() interface{} {
+	return new(Flags)
+}
+
+// NewScanner returns a new Scanner instance.
+func (m *Module) NewScanner() zgrab2.Scanner {
+	return new(Scanner)
+}
+
+// Description returns an overview of this module.
+func (m *Module) Description() string {
+	return "Scan for an XMPP service by initiating an XMPP connection"
+}
+
+// Validate ensures that the flags provided are valid.
+func (f *Flags) Validate(args []string) error {
+	return nil
+}
+
+// Help returns this module's help string.
+func (f *Flags) Help() string {
+	return ""
+}
+
+// Protocol returns the protocol identifier for the scanner.
+func (s *Scanner) Protocol() string {
+	return "xmpp"
+}
+
+// Init initializes the Scanner instance with the flags from the command line.
+func (s *Scanner) Init(flags zgrab2.ScanFlags) error {
+	f, _ := flags.(*Flags)
+	s.config = f
+	return nil
+}
+
+// InitPerSender does nothing in this module.
+func (s *Scanner) InitPerSender(senderID int) error {
+	return nil
+}
+
+// GetName returns the configured name for the Scanner.
+func (s *Scanner) GetName() string {
+	return s.config.Name
+}
+
+// GetTrigger returns the Trigger defined in the Flags.
+func (scanner *Scanner) GetTrigger() string {
+	return scanner.config.Trigger
+}
+
+// streamFeaturesEndRegex matches the end of a <stream:features> element, or,
+// failing that, the end of the stream itself.
+var streamFeaturesEndRegex = regexp.MustCompile(`(</stream:features>|<stream:features[^>]*/>|</stream:stream>)`)
+
+// readUntilFeatures reads until the end of a <stream:features> element (or
+// the stream close, if the server has no features to offer).
+func (conn *Connection) readUntilFeatures() (string, error) {
+	respLen, err := zgrab2.ReadUntilRegex(conn.conn, conn.buffer[:], streamFeaturesEndRegex)
+	if err != nil {
+		return "", err
+	}
+	return string(conn.buffer[0:respLen]), nil
+}
+
+// sendStreamHeader sends the XMPP stream header to initiate communication.
+func (conn *Connection) sendStreamHeader(from, to string) error {
+	contentNS := "jabber:client"
+	if conn.config.S2S {
+		contentNS = "jabber:server"
+	}
+	header := fmt.Sprintf(
+		"<?xml version='1.0'?><stream:stream from='%s' to='%s' version='1.0' xml:lang='en' xmlns='%s' xmlns:stream='http://etherx.jabber.org/streams'>",
+		from, to, contentNS)
+	_, err := conn.conn.Write([]byte(header))
+	return err
+}
+
+// parseFeatures extracts the <stream:features/> element from a raw stream
+// fragment and decodes it into a StreamFeatures struct.
+func parseFeatures(raw string) (*StreamFeatures, error) {
+	idx := strings.Index(raw, "<stream:features")
+	if idx < 0 {
+		return nil, fmt.Errorf("no <stream:features> element found")
+	}
+	end := strings.Index(raw[idx:], "</stream:features>")
+	var fragment string
+	if end < 0 {
+		// Self-closing <stream:features/> with no children.
+		closeIdx := strings.Index(raw[idx:], "/>")
+		if closeIdx < 0 {
+			return nil, fmt.Errorf("malformed <stream:features> element")
+		}
+		fragment = raw[idx : idx+closeIdx+2]
+	} else {
+		fragment = raw[idx : idx+end+len("</stream:features>")]
+	}
+
+	var decoded xmppStreamFeatures
+	if err := xml.Unmarshal([]byte(fragment), &decoded); err != nil {
+		return nil, fmt.Errorf("error decoding stream features: %w", err)
+	}
+
+	features := &StreamFeatures{}
+	if decoded.Mechanisms != nil {
+		features.Mechanisms = decoded.Mechanisms.Mechanism
+	}
+	if decoded.StartTLS != nil {
+		features.StartTLS = true
+		features.StartTLSRequired = decoded.StartTLS.Required != nil
+	}
+	if decoded.Compression != nil {
+		features.CompressionMethods = decoded.Compression.Method
+	}
+	features.Bind = decoded.Bind != nil
+	features.Session = decoded.Session != nil
+	features.Register = decoded.Register != nil
+	features.Auth = decoded.Auth != nil
+	features.StreamManagement = decoded.SM != nil
+
+	return features, nil
+}
+
+// GetXMPPBanner sends the initial stream header, reads the advertised
+// features, and optionally upgrades the connection via STARTTLS.
+func (conn *Connection) GetXMPPBanner(from, to string) (bool, error) {
+	if err := conn.sendStreamHeader(from, to); err != nil {
+		return false, fmt.Errorf("error sending XMPP stream header: %w", err)
+	}
+
+	banner, err := conn.readUntilFeatures()
+	if err != nil {
+		return false, fmt.Errorf("error reading XMPP response: %w", err)
+	}
+	conn.results.Banner = banner
+
+	if !strings.Contains(banner, "<stream:stream") {
+		return false, nil
+	}
+
+	features, err := parseFeatures(banner)
+	if err != nil {
+		// A server that never discloses features (pre-RFC 6120 servers) is
+		// still a valid XMPP response.
+		return true, nil
+	}
+	conn.results.Features = features
+
+	if conn.config.StartTLS && features.StartTLS {
+		if err := conn.upgradeStartTLS(from, to); err != nil {
+			return true, fmt.Errorf("error upgrading to STARTTLS: %w", err)
+		}
+	}
+
+	return true, nil
+}
+
+// upgradeStartTLS negotiates STARTTLS and re-opens the stream to capture
+// the post-TLS feature set.
+func (conn *Connection) upgradeStartTLS(from, to string) error {
+	_, err := conn.conn.Write([]byte("<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>"))
+	if err != nil {
+		return fmt.Errorf("error sending starttls: %w", err)
+	}
+
+	n, err := conn.conn.Read(conn.buffer[:])
+	if err != nil {
+		return fmt.Errorf("error reading starttls response: %w", err)
+	}
+	if !strings.Contains(string(conn.buffer[:n]), "<proceed") {
+		return fmt.Errorf("server did not proceed with STARTTLS: %s", string(conn.buffer[:n]))
+	}
+
+	tlsConn, err := conn.config.TLSFlags.GetTLSConnection(conn.conn)
+	if err != nil {
+		return fmt.Errorf("error setting up TLS connection: %w", err)
+	}
+	conn.results.TLSLog = tlsConn.GetLog()
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	conn.conn = tlsConn
+	conn.results.StartTLSUpgraded = true
+
+	if err := conn.sendStreamHeader(from, to); err != nil {
+		return fmt.Errorf("error re-sending stream header over TLS: %w", err)
+	}
+	post, err := conn.readUntilFeatures()
+	if err != nil {
+		return fmt.Errorf("error reading post-TLS stream features: %w", err)
+	}
+	if features, err := parseFeatures(post); err == nil {
+		conn.results.TLSFeatures = features
+	}
+	return nil
+}
+
+// closeStream sends a proper </stream:stream> close.
+func (conn *Connection) closeStream() {
+	conn.conn.Write([]byte("</stream:stream>"))
+}
+
+// Scan performs the XMPP scan.
+func (s *Scanner) Scan(t zgrab2.ScanTarget) (status zgrab2.ScanStatus, result interface{}, thrown error) {
+	// Open a connection to the target
+	conn, err := t.Open(&s.config.BaseFlags)
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	cn := conn
+	defer cn.Close()
+
+	results := ScanResults{}
+
+	if s.config.ImplicitTLS {
+		tlsConn, err := s.config.TLSFlags.GetTLSConnection(conn)
+		if err != nil {
+			return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("error setting up TLS connection: %w", err)
+		}
+		results.ImplicitTLS = true
+		results.TLSLog = tlsConn.GetLog()
+		err = tlsConn.Handshake()
+		if err != nil {
+			return zgrab2.TryGetScanStatus(err), nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		cn = tlsConn
+	}
+
+	xmpp := Connection{conn: cn, config: s.config, results: results}
+	defer xmpp.closeStream()
+
+	// Send the XMPP stream header and check the banner
+	success, err := xmpp.GetXMPPBanner("scanner-ip", t.IP.String())
+	if err != nil {
+		return zgrab2.TryGetScanStatus(err), &xmpp.results, fmt.Errorf("error during XMPP banner grab: %w", err)
+	}
+
+	// If there's any valid information (even if an error), return SCAN_SUCCESS
+	if success {
+		return zgrab2.SCAN_SUCCESS, &xmpp.results, nil
+	}
+
+	// Otherwise, log the server response and return the error
+	return zgrab2.SCAN_UNKNOWN_ERROR, &xmpp.results, nil
+}
@@ -0,0 +1,224 @@
+// Package script provides a small, protocol-agnostic mechanism for
+// operators to supply an ordered sequence of send/expect steps that a
+// scanner runs over an already-open connection, for fingerprinting
+// vendor-specific quirks without forking the scanner itself.
+//
+// This mirrors the redis module's --custom-commands/--mappings mechanism,
+// generalized across modules: a ProbeScript is loaded from a JSON or YAML
+// file (bounded by a caller-supplied max size) and executed step by step
+// with Run.
+package script
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Step is a single send/expect step in a ProbeScript.
+type Step struct {
+	// Name labels the step in the resulting StepResult.
+	Name string `json:"name" yaml:"name"`
+
+	// Send is the data to write to the connection. A "hex:" prefix means
+	// the remainder is hex-decoded; otherwise it is sent as a string,
+	// with "\r\n", "\n", and "\t" escapes expanded.
+	Send string `json:"send" yaml:"send"`
+
+	// ExpectRegex, if set, is matched against the response. Named capture
+	// groups are recorded in the StepResult's Captures.
+	ExpectRegex string `json:"expect_regex,omitempty" yaml:"expect_regex,omitempty"`
+
+	// ReadBytes, if non-zero, reads exactly that many bytes for the
+	// response instead of a single best-effort Read.
+	ReadBytes int `json:"read_bytes,omitempty" yaml:"read_bytes,omitempty"`
+
+	// SaveGroup, if set, names one of ExpectRegex's named capture groups.
+	// If that group matched, its value is also recorded under this same
+	// name in Run's returned savedGroups map, which the caller gets back
+	// once the whole script finishes (e.g. to surface a server-issued
+	// nonce or session token in the scan results).
+	SaveGroup string `json:"save_group,omitempty" yaml:"save_group,omitempty"`
+
+	// Optional marks a step whose failure (read/write error, or a regex
+	// that doesn't match) should not abort the remaining script.
+	Optional bool `json:"optional,omitempty" yaml:"optional,omitempty"`
+}
+
+// ProbeScript is an ordered list of Steps loaded from a file.
+type ProbeScript struct {
+	Steps []Step `json:"steps" yaml:"steps"`
+}
+
+// StepResult is the outcome of running a single Step.
+type StepResult struct {
+	Name     string            `json:"name"`
+	Request  string            `json:"request,omitempty"`
+	Response string            `json:"response,omitempty"`
+	Matched  bool              `json:"matched"`
+	Captures map[string]string `json:"captures,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// Load reads and parses a ProbeScript from path, which must be no larger
+// than maxSize bytes. JSON is used for a ".json" extension, YAML otherwise.
+func Load(path string, maxSize int64) (*ProbeScript, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error statting %s: %w", path, err)
+	}
+	if info.Size() > maxSize {
+		return nil, fmt.Errorf("%s is %d bytes, exceeding the %d byte limit", path, info.Size(), maxSize)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	var ps ProbeScript
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		if err := json.Unmarshal(data, &ps); err != nil {
+			return nil, fmt.Errorf("error parsing %s as JSON: %w", path, err)
+		}
+	} else if err := yaml.Unmarshal(data, &ps); err != nil {
+		return nil, fmt.Errorf("error parsing %s as YAML: %w", path, err)
+	}
+	return &ps, nil
+}
+
+// unescape expands the handful of backslash escapes a script author would
+// expect to write for line-oriented text protocols.
+func unescape(s string) string {
+	r := strings.NewReplacer(`\r\n`, "\r\n", `\n`, "\n", `\t`, "\t")
+	return r.Replace(s)
+}
+
+// encodeSend decodes a Step's Send field into the bytes to write.
+func encodeSend(send string) ([]byte, error) {
+	if rest, ok := strings.CutPrefix(send, "hex:"); ok {
+		decoded, err := hex.DecodeString(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding hex send payload: %w", err)
+		}
+		return decoded, nil
+	}
+	return []byte(unescape(send)), nil
+}
+
+// Run executes steps in order over conn, returning one StepResult per
+// step plus the saved named captures accumulated across the whole run
+// (see Step.SaveGroup). readSize bounds a best-effort (non-ReadBytes)
+// response read, and deadline bounds each step's read.
+func Run(conn net.Conn, steps []Step, readSize int, deadline time.Duration) ([]StepResult, map[string]string, error) {
+	results := make([]StepResult, 0, len(steps))
+	var savedGroups map[string]string
+
+	for _, step := range steps {
+		result := StepResult{Name: step.Name}
+
+		payload, err := encodeSend(step.Send)
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			if !step.Optional {
+				return results, savedGroups, err
+			}
+			continue
+		}
+		result.Request = string(payload)
+
+		if deadline > 0 {
+			conn.SetDeadline(time.Now().Add(deadline))
+		}
+
+		if _, err := conn.Write(payload); err != nil {
+			result.Error = fmt.Errorf("error writing step %q: %w", step.Name, err).Error()
+			results = append(results, result)
+			if !step.Optional {
+				return results, savedGroups, err
+			}
+			continue
+		}
+
+		response, err := readResponse(conn, step.ReadBytes, readSize)
+		if err != nil {
+			result.Error = fmt.Errorf("error reading step %q response: %w", step.Name, err).Error()
+			results = append(results, result)
+			if !step.Optional {
+				return results, savedGroups, err
+			}
+			continue
+		}
+		result.Response = string(response)
+
+		if step.ExpectRegex != "" {
+			re, err := regexp.Compile(step.ExpectRegex)
+			if err != nil {
+				result.Error = fmt.Errorf("error compiling expect_regex for step %q: %w", step.Name, err).Error()
+				results = append(results, result)
+				if !step.Optional {
+					return results, savedGroups, err
+				}
+				continue
+			}
+			match := re.FindStringSubmatch(result.Response)
+			result.Matched = match != nil
+			if match != nil {
+				captures := make(map[string]string)
+				for i, name := range re.SubexpNames() {
+					if name != "" && i < len(match) {
+						captures[name] = match[i]
+					}
+				}
+				if len(captures) > 0 {
+					result.Captures = captures
+				}
+			}
+
+			if step.SaveGroup != "" {
+				if value, ok := result.Captures[step.SaveGroup]; ok {
+					if savedGroups == nil {
+						savedGroups = make(map[string]string)
+					}
+					savedGroups[step.SaveGroup] = value
+				}
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	return results, savedGroups, nil
+}
+
+// readResponse reads exactly n bytes if n > 0, otherwise performs a single
+// best-effort read into a buffer of size readSize.
+func readResponse(conn net.Conn, n, readSize int) ([]byte, error) {
+	if n > 0 {
+		buf := make([]byte, n)
+		read := 0
+		for read < n {
+			k, err := conn.Read(buf[read:])
+			if err != nil {
+				return buf[:read], err
+			}
+			read += k
+		}
+		return buf, nil
+	}
+
+	buf := make([]byte, readSize)
+	k, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:k], nil
+}
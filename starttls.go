@@ -0,0 +1,108 @@
+package zgrab2
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// CommandDirection marks whether a CommandLogEntry was sent to, or
+// received from, the server.
+type CommandDirection string
+
+const (
+	CommandSent     CommandDirection = "sent"
+	CommandReceived CommandDirection = "received"
+)
+
+// CommandLogEntry is a single entry in a CommandLog.
+type CommandLogEntry struct {
+	Direction CommandDirection `json:"direction"`
+	Bytes     []byte           `json:"bytes"`
+	Timestamp time.Time        `json:"timestamp"`
+}
+
+// CommandLog is an ordered transcript of everything sent and received on
+// a connection. It's meant to replace the ad-hoc RawResponse/Banner/
+// BindResponse-style string fields modules have historically kept for
+// this purpose, with a single shape that's uniform across protocols.
+type CommandLog []CommandLogEntry
+
+// Sent appends a sent-command entry to the log.
+func (l *CommandLog) Sent(data []byte) {
+	*l = append(*l, CommandLogEntry{Direction: CommandSent, Bytes: append([]byte(nil), data...), Timestamp: time.Now()})
+}
+
+// Received appends a received-response entry to the log.
+func (l *CommandLog) Received(data []byte) {
+	*l = append(*l, CommandLogEntry{Direction: CommandReceived, Bytes: append([]byte(nil), data...), Timestamp: time.Now()})
+}
+
+// maxStartTLSReads bounds how many reads StartTLSUpgrader.Negotiate will
+// attempt before giving up on a server that never satisfies ready.
+const maxStartTLSReads = 16
+
+// startTLSReadSize is the size of each read attempted while waiting for
+// the server's STARTTLS go-ahead.
+const startTLSReadSize = 4096
+
+// StartTLSUpgrader drives the common "send a command that asks the
+// server to expect TLS, wait for its go-ahead, then let the caller wrap
+// the connection" negotiation shared by LDAP's StartTLS ExtendedRequest,
+// SIP's Via transport upgrade, and IRC's STARTTLS command.
+type StartTLSUpgrader struct {
+	// Log, if non-nil, records every command sent via Send and every
+	// response read during Negotiate.
+	Log *CommandLog
+}
+
+// Send writes data to conn and, if Log is set, records it as a sent
+// CommandLogEntry.
+func (u *StartTLSUpgrader) Send(conn net.Conn, data []byte) error {
+	if _, err := conn.Write(data); err != nil {
+		return err
+	}
+	if u.Log != nil {
+		u.Log.Sent(data)
+	}
+	return nil
+}
+
+// Negotiate calls trigger to send whatever command tells the server to
+// expect TLS, then reads from reader (conn itself, if reader is nil)
+// until ready reports true for a response, at which point Negotiate
+// returns nil and the caller should wrap conn in TLS. Every response read
+// is appended to Log, if set. conn is used only for its read deadline;
+// pass a reader that already wraps conn (e.g. a bufio.Reader a caller is
+// using elsewhere on the same connection) to avoid losing buffered data
+// the caller has already consumed ahead of the raw socket.
+func (u *StartTLSUpgrader) Negotiate(conn net.Conn, reader io.Reader, timeout time.Duration, trigger func() error, ready func(response []byte) bool) error {
+	if reader == nil {
+		reader = conn
+	}
+	if err := trigger(); err != nil {
+		return fmt.Errorf("error sending STARTTLS trigger: %w", err)
+	}
+
+	buffer := make([]byte, startTLSReadSize)
+	for attempt := 0; attempt < maxStartTLSReads; attempt++ {
+		if timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			response := append([]byte(nil), buffer[:n]...)
+			if u.Log != nil {
+				u.Log.Received(response)
+			}
+			if ready(response) {
+				return nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("error reading STARTTLS response: %w", err)
+		}
+	}
+	return fmt.Errorf("server did not confirm STARTTLS within %d reads", maxStartTLSReads)
+}